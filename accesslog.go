@@ -0,0 +1,158 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Access logs go to their own stream, stdout by default, so they can be
+// shipped separately from the application log on stderr
+
+var accessLog struct {
+    sync.Mutex
+    out io.Writer
+}
+
+type accessLogEntry struct {
+    Time       string  `json:"time"`
+    RemoteAddr string  `json:"remote_addr"`
+    Method     string  `json:"method"`
+    URI        string  `json:"uri"`
+    Proto      string  `json:"proto"`
+    Status     int     `json:"status"`
+    Bytes      int64   `json:"bytes"`
+    DurationMS float64 `json:"duration_ms"`
+    UserAgent  string  `json:"user_agent"`
+    Referer    string  `json:"referer"`
+    RequestID  string  `json:"request_id,omitempty"`
+}
+
+// initAccessLog opens ACCESS_LOG_FILE, "-" meaning stdout
+func initAccessLog() {
+    if config.AccessLogFormat == "off" {
+        return
+    }
+
+    if config.AccessLogFile == "" || config.AccessLogFile == "-" {
+        accessLog.out = os.Stdout
+        return
+    }
+
+    f, err := os.OpenFile(config.AccessLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+    if err != nil {
+        panic(err)
+    }
+    accessLog.out = f
+}
+
+// accessRecorder notes the status and body size of a response
+type accessRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int64
+}
+
+func (w *accessRecorder) WriteHeader(status int) {
+    if w.status == 0 {
+        w.status = status
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessRecorder) Write(p []byte) (int, error) {
+    if w.status == 0 {
+        w.status = 200
+    }
+    n, err := w.ResponseWriter.Write(p)
+    w.bytes += int64(n)
+    return n, err
+}
+
+func (w *accessRecorder) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+func (w *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    w.status = 101
+    return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// logAccess writes an access log line once the response is done
+func logAccess(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if accessLog.out == nil {
+            next(w, r)
+            return
+        }
+
+        start := time.Now()
+        recorder := &accessRecorder{ResponseWriter: w}
+
+        // Aborted downloads still get logged
+        defer func() {
+            if recorder.status == 0 {
+                recorder.status = 200
+            }
+            writeAccessLog(r, recorder, start)
+        }()
+
+        next(recorder, r)
+    }
+}
+
+func writeAccessLog(r *http.Request, recorder *accessRecorder, start time.Time) {
+    duration := time.Since(start)
+
+    var line []byte
+    if config.AccessLogFormat == "json" {
+        line, _ = json.Marshal(accessLogEntry{
+            Time:       start.UTC().Format(time.RFC3339Nano),
+            RemoteAddr: clientIP(r),
+            Method:     r.Method,
+            URI:        r.RequestURI,
+            Proto:      r.Proto,
+            Status:     recorder.status,
+            Bytes:      recorder.bytes,
+            DurationMS: float64(duration.Microseconds()) / 1000,
+            UserAgent:  r.UserAgent(),
+            Referer:    r.Referer(),
+            RequestID:  requestID(r.Context()),
+        })
+        line = append(line, '\n')
+    } else {
+        // Apache combined, plus the duration in microseconds like %D
+        size := "-"
+        if recorder.bytes > 0 {
+            size = strconv.FormatInt(recorder.bytes, 10)
+        }
+        line = []byte(fmt.Sprintf("%s - - [%s] %q %d %s %q %q %d\n",
+            clientIP(r),
+            start.Format("02/Jan/2006:15:04:05 -0700"),
+            r.Method+" "+r.RequestURI+" "+r.Proto,
+            recorder.status,
+            size,
+            orDash(r.Referer()),
+            orDash(r.UserAgent()),
+            duration.Microseconds(),
+        ))
+    }
+
+    accessLog.Lock()
+    accessLog.out.Write(line)
+    accessLog.Unlock()
+}
+
+func orDash(s string) string {
+    if s == "" {
+        return "-"
+    }
+    return s
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "expvar"
+    "log/slog"
+    "net"
+    "net/http"
+    "net/http/pprof"
+)
+
+// adminMux holds health, metrics, debugging and admin endpoints. They are
+// served on ADMIN_PORT / ADMIN_SOCKET when configured so they can be
+// firewalled separately, and on the public port otherwise.
+var adminMux = http.NewServeMux()
+
+// adminListenerEnabled reports whether ops endpoints get their own listener
+func adminListenerEnabled() bool {
+    return config.AdminPort != "" || config.AdminSocket != ""
+}
+
+// handleAdmin registers an ops endpoint on whichever mux serves them
+func handleAdmin(pattern string, handler http.HandlerFunc) {
+    if adminListenerEnabled() {
+        adminMux.HandleFunc(pattern, handler)
+        return
+    }
+    publicMux.HandleFunc(pattern, handler)
+}
+
+// registerAdminRoutes adds health checks and the admin API, which needs an
+// admin scoped key
+func registerAdminRoutes() {
+    handleAdmin("GET /healthz", healthzHandler)
+    handleAdmin("GET /livez", livezHandler)
+    handleAdmin("GET /readyz", readyzHandler)
+    handleAdmin("GET /metrics", metricsHandler)
+    handleAdmin("GET /debug/vars", expvar.Handler().ServeHTTP)
+
+    // Profiles reveal too much to ever share the public port
+    if config.Pprof {
+        if !adminListenerEnabled() {
+            slog.Warn("PPROF needs ADMIN_PORT or ADMIN_SOCKET, not serving profiles")
+        } else {
+            adminMux.HandleFunc("GET /debug/pprof/", pprof.Index)
+            adminMux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+            adminMux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+            adminMux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+            adminMux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+            adminMux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+        }
+    }
+
+    handleAdmin("DELETE /admin/tokens/{token}", requireAPIKey(scopeAdmin, revokeTokenHandler))
+    handleAdmin("GET /admin/downloads", requireAPIKey(scopeAdmin, listDownloadsHandler))
+    handleAdmin("DELETE /admin/downloads/{id}", requireAPIKey(scopeAdmin, terminateDownloadHandler))
+    handleAdmin("GET /admin/stats", requireAPIKey(scopeAdmin, statsHandler))
+    handleAdmin("GET /admin/audit/verify", requireAPIKey(scopeAdmin, verifyAuditHandler))
+    handleAdmin("GET /admin/usage", requireAPIKey(scopeAdmin, usageHandler))
+    handleAdmin("POST /admin/reload", requireAPIKey(scopeAdmin, reloadHandler))
+
+    // The dashboard itself is static, it asks for a key before calling the
+    // endpoints above
+    handleAdmin("GET /admin/{$}", func(w http.ResponseWriter, r *http.Request) {
+        http.ServeFileFS(w, r, assets, "assets/dashboard.html")
+    })
+    handleAdmin("GET /admin/assets/", http.StripPrefix("/admin/", http.FileServerFS(assets)).ServeHTTP)
+}
+
+// serveAdmin starts the admin listener in the background
+func serveAdmin() error {
+    if !adminListenerEnabled() {
+        return nil
+    }
+
+    var listeners []net.Listener
+
+    if config.AdminPort != "" {
+        ln, err := net.Listen("tcp", ":"+config.AdminPort)
+        if err != nil {
+            return err
+        }
+        slog.Info("Admin listening", "port", config.AdminPort)
+        listeners = append(listeners, ln)
+    }
+
+    if config.AdminSocket != "" {
+        ln, err := listenUnix(config.AdminSocket, config.UnixSocketMode)
+        if err != nil {
+            return err
+        }
+        slog.Info("Admin listening", "socket", config.AdminSocket)
+        listeners = append(listeners, ln)
+    }
+
+    server := &http.Server{Handler: adminMux}
+    setTimeouts(server)
+    go func() {
+        fatal("Admin server stopped", serve(server, listeners))
+    }()
+
+    return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "log/slog"
+    "net/http"
+    "strings"
+    "sync/atomic"
+
+    goredis "github.com/redis/go-redis/v9"
+)
+
+// API key scopes
+const (
+    scopeTokensWrite   = "tokens:write"
+    scopeArchivesRead  = "archives:read"
+    scopeArchivesWrite = "archives:write"
+    scopeAdmin         = "admin"
+)
+
+// apiKeys maps the hex SHA-256 of each configured key to its scopes. It's
+// replaced whole when API_KEYS is reloaded.
+var apiKeys atomic.Pointer[map[string][]string]
+
+// loadAPIKeys parses API_KEYS, a comma separated list of
+// "<sha256 hex>:<scope>|<scope>" entries. Only hashes are ever configured so
+// the plain keys never sit in the environment.
+func loadAPIKeys(c Configuration) {
+    keys := map[string][]string{}
+    for _, entry := range strings.Split(c.APIKeys, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+
+        hash, scopes, _ := strings.Cut(entry, ":")
+        keys[strings.ToLower(hash)] = parseScopes(scopes)
+    }
+    if *devMode && len(keys) == 0 {
+        keys[hashAPIKey(devAPIKey)] = []string{scopeAdmin}
+    }
+    apiKeys.Store(&keys)
+}
+
+// parseScopes splits a key's scopes, written "<scope>|<scope>" both in
+// API_KEYS and at "apikey:<hash>" in Redis
+func parseScopes(value string) []string {
+    var scopes []string
+    for _, scope := range strings.Split(value, "|") {
+        if scope = strings.TrimSpace(scope); scope != "" {
+            scopes = append(scopes, scope)
+        }
+    }
+    return scopes
+}
+
+func hashAPIKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+// apiKeyScopes returns the scopes granted to a key, looking first at the
+// configured hashes and then at "apikey:<hash>" in Redis, which holds them
+// like API_KEYS does
+func apiKeyScopes(ctx context.Context, key string) (scopes []string, ok bool) {
+    hash := hashAPIKey(key)
+
+    for configured, scopes := range *apiKeys.Load() {
+        if subtle.ConstantTimeCompare([]byte(configured), []byte(hash)) == 1 {
+            return scopes, true
+        }
+    }
+
+    value, err := redisClient.Get(ctx, redisKey("apikey:"+hash)).Result()
+    if err != nil {
+        if err != goredis.Nil {
+            slog.ErrorContext(ctx, "Error looking up API key", "error", err)
+        }
+        return nil, false
+    }
+
+    return parseScopes(value), true
+}
+
+func hasScope(scopes []string, scope string) bool {
+    for _, s := range scopes {
+        if s == scope || s == scopeAdmin {
+            return true
+        }
+    }
+    return false
+}
+
+// requireAPIKey wraps management handlers so they are only reachable with an
+// X-API-Key header granting the given scope
+func requireAPIKey(scope string, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if checkAPIKey(w, r, scope) {
+            next(w, r)
+        }
+    }
+}
+
+// checkAPIKey reports whether the request's X-API-Key grants scope, writing
+// the problem response when it doesn't
+func checkAPIKey(w http.ResponseWriter, r *http.Request, scope string) bool {
+    key := r.Header.Get("X-API-Key")
+    if key == "" {
+        writeProblem(w, r, 401, codeUnauthorized, "An X-API-Key header is required")
+        return false
+    }
+
+    scopes, ok := apiKeyScopes(r.Context(), key)
+    if !ok {
+        writeProblem(w, r, 401, codeUnauthorized, "Unknown API key")
+        return false
+    }
+
+    if !hasScope(scopes, scope) {
+        writeProblem(w, r, 403, codeForbidden, "API key lacks the "+scope+" scope")
+        return false
+    }
+    return true
+}
@@ -0,0 +1,268 @@
+// Package archive streams files from S3, or any other Source, into a zip
+// archive. It is the core of the zipper server, usable on its own by
+// services that already know what they want zipped:
+//
+//	archiver := &archive.Archiver{Source: archive.S3Source{Bucket: bucket}}
+//	err := archiver.Stream(ctx, files, w)
+package archive
+
+import (
+    "archive/zip"
+    "context"
+    "errors"
+    "io"
+    "log/slog"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// File is one entry of an archive
+type File struct {
+    FileName string
+    Folder   string
+    S3Path   string
+    Size     int64 // Optional, saves a HEAD request when estimating
+}
+
+// Update describes how far along an archive is
+type Update struct {
+    FilesDone    int
+    BytesWritten int64
+    CurrentFile  string
+    Error        string
+}
+
+// Progress is told when each file starts, when one fails and when the
+// archive is finished
+type Progress func(update Update)
+
+// FetchHook is called as each file starts downloading. The function it
+// returns is called once the file is in the archive or has failed, with the
+// bytes read, which is where metrics and tracing can hook in.
+type FetchHook func(ctx context.Context, file *File) (done func(read int64, err error))
+
+// Archiver builds archives from the files in one source. Its fields must
+// not change while it's in use.
+type Archiver struct {
+    Source Source
+
+    // Logs missing and failed files, and each file at debug level.
+    // slog.Default() when nil.
+    Logger *slog.Logger
+
+    // Optional
+    FetchHook FetchHook
+    Hooks     []Hooks
+
+    // Fail with ErrEmpty, having written nothing, when none of the files
+    // could be added and nothing has reached the writer yet, instead of
+    // writing an empty zip
+    RefuseEmpty bool
+
+    // Store the files as they are instead of deflating them, which is
+    // faster where the bandwidth is there to spare
+    Store bool
+}
+
+// ErrEmpty is returned when none of the files could be added, with
+// RefuseEmpty set
+var ErrEmpty = errors.New("none of the files could be added to the archive")
+
+var errMissingPath = errors.New("missing path")
+
+var unsafeFileName = regexp.MustCompile(`[#<>:"/\|?*\\]`)
+
+// SafeName strips the characters that cause trouble in file names
+func SafeName(name string) string {
+    return unsafeFileName.ReplaceAllString(name, "")
+}
+
+// Path builds a good path for the file within the zip
+func Path(file *File) string {
+    // Build safe file file name
+    safeFileName := SafeName(file.FileName)
+
+    if safeFileName == "" { // Unlikely but just in case
+        safeFileName = "file"
+    }
+
+    path := ""
+
+    // Prefix folder name, if any
+    if file.Folder != "" {
+        path += file.Folder
+        if !strings.HasSuffix(path, "/") {
+            path += "/"
+        }
+    }
+
+    return path + safeFileName
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+    w io.Writer
+    n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+    n, err := c.w.Write(p)
+    c.n += int64(n)
+    return n, err
+}
+
+// countingReader counts the bytes read through it, which is what was
+// fetched whatever a hook turns it into
+type countingReader struct {
+    r io.Reader
+    n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    n, err := c.r.Read(p)
+    c.n += int64(n)
+    return n, err
+}
+
+func (a *Archiver) logger() *slog.Logger {
+    if a.Logger != nil {
+        return a.Logger
+    }
+    return slog.Default()
+}
+
+// Stream writes the files into a zip on w
+func (a *Archiver) Stream(ctx context.Context, files []*File, w io.Writer) error {
+    return a.StreamProgress(ctx, files, w, nil)
+}
+
+// StreamProgress writes the files into a zip on w, reporting to progress as
+// it goes. Missing and unreadable files are logged and skipped. It stops
+// early if ctx is cancelled.
+func (a *Archiver) StreamProgress(ctx context.Context, files []*File, w io.Writer, progress Progress) (err error) {
+    logger := a.logger()
+
+    // Loop over files, add them to the zip
+    counter := &countingWriter{w: w}
+    zipWriter := zip.NewWriter(counter)
+
+    // Each file is logged when its entry is closed and the compressed size
+    // is known
+    var current *entry
+    zipWriter.RegisterCompressor(zip.Deflate, entryCompressor(ctx, logger, &current))
+    zipWriter.RegisterCompressor(zip.Store, entryStorer(ctx, logger, &current))
+    method := zip.Deflate
+    if a.Store {
+        method = zip.Store
+    }
+
+    report := func(update Update) {
+        if progress != nil {
+            update.BytesWritten = counter.n
+            progress(update)
+        }
+    }
+
+    result := Result{Files: len(files)}
+    defer func() {
+        result.BytesWritten = counter.n
+        result.Err = err
+        a.onArchiveComplete(ctx, result)
+    }()
+
+    fail := func(i int, file *File, err error) {
+        result.Failed++
+        a.onEntryError(ctx, file, err)
+        report(Update{FilesDone: i, CurrentFile: file.FileName, Error: err.Error()})
+    }
+
+    for i, file := range files {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        if file == nil {
+            result.Skipped++
+            continue
+        }
+
+        // Skipped files count as processed too
+        report(Update{FilesDone: i, CurrentFile: file.FileName})
+
+        if file = a.onEntryStart(ctx, file); file == nil {
+            result.Skipped++
+            continue
+        }
+
+        if file.S3Path == "" {
+            logger.WarnContext(ctx, "Missing path for file", "file", file.FileName)
+            fail(i, file, errMissingPath)
+            continue
+        }
+
+        // Read file from the source, log any errors
+        fetchStart := time.Now()
+        done := func(int64, error) {}
+        if a.FetchHook != nil {
+            done = a.FetchHook(ctx, file)
+        }
+
+        rdr, _, err := a.Source.Open(ctx, file.S3Path)
+        if err != nil {
+            logEntry(ctx, logger, &entry{path: file.S3Path, duration: time.Since(fetchStart), err: err}, 0)
+            done(0, err)
+            if errors.Is(err, ErrNotFound) {
+                logger.WarnContext(ctx, "File not found", "path", file.S3Path)
+            } else {
+                logger.ErrorContext(ctx, "Error downloading file", "path", file.S3Path, "error", err)
+            }
+            fail(i, file, err)
+            continue
+        }
+
+        h := &zip.FileHeader{
+            Name:   Path(file),
+            Method: method,
+        }
+
+        current = &entry{path: file.S3Path}
+        f, _ := zipWriter.CreateHeader(h)
+
+        // Closing the reader is what stops a transfer that's been cancelled
+        stop := context.AfterFunc(ctx, func() { rdr.Close() })
+        counted := &countingReader{r: rdr}
+        _, err = io.Copy(f, a.onEntryOpen(ctx, file, counted))
+        copied := counted.n
+        stop()
+        rdr.Close()
+
+        current.read = copied
+        current.duration = time.Since(fetchStart)
+        current.err = err
+
+        if err != nil && ctx.Err() != nil {
+            done(copied, ctx.Err())
+            return ctx.Err()
+        }
+        done(copied, err)
+
+        if err != nil {
+            logger.ErrorContext(ctx, "Error copying file", "path", file.S3Path, "error", err)
+            fail(i, file, err)
+            continue
+        }
+        result.Written++
+    }
+
+    // A file that failed part way may have had its header and some data
+    // flushed through the zip writer's buffer already, and then it's too
+    // late to refuse. Whatever is still buffered is dropped.
+    if a.RefuseEmpty && result.Written == 0 && counter.n == 0 {
+        report(Update{FilesDone: len(files)})
+        return ErrEmpty
+    }
+
+    err = zipWriter.Close()
+    report(Update{FilesDone: len(files)})
+    return err
+}
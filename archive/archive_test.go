@@ -0,0 +1,225 @@
+package archive
+
+import (
+    "archive/zip"
+    "bytes"
+    "context"
+    "errors"
+    "io"
+    "log/slog"
+    "strings"
+    "testing"
+)
+
+// fakeSource serves files from memory. Refs in broken fail part way
+// through being read.
+type fakeSource struct {
+    files  map[string]string
+    broken map[string]bool
+}
+
+var errBroken = errors.New("connection reset")
+
+type brokenReader struct {
+    r io.Reader
+}
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+    n, err := b.r.Read(p)
+    if err == io.EOF {
+        return n, errBroken
+    }
+    return n, err
+}
+
+func (s fakeSource) Open(ctx context.Context, ref string) (io.ReadCloser, Info, error) {
+    content, ok := s.files[ref]
+    if !ok {
+        return nil, Info{}, ErrNotFound
+    }
+    var r io.Reader = strings.NewReader(content)
+    if s.broken[ref] {
+        r = &brokenReader{r: r}
+    }
+    return io.NopCloser(r), Info{Size: int64(len(content))}, nil
+}
+
+func (s fakeSource) Stat(ctx context.Context, ref string) (Info, error) {
+    content, ok := s.files[ref]
+    if !ok {
+        return Info{}, ErrNotFound
+    }
+    return Info{Size: int64(len(content))}, nil
+}
+
+func newTestArchiver(source fakeSource) *Archiver {
+    return &Archiver{Source: source, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+}
+
+// stream archives the files, returning the zip, the updates reported and
+// the error
+func stream(t *testing.T, a *Archiver, files []*File) ([]byte, []Update, error) {
+    t.Helper()
+    var out bytes.Buffer
+    var updates []Update
+    err := a.StreamProgress(context.Background(), files, &out, func(update Update) {
+        updates = append(updates, update)
+    })
+    return out.Bytes(), updates, err
+}
+
+// entries reads back the zip, mapping each entry's name to its contents
+func entries(t *testing.T, data []byte) map[string]*zip.File {
+    t.Helper()
+    r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+    if err != nil {
+        t.Fatalf("reading the zip: %v", err)
+    }
+    found := map[string]*zip.File{}
+    for _, f := range r.File {
+        found[f.Name] = f
+    }
+    return found
+}
+
+func contents(t *testing.T, f *zip.File) string {
+    t.Helper()
+    r, err := f.Open()
+    if err != nil {
+        t.Fatalf("opening %s: %v", f.Name, err)
+    }
+    defer r.Close()
+    data, err := io.ReadAll(r)
+    if err != nil {
+        t.Fatalf("reading %s: %v", f.Name, err)
+    }
+    return string(data)
+}
+
+// errorsReported lists the files progress was told failed
+func errorsReported(updates []Update) []string {
+    var failed []string
+    for _, update := range updates {
+        if update.Error != "" {
+            failed = append(failed, update.CurrentFile)
+        }
+    }
+    return failed
+}
+
+func TestStreamProgressSkipsMissingFiles(t *testing.T) {
+    a := newTestArchiver(fakeSource{files: map[string]string{"a.txt": "hello"}})
+    files := []*File{
+        {FileName: "a.txt", Folder: "docs", S3Path: "a.txt"},
+        {FileName: "gone.txt", S3Path: "gone.txt"},
+    }
+
+    data, updates, err := stream(t, a, files)
+    if err != nil {
+        t.Fatalf("StreamProgress: %v", err)
+    }
+
+    found := entries(t, data)
+    if len(found) != 1 || found["docs/a.txt"] == nil {
+        t.Fatalf("entries = %v, want only docs/a.txt", found)
+    }
+    if got := contents(t, found["docs/a.txt"]); got != "hello" {
+        t.Errorf("docs/a.txt = %q, want %q", got, "hello")
+    }
+    if failed := errorsReported(updates); len(failed) != 1 || failed[0] != "gone.txt" {
+        t.Errorf("failures reported = %v, want [gone.txt]", failed)
+    }
+    if last := updates[len(updates)-1]; last.FilesDone != 2 || last.BytesWritten != int64(len(data)) {
+        t.Errorf("last update = %+v, want 2 files done and %d bytes", last, len(data))
+    }
+}
+
+func TestStreamProgressReportsCopyErrors(t *testing.T) {
+    a := newTestArchiver(fakeSource{
+        files:  map[string]string{"a.txt": "hello", "b.txt": "half a file"},
+        broken: map[string]bool{"b.txt": true},
+    })
+    files := []*File{
+        {FileName: "b.txt", S3Path: "b.txt"},
+        {FileName: "a.txt", S3Path: "a.txt"},
+    }
+
+    var result Result
+    a.Hooks = []Hooks{{OnArchiveComplete: func(ctx context.Context, r Result) { result = r }}}
+
+    data, updates, err := stream(t, a, files)
+    if err != nil {
+        t.Fatalf("StreamProgress: %v", err)
+    }
+
+    found := entries(t, data)
+    if found["a.txt"] == nil || contents(t, found["a.txt"]) != "hello" {
+        t.Errorf("a.txt missing or wrong after b.txt failed")
+    }
+    if failed := errorsReported(updates); len(failed) != 1 || failed[0] != "b.txt" {
+        t.Errorf("failures reported = %v, want [b.txt]", failed)
+    }
+    if result.Written != 1 || result.Failed != 1 {
+        t.Errorf("result = %+v, want 1 written and 1 failed", result)
+    }
+}
+
+func TestStreamProgressRefuseEmpty(t *testing.T) {
+    a := newTestArchiver(fakeSource{files: map[string]string{}})
+    a.RefuseEmpty = true
+    files := []*File{
+        {FileName: "gone.txt", S3Path: "gone.txt"},
+        {FileName: "nopath.txt"},
+    }
+
+    data, updates, err := stream(t, a, files)
+    if !errors.Is(err, ErrEmpty) {
+        t.Fatalf("err = %v, want ErrEmpty", err)
+    }
+    if len(data) != 0 {
+        t.Errorf("wrote %d bytes, want none", len(data))
+    }
+    if failed := errorsReported(updates); len(failed) != 2 {
+        t.Errorf("failures reported = %v, want both files", failed)
+    }
+
+    // Without it, the same files make an empty zip
+    a.RefuseEmpty = false
+    data, _, err = stream(t, a, files)
+    if err != nil {
+        t.Fatalf("StreamProgress: %v", err)
+    }
+    if found := entries(t, data); len(found) != 0 {
+        t.Errorf("entries = %v, want none", found)
+    }
+}
+
+func TestStreamProgressStore(t *testing.T) {
+    content := strings.Repeat("compressible ", 100)
+    source := fakeSource{files: map[string]string{"a.txt": content}}
+    files := []*File{{FileName: "a.txt", S3Path: "a.txt"}}
+
+    for _, store := range []bool{false, true} {
+        a := newTestArchiver(source)
+        a.Store = store
+        data, _, err := stream(t, a, files)
+        if err != nil {
+            t.Fatalf("StreamProgress with Store %v: %v", store, err)
+        }
+
+        f := entries(t, data)["a.txt"]
+        if f == nil {
+            t.Fatalf("a.txt missing with Store %v", store)
+        }
+        want := zip.Deflate
+        if store {
+            want = zip.Store
+        }
+        if f.Method != want {
+            t.Errorf("method with Store %v = %d, want %d", store, f.Method, want)
+        }
+        if got := contents(t, f); got != content {
+            t.Errorf("a.txt with Store %v came back different", store)
+        }
+    }
+}
@@ -0,0 +1,89 @@
+package archive
+
+import (
+    "compress/flate"
+    "context"
+    "io"
+    "log/slog"
+    "math"
+    "time"
+)
+
+// entry is what gets logged about each file once it's in the archive
+type entry struct {
+    path     string
+    duration time.Duration
+    read     int64
+    err      error
+}
+
+// logEntry writes the debug line for one file
+func logEntry(ctx context.Context, logger *slog.Logger, entry *entry, compressed int64) {
+    outcome := "ok"
+    if entry.err != nil {
+        outcome = "error"
+    }
+
+    attrs := []any{
+        "path", entry.path,
+        "outcome", outcome,
+        "duration", entry.duration,
+        "bytes", entry.read,
+        "compressed", compressed,
+    }
+    if entry.read > 0 {
+        attrs = append(attrs, "ratio", math.Round(float64(compressed)/float64(entry.read)*1000)/1000)
+    }
+    if entry.err != nil {
+        attrs = append(attrs, "error", entry.err)
+    }
+
+    logger.DebugContext(ctx, "Archived file", attrs...)
+}
+
+// entryCompressor deflates like archive/zip does, but counts the compressed
+// bytes so each entry can be logged once the zip writer closes it. *current
+// is the entry about to be written.
+func entryCompressor(ctx context.Context, logger *slog.Logger, current **entry) func(io.Writer) (io.WriteCloser, error) {
+    return func(out io.Writer) (io.WriteCloser, error) {
+        counter := &countingWriter{w: out}
+        fw, err := flate.NewWriter(counter, 5)
+        if err != nil {
+            return nil, err
+        }
+        return &loggedCompressor{WriteCloser: fw, counter: counter, entry: *current, ctx: ctx, logger: logger}, nil
+    }
+}
+
+// entryStorer is entryCompressor for stored entries, which are copied as
+// they are
+func entryStorer(ctx context.Context, logger *slog.Logger, current **entry) func(io.Writer) (io.WriteCloser, error) {
+    return func(out io.Writer) (io.WriteCloser, error) {
+        counter := &countingWriter{w: out}
+        return &loggedCompressor{WriteCloser: nopCloser{counter}, counter: counter, entry: *current, ctx: ctx, logger: logger}, nil
+    }
+}
+
+type nopCloser struct {
+    io.Writer
+}
+
+func (nopCloser) Close() error {
+    return nil
+}
+
+type loggedCompressor struct {
+    io.WriteCloser
+    counter *countingWriter
+    entry   *entry
+    ctx     context.Context
+    logger  *slog.Logger
+}
+
+func (c *loggedCompressor) Close() error {
+    err := c.WriteCloser.Close()
+    if c.entry != nil {
+        logEntry(c.ctx, c.logger, c.entry, c.counter.n)
+    }
+    return err
+}
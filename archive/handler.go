@@ -0,0 +1,47 @@
+package archive
+
+import (
+    "net/http"
+    "strings"
+)
+
+// Resolver works out which files a request is for and what to call the
+// archive. When the request can't be served it writes the response itself
+// and returns false.
+type Resolver func(w http.ResponseWriter, r *http.Request) (files []*File, name string, ok bool)
+
+// NewHandler returns an http.Handler that streams the archive described by
+// resolve. It needs no particular path, so it can be mounted anywhere and
+// wrapped in the host application's own middleware:
+//
+//	mux.Handle("/exports/", http.StripPrefix("/exports", archive.NewHandler(archiver, resolve)))
+func NewHandler(archiver *Archiver, resolve Resolver) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if err := archiver.Authorize(r); err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
+        files, name, ok := resolve(w, r)
+        if !ok {
+            return
+        }
+
+        name = SafeName(name)
+        if name == "" {
+            name = "download.zip"
+        }
+        if !strings.HasSuffix(strings.ToLower(name), ".zip") {
+            name += ".zip"
+        }
+
+        w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+        w.Header().Set("Content-Type", "application/zip")
+
+        // The status has gone by the time anything fails, breaking the
+        // connection is the only way left to say the archive is incomplete
+        if err := archiver.Stream(r.Context(), files, w); err != nil && r.Context().Err() == nil {
+            panic(http.ErrAbortHandler)
+        }
+    })
+}
@@ -0,0 +1,94 @@
+package archive
+
+import (
+    "context"
+    "io"
+    "net/http"
+)
+
+// Result sums up an archive once it's finished or has stopped
+type Result struct {
+    Files        int // Entries asked for
+    Written      int // Entries that made it into the archive
+    Skipped      int // Entries a hook dropped
+    Failed       int // Entries that were missing or couldn't be read
+    BytesWritten int64
+    Err          error // Why the archive stopped early, if it did
+}
+
+// Hooks are called at points in an archive's life. Any of them may be nil.
+// They run on the goroutine streaming the archive, so they hold it up for
+// as long as they take.
+type Hooks struct {
+    // OnRequest is called before an archive request is served. Returning an
+    // error refuses it with a 403.
+    OnRequest func(r *http.Request) error
+
+    // OnEntryStart is called before each entry is fetched and can rewrite
+    // it by returning a different file, or skip it by returning nil. The
+    // file passed in must not be modified.
+    OnEntryStart func(ctx context.Context, file *File) *File
+
+    // OnEntryOpen can transform an entry's contents by returning a reader
+    // over body, or body itself to leave them alone. Read errors fail the
+    // entry.
+    OnEntryOpen func(ctx context.Context, file *File, body io.Reader) io.Reader
+
+    // OnEntryError is called for each entry that's missing or fails
+    OnEntryError func(ctx context.Context, file *File, err error)
+
+    // OnArchiveComplete is called once the archive is finished or stops
+    OnArchiveComplete func(ctx context.Context, result Result)
+}
+
+// Authorize runs every OnRequest hook, stopping at the first refusal.
+// NewHandler calls it, other servers streaming archives should too.
+func (a *Archiver) Authorize(r *http.Request) error {
+    for _, hooks := range a.Hooks {
+        if hooks.OnRequest != nil {
+            if err := hooks.OnRequest(r); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// onEntryStart passes the file through every OnEntryStart hook in turn,
+// returning nil as soon as one skips it
+func (a *Archiver) onEntryStart(ctx context.Context, file *File) *File {
+    for _, hooks := range a.Hooks {
+        if hooks.OnEntryStart != nil {
+            if file = hooks.OnEntryStart(ctx, file); file == nil {
+                return nil
+            }
+        }
+    }
+    return file
+}
+
+// onEntryOpen wraps body in every OnEntryOpen hook's reader in turn
+func (a *Archiver) onEntryOpen(ctx context.Context, file *File, body io.Reader) io.Reader {
+    for _, hooks := range a.Hooks {
+        if hooks.OnEntryOpen != nil {
+            body = hooks.OnEntryOpen(ctx, file, body)
+        }
+    }
+    return body
+}
+
+func (a *Archiver) onEntryError(ctx context.Context, file *File, err error) {
+    for _, hooks := range a.Hooks {
+        if hooks.OnEntryError != nil {
+            hooks.OnEntryError(ctx, file, err)
+        }
+    }
+}
+
+func (a *Archiver) onArchiveComplete(ctx context.Context, result Result) {
+    for _, hooks := range a.Hooks {
+        if hooks.OnArchiveComplete != nil {
+            hooks.OnArchiveComplete(ctx, result)
+        }
+    }
+}
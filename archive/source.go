@@ -0,0 +1,219 @@
+package archive
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/AdRoll/goamz/s3"
+)
+
+// ErrNotFound is returned by sources for objects that don't exist
+var ErrNotFound = errors.New("not found")
+
+// Info describes an object in a source
+type Info struct {
+    Size        int64
+    ModTime     time.Time // Zero when the source doesn't know
+    ContentType string    // Empty when the source doesn't know
+}
+
+// Source is where the files of an archive are read from. A file's S3Path is
+// the ref it's opened by. Missing objects are reported as ErrNotFound.
+type Source interface {
+    Open(ctx context.Context, ref string) (io.ReadCloser, Info, error)
+    Stat(ctx context.Context, ref string) (Info, error)
+}
+
+// Lister is a source that can list the objects under a prefix, for
+// manifests that take a whole folder. fn is called for each in key order.
+type Lister interface {
+    List(ctx context.Context, prefix string, fn func(ref string, info Info) error) error
+}
+
+// SourceFactory builds a source from a URL such as s3://bucket or
+// file:///srv/files
+type SourceFactory func(u *url.URL) (Source, error)
+
+var sources = struct {
+    sync.Mutex
+    factories map[string]SourceFactory
+}{factories: map[string]SourceFactory{
+    "file": func(u *url.URL) (Source, error) { return DirSource(u.Path), nil },
+}}
+
+// Register makes a backend available to NewSource under a URL scheme,
+// replacing any already registered
+func Register(scheme string, factory SourceFactory) {
+    sources.Lock()
+    defer sources.Unlock()
+    sources.factories[scheme] = factory
+}
+
+// NewSource builds a source from a URL using the factory registered for
+// its scheme
+func NewSource(rawURL string) (Source, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+
+    sources.Lock()
+    factory, ok := sources.factories[u.Scheme]
+    sources.Unlock()
+    if !ok {
+        return nil, fmt.Errorf("no source registered for %q", u.Scheme)
+    }
+
+    return factory(u)
+}
+
+// S3Source reads objects from a bucket, refs being their keys
+type S3Source struct {
+    Bucket *s3.Bucket
+}
+
+func (s S3Source) Open(ctx context.Context, ref string) (io.ReadCloser, Info, error) {
+    resp, err := s.Bucket.GetResponse(ref)
+    if err != nil {
+        return nil, Info{}, s3Error(err)
+    }
+    return resp.Body, s3Info(resp), nil
+}
+
+func (s S3Source) Stat(ctx context.Context, ref string) (Info, error) {
+    resp, err := s.Bucket.Head(ref, nil)
+    if err != nil {
+        return Info{}, s3Error(err)
+    }
+    resp.Body.Close()
+    return s3Info(resp), nil
+}
+
+// List pages through the keys under prefix, a thousand at a time
+func (s S3Source) List(ctx context.Context, prefix string, fn func(ref string, info Info) error) error {
+    marker := ""
+    for {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        resp, err := s.Bucket.List(prefix, "", marker, 1000)
+        if err != nil {
+            return err
+        }
+        for _, key := range resp.Contents {
+            info := Info{Size: key.Size}
+            info.ModTime, _ = time.Parse(time.RFC3339, key.LastModified)
+            if err := fn(key.Key, info); err != nil {
+                return err
+            }
+        }
+        if !resp.IsTruncated || resp.NextMarker == "" {
+            return nil
+        }
+        marker = resp.NextMarker
+    }
+}
+
+func s3Error(err error) error {
+    if t, ok := err.(*s3.Error); ok && t.StatusCode == 404 {
+        return ErrNotFound
+    }
+    return err
+}
+
+func s3Info(resp *http.Response) Info {
+    info := Info{Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type")}
+    info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+    return info
+}
+
+// DirSource reads files from a local directory, refs being slash separated
+// paths within it. Refs can't escape the directory.
+type DirSource string
+
+func (d DirSource) path(ref string) string {
+    return filepath.Join(string(d), filepath.FromSlash(filepath.Clean("/"+ref)))
+}
+
+func (d DirSource) Open(ctx context.Context, ref string) (io.ReadCloser, Info, error) {
+    f, err := os.Open(d.path(ref))
+    if err != nil {
+        return nil, Info{}, dirError(err)
+    }
+
+    stat, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return nil, Info{}, err
+    }
+    if stat.IsDir() {
+        f.Close()
+        return nil, Info{}, ErrNotFound
+    }
+
+    return f, Info{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (d DirSource) Stat(ctx context.Context, ref string) (Info, error) {
+    stat, err := os.Stat(d.path(ref))
+    if err != nil {
+        return Info{}, dirError(err)
+    }
+    if stat.IsDir() {
+        return Info{}, ErrNotFound
+    }
+    return Info{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// List walks the directory under prefix, taking it as a path prefix as S3
+// would
+func (d DirSource) List(ctx context.Context, prefix string, fn func(ref string, info Info) error) error {
+    root := d.path(path.Dir(prefix + "x"))
+    err := filepath.WalkDir(root, func(file string, entry fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        if entry.IsDir() {
+            return nil
+        }
+
+        rel, err := filepath.Rel(string(d), file)
+        if err != nil {
+            return err
+        }
+        ref := filepath.ToSlash(rel)
+        if !strings.HasPrefix(ref, prefix) {
+            return nil
+        }
+        stat, err := entry.Info()
+        if err != nil {
+            return err
+        }
+        return fn(ref, Info{Size: stat.Size(), ModTime: stat.ModTime()})
+    })
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil
+    }
+    return err
+}
+
+func dirError(err error) error {
+    if errors.Is(err, os.ErrNotExist) {
+        return ErrNotFound
+    }
+    return err
+}
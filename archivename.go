@@ -0,0 +1,76 @@
+package main
+
+import (
+    "fmt"
+    "path"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// A manifest can name its archive, overriding ?as=, so producers keep one
+// naming scheme whatever links they hand out:
+//
+//	{"Version": 1, "ArchiveName": "{owner}-photos-{date}.zip", "Files": [...]}
+//
+// {date} and {time} are when the download starts, in UTC, like 2024-05-01
+// and 13-45-00. {owner} and {tenant} are the manifest's, and {files} is how
+// many files it has. Names can only have letters, digits, spaces and
+// ._-()+, and be up to maxArchiveName bytes. Versioned manifests breaking
+// that are invalid, older ones have the rest replaced by _ and cut short.
+
+// The longest archive name, which most file systems can take
+const maxArchiveName = 255
+
+var (
+    archiveNameVariable = regexp.MustCompile(`\{([a-z]+)\}`)
+    archiveNameUnsafe   = regexp.MustCompile(`[^A-Za-z0-9 ._()+,-]`)
+)
+
+var archiveNameVariables = map[string]func(manifest *Manifest, now time.Time) string{
+    "date":   func(_ *Manifest, now time.Time) string { return now.UTC().Format("2006-01-02") },
+    "time":   func(_ *Manifest, now time.Time) string { return now.UTC().Format("15-04-05") },
+    "owner":  func(manifest *Manifest, _ time.Time) string { return manifest.Owner },
+    "tenant": func(manifest *Manifest, _ time.Time) string { return manifest.Tenant },
+    "files":  func(manifest *Manifest, _ time.Time) string { return strconv.Itoa(len(manifest.Files)) },
+}
+
+// archiveNameProblem is what's wrong with an ArchiveName, if anything
+func archiveNameProblem(name string) string {
+    if len(name) > maxArchiveName {
+        return fmt.Sprintf("is longer than %d bytes", maxArchiveName)
+    }
+    for _, match := range archiveNameVariable.FindAllStringSubmatch(name, -1) {
+        if _, ok := archiveNameVariables[match[1]]; !ok {
+            return fmt.Sprintf("has an unknown variable {%s}", match[1])
+        }
+    }
+    if archiveNameUnsafe.MatchString(archiveNameVariable.ReplaceAllString(name, "")) {
+        return "can only have letters, digits, spaces and ._-()+,"
+    }
+    return ""
+}
+
+// renderArchiveName fills in the manifest's ArchiveName as of now, empty if
+// nothing's left of it
+func renderArchiveName(manifest *Manifest, now time.Time) string {
+    name := archiveNameVariable.ReplaceAllStringFunc(manifest.ArchiveName, func(variable string) string {
+        if value, ok := archiveNameVariables[variable[1:len(variable)-1]]; ok {
+            return value(manifest, now)
+        }
+        return variable
+    })
+    name = strings.TrimSpace(archiveNameUnsafe.ReplaceAllString(name, "_"))
+
+    // Owners and tenants can make it too long, so it's cut before the
+    // extension
+    if len(name) > maxArchiveName {
+        ext := path.Ext(name)
+        if len(ext) > 16 {
+            ext = ""
+        }
+        name = name[:maxArchiveName-len(ext)] + ext
+    }
+    return name
+}
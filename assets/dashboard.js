@@ -0,0 +1,103 @@
+// Polls the admin API with a key kept for the browser session
+(function () {
+    var key = sessionStorage.getItem("zipperAdminKey");
+
+    function api(method, path) {
+        return fetch(path, {method: method, headers: {"X-API-Key": key}}).then(function (resp) {
+            if (resp.status === 401 || resp.status === 403) {
+                sessionStorage.removeItem("zipperAdminKey");
+                showLogin();
+                throw new Error("unauthorized");
+            }
+            return resp.status === 204 ? null : resp.json();
+        });
+    }
+
+    function humanSize(n) {
+        var units = ["B", "kB", "MB", "GB", "TB"];
+        var i = 0;
+        while (n >= 1000 && i < units.length - 1) {
+            n /= 1000;
+            i++;
+        }
+        return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+    }
+
+    function cell(row, text, className) {
+        var td = row.insertCell();
+        td.textContent = text;
+        if (className) {
+            td.className = className;
+        }
+        return td;
+    }
+
+    function drawThroughput(samples) {
+        var svg = document.getElementById("throughput");
+        var max = Math.max.apply(null, samples.map(function (s) { return s.bytes; }).concat([1]));
+        var points = samples.map(function (s, i) {
+            return i + "," + (100 - s.bytes / max * 95).toFixed(1);
+        });
+        svg.innerHTML = '<polyline fill="none" stroke="#2563eb" stroke-width="1" points="' + points.join(" ") + '"/>';
+        svg.setAttribute("aria-label", "Peak " + humanSize(max / 10) + "/s");
+    }
+
+    function refresh() {
+        api("GET", "stats").then(function (stats) {
+            document.getElementById("summary").textContent = "Up " + stats.uptime + ", " +
+                stats.activeDownloads + " downloads and " + stats.activeJobs + " jobs running";
+            drawThroughput(stats.throughput);
+
+            var errors = document.getElementById("errors");
+            errors.innerHTML = "";
+            stats.recentErrors.slice().reverse().forEach(function (e) {
+                var row = errors.insertRow();
+                cell(row, new Date(e.time).toLocaleTimeString());
+                cell(row, e.message);
+            });
+        });
+
+        api("GET", "downloads").then(function (downloads) {
+            var tbody = document.getElementById("downloads");
+            tbody.innerHTML = "";
+            downloads.forEach(function (d) {
+                var row = tbody.insertRow();
+                cell(row, d.token);
+                cell(row, d.clientIp);
+                cell(row, d.filesDone + " / " + d.filesTotal, "size");
+                cell(row, humanSize(d.bytesStreamed), "size");
+                cell(row, d.duration, "size");
+
+                var stop = document.createElement("button");
+                stop.textContent = "Terminate";
+                stop.onclick = function () {
+                    api("DELETE", "downloads/" + encodeURIComponent(d.id)).then(refresh);
+                };
+                cell(row, "").appendChild(stop);
+            });
+        });
+    }
+
+    function showLogin() {
+        document.getElementById("login").hidden = false;
+    }
+
+    document.getElementById("login").onsubmit = function (e) {
+        e.preventDefault();
+        key = this.key.value;
+        sessionStorage.setItem("zipperAdminKey", key);
+        this.hidden = true;
+        refresh();
+    };
+
+    if (key) {
+        refresh();
+    } else {
+        showLogin();
+    }
+    setInterval(function () {
+        if (key) {
+            refresh();
+        }
+    }, 5000);
+})();
@@ -0,0 +1,257 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "hash"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    goredis "github.com/redis/go-redis/v9"
+)
+
+// Every download is appended to the AUDIT_STREAM Redis stream. Each entry
+// carries the hash of the one before it, so editing or removing an entry
+// breaks the chain from that point on. With AUDIT_KEY set the hashes are
+// HMACs, which can't be recomputed by someone who only has Redis access.
+//
+// The newest hash is kept at <AUDIT_STREAM>:head, so entries removed from the
+// end show up too, and logged with each append, so the head can be checked
+// against something that isn't in Redis. Both are written in one
+// transaction, so the stream's name is a Redis Cluster hash tag, AUDIT_STREAM
+// in braces unless it has a tag of its own.
+
+// How many times appending is retried when another replica wins the race
+// for the head of the chain
+const auditAttempts = 5
+
+var errAuditContention = errors.New("audit stream is too busy")
+
+// auditRecord is what gets written about a download
+type auditRecord struct {
+    Time        time.Time
+    DownloadID  string
+    RequestID   string
+    Token       string
+    IP          string
+    UserAgent   string
+    Result      string
+    Bytes       int64
+    FilesTotal  int
+    FailedFiles []string
+}
+
+// fields lays the record out as stream fields, in the order they're hashed
+func (a *auditRecord) fields() []string {
+    failed, _ := json.Marshal(a.FailedFiles)
+    if a.FailedFiles == nil {
+        failed = []byte("[]")
+    }
+
+    return []string{
+        "time", a.Time.UTC().Format(time.RFC3339Nano),
+        "download_id", a.DownloadID,
+        "request_id", a.RequestID,
+        "token", a.Token,
+        "ip", a.IP,
+        "user_agent", a.UserAgent,
+        "result", a.Result,
+        "bytes", strconv.FormatInt(a.Bytes, 10),
+        "files_total", strconv.Itoa(a.FilesTotal),
+        "failed_files", string(failed),
+    }
+}
+
+// auditStreamKey is AUDIT_STREAM as a hash tag, so the head lands in the
+// same cluster slot
+func auditStreamKey() string {
+    name := config.AuditStream
+    if open := strings.Index(name, "{"); open >= 0 {
+        if close := strings.Index(name[open+1:], "}"); close > 0 {
+            return name
+        }
+    }
+    return "{" + name + "}"
+}
+
+func auditHeadKey() string {
+    return auditStreamKey() + ":head"
+}
+
+func newAuditHash() hash.Hash {
+    if key := secrets().AuditKey; key != "" {
+        return hmac.New(sha256.New, []byte(key))
+    }
+    return sha256.New()
+}
+
+// auditHash covers every field of an entry, including the previous hash.
+// Lengths are written ahead of each value so fields can't be shifted into
+// one another.
+func auditHash(fields []string) string {
+    h := newAuditHash()
+    for _, field := range fields {
+        h.Write([]byte(strconv.Itoa(len(field)) + ":"))
+        h.Write([]byte(field))
+    }
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// audit appends a download to the stream. It is only logged when that
+// fails, the archive has already been sent by then.
+func audit(ctx context.Context, record *auditRecord) {
+    if config.AuditStream == "" {
+        return
+    }
+
+    if err := appendAudit(ctx, record); err != nil {
+        slog.ErrorContext(ctx, "Error writing audit record", "download_id", record.DownloadID, "error", err)
+        recordError("Audit record for download " + record.DownloadID + " was not written: " + err.Error())
+    }
+}
+
+// appendAudit chains the record onto the current head. WATCH makes the
+// write fail if another replica appends in between, in which case it's
+// tried again on the new head.
+func appendAudit(ctx context.Context, record *auditRecord) error {
+    var sum string
+    for attempt := 0; attempt < auditAttempts; attempt++ {
+        err := redisClient.Watch(ctx, func(tx *goredis.Tx) error {
+            prev, err := tx.Get(ctx, auditHeadKey()).Result()
+            if err != nil && err != goredis.Nil {
+                return err
+            }
+
+            fields := append(record.fields(), "prev", prev)
+            sum = auditHash(fields)
+            fields = append(fields, "hash", sum)
+
+            _, err = tx.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+                pipe.XAdd(ctx, &goredis.XAddArgs{Stream: auditStreamKey(), Values: fields})
+                pipe.Set(ctx, auditHeadKey(), sum, 0)
+                return nil
+            })
+            return err
+        }, auditHeadKey())
+        if err == nil {
+            slog.InfoContext(ctx, "Audit record appended", "download_id", record.DownloadID, "audit_head", sum)
+        }
+        if err != goredis.TxFailedErr {
+            return err
+        }
+    }
+
+    return errAuditContention
+}
+
+type auditVerifyResponse struct {
+    Entries  int    `json:"entries"`
+    Valid    bool   `json:"valid"`
+    BrokenAt string `json:"brokenAt,omitempty"`
+    Reason   string `json:"reason,omitempty"`
+
+    // The hash the chain should reach, to compare with the logged one
+    Head string `json:"head,omitempty"`
+}
+
+// verifyAuditHandler walks the whole stream checking every entry's hash and
+// link to the entry before it
+func verifyAuditHandler(w http.ResponseWriter, r *http.Request) {
+    if config.AuditStream == "" {
+        writeProblem(w, r, 404, codeNotFound, "Auditing is not enabled")
+        return
+    }
+
+    // The head is read first, so entries appended during the walk can't make
+    // it look missing
+    head, err := redisClient.Get(r.Context(), auditHeadKey()).Result()
+    if err != nil && err != goredis.Nil {
+        slog.ErrorContext(r.Context(), "Error reading audit head", "error", err)
+        writeProblem(w, r, 503, codeStorageUnreachable, "Could not read the audit stream")
+        return
+    }
+
+    result := auditVerifyResponse{Valid: true, Head: head}
+    prev, start := "", "-"
+    reachedHead := head == ""
+
+    for {
+        // XRANGE itself rather than XRangeN, which loses the field order
+        // the hashes cover
+        entries, err := redisClient.Do(r.Context(), "XRANGE", auditStreamKey(), start, "+", "COUNT", 500).Slice()
+        if err != nil {
+            slog.ErrorContext(r.Context(), "Error reading audit stream", "error", err)
+            writeProblem(w, r, 503, codeStorageUnreachable, "Could not read the audit stream")
+            return
+        }
+        if len(entries) == 0 {
+            break
+        }
+
+        for _, entry := range entries {
+            parts, _ := entry.([]interface{})
+            id, fields := auditEntry(parts)
+            result.Entries++
+
+            if reason := checkAuditEntry(fields, prev); reason != "" {
+                result.Valid = false
+                result.BrokenAt = id
+                result.Reason = reason
+                writeJSON(w, 200, result)
+                return
+            }
+
+            prev = fields[len(fields)-1]
+            start = "(" + id
+            reachedHead = reachedHead || prev == head
+        }
+    }
+
+    // Entries removed from the end leave a chain that's fine as far as it
+    // goes
+    switch {
+    case !reachedHead:
+        result.Valid = false
+        result.Reason = "the chain ends before the head, entries have been removed from the end"
+    case head == "" && result.Entries > 0 && redisClient.Exists(r.Context(), auditHeadKey()).Val() == 0:
+        result.Valid = false
+        result.Reason = "the head is missing"
+    }
+    writeJSON(w, 200, result)
+}
+
+// auditEntry reads an XRANGE entry, [id, [field, value, ...]]
+func auditEntry(parts []interface{}) (id string, fields []string) {
+    if len(parts) != 2 {
+        return "", nil
+    }
+    id, _ = parts[0].(string)
+    values, _ := parts[1].([]interface{})
+    for _, value := range values {
+        field, _ := value.(string)
+        fields = append(fields, field)
+    }
+    return id, fields
+}
+
+// checkAuditEntry explains what's wrong with an entry, if anything
+func checkAuditEntry(fields []string, prev string) string {
+    n := len(fields)
+    if n < 4 || fields[n-4] != "prev" || fields[n-2] != "hash" {
+        return "entry is missing its hashes"
+    }
+    if fields[n-3] != prev {
+        return "entry does not follow the one before it"
+    }
+    if auditHash(fields[:n-2]) != fields[n-1] {
+        return "entry has been modified"
+    }
+    return ""
+}
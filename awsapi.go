@@ -0,0 +1,68 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+
+    "github.com/AdRoll/goamz/aws"
+)
+
+// awsJSONAPI calls one of the AWS services that take JSON POSTed with an
+// X-Amz-Target, like DynamoDB and Secrets Manager. goamz only has S3.
+type awsJSONAPI struct {
+    endpoint    string
+    contentType string // application/x-amz-json-1.0 or 1.1, per service
+    target      string // prefixed to each action
+    auth        aws.Auth
+    signer      *aws.V4Signer
+}
+
+func newAWSJSONAPI(auth aws.Auth, service, region, endpoint, version, target string) *awsJSONAPI {
+    return &awsJSONAPI{
+        endpoint:    endpoint,
+        contentType: "application/x-amz-json-" + version,
+        target:      target,
+        auth:        auth,
+        signer:      aws.NewV4Signer(auth, service, aws.Region{Name: region}),
+    }
+}
+
+// call makes a request, decoding the response into response
+func (api *awsJSONAPI) call(ctx context.Context, action string, request, response interface{}) error {
+    body, err := json.Marshal(request)
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequestWithContext(ctx, "POST", api.endpoint, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", api.contentType)
+    req.Header.Set("X-Amz-Target", api.target+"."+action)
+    if token := api.auth.Token(); token != "" {
+        req.Header.Set("X-Amz-Security-Token", token)
+    }
+    api.signer.Sign(req)
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != 200 {
+        var failure struct {
+            Type    string `json:"__type"`
+            Message string `json:"message"`
+        }
+        json.NewDecoder(resp.Body).Decode(&failure)
+        kind := failure.Type[strings.LastIndex(failure.Type, "#")+1:]
+        return fmt.Errorf("%s failed with %d: %s %s", action, resp.StatusCode, kind, failure.Message)
+    }
+    return json.NewDecoder(resp.Body).Decode(response)
+}
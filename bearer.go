@@ -0,0 +1,72 @@
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+var (
+    errBearerMissing  = errors.New("missing bearer token")
+    errBearerInvalid  = errors.New("invalid bearer token")
+    errBearerInactive = errors.New("bearer token is not active")
+)
+
+var introspectionClient = &http.Client{Timeout: 5 * time.Second}
+
+// bearerRequired reports whether downloads need an Authorization header on
+// top of the download token
+func bearerRequired() bool {
+    return secrets().BearerSecret != "" || config.BearerIntrospectionURL != ""
+}
+
+func bearerToken(r *http.Request) string {
+    auth := r.Header.Get("Authorization")
+    if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+        return ""
+    }
+    return strings.TrimSpace(auth[7:])
+}
+
+// verifyBearer validates the request's bearer token against the configured
+// secret, or failing that the OAuth 2.0 introspection endpoint (RFC 7662)
+func verifyBearer(r *http.Request) error {
+    token := bearerToken(r)
+    if token == "" {
+        return errBearerMissing
+    }
+
+    if secret := secrets().BearerSecret; secret != "" {
+        if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+            return errBearerInvalid
+        }
+        return nil
+    }
+
+    resp, err := introspectionClient.PostForm(config.BearerIntrospectionURL, url.Values{"token": {token}})
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != 200 {
+        return errBearerInvalid
+    }
+
+    var result struct {
+        Active bool `json:"active"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return err
+    }
+
+    if !result.Active {
+        return errBearerInactive
+    }
+
+    return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/AdRoll/goamz/aws"
+    "github.com/AdRoll/goamz/s3"
+    goredis "github.com/redis/go-redis/v9"
+)
+
+// Every finished archive is sent to BILLING_SINK as a billingEvent, for the
+// billing pipeline to pick up:
+//
+//	s3://<bucket>/<prefix>   an object of JSON lines per replica per hour,
+//	                         <prefix>/2024/05/01/13/<host>-<id>.jsonl
+//	sqs://<queue URL host and path>   an SQS message per event
+//	redis://<stream>         an entry per event on a Redis stream, in the
+//	                         "event" field
+//
+// Events go out in the background. S3 objects are put once their hour is
+// over and on shutdown, so a replica that crashes loses its current hour.
+
+// billingEvent is one archive, as the billing pipeline sees it
+type billingEvent struct {
+    ID      string    `json:"id"`
+    Kind    string    `json:"kind"` // download, grpc or job
+    Time    time.Time `json:"time"`
+    Tenant  string    `json:"tenant,omitempty"`
+    Owner   string    `json:"owner,omitempty"`
+    Result  string    `json:"result"`
+    Bytes   int64     `json:"bytes"`
+    Files   int       `json:"files"`
+    Replica string    `json:"replica"`
+}
+
+// billingSink delivers events. It's only called from one goroutine. flush
+// is called every minute, and with all set on shutdown.
+type billingSink interface {
+    send(ctx context.Context, event []byte, at time.Time) error
+    flush(ctx context.Context, all bool) error
+}
+
+// How many events can wait to be sent before new ones are dropped
+const billingQueueSize = 10000
+
+var (
+    billingEvents  chan *billingEvent
+    billingDone    = make(chan struct{})
+    replicaName, _ = os.Hostname()
+
+    // Jobs can still finish after the queue is closed on shutdown
+    billingLock   sync.RWMutex
+    billingClosed bool
+)
+
+func initBilling() {
+    if config.BillingSink == "" {
+        return
+    }
+
+    sink, err := newBillingSink(config.BillingSink)
+    if err != nil {
+        panic(err)
+    }
+
+    billingEvents = make(chan *billingEvent, billingQueueSize)
+    go sendBilling(sink)
+    slog.Info("Sending billing events", "sink", config.BillingSink)
+}
+
+func newBillingSink(raw string) (billingSink, error) {
+    u, err := url.Parse(raw)
+    if err != nil {
+        return nil, err
+    }
+
+    switch u.Scheme {
+    case "s3":
+        bucket := s3.New(awsAuth, aws.GetRegion(config.Region)).Bucket(u.Host)
+        return &s3BillingSink{bucket: bucket, prefix: strings.Trim(u.Path, "/"), id: newToken()[:8]}, nil
+    case "sqs":
+        return newSQSBillingSink(u), nil
+    case "redis":
+        return redisBillingSink{stream: u.Host + u.Path}, nil
+    }
+    return nil, fmt.Errorf("BILLING_SINK %q should be s3://, sqs:// or redis://", raw)
+}
+
+// emitBilling queues an event, dropping it with an error logged rather than
+// holding up the request when the sink is that far behind
+func emitBilling(event *billingEvent) {
+    if billingEvents == nil {
+        return
+    }
+
+    billingLock.RLock()
+    defer billingLock.RUnlock()
+    if billingClosed {
+        slog.Error("Billing event after shutdown, dropped it", "id", event.ID, "tenant", event.Tenant, "bytes", event.Bytes)
+        return
+    }
+
+    event.Replica = replicaName
+    select {
+    case billingEvents <- event:
+    default:
+        slog.Error("Billing queue full, dropped an event", "id", event.ID, "tenant", event.Tenant, "bytes", event.Bytes)
+    }
+}
+
+// sendBilling sends events as they come, flushing the sink every minute
+// and once the queue is closed
+func sendBilling(sink billingSink) {
+    defer close(billingDone)
+    ticker := time.NewTicker(time.Minute)
+    defer ticker.Stop()
+
+    ctx := context.Background()
+    for {
+        select {
+        case event, ok := <-billingEvents:
+            if !ok {
+                if err := sink.flush(ctx, true); err != nil {
+                    slog.Error("Error flushing billing events", "error", err)
+                }
+                return
+            }
+
+            line, _ := json.Marshal(event)
+            if err := sink.send(ctx, line, event.Time); err != nil {
+                slog.Error("Error sending billing event", "id", event.ID, "event", string(line), "error", err)
+            }
+        case <-ticker.C:
+            if err := sink.flush(ctx, false); err != nil {
+                slog.Error("Error flushing billing events", "error", err)
+            }
+        }
+    }
+}
+
+// closeBilling sends what's left, on shutdown
+func closeBilling() {
+    if billingEvents == nil {
+        return
+    }
+
+    billingLock.Lock()
+    billingClosed = true
+    close(billingEvents)
+    billingLock.Unlock()
+
+    select {
+    case <-billingDone:
+    case <-time.After(config.ShutdownTimeout):
+        slog.Error("Timed out sending the last billing events")
+    }
+}
+
+// s3BillingSink collects an hour's events and puts them as one object
+type s3BillingSink struct {
+    bucket *s3.Bucket
+    prefix string
+    id     string // tells this process's objects from an earlier one's
+
+    hours map[time.Time]*bytes.Buffer
+}
+
+func (s *s3BillingSink) send(ctx context.Context, event []byte, at time.Time) error {
+    hour := at.UTC().Truncate(time.Hour)
+    if s.hours == nil {
+        s.hours = map[time.Time]*bytes.Buffer{}
+    }
+    if s.hours[hour] == nil {
+        s.hours[hour] = &bytes.Buffer{}
+    }
+    s.hours[hour].Write(event)
+    s.hours[hour].WriteByte('\n')
+    return nil
+}
+
+// flush puts the hours that are over, or all of them when shutting down
+func (s *s3BillingSink) flush(ctx context.Context, all bool) error {
+    current := time.Now().UTC().Truncate(time.Hour)
+    for hour, buf := range s.hours {
+        if hour.Equal(current) && !all {
+            continue
+        }
+
+        key := s.key(hour)
+        if err := s.bucket.Put(key, buf.Bytes(), "application/x-ndjson", s3.Private, s3.Options{}); err != nil {
+            s3Errors.inc("put")
+            return fmt.Errorf("putting %s: %w", key, err)
+        }
+        delete(s.hours, hour)
+    }
+    return nil
+}
+
+func (s *s3BillingSink) key(hour time.Time) string {
+    key := hour.Format("2006/01/02/15") + "/" + replicaName + "-" + s.id + ".jsonl"
+    if s.prefix != "" {
+        key = s.prefix + "/" + key
+    }
+    return key
+}
+
+// sqsBillingSink sends each event as a message
+type sqsBillingSink struct {
+    queueURL string
+    api      *awsJSONAPI
+}
+
+// newSQSBillingSink takes sqs://sqs.<region>.amazonaws.com/<account>/<queue>,
+// the queue URL with sqs:// for https://
+func newSQSBillingSink(u *url.URL) *sqsBillingSink {
+    region := config.Region
+    if parts := strings.Split(u.Host, "."); len(parts) > 2 && parts[0] == "sqs" {
+        region = parts[1]
+    }
+
+    queueURL := "https://" + u.Host + u.Path
+    return &sqsBillingSink{
+        queueURL: queueURL,
+        api:      newAWSJSONAPI(awsAuth, "sqs", region, "https://"+u.Host+"/", "1.0", "AmazonSQS"),
+    }
+}
+
+func (s *sqsBillingSink) send(ctx context.Context, event []byte, at time.Time) error {
+    return s.api.call(ctx, "SendMessage", map[string]string{
+        "QueueUrl":    s.queueURL,
+        "MessageBody": string(event),
+    }, &struct{}{})
+}
+
+func (s *sqsBillingSink) flush(ctx context.Context, all bool) error {
+    return nil
+}
+
+// redisBillingSink adds each event to a stream
+type redisBillingSink struct {
+    stream string
+}
+
+func (s redisBillingSink) send(ctx context.Context, event []byte, at time.Time) error {
+    return redisClient.XAdd(ctx, &goredis.XAddArgs{Stream: s.stream, Values: []string{"event", string(event)}}).Err()
+}
+
+func (s redisBillingSink) flush(ctx context.Context, all bool) error {
+    return nil
+}
@@ -0,0 +1,284 @@
+// Package client talks to a zipper server over its HTTP API, so Go services
+// can create tokens, run background jobs and stream archives without
+// writing manifests to Redis or building requests by hand.
+//
+//	c := client.New("https://zipper.internal", client.WithAPIKey(key))
+//	token, err := c.CreateToken(ctx, []client.File{{FileName: "a.pdf", S3Path: "docs/a.pdf"}}, 0)
+//	archive, err := c.Download(ctx, token, "documents")
+//	defer archive.Close()
+package client
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// File is one entry in an archive's manifest
+type File struct {
+    FileName string
+    Folder   string `json:",omitempty"`
+    S3Path   string
+    Size     int64 `json:",omitempty"` // Optional, saves a HEAD request when estimating
+}
+
+// Job states
+const (
+    JobQueued    = "queued"
+    JobRunning   = "running"
+    JobUploading = "uploading"
+    JobDone      = "done"
+    JobFailed    = "failed"
+    JobCancelled = "cancelled"
+)
+
+// Job is an archive being built in the background
+type Job struct {
+    ID            string    `json:"id"`
+    RequestID     string    `json:"requestId,omitempty"`
+    State         string    `json:"state"`
+    FilesTotal    int       `json:"filesTotal"`
+    FilesDone     int       `json:"filesDone"`
+    BytesStreamed int64     `json:"bytesStreamed"`
+    CurrentFile   string    `json:"currentFile,omitempty"`
+    LastError     string    `json:"lastError,omitempty"`
+    ResultURL     string    `json:"resultUrl,omitempty"`
+    Error         string    `json:"error,omitempty"`
+    CreatedAt     time.Time `json:"createdAt"`
+    UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// Finished reports whether the job has stopped, one way or another
+func (j *Job) Finished() bool {
+    return j.State == JobDone || j.State == JobFailed || j.State == JobCancelled
+}
+
+// FileStatus describes an entry of a manifest as found in S3
+type FileStatus struct {
+    FileName string `json:"fileName"`
+    Folder   string `json:"folder,omitempty"`
+    Path     string `json:"path"`
+    S3Path   string `json:"s3Path"`
+    Exists   bool   `json:"exists"`
+    Size     int64  `json:"size"`
+    Error    string `json:"error,omitempty"`
+}
+
+// Validation is the result of checking a token's files exist
+type Validation struct {
+    Valid     bool         `json:"valid"`
+    Files     []FileStatus `json:"files"`
+    Missing   int          `json:"missing"`
+    TotalSize int64        `json:"totalSize"`
+}
+
+// Error is a problem the server reported, with the code from its problem
+// details body such as "token_not_found"
+type Error struct {
+    Status int    `json:"status"`
+    Code   string `json:"code"`
+    Title  string `json:"title"`
+    Detail string `json:"detail"`
+}
+
+func (e *Error) Error() string {
+    if e.Detail != "" {
+        return fmt.Sprintf("zipper: %s (%d): %s", e.Code, e.Status, e.Detail)
+    }
+    return fmt.Sprintf("zipper: %s (%d)", e.Code, e.Status)
+}
+
+// Client calls one zipper server. It's safe to share between goroutines.
+type Client struct {
+    baseURL    string
+    apiKey     string
+    httpClient *http.Client
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithAPIKey sends key in X-API-Key, which creating tokens needs
+func WithAPIKey(key string) Option {
+    return func(c *Client) {
+        c.apiKey = key
+    }
+}
+
+// WithHTTPClient replaces http.DefaultClient. Archives stream for as long
+// as they take, so it shouldn't have an overall timeout.
+func WithHTTPClient(httpClient *http.Client) Option {
+    return func(c *Client) {
+        c.httpClient = httpClient
+    }
+}
+
+// New returns a client for the server at baseURL
+func New(baseURL string, options ...Option) *Client {
+    c := &Client{baseURL: strings.TrimRight(baseURL, "/"), httpClient: http.DefaultClient}
+    for _, option := range options {
+        option(c)
+    }
+    return c
+}
+
+// do sends a request and returns the response when its status is the one
+// expected, and an *Error otherwise
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body interface{}, expect int) (*http.Response, error) {
+    u := c.baseURL + path
+    if len(query) > 0 {
+        u += "?" + query.Encode()
+    }
+
+    var reader io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return nil, err
+        }
+        reader = bytes.NewReader(data)
+    }
+
+    req, err := http.NewRequestWithContext(ctx, method, u, reader)
+    if err != nil {
+        return nil, err
+    }
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    if c.apiKey != "" {
+        req.Header.Set("X-API-Key", c.apiKey)
+    }
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode != expect {
+        defer resp.Body.Close()
+
+        problem := &Error{Status: resp.StatusCode, Code: "unexpected_status"}
+        json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(problem)
+        problem.Status = resp.StatusCode
+        return nil, problem
+    }
+
+    return resp, nil
+}
+
+// doJSON is do for endpoints answering with JSON, decoded into v
+func (c *Client) doJSON(ctx context.Context, method, path string, query url.Values, body interface{}, expect int, v interface{}) error {
+    resp, err := c.do(ctx, method, path, query, body, expect)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// tokenQuery is how the non-download endpoints take a token
+func tokenQuery(token string) url.Values {
+    return url.Values{"token": {token}}
+}
+
+// CreateToken stores files as a new archive and returns its download token.
+// A ttl of zero leaves the server's default of a day.
+func (c *Client) CreateToken(ctx context.Context, files []File, ttl time.Duration) (string, error) {
+    body := struct {
+        Files []File `json:"files"`
+        TTL   int    `json:"ttl,omitempty"`
+    }{Files: files, TTL: int(ttl.Seconds())}
+
+    var created struct {
+        Token string `json:"token"`
+    }
+    if err := c.doJSON(ctx, "POST", "/v1/tokens", nil, body, 201, &created); err != nil {
+        return "", err
+    }
+    return created.Token, nil
+}
+
+// Download streams a token's archive. name is the file name to ask for,
+// without .zip, or empty for the server's default. The caller must close
+// the archive.
+func (c *Client) Download(ctx context.Context, token, name string) (io.ReadCloser, error) {
+    var query url.Values
+    if name != "" {
+        query = url.Values{"as": {name}}
+    }
+
+    resp, err := c.do(ctx, "GET", "/v1/download/"+url.PathEscape(token), query, nil, 200)
+    if err != nil {
+        return nil, err
+    }
+    return resp.Body, nil
+}
+
+// Validate checks every file in a token's manifest exists in S3
+func (c *Client) Validate(ctx context.Context, token string) (*Validation, error) {
+    validation := &Validation{}
+    return validation, c.doJSON(ctx, "GET", "/v1/validate", tokenQuery(token), nil, 200, validation)
+}
+
+// List returns the files in a token's archive
+func (c *Client) List(ctx context.Context, token string) ([]FileStatus, error) {
+    var list struct {
+        Files []FileStatus `json:"files"`
+    }
+    return list.Files, c.doJSON(ctx, "GET", "/v1/list", tokenQuery(token), nil, 200, &list)
+}
+
+// StartJob queues a background build of a token's archive, which ends up in
+// S3 at the job's ResultURL
+func (c *Client) StartJob(ctx context.Context, token, name string) (*Job, error) {
+    query := tokenQuery(token)
+    if name != "" {
+        query.Set("as", name)
+    }
+
+    job := &Job{}
+    return job, c.doJSON(ctx, "POST", "/v1/jobs", query, nil, 202, job)
+}
+
+// Job returns a job's current state
+func (c *Client) Job(ctx context.Context, id string) (*Job, error) {
+    job := &Job{}
+    return job, c.doJSON(ctx, "GET", "/v1/jobs/"+url.PathEscape(id), nil, nil, 200, job)
+}
+
+// CancelJob stops a job and deletes anything it uploaded
+func (c *Client) CancelJob(ctx context.Context, id string) (*Job, error) {
+    job := &Job{}
+    return job, c.doJSON(ctx, "DELETE", "/v1/jobs/"+url.PathEscape(id), nil, nil, 200, job)
+}
+
+// WaitJob polls a job every interval until it finishes or ctx is done. A
+// failed or cancelled job is returned without an error, check its State.
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration) (*Job, error) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        job, err := c.Job(ctx, id)
+        if err != nil {
+            return nil, err
+        }
+        if job.Finished() {
+            return job, nil
+        }
+
+        select {
+        case <-ctx.Done():
+            return job, ctx.Err()
+        case <-ticker.C:
+        }
+    }
+}
@@ -0,0 +1,328 @@
+// Command zipperctl is for runbooks and debugging. It talks to a zipper
+// server through its API, or straight to Redis with -redis.
+//
+//	zipperctl token create -ttl 1h manifest.json
+//	zipperctl token inspect <token>
+//	zipperctl download -o out.zip <token>
+//	zipperctl validate <token>
+//	zipperctl job status -wait <id>
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "os/signal"
+    "strings"
+    "text/tabwriter"
+    "time"
+
+    "codecourse/zipper/client"
+    goredis "github.com/redis/go-redis/v9"
+)
+
+const usage = `Usage: zipperctl [flags] <command>
+
+Commands:
+  token create [-ttl duration] [manifest.json]  store a manifest, read from stdin without a file
+  token inspect <token>                         show a token's manifest
+  download [-o file] [-as name] <token>         save a token's archive, to stdout without -o
+  validate <token>                              check a token's files exist
+  job status [-wait] <id>                       show a background job
+
+Flags:
+`
+
+var (
+    server = flag.String("server", envOr("ZIPPER_URL", "http://localhost:8080"), "zipper server URL")
+    apiKey = flag.String("api-key", os.Getenv("ZIPPER_API_KEY"), "API key for creating tokens")
+    redis  = flag.String("redis", "", "host:port of Redis to use for tokens instead of the server, with REDIS_PASSWORD and REDIS_KEY_PREFIX or REDIS_KEY_TEMPLATE")
+)
+
+func envOr(name, fallback string) string {
+    if value := os.Getenv(name); value != "" {
+        return value
+    }
+    return fallback
+}
+
+func main() {
+    flag.Usage = func() {
+        fmt.Fprint(flag.CommandLine.Output(), usage)
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+
+    if err := run(ctx, flag.Args()); err != nil {
+        fmt.Fprintln(os.Stderr, "zipperctl:", err)
+        os.Exit(1)
+    }
+}
+
+var errUsage = errors.New("unknown command, see zipperctl -h")
+
+func run(ctx context.Context, args []string) error {
+    if len(args) == 0 {
+        return errUsage
+    }
+
+    switch args[0] {
+    case "token":
+        if len(args) > 1 && args[1] == "create" {
+            return tokenCreate(ctx, args[2:])
+        }
+        if len(args) > 1 && args[1] == "inspect" {
+            return tokenInspect(ctx, args[2:])
+        }
+    case "download":
+        return download(ctx, args[1:])
+    case "validate":
+        return validate(ctx, args[1:])
+    case "job":
+        if len(args) > 1 && args[1] == "status" {
+            return jobStatus(ctx, args[2:])
+        }
+    }
+    return errUsage
+}
+
+func newClient() *client.Client {
+    return client.New(*server, client.WithAPIKey(*apiKey))
+}
+
+func redisClient() *goredis.Client {
+    return goredis.NewClient(&goredis.Options{Addr: *redis, Password: os.Getenv("REDIS_PASSWORD")})
+}
+
+// manifestKey is where the server keeps a token's manifest, following its
+// REDIS_KEY_PREFIX and REDIS_KEY_TEMPLATE
+func manifestKey(token string) string {
+    if template := os.Getenv("REDIS_KEY_TEMPLATE"); template != "" {
+        return strings.ReplaceAll(template, "{token}", token)
+    }
+    return envOr("REDIS_KEY_PREFIX", "zip:") + token
+}
+
+// serverKey is where the server keeps one of its other keys, under a
+// REDIS_KEY_PREFIX other than the default
+func serverKey(name string) string {
+    if prefix := envOr("REDIS_KEY_PREFIX", "zip:"); prefix != "zip:" {
+        return prefix + name
+    }
+    return name
+}
+
+// oneArg parses a subcommand's flags and returns its single argument
+func oneArg(flags *flag.FlagSet, args []string, name string) (string, error) {
+    if err := flags.Parse(args); err != nil {
+        return "", err
+    }
+    if flags.NArg() != 1 {
+        return "", fmt.Errorf("expected a %s", name)
+    }
+    return flags.Arg(0), nil
+}
+
+func printJSON(v interface{}) error {
+    encoder := json.NewEncoder(os.Stdout)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(v)
+}
+
+func tokenCreate(ctx context.Context, args []string) error {
+    flags := flag.NewFlagSet("token create", flag.ExitOnError)
+    ttl := flags.Duration("ttl", 24*time.Hour, "how long the token lasts")
+    flags.Parse(args)
+
+    input := io.Reader(os.Stdin)
+    if flags.NArg() > 0 {
+        f, err := os.Open(flags.Arg(0))
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        input = f
+    }
+
+    var files []client.File
+    if err := json.NewDecoder(input).Decode(&files); err != nil {
+        return fmt.Errorf("reading manifest: %w", err)
+    }
+    if len(files) == 0 {
+        return errors.New("the manifest has no files")
+    }
+
+    if *redis == "" {
+        token, err := newClient().CreateToken(ctx, files, *ttl)
+        if err != nil {
+            return err
+        }
+        fmt.Println(token)
+        return nil
+    }
+
+    manifest, _ := json.Marshal(files)
+    token := newToken()
+
+    conn := redisClient()
+    defer conn.Close()
+
+    if err := conn.Set(ctx, manifestKey(token), manifest, *ttl).Err(); err != nil {
+        return err
+    }
+    fmt.Println(token)
+    return nil
+}
+
+// newToken returns a random version 4 UUID, as the server does
+func newToken() string {
+    var b [16]byte
+    rand.Read(b[:])
+    b[6] = (b[6] & 0x0f) | 0x40
+    b[8] = (b[8] & 0x3f) | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+type tokenInfo struct {
+    Token   string          `json:"token"`
+    TTL     string          `json:"ttl,omitempty"`
+    Revoked bool            `json:"revoked"`
+    Files   json.RawMessage `json:"files,omitempty"`
+}
+
+// tokenInspect shows the stored manifest as is when reading from Redis, or
+// what the server makes of it otherwise
+func tokenInspect(ctx context.Context, args []string) error {
+    token, err := oneArg(flag.NewFlagSet("token inspect", flag.ExitOnError), args, "token")
+    if err != nil {
+        return err
+    }
+
+    if *redis == "" {
+        files, err := newClient().List(ctx, token)
+        if err != nil {
+            return err
+        }
+        return printJSON(files)
+    }
+
+    conn := redisClient()
+    defer conn.Close()
+
+    info := tokenInfo{Token: token}
+    revoked, _ := conn.Exists(ctx, serverKey("revoked:"+token)).Result()
+    info.Revoked = revoked > 0
+
+    manifest, err := conn.Get(ctx, manifestKey(token)).Bytes()
+    if err == goredis.Nil {
+        printJSON(info)
+        return errors.New("no manifest is stored for this token")
+    }
+    if err != nil {
+        return err
+    }
+    info.Files = manifest
+
+    if ttl, err := conn.TTL(ctx, manifestKey(token)).Result(); err == nil && ttl >= 0 {
+        info.TTL = ttl.String()
+    }
+
+    return printJSON(info)
+}
+
+func download(ctx context.Context, args []string) error {
+    flags := flag.NewFlagSet("download", flag.ExitOnError)
+    output := flags.String("o", "", "file to save the archive to")
+    name := flags.String("as", "", "archive name to ask the server for")
+    token, err := oneArg(flags, args, "token")
+    if err != nil {
+        return err
+    }
+
+    archive, err := newClient().Download(ctx, token, *name)
+    if err != nil {
+        return err
+    }
+    defer archive.Close()
+
+    out := io.Writer(os.Stdout)
+    if *output != "" {
+        f, err := os.Create(*output)
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        out = f
+    }
+
+    n, err := io.Copy(out, archive)
+    if err != nil {
+        return err
+    }
+    if *output != "" {
+        fmt.Fprintf(os.Stderr, "Saved %d bytes to %s\n", n, *output)
+    }
+    return nil
+}
+
+func validate(ctx context.Context, args []string) error {
+    token, err := oneArg(flag.NewFlagSet("validate", flag.ExitOnError), args, "token")
+    if err != nil {
+        return err
+    }
+
+    validation, err := newClient().Validate(ctx, token)
+    if err != nil {
+        return err
+    }
+
+    table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(table, "PATH\tS3 PATH\tSIZE\tSTATUS")
+    for _, file := range validation.Files {
+        status := "ok"
+        if !file.Exists {
+            status = strings.TrimSpace("missing " + file.Error)
+        }
+        fmt.Fprintf(table, "%s\t%s\t%d\t%s\n", file.Path, file.S3Path, file.Size, status)
+    }
+    table.Flush()
+
+    if !validation.Valid {
+        return fmt.Errorf("%d of %d files are missing", validation.Missing, len(validation.Files))
+    }
+    return nil
+}
+
+func jobStatus(ctx context.Context, args []string) error {
+    flags := flag.NewFlagSet("job status", flag.ExitOnError)
+    wait := flags.Bool("wait", false, "wait for the job to finish")
+    id, err := oneArg(flags, args, "job ID")
+    if err != nil {
+        return err
+    }
+
+    c := newClient()
+    var job *client.Job
+    if *wait {
+        job, err = c.WaitJob(ctx, id, time.Second)
+    } else {
+        job, err = c.Job(ctx, id)
+    }
+    if err != nil {
+        return err
+    }
+
+    printJSON(job)
+    if job.State == client.JobFailed {
+        return errors.New("the job failed")
+    }
+    return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/url"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+
+    "github.com/AdRoll/goamz/aws"
+)
+
+// settingErrors are the settings loadConfiguration couldn't parse
+var settingErrors []error
+
+// invalidSetting records that a setting that's set isn't what it should be
+func invalidSetting(key, expected string) {
+    if value := setting(key); value != "" {
+        settingErrors = append(settingErrors, fmt.Errorf("%s is %q, expected %s", key, value, expected))
+    }
+}
+
+// checkConfig reports everything wrong with the configuration at once, so a
+// bad deploy fails at boot with the whole list rather than on the first
+// request that trips over one of them
+func checkConfig(c Configuration) error {
+    problems := append([]error(nil), settingErrors...)
+    problem := func(format string, args ...interface{}) {
+        problems = append(problems, fmt.Errorf(format, args...))
+    }
+
+    // Dev mode fills in S3, Redis and the port itself
+    if !*devMode {
+        if c.Bucket == "" {
+            problem("S3_BUCKET is required")
+        }
+        if c.Region == "" {
+            problem("S3_REGION is required")
+        } else if _, ok := aws.Regions[c.Region]; !ok {
+            problem("S3_REGION %q isn't a known region", c.Region)
+        }
+        if (c.AccessKey == "") != (c.SecretKey == "") {
+            problem("S3_KEY and S3_SECRET go together")
+        }
+
+        if c.ProxyProtocol && c.ProxyProtocolTrusted == "" {
+            problem("PROXY_PROTOCOL needs PROXY_PROTOCOL_TRUSTED, the load balancers allowed to send it")
+        }
+        for _, value := range strings.Split(c.ProxyProtocolTrusted, ",") {
+            if value = strings.TrimSpace(value); value != "" {
+                if _, err := parsePrefix(value); err != nil {
+                    problem("PROXY_PROTOCOL_TRUSTED has %q, which isn't an address or CIDR", value)
+                }
+            }
+        }
+
+        if c.TenantHeader != "" && c.TenantHeaderTrusted == "" {
+            problem("TENANT_HEADER needs TENANT_HEADER_TRUSTED, the proxies allowed to set it")
+        }
+        for _, value := range strings.Split(c.TenantHeaderTrusted, ",") {
+            if value = strings.TrimSpace(value); value != "" {
+                if _, err := parsePrefix(value); err != nil {
+                    problem("TENANT_HEADER_TRUSTED has %q, which isn't an address or CIDR", value)
+                }
+            }
+        }
+
+        seen := map[string]bool{}
+        for _, t := range c.Tenants {
+            prefix := tenantPrefix(t.Name)
+            if seen[prefix] {
+                problem("TENANTS has %q twice", t.Name)
+                continue
+            }
+            seen[prefix] = true
+
+            // Names are part of setting names and usage keys
+            if !tenantName.MatchString(t.Name) {
+                problem("TENANTS has %q, names can only have letters, digits, - and _", t.Name)
+            }
+
+            if t.Bucket == "" {
+                problem("%sS3_BUCKET is required", prefix)
+            }
+            if _, ok := aws.Regions[t.Region]; !ok {
+                problem("%sS3_REGION %q isn't a known region", prefix, t.Region)
+            }
+            if (t.AccessKey == "") != (t.SecretKey == "") {
+                problem("%sS3_KEY and %sS3_SECRET go together", prefix, prefix)
+            }
+            if t.Quota.MaxBytes < 0 || t.Quota.MaxArchives < 0 || t.Quota.MaxConcurrent < 0 {
+                problem("%sMAX_* quotas can't be negative", prefix)
+            }
+            if t.Inventory != "" {
+                if _, _, err := parseInventory(t.Inventory); err != nil {
+                    problem("%sS3_INVENTORY %v", prefix, err)
+                }
+            }
+        }
+        if c.TenantQuotaWindow <= 0 {
+            problem("TENANT_QUOTA_WINDOW should be positive")
+        }
+        if c.UsageRetention < 0 {
+            problem("USAGE_RETENTION can't be negative")
+        }
+
+        if c.RedisURL == "" && c.RedisSentinels == "" && c.RedisClusterNodes == "" {
+            if c.RedisServer == "" {
+                problem("REDIS_HOST, REDIS_URL, REDIS_SENTINELS or REDIS_CLUSTER_NODES is required")
+            }
+            checkPort(problem, "REDIS_PORT", c.RedisPort, true)
+        }
+
+        if c.Port == "" && c.UnixSocket == "" && os.Getenv("LISTEN_FDS") == "" {
+            problem("PORT or UNIX_SOCKET is required")
+        }
+    }
+    if c.RedisURL != "" {
+        if target, err := parseRedisURL(c.RedisURL); err != nil {
+            problem("REDIS_URL: %v", err)
+        } else if target.db != 0 && c.RedisClusterNodes != "" {
+            problem("REDIS_URL can't pick a database with REDIS_CLUSTER_NODES, a cluster only has database 0")
+        }
+    }
+    if c.RedisPoolMaxIdle < 0 || c.RedisPoolMaxActive < 0 {
+        problem("REDIS_POOL_MAX_IDLE and REDIS_POOL_MAX_ACTIVE can't be negative")
+    }
+    if c.RedisPoolMaxActive > 0 && c.RedisPoolMaxIdle > c.RedisPoolMaxActive {
+        problem("REDIS_POOL_MAX_IDLE %d is more than REDIS_POOL_MAX_ACTIVE %d", c.RedisPoolMaxIdle, c.RedisPoolMaxActive)
+    }
+    if c.RedisTimeout <= 0 {
+        problem("REDIS_TIMEOUT should be more than 0")
+    }
+    if c.RedisUsername != "" && c.RedisPassword == "" {
+        problem("REDIS_USERNAME needs REDIS_PASSWORD")
+    }
+    if c.RedisDB < 0 {
+        problem("REDIS_DB can't be negative")
+    } else if c.RedisDB != 0 && c.RedisClusterNodes != "" {
+        problem("REDIS_DB can't be set with REDIS_CLUSTER_NODES, a cluster only has database 0")
+    }
+    if c.RedisSentinels != "" && c.RedisClusterNodes != "" {
+        problem("REDIS_SENTINELS and REDIS_CLUSTER_NODES can't both be set")
+    }
+    if (c.RedisSentinels == "") != (c.RedisSentinelMaster == "") {
+        problem("REDIS_SENTINELS and REDIS_SENTINEL_MASTER go together")
+    }
+    if c.BillingSink != "" {
+        if u, err := url.Parse(c.BillingSink); err != nil || (u.Scheme != "s3" && u.Scheme != "sqs" && u.Scheme != "redis") || u.Host == "" {
+            problem("BILLING_SINK %q should be s3://<bucket>[/<prefix>], sqs://<queue URL without https://> or redis://<stream>", c.BillingSink)
+        }
+    }
+    if c.S3Inventory != "" {
+        if _, _, err := parseInventory(c.S3Inventory); err != nil {
+            problem("S3_INVENTORY %v", err)
+        }
+    }
+    if c.SourceURL != "" {
+        if u, err := url.Parse(c.SourceURL); err != nil || (u.Scheme != "s3" && u.Scheme != "file") {
+            problem("SOURCE_URL %q should be s3://<bucket> or file:///<dir>", c.SourceURL)
+        }
+    }
+
+    checkPort(problem, "PORT", c.Port, false)
+    checkPort(problem, "ADMIN_PORT", c.AdminPort, false)
+    checkPort(problem, "GRPC_PORT", c.GRPCPort, false)
+    ports := map[string]string{}
+    for _, port := range []struct{ name, value string }{{"PORT", c.Port}, {"ADMIN_PORT", c.AdminPort}, {"GRPC_PORT", c.GRPCPort}} {
+        if port.value == "" {
+            continue
+        }
+        if other, ok := ports[port.value]; ok {
+            problem("%s and %s are both %s", other, port.name, port.value)
+        }
+        ports[port.value] = port.name
+    }
+    if c.AdminPort != "" && c.AdminSocket != "" {
+        problem("ADMIN_PORT and ADMIN_SOCKET can't both be set")
+    }
+    if c.UnixSocketMode != "" {
+        if _, err := strconv.ParseUint(c.UnixSocketMode, 8, 32); err != nil {
+            problem("UNIX_SOCKET_MODE %q isn't an octal mode", c.UnixSocketMode)
+        }
+    }
+
+    if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+        problem("TLS_CERT_FILE and TLS_KEY_FILE go together")
+    }
+    if c.TLSCertFile != "" && c.AutocertHosts != "" {
+        problem("TLS_CERT_FILE and TLS_AUTOCERT_HOSTS can't both be set")
+    }
+    if c.TLSClientCAFile != "" && c.TLSCertFile == "" && c.AutocertHosts == "" {
+        problem("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE or TLS_AUTOCERT_HOSTS")
+    }
+    checkFile(problem, "TLS_CERT_FILE", c.TLSCertFile)
+    checkFile(problem, "TLS_KEY_FILE", c.TLSKeyFile)
+    checkFile(problem, "TLS_CLIENT_CA_FILE", c.TLSClientCAFile)
+    checkFile(problem, "JWT_PUBLIC_KEY", c.JWTPublicKey)
+    if (c.RedisTLSCertFile == "") != (c.RedisTLSKeyFile == "") {
+        problem("REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE go together")
+    }
+    if !c.RedisTLS && !strings.HasPrefix(c.RedisURL, "rediss://") && (c.RedisTLSCAFile != "" || c.RedisTLSServerName != "" || c.RedisTLSCertFile != "") {
+        problem("REDIS_TLS_* settings need REDIS_TLS=true or a rediss:// REDIS_URL")
+    }
+    checkFile(problem, "REDIS_TLS_CA_FILE", c.RedisTLSCAFile)
+    checkFile(problem, "REDIS_TLS_CERT_FILE", c.RedisTLSCertFile)
+    checkFile(problem, "REDIS_TLS_KEY_FILE", c.RedisTLSKeyFile)
+    for _, plugin := range strings.Split(c.Plugins, ",") {
+        checkFile(problem, "PLUGINS", strings.TrimSpace(plugin))
+    }
+
+    var level slog.Level
+    if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+        problem("LOG_LEVEL %q should be debug, info, warn or error", c.LogLevel)
+    }
+    checkChoice(problem, "LOG_FORMAT", strings.ToLower(c.LogFormat), "text", "json")
+    checkChoice(problem, "ACCESS_LOG", c.AccessLogFormat, "combined", "json", "off")
+    checkChoice(problem, "TOKEN_STORE", c.TokenStore, "redis", "memory", "dynamodb", "postgres")
+    if c.TokenStore == "dynamodb" && c.DynamoDBTable == "" {
+        problem("TOKEN_STORE=dynamodb needs DYNAMODB_TABLE")
+    }
+    if c.TokenStore == "postgres" && c.PostgresURL == "" {
+        problem("TOKEN_STORE=postgres needs POSTGRES_URL")
+    }
+    // It's put straight into the queries
+    if !sqlIdentifier.MatchString(c.PostgresTable) {
+        problem("POSTGRES_TABLE %q should be a table name, optionally with its schema", c.PostgresTable)
+    }
+    if c.RedisKeyTemplate != "" && !strings.Contains(c.RedisKeyTemplate, "{token}") {
+        problem("REDIS_KEY_TEMPLATE %q needs a {token}", c.RedisKeyTemplate)
+    }
+
+    if _, err := regexp.Compile(c.TokenPattern); err != nil {
+        problem("TOKEN_PATTERN doesn't compile: %v", err)
+    }
+    if c.ListMaxFiles <= 0 || c.ListMaxKeys <= 0 {
+        problem("LIST_MAX_FILES and LIST_MAX_KEYS should be more than 0")
+    }
+    if c.MaxArchiveFiles < 0 || c.MaxArchiveBytes < 0 {
+        problem("MAX_ARCHIVE_FILES and MAX_ARCHIVE_BYTES can't be negative")
+    }
+    if c.EmptyArchiveStatus != 200 && c.EmptyArchiveStatus != 404 && c.EmptyArchiveStatus != 422 {
+        problem("EMPTY_ARCHIVE_STATUS should be 404, 422 or 200, not %d", c.EmptyArchiveStatus)
+    }
+    if c.ExtractMaxBytes <= 0 || c.ExtractMaxFiles <= 0 || c.ExtractMaxUnpacked <= 0 {
+        problem("EXTRACT_MAX_BYTES, EXTRACT_MAX_FILES and EXTRACT_MAX_UNPACKED_BYTES should be more than 0")
+    }
+    if c.ExtractTimeout <= 0 {
+        problem("EXTRACT_TIMEOUT should be positive")
+    }
+    if c.Middleware != "none" {
+        for _, name := range strings.Split(c.Middleware, ",") {
+            if name = strings.TrimSpace(name); name != "" && middlewares[name] == nil {
+                problem("MIDDLEWARE has unknown middleware %q", name)
+            }
+        }
+    }
+    if c.BasePath != "" && !strings.HasPrefix(c.BasePath, "/") {
+        problem("BASE_PATH %q should start with /", c.BasePath)
+    }
+
+    if c.SecretsRefresh < 0 {
+        problem("SECRETS_REFRESH can't be negative")
+    }
+    if c.JobWorkers <= 0 {
+        problem("JOB_WORKERS should be at least 1")
+    }
+    if c.RateLimit < 0 {
+        problem("RATE_LIMIT can't be negative")
+    }
+
+    return errors.Join(problems...)
+}
+
+var tenantName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func checkPort(problem func(string, ...interface{}), name, value string, required bool) {
+    if value == "" {
+        if required {
+            problem("%s is required", name)
+        }
+        return
+    }
+    if port, err := strconv.Atoi(value); err != nil || port < 1 || port > 65535 {
+        problem("%s %q isn't a port number", name, value)
+    }
+}
+
+func checkFile(problem func(string, ...interface{}), name, path string) {
+    if path == "" {
+        return
+    }
+    if _, err := os.Stat(path); err != nil {
+        problem("%s: %v", name, err)
+    }
+}
+
+func checkChoice(problem func(string, ...interface{}), name, value string, choices ...string) {
+    for _, choice := range choices {
+        if value == choice {
+            return
+        }
+    }
+    problem("%s %q should be one of %s", name, value, strings.Join(choices, ", "))
+}
+
+// mustCheckConfig exits with a list of every problem with the
+// configuration, if there are any. It's written straight to stderr, log
+// sampling would drop most of a long list.
+func mustCheckConfig() {
+    err := checkConfig(config)
+    if err == nil {
+        return
+    }
+
+    problems := strings.Split(err.Error(), "\n")
+    fmt.Fprintf(os.Stderr, "zipper: %d configuration problems:\n", len(problems))
+    for _, problem := range problems {
+        fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+    }
+    os.Exit(1)
+}
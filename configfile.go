@@ -0,0 +1,155 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+
+    "gopkg.in/yaml.v3"
+)
+
+// Settings come from -set flags, then the environment, then the config file.
+// The file uses the environment variable names, in any case, either flat or
+// nested with the parts joined by underscores:
+//
+//	s3:
+//	  bucket: downloads
+//	  region: eu-west-1
+//	port: 8080
+//	plugins: [redact.wasm, watermark.wasm]
+var configFile = flag.String("config", os.Getenv("ZIPPER_CONFIG"), "YAML file to read settings from")
+
+// settingFlags are the -set KEY=VALUE flags
+var settingFlags = settingOverrides{}
+
+// fileSettings is the config file, flattened
+var fileSettings = map[string]string{}
+
+func init() {
+    flag.Var(settingFlags, "set", "KEY=VALUE setting overriding the environment and config file, may be repeated")
+}
+
+type settingOverrides map[string]string
+
+func (s settingOverrides) String() string {
+    keys := make([]string, 0, len(s))
+    for key := range s {
+        keys = append(keys, key+"="+s[key])
+    }
+    sort.Strings(keys)
+    return strings.Join(keys, ",")
+}
+
+func (s settingOverrides) Set(value string) error {
+    key, value, ok := strings.Cut(value, "=")
+    if !ok || key == "" {
+        return fmt.Errorf("expected KEY=VALUE")
+    }
+    s[strings.ToUpper(key)] = value
+    return nil
+}
+
+// setting looks a setting up by its environment variable name
+func setting(key string) string {
+    if value, ok := settingFlags[key]; ok {
+        return value
+    }
+    if value := os.Getenv(key); value != "" {
+        return value
+    }
+    return fileSettings[key]
+}
+
+// loadConfig reads the config file, if there is one, and then every setting
+func loadConfig() error {
+    if *configFile != "" {
+        settings, err := readConfigFile(*configFile)
+        if err != nil {
+            return err
+        }
+        fileSettings = settings
+    }
+
+    settingErrors = nil
+    config = loadConfiguration()
+    return nil
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var values map[string]interface{}
+    if err := yaml.Unmarshal(data, &values); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+
+    settings := map[string]string{}
+    if err := flattenSettings(settings, "", values); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return settings, nil
+}
+
+// flattenSettings turns nested maps into KEY_NAME settings and lists into
+// comma separated values
+func flattenSettings(settings map[string]string, prefix string, values map[string]interface{}) error {
+    for key, value := range values {
+        key = strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+        if prefix != "" {
+            key = prefix + "_" + key
+        }
+
+        if nested, ok := value.(map[string]interface{}); ok {
+            if err := flattenSettings(settings, key, nested); err != nil {
+                return err
+            }
+            continue
+        }
+
+        if list, ok := value.([]interface{}); ok {
+            items := make([]string, len(list))
+            for i, item := range list {
+                s, err := settingValue(key, item)
+                if err != nil {
+                    return err
+                }
+                items[i] = s
+            }
+            settings[key] = strings.Join(items, ",")
+            continue
+        }
+
+        s, err := settingValue(key, value)
+        if err != nil {
+            return err
+        }
+        settings[key] = s
+    }
+    return nil
+}
+
+func settingValue(key string, value interface{}) (string, error) {
+    switch v := value.(type) {
+    case nil:
+        return "", nil
+    case string:
+        return v, nil
+    case bool:
+        return strconv.FormatBool(v), nil
+    case int:
+        return strconv.Itoa(v), nil
+    case int64:
+        return strconv.FormatInt(v, 10), nil
+    case uint64:
+        return strconv.FormatUint(v, 10), nil
+    case float64:
+        return strconv.FormatFloat(v, 'f', -1, 64), nil
+    }
+    return "", fmt.Errorf("%s can't be a %T", key, value)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+    "sync/atomic"
+)
+
+// corsPolicy is the CORS settings, swapped whole when they're reloaded
+type corsPolicy struct {
+    origins        []string
+    allowedMethods string
+    allowedHeaders string
+    exposedHeaders string
+    maxAge         int
+}
+
+var corsSettings atomic.Pointer[corsPolicy]
+
+func initCORS() {
+    loadCORS(config)
+}
+
+func loadCORS(c Configuration) {
+    policy := &corsPolicy{
+        allowedMethods: c.CORSAllowedMethods,
+        allowedHeaders: c.CORSAllowedHeaders,
+        exposedHeaders: c.CORSExposedHeaders,
+        maxAge:         c.CORSMaxAge,
+    }
+    for _, origin := range strings.Split(c.CORSAllowedOrigins, ",") {
+        if origin = strings.TrimSpace(origin); origin != "" {
+            policy.origins = append(policy.origins, origin)
+        }
+    }
+    corsSettings.Store(policy)
+}
+
+// corsEnabled reports whether any origins are allowed
+func corsEnabled() bool {
+    return len(corsSettings.Load().origins) > 0
+}
+
+// corsOrigin returns the value for Access-Control-Allow-Origin, or "" when
+// the origin isn't allowed
+func corsOrigin(origin string) string {
+    for _, allowed := range corsSettings.Load().origins {
+        if allowed == "*" {
+            return "*"
+        }
+        if strings.EqualFold(allowed, origin) {
+            return origin
+        }
+    }
+    return ""
+}
+
+// cors adds CORS headers for allowed origins and answers preflight requests
+func cors(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        policy := corsSettings.Load()
+
+        origin := r.Header.Get("Origin")
+        if origin == "" || len(policy.origins) == 0 {
+            next(w, r)
+            return
+        }
+
+        w.Header().Add("Vary", "Origin")
+
+        allowOrigin := corsOrigin(origin)
+        if allowOrigin == "" {
+            next(w, r)
+            return
+        }
+
+        w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+        if policy.exposedHeaders != "" {
+            w.Header().Set("Access-Control-Expose-Headers", policy.exposedHeaders)
+        }
+
+        // Preflight
+        if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+            w.Header().Set("Access-Control-Allow-Methods", policy.allowedMethods)
+            w.Header().Set("Access-Control-Allow-Headers", policy.allowedHeaders)
+            if policy.maxAge > 0 {
+                w.Header().Set("Access-Control-Max-Age", strconv.Itoa(policy.maxAge))
+            }
+            w.WriteHeader(204)
+            return
+        }
+
+        next(w, r)
+    }
+}
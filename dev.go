@@ -0,0 +1,547 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "encoding/xml"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/fs"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "codecourse/zipper/archive"
+    "github.com/AdRoll/goamz/aws"
+)
+
+// Development mode, "zipper -dev", runs the whole service without AWS or
+// Redis. Tokens live in memory behind a Redis lookalike, and files are served
+// from DEV_DIR by a small S3 lookalike, both on loopback ports, so signed job
+// results download too.
+// "zipper -dev seed" also fills an empty DEV_DIR with sample files and
+// stores a token for everything in it.
+
+var devMode = flag.Bool("dev", false, "run with an in-memory token store and files from DEV_DIR")
+
+// The API key and token development mode sets up, printed at startup
+const (
+    devAPIKey = "dev"
+    devToken  = "00000000-0000-4000-8000-000000000000"
+)
+
+var devSampleFiles = map[string]string{
+    "hello.txt":           "Hello from zipper.\n",
+    "docs/readme.md":      "# Sample\n\nFiles in DEV_DIR are served as if they were in the bucket.\n",
+    "docs/notes/todo.txt": "- Create a token\n- Download it\n",
+}
+
+// initDev points the S3 client at DEV_DIR and fills in whatever else the
+// rest of the service needs configured. It runs before anything connects.
+func initDev() {
+    if err := os.MkdirAll(config.DevDir, 0755); err != nil {
+        fatal("Error creating DEV_DIR", err)
+    }
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        fatal("Error starting development file server", err)
+    }
+    go http.Serve(ln, devS3{dir: config.DevDir})
+
+    aws.Regions["dev"] = aws.Region{Name: "us-east-1", S3Endpoint: "http://" + ln.Addr().String()}
+
+    redisLn, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        fatal("Error starting development Redis", err)
+    }
+    go serveDevRedis(redisLn)
+    devRedisAddress = redisLn.Addr().String()
+    config.Region = "dev"
+    config.Bucket = "dev"
+    config.AccessKey = "dev"
+    config.SecretKey = "dev"
+
+    if config.Port == "" {
+        config.Port = "8080"
+    }
+
+    slog.Warn("Development mode, tokens are kept in memory", "dir", config.DevDir, "api_key", devAPIKey)
+}
+
+// seedDev writes the sample files if DEV_DIR is empty, then stores a token
+// for every file in it
+func seedDev() {
+    entries, _ := os.ReadDir(config.DevDir)
+    if len(entries) == 0 {
+        for name, content := range devSampleFiles {
+            file := filepath.Join(config.DevDir, filepath.FromSlash(name))
+            os.MkdirAll(filepath.Dir(file), 0755)
+            if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+                fatal("Error writing sample file", err)
+            }
+        }
+    }
+
+    var files []*RedisFile
+    filepath.WalkDir(config.DevDir, func(file string, entry fs.DirEntry, err error) error {
+        if err != nil || entry.IsDir() {
+            return err
+        }
+        rel, _ := filepath.Rel(config.DevDir, file)
+        rel = filepath.ToSlash(rel)
+        folder := path.Dir(rel)
+        if folder == "." {
+            folder = ""
+        }
+        files = append(files, &RedisFile{FileName: path.Base(rel), Folder: folder, S3Path: rel})
+        return nil
+    })
+
+    manifest, _ := json.Marshal(files)
+    if err := tokenStore.Put(context.Background(), devToken, manifest, 0); err != nil {
+        fatal("Error seeding token", err)
+    }
+
+    slog.Info("Seeded token", "files", len(files), "url", "http://localhost:"+config.Port+"/v1/download/"+devToken)
+}
+
+// devS3 answers the handful of S3 requests zipper makes from a directory.
+// Multipart uploads aren't supported, so jobs over 100MB fail.
+type devS3 struct {
+    dir string
+}
+
+func (s devS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    // Path style requests, /<bucket>/<key>
+    _, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+    file := filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+key)))
+
+    switch r.Method {
+    case "HEAD", "GET":
+        if key == "" && r.Method == "GET" {
+            s.list(w, r)
+            return
+        }
+        if key == "" {
+            w.WriteHeader(200)
+            return
+        }
+        f, err := os.Open(file)
+        if err != nil {
+            http.Error(w, "NoSuchKey", 404)
+            return
+        }
+        defer f.Close()
+        info, err := f.Stat()
+        if err != nil || info.IsDir() {
+            http.Error(w, "NoSuchKey", 404)
+            return
+        }
+        w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+        w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+        if r.Method == "GET" {
+            io.Copy(w, f)
+        }
+    case "PUT":
+        if r.URL.Query().Has("uploadId") {
+            http.Error(w, "NotImplemented", 501)
+            return
+        }
+        os.MkdirAll(filepath.Dir(file), 0755)
+        f, err := os.Create(file)
+        if err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        defer f.Close()
+        if _, err := io.Copy(f, r.Body); err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+    case "DELETE":
+        os.Remove(file)
+        w.WriteHeader(204)
+    default:
+        http.Error(w, "NotImplemented", 501)
+    }
+}
+
+// list answers a bucket listing, with everything under the prefix at once
+func (s devS3) list(w http.ResponseWriter, r *http.Request) {
+    type content struct {
+        Key          string
+        Size         int64
+        LastModified string
+    }
+    result := struct {
+        XMLName        xml.Name `xml:"ListBucketResult"`
+        Prefix         string
+        Contents       []content
+        CommonPrefixes []string `xml:"CommonPrefixes>Prefix"`
+    }{Prefix: r.URL.Query().Get("prefix")}
+    delimiter := r.URL.Query().Get("delimiter")
+
+    seen := map[string]bool{}
+    archive.DirSource(s.dir).List(r.Context(), result.Prefix, func(ref string, info archive.Info) error {
+        rest := strings.TrimPrefix(ref, result.Prefix)
+        if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+            if common := result.Prefix + rest[:i+len(delimiter)]; !seen[common] {
+                seen[common] = true
+                result.CommonPrefixes = append(result.CommonPrefixes, common)
+            }
+            return nil
+        }
+        result.Contents = append(result.Contents, content{ref, info.Size, info.ModTime.UTC().Format(time.RFC3339)})
+        return nil
+    })
+    w.Header().Set("Content-Type", "application/xml")
+    xml.NewEncoder(w).Encode(result)
+}
+
+// devRedis is an in-memory stand in for the Redis commands zipper uses
+type devRedis struct {
+    sync.Mutex
+    values   map[string]devValue
+    versions map[string]int
+    streams  map[string][]devStreamEntry
+    lastID   int64
+}
+
+type devValue struct {
+    data    []byte
+    hash    map[string]int64 // for the counters kept in hashes
+    expires time.Time
+}
+
+type devStreamEntry struct {
+    id     string
+    fields []interface{}
+}
+
+var devStore = &devRedis{
+    values:   map[string]devValue{},
+    versions: map[string]int{},
+    streams:  map[string][]devStreamEntry{},
+}
+
+// devRedisAddress is where serveDevRedis listens
+var devRedisAddress string
+
+// serveDevRedis answers Redis clients from devStore, each connection with
+// its own MULTI and WATCH state
+func serveDevRedis(ln net.Listener) {
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            return
+        }
+        go (&devRedisConn{}).serve(conn)
+    }
+}
+
+// devRedisConn is one client's connection
+type devRedisConn struct {
+    multi   [][]interface{}
+    inMulti bool
+    watched map[string]int
+}
+
+// serve reads RESP commands and writes a reply to each, flushing whenever
+// the client has nothing more pipelined
+func (c *devRedisConn) serve(conn net.Conn) {
+    defer conn.Close()
+    r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+
+    for {
+        args, err := readDevCommand(r)
+        if err != nil {
+            return
+        }
+
+        reply, err := c.command(devString(args[0]), args[1:])
+        if err != nil {
+            reply = err
+        }
+        writeDevReply(w, reply)
+
+        if r.Buffered() == 0 && w.Flush() != nil {
+            return
+        }
+    }
+}
+
+// readDevCommand reads a command sent as an array of bulk strings
+func readDevCommand(r *bufio.Reader) ([]interface{}, error) {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+    if !strings.HasPrefix(line, "*") || err != nil || n < 1 {
+        return nil, errors.New("expected a command")
+    }
+
+    args := make([]interface{}, n)
+    for i := range args {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            return nil, err
+        }
+        size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+        if !strings.HasPrefix(line, "$") || err != nil || size < 0 {
+            return nil, errors.New("expected a bulk string")
+        }
+
+        arg := make([]byte, size+2)
+        if _, err := io.ReadFull(r, arg); err != nil {
+            return nil, err
+        }
+        args[i] = arg[:size]
+    }
+    return args, nil
+}
+
+// writeDevReply writes strings as status replies, bytes as bulk strings
+// and nil as a missing value
+func writeDevReply(w *bufio.Writer, reply interface{}) {
+    switch reply := reply.(type) {
+    case nil:
+        w.WriteString("$-1\r\n")
+    case string:
+        w.WriteString("+" + reply + "\r\n")
+    case []byte:
+        fmt.Fprintf(w, "$%d\r\n%s\r\n", len(reply), reply)
+    case int64:
+        fmt.Fprintf(w, ":%d\r\n", reply)
+    case error:
+        w.WriteString("-" + reply.Error() + "\r\n")
+    case []interface{}:
+        fmt.Fprintf(w, "*%d\r\n", len(reply))
+        for _, item := range reply {
+            writeDevReply(w, item)
+        }
+    }
+}
+
+func (c *devRedisConn) command(command string, args []interface{}) (interface{}, error) {
+    command = strings.ToUpper(command)
+
+    switch command {
+    case "MULTI":
+        c.inMulti, c.multi = true, nil
+        return "OK", nil
+    case "EXEC":
+        return c.exec()
+    case "WATCH":
+        devStore.Lock()
+        defer devStore.Unlock()
+        if c.watched == nil {
+            c.watched = map[string]int{}
+        }
+        for _, key := range args {
+            c.watched[devString(key)] = devStore.versions[devString(key)]
+        }
+        return "OK", nil
+    case "UNWATCH":
+        c.watched = nil
+        return "OK", nil
+    }
+
+    if c.inMulti {
+        c.multi = append(c.multi, append([]interface{}{command}, args...))
+        return "QUEUED", nil
+    }
+
+    devStore.Lock()
+    defer devStore.Unlock()
+    return devStore.run(command, args)
+}
+
+// exec runs the queued commands together, or none of them when a watched
+// key has changed
+func (c *devRedisConn) exec() (interface{}, error) {
+    queued, watched := c.multi, c.watched
+    c.inMulti, c.multi, c.watched = false, nil, nil
+
+    devStore.Lock()
+    defer devStore.Unlock()
+
+    for key, version := range watched {
+        if devStore.versions[key] != version {
+            return nil, nil
+        }
+    }
+
+    replies := make([]interface{}, len(queued))
+    for i, command := range queued {
+        reply, err := devStore.run(command[0].(string), command[1:])
+        if err != nil {
+            reply = err
+        }
+        replies[i] = reply
+    }
+    return replies, nil
+}
+
+func devString(arg interface{}) string {
+    switch arg := arg.(type) {
+    case []byte:
+        return string(arg)
+    case string:
+        return arg
+    default:
+        return fmt.Sprint(arg)
+    }
+}
+
+func (s *devRedis) get(key string) (devValue, bool) {
+    value, ok := s.values[key]
+    if ok && !value.expires.IsZero() && time.Now().After(value.expires) {
+        delete(s.values, key)
+        return devValue{}, false
+    }
+    return value, ok
+}
+
+func (s *devRedis) set(key string, value devValue) {
+    s.values[key] = value
+    s.versions[key]++
+}
+
+func (s *devRedis) run(command string, args []interface{}) (interface{}, error) {
+    key := ""
+    if len(args) > 0 {
+        key = devString(args[0])
+    }
+
+    switch command {
+    case "PING":
+        return "PONG", nil
+    case "AUTH", "SELECT":
+        return "OK", nil
+    case "GET":
+        if value, ok := s.get(key); ok {
+            return value.data, nil
+        }
+        return nil, nil
+    case "SET":
+        value := devValue{data: []byte(devString(args[1]))}
+        for i := 2; i+1 < len(args); i += 2 {
+            if strings.EqualFold(devString(args[i]), "EX") {
+                seconds, _ := strconv.Atoi(devString(args[i+1]))
+                value.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+            }
+        }
+        s.set(key, value)
+        return "OK", nil
+    case "DEL":
+        deleted := int64(0)
+        for _, arg := range args {
+            if _, ok := s.get(devString(arg)); ok {
+                delete(s.values, devString(arg))
+                s.versions[devString(arg)]++
+                deleted++
+            }
+        }
+        return deleted, nil
+    case "EXISTS":
+        found := int64(0)
+        for _, arg := range args {
+            if _, ok := s.get(devString(arg)); ok {
+                found++
+            }
+        }
+        return found, nil
+    case "INCR":
+        value, _ := s.get(key)
+        n, _ := strconv.ParseInt(string(value.data), 10, 64)
+        value.data = []byte(strconv.FormatInt(n+1, 10))
+        s.set(key, value)
+        return n + 1, nil
+    case "EXPIRE":
+        value, ok := s.get(key)
+        if !ok {
+            return int64(0), nil
+        }
+        seconds, _ := strconv.Atoi(devString(args[1]))
+        value.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+        s.set(key, value)
+        return int64(1), nil
+    case "TTL":
+        value, ok := s.get(key)
+        if !ok {
+            return int64(-2), nil
+        }
+        if value.expires.IsZero() {
+            return int64(-1), nil
+        }
+        return int64(time.Until(value.expires).Seconds()), nil
+    case "HINCRBY":
+        value, _ := s.get(key)
+        if value.hash == nil {
+            value.hash = map[string]int64{}
+        }
+        by, _ := strconv.ParseInt(devString(args[2]), 10, 64)
+        value.hash[devString(args[1])] += by
+        s.set(key, value)
+        return value.hash[devString(args[1])], nil
+    case "HGETALL":
+        value, _ := s.get(key)
+        fields := make([]interface{}, 0, 2*len(value.hash))
+        for field, n := range value.hash {
+            fields = append(fields, []byte(field), []byte(strconv.FormatInt(n, 10)))
+        }
+        return fields, nil
+    case "XADD":
+        // Only "*" IDs, milliseconds are ignored as entries just count up
+        s.lastID++
+        id := strconv.FormatInt(s.lastID, 10) + "-0"
+        fields := make([]interface{}, 0, len(args)-2)
+        for _, arg := range args[2:] {
+            fields = append(fields, []byte(devString(arg)))
+        }
+        s.streams[key] = append(s.streams[key], devStreamEntry{id: id, fields: fields})
+        return []byte(id), nil
+    case "XRANGE":
+        return s.xrange(key, args[1:]), nil
+    }
+
+    return nil, errors.New("ERR unknown command '" + command + "'")
+}
+
+// xrange supports the "-", "(<id>" and "+" bounds and COUNT
+func (s *devRedis) xrange(key string, args []interface{}) []interface{} {
+    start, count := devString(args[0]), -1
+    if len(args) >= 4 && strings.EqualFold(devString(args[2]), "COUNT") {
+        count, _ = strconv.Atoi(devString(args[3]))
+    }
+
+    after := int64(0)
+    if strings.HasPrefix(start, "(") {
+        after, _ = strconv.ParseInt(strings.TrimSuffix(start[1:], "-0"), 10, 64)
+    }
+
+    var entries []interface{}
+    for _, entry := range s.streams[key] {
+        id, _ := strconv.ParseInt(strings.TrimSuffix(entry.id, "-0"), 10, 64)
+        if id <= after {
+            continue
+        }
+        if count >= 0 && len(entries) == count {
+            break
+        }
+        entries = append(entries, []interface{}{[]byte(entry.id), entry.fields})
+    }
+    return entries
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+    "context"
+    "io"
+    "log/slog"
+    "net/http"
+    "slices"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// activeDownload is an archive this replica is streaming right now
+type activeDownload struct {
+    id         string
+    token      string
+    clientIP   string
+    filesTotal int
+    startedAt  time.Time
+    cancel     context.CancelFunc
+
+    filesDone     atomic.Int64
+    bytesStreamed atomic.Int64
+    terminated    atomic.Bool
+}
+
+type downloadInfo struct {
+    ID            string    `json:"id"`
+    Token         string    `json:"token"`
+    ClientIP      string    `json:"clientIp"`
+    FilesTotal    int       `json:"filesTotal"`
+    FilesDone     int64     `json:"filesDone"`
+    BytesStreamed int64     `json:"bytesStreamed"`
+    StartedAt     time.Time `json:"startedAt"`
+    Duration      string    `json:"duration"`
+}
+
+var activeDownloads = struct {
+    sync.Mutex
+    byID map[string]*activeDownload
+}{byID: map[string]*activeDownload{}}
+
+func trackDownload(id, token, clientIP string, filesTotal int, cancel context.CancelFunc) *activeDownload {
+    download := &activeDownload{
+        id:         id,
+        token:      token,
+        clientIP:   clientIP,
+        filesTotal: filesTotal,
+        startedAt:  time.Now(),
+        cancel:     cancel,
+    }
+
+    activeDownloads.Lock()
+    activeDownloads.byID[id] = download
+    activeDownloads.Unlock()
+
+    return download
+}
+
+func untrackDownload(id string) {
+    activeDownloads.Lock()
+    delete(activeDownloads.byID, id)
+    activeDownloads.Unlock()
+}
+
+func (d *activeDownload) update(update archiveUpdate) {
+    d.filesDone.Store(int64(update.FilesDone))
+}
+
+// writer counts bytes as they go out, so the listing is live even while a
+// single large file streams
+func (d *activeDownload) writer(w io.Writer) io.Writer {
+    return &downloadWriter{w: w, d: d}
+}
+
+type downloadWriter struct {
+    w io.Writer
+    d *activeDownload
+}
+
+func (w *downloadWriter) Write(p []byte) (int, error) {
+    n, err := w.w.Write(p)
+    w.d.bytesStreamed.Add(int64(n))
+    recordThroughput(n)
+    bytesStreamed.add(float64(n))
+    return n, err
+}
+
+func (d *activeDownload) terminate() {
+    d.terminated.Store(true)
+    d.cancel()
+}
+
+func (d *activeDownload) info() downloadInfo {
+    return downloadInfo{
+        ID:            d.id,
+        Token:         d.token,
+        ClientIP:      d.clientIP,
+        FilesTotal:    d.filesTotal,
+        FilesDone:     d.filesDone.Load(),
+        BytesStreamed: d.bytesStreamed.Load(),
+        StartedAt:     d.startedAt.UTC(),
+        Duration:      time.Since(d.startedAt).Round(time.Millisecond).String(),
+    }
+}
+
+// terminateTokenDownloads stops every download of a token on this replica,
+// combined ones included
+func terminateTokenDownloads(token string) (terminated int) {
+    activeDownloads.Lock()
+    defer activeDownloads.Unlock()
+
+    for _, download := range activeDownloads.byID {
+        if slices.Contains(strings.Split(download.token, ","), token) {
+            download.terminate()
+            terminated++
+        }
+    }
+    return
+}
+
+// listDownloadsHandler shows the downloads in flight on this replica, oldest
+// first
+func listDownloadsHandler(w http.ResponseWriter, r *http.Request) {
+    activeDownloads.Lock()
+    downloads := make([]downloadInfo, 0, len(activeDownloads.byID))
+    for _, download := range activeDownloads.byID {
+        downloads = append(downloads, download.info())
+    }
+    activeDownloads.Unlock()
+
+    sort.Slice(downloads, func(i, j int) bool {
+        return downloads[i].StartedAt.Before(downloads[j].StartedAt)
+    })
+
+    writeJSON(w, 200, downloads)
+}
+
+// terminateDownloadHandler cuts off a download in flight on this replica
+func terminateDownloadHandler(w http.ResponseWriter, r *http.Request) {
+    id := r.PathValue("id")
+
+    activeDownloads.Lock()
+    download, ok := activeDownloads.byID[id]
+    activeDownloads.Unlock()
+
+    if !ok {
+        writeProblem(w, r, 404, codeNotFound, "No download with this ID is in progress on this server")
+        return
+    }
+
+    download.terminate()
+    slog.InfoContext(r.Context(), "Terminated download", "download_id", id, "token", download.token)
+
+    w.WriteHeader(204)
+}
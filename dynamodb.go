@@ -0,0 +1,96 @@
+package main
+
+import (
+    "context"
+    "strconv"
+    "time"
+
+    "github.com/AdRoll/goamz/aws"
+)
+
+// dynamoTokenStore keeps manifests in a DynamoDB table, for deployments on
+// AWS that would rather not keep them in Redis. The table's partition key is
+// the string "token", "manifest" holds the manifest and "expires" the Unix
+// time it expires at, which the table's TTL should be set to. DynamoDB gets
+// round to deleting expired items in its own time, so they're checked here
+// too. Items can't be more than 400KB, bigger manifests need Redis.
+type dynamoTokenStore struct {
+    table string
+    api   *awsJSONAPI
+}
+
+func newDynamoTokenStore(c Configuration) *dynamoTokenStore {
+    endpoint := c.DynamoDBEndpoint
+    if endpoint == "" {
+        endpoint = aws.GetRegion(c.Region).DynamoDBEndpoint
+    }
+
+    return &dynamoTokenStore{
+        table: c.DynamoDBTable,
+        api:   newAWSJSONAPI(awsAuth, "dynamodb", c.Region, endpoint, "1.0", "DynamoDB_20120810"),
+    }
+}
+
+// dynamoItem is a token's item, in DynamoDB's typed JSON
+type dynamoItem struct {
+    Token    *dynamoValue `json:"token,omitempty"`
+    Manifest *dynamoValue `json:"manifest,omitempty"`
+    Expires  *dynamoValue `json:"expires,omitempty"`
+}
+
+type dynamoValue struct {
+    S string `json:",omitempty"`
+    B []byte `json:",omitempty"`
+    N string `json:",omitempty"`
+}
+
+func (s *dynamoTokenStore) key(token string) dynamoItem {
+    return dynamoItem{Token: &dynamoValue{S: token}}
+}
+
+func (s *dynamoTokenStore) Get(ctx context.Context, token string) ([]byte, error) {
+    var response struct{ Item dynamoItem }
+    err := s.api.call(ctx, "GetItem", map[string]interface{}{
+        "TableName":      s.table,
+        "Key":            s.key(token),
+        "ConsistentRead": true,
+    }, &response)
+    if err != nil {
+        return nil, err
+    }
+
+    item := response.Item
+    if item.Manifest == nil {
+        return nil, errTokenNotFound
+    }
+    if item.Expires != nil {
+        expires, _ := strconv.ParseInt(item.Expires.N, 10, 64)
+        if time.Now().Unix() >= expires {
+            return nil, errTokenNotFound
+        }
+    }
+    return item.Manifest.B, nil
+}
+
+func (s *dynamoTokenStore) Put(ctx context.Context, token string, manifest []byte, ttl time.Duration) error {
+    item := s.key(token)
+    item.Manifest = &dynamoValue{B: manifest}
+    if ttl > 0 {
+        item.Expires = &dynamoValue{N: strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)}
+    }
+
+    return s.api.call(ctx, "PutItem", map[string]interface{}{
+        "TableName": s.table,
+        "Item":      item,
+    }, &struct{}{})
+}
+
+func (s *dynamoTokenStore) Delete(ctx context.Context, token string) (bool, error) {
+    var response struct{ Attributes *dynamoItem }
+    err := s.api.call(ctx, "DeleteItem", map[string]interface{}{
+        "TableName":    s.table,
+        "Key":          s.key(token),
+        "ReturnValues": "ALL_OLD",
+    }, &response)
+    return response.Attributes != nil, err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+    "net/http"
+    "path"
+    "strings"
+)
+
+// Zip format overhead per entry: local header and data descriptor, plus the
+// central directory record, each carrying the name. Zip64 extras are
+// ignored as they're small.
+const (
+    zipLocalHeaderSize    = 30 + 16
+    zipCentralHeaderSize  = 46
+    zipEndOfDirectorySize = 22
+)
+
+// Rough deflate ratios by file type, used to estimate the archive size
+var compressionRatios = map[string]float64{
+    // Already compressed, deflate gains nothing
+    ".jpg": 1, ".jpeg": 1, ".png": 1, ".gif": 1, ".webp": 1, ".heic": 1,
+    ".mp3": 1, ".mp4": 1, ".mov": 1, ".mkv": 1, ".avi": 1, ".webm": 1,
+    ".zip": 1, ".gz": 1, ".bz2": 1, ".xz": 1, ".7z": 1, ".rar": 1,
+    ".pdf": 0.95, ".docx": 0.98, ".xlsx": 0.98, ".pptx": 0.98,
+
+    // Text compresses well
+    ".txt": 0.35, ".csv": 0.3, ".json": 0.25, ".xml": 0.25, ".html": 0.3,
+    ".md": 0.4, ".log": 0.2, ".svg": 0.35,
+}
+
+// Anything we don't recognise
+const defaultCompressionRatio = 0.8
+
+type estimateResponse struct {
+    FileCount        int   `json:"fileCount"`
+    MissingCount     int   `json:"missingCount"`
+    UncompressedSize int64 `json:"uncompressedSize"`
+    EstimatedSize    int64 `json:"estimatedSize"`
+}
+
+func compressionRatio(name string) float64 {
+    if ratio, ok := compressionRatios[strings.ToLower(path.Ext(name))]; ok {
+        return ratio
+    }
+    return defaultCompressionRatio
+}
+
+// estimateArchive totals the entries and estimates the size of the zip, with
+// the files stored as they are when store is set
+func estimateArchive(statuses []fileStatus, store bool) (estimate estimateResponse) {
+    estimated := float64(zipEndOfDirectorySize)
+
+    for _, status := range statuses {
+        if !status.Exists {
+            estimate.MissingCount++
+            continue
+        }
+
+        estimate.FileCount++
+        estimate.UncompressedSize += status.Size
+
+        ratio := 1.0
+        if !store {
+            ratio = compressionRatio(status.Path)
+        }
+        estimated += float64(status.Size) * ratio
+        estimated += float64(zipLocalHeaderSize + zipCentralHeaderSize + 2*len(status.Path))
+    }
+
+    estimate.EstimatedSize = int64(estimated)
+    return
+}
+
+// estimateHandler reports how big a token's archive will be
+func estimateHandler(w http.ResponseWriter, r *http.Request) {
+    _, manifest, ok := authorizeDownload(w, r)
+    if !ok {
+        return
+    }
+
+    store, err := storeRequested(r)
+    if err != nil {
+        writeProblem(w, r, 400, codeBadRequest, err.Error())
+        return
+    }
+
+    writeJSON(w, 200, estimateArchive(headFiles(r.Context(), manifest, true), store))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "expvar"
+    "runtime"
+)
+
+// Internal counters for /debug/vars, for a quick look without a metrics stack
+func init() {
+    expvar.Publish("goroutines", expvar.Func(func() interface{} {
+        return runtime.NumGoroutine()
+    }))
+
+    // What those goroutines are doing
+    expvar.Publish("stages", expvar.Func(func() interface{} {
+        activeDownloads.Lock()
+        streaming := len(activeDownloads.byID)
+        activeDownloads.Unlock()
+
+        jobs.Lock()
+        building := len(jobs.running)
+        jobs.Unlock()
+
+        progressSubscribers.Lock()
+        watching := 0
+        for _, channels := range progressSubscribers.channels {
+            watching += len(channels)
+        }
+        progressSubscribers.Unlock()
+
+        return map[string]int{
+            "downloads_streaming": streaming,
+            "jobs_running":        building,
+            "jobs_queued":         len(jobQueue),
+            "progress_streams":    watching,
+        }
+    }))
+
+    expvar.Publish("redis_pool", expvar.Func(func() interface{} {
+        if redisClient == nil {
+            return nil
+        }
+        stats := redisClient.PoolStats()
+        return map[string]interface{}{
+            "total":      stats.TotalConns,
+            "idle":       stats.IdleConns,
+            "timeouts":   stats.Timeouts,
+            "max_idle":   config.RedisPoolMaxIdle,
+            "max_active": config.RedisPoolMaxActive,
+        }
+    }))
+
+    expvar.Publish("archives_in_flight", expvar.Func(func() interface{} {
+        activeDownloads.Lock()
+        defer activeDownloads.Unlock()
+
+        jobs.Lock()
+        defer jobs.Unlock()
+
+        return len(activeDownloads.byID) + len(jobs.running)
+    }))
+
+    expvar.Publish("bytes_copied", expvar.Func(func() interface{} {
+        bytesStreamed.mu.Lock()
+        defer bytesStreamed.mu.Unlock()
+        return int64(bytesStreamed.values[""])
+    }))
+}
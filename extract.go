@@ -0,0 +1,254 @@
+package main
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "mime"
+    "net/http"
+    "os"
+    "path"
+    "strings"
+    "time"
+
+    "github.com/AdRoll/goamz/s3"
+)
+
+// The reverse of a download: a zip or tar POSTed to /v1/extract?token= is
+// unpacked into the token's bucket, each file under the manifest's
+// ExtractTo prefix:
+//
+//	{"Version": 1, "ExtractTo": "uploads/customer-42"}
+//
+// It takes an API key with the archives:write scope as well as whatever a
+// download of the token takes. Tokens without ExtractTo can't be extracted
+// to. Tars, gzipped or not, stream straight through to S3, zips have their
+// directory at the end so they're spooled to disk first.
+//
+// The answer is a manifest of the objects made, which can be stored as a
+// token to download them again. Entries that aren't files, or whose names
+// would climb out of the prefix, are logged and skipped. Uploads can be up
+// to EXTRACT_MAX_BYTES with EXTRACT_MAX_FILES files in them, which can add
+// up to EXTRACT_MAX_UNPACKED_BYTES, and take up to EXTRACT_TIMEOUT. A tar
+// that turns out to have too many, or too much in them, leaves the files
+// before in place.
+
+// The largest object a single PUT can make
+const maxExtractedFile = 5 << 30
+
+var (
+    errTooManyExtracted = errors.New("too many files in the archive")
+    errTooMuchExtracted = errors.New("the archive unpacks to too much")
+    errExtractPut       = errors.New("could not put a file")
+)
+
+// extractResponse is the manifest of the files an upload was unpacked into
+type extractResponse struct {
+    Version int
+    Tenant  string `json:",omitempty"`
+    Files   []*RedisFile
+}
+
+// extraction puts an upload's files in the bucket under prefix
+type extraction struct {
+    ctx      context.Context
+    bucket   *s3.Bucket
+    prefix   string
+    result   extractResponse
+    unpacked int64 // bytes put so far
+}
+
+func extractHandler(w http.ResponseWriter, r *http.Request) {
+    if err := archiver.Authorize(r); err != nil {
+        writeProblem(w, r, 403, codeForbidden, err.Error())
+        return
+    }
+
+    token, manifest, ok := authorizeDownload(w, r)
+    if !ok {
+        return
+    }
+    if manifest.ExtractTo == "" {
+        writeProblem(w, r, 403, codeForbidden, "This token can't be extracted to")
+        return
+    }
+    if reason := folderProblem(manifest.ExtractTo); reason != "" {
+        writeProblem(w, r, 422, codeManifestInvalid, fmt.Sprintf("The manifest's ExtractTo %q %s", manifest.ExtractTo, reason))
+        return
+    }
+
+    // Uploads take far longer than READ_TIMEOUT allows, and the answer only
+    // comes once they're unpacked
+    deadline := time.Now().Add(config.ExtractTimeout)
+    rc := http.NewResponseController(w)
+    rc.SetReadDeadline(deadline)
+    rc.SetWriteDeadline(deadline)
+
+    e := &extraction{
+        ctx:    r.Context(),
+        bucket: tenantFor(manifest).bucket,
+        prefix: strings.TrimSuffix(manifest.ExtractTo, "/"),
+        result: extractResponse{Version: manifestVersion, Tenant: manifest.Tenant, Files: []*RedisFile{}},
+    }
+
+    // What it is can be told from the first bytes, the tar magic is at 257
+    body := bufio.NewReader(http.MaxBytesReader(w, r.Body, config.ExtractMaxBytes))
+    head, _ := body.Peek(512)
+
+    var err error
+    switch {
+    case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+        err = e.zip(body)
+    case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+        var gz *gzip.Reader
+        if gz, err = gzip.NewReader(body); err == nil {
+            err = e.tar(gz)
+        }
+    case len(head) >= 262 && string(head[257:262]) == "ustar":
+        err = e.tar(body)
+    default:
+        writeProblem(w, r, 415, codeBadRequest, "The upload should be a zip or a tar")
+        return
+    }
+
+    var tooLarge *http.MaxBytesError
+    switch {
+    case errors.As(err, &tooLarge):
+        writeProblem(w, r, 413, codeArchiveTooLarge, fmt.Sprintf("The upload is larger than %d bytes", config.ExtractMaxBytes))
+        return
+    case errors.Is(err, errTooManyExtracted):
+        writeProblem(w, r, 422, codeArchiveTooLarge, fmt.Sprintf("The archive has more than %d files", config.ExtractMaxFiles))
+        return
+    case errors.Is(err, errTooMuchExtracted):
+        writeProblem(w, r, 413, codeArchiveTooLarge, fmt.Sprintf("The archive unpacks to more than %d bytes", config.ExtractMaxUnpacked))
+        return
+    case errors.Is(err, errExtractPut):
+        slog.ErrorContext(r.Context(), "Error extracting archive", "token", token, "error", err)
+        writeProblem(w, r, 503, codeStorageUnreachable, "Could not store the archive's files")
+        return
+    case err != nil:
+        writeProblem(w, r, 400, codeBadRequest, "The archive could not be read: "+err.Error())
+        return
+    }
+
+    slog.InfoContext(r.Context(), "Extracted archive", "token", token, "tenant", manifest.Tenant, "prefix", e.prefix, "files", len(e.result.Files))
+    writeJSON(w, 201, e.result)
+}
+
+// tar extracts each file of a tar as it's read
+func (e *extraction) tar(r io.Reader) error {
+    archive := tar.NewReader(r)
+    for {
+        header, err := archive.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if !header.FileInfo().Mode().IsRegular() {
+            continue
+        }
+        if err := e.put(header.Name, header.Size, archive); err != nil {
+            return err
+        }
+    }
+}
+
+// zip spools the zip to a temporary file, where its directory can be read,
+// and extracts each file
+func (e *extraction) zip(r io.Reader) error {
+    spool, err := os.CreateTemp("", "zipper-extract-*.zip")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(spool.Name())
+    defer spool.Close()
+
+    size, err := io.Copy(spool, r)
+    if err != nil {
+        return err
+    }
+    archive, err := zip.NewReader(spool, size)
+    if err != nil {
+        return err
+    }
+
+    // Zips say how many files they have and how big, so too many or too
+    // much is refused before any are put
+    files, left := 0, uint64(config.ExtractMaxUnpacked)
+    for _, file := range archive.File {
+        if !file.Mode().IsRegular() {
+            continue
+        }
+        if files++; files > config.ExtractMaxFiles {
+            return errTooManyExtracted
+        }
+        if file.UncompressedSize64 > left {
+            return errTooMuchExtracted
+        }
+        left -= file.UncompressedSize64
+    }
+
+    for _, file := range archive.File {
+        if !file.Mode().IsRegular() {
+            continue
+        }
+        body, err := file.Open()
+        if err != nil {
+            return fmt.Errorf("%s: %w", file.Name, err)
+        }
+        err = e.put(file.Name, int64(file.UncompressedSize64), body)
+        body.Close()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// put stores one file of the archive under the prefix, unless its name
+// would put it somewhere else
+func (e *extraction) put(name string, size int64, body io.Reader) error {
+    name = strings.TrimPrefix(name, "./")
+    if reason := folderProblem(name); reason != "" || strings.HasSuffix(name, "/") {
+        slog.WarnContext(e.ctx, "Skipped archive entry", "name", name, "reason", reason)
+        return nil
+    }
+    if size > maxExtractedFile {
+        slog.WarnContext(e.ctx, "Skipped archive entry", "name", name, "reason", "larger than a single PUT allows")
+        return nil
+    }
+    if len(e.result.Files) >= config.ExtractMaxFiles {
+        return errTooManyExtracted
+    }
+    if size > config.ExtractMaxUnpacked-e.unpacked {
+        return errTooMuchExtracted
+    }
+
+    contentType := mime.TypeByExtension(path.Ext(name))
+    if contentType == "" {
+        contentType = "application/octet-stream"
+    }
+    key := path.Join(e.prefix, name)
+    // Never more than the entry said it has, whatever it inflates to
+    if err := e.bucket.PutReader(key, io.LimitReader(body, size), size, contentType, s3.Private, s3.Options{}); err != nil {
+        s3Errors.inc("put")
+        return fmt.Errorf("%w %s: %w", errExtractPut, key, err)
+    }
+    e.unpacked += size
+
+    folder := path.Dir(name)
+    if folder == "." {
+        folder = ""
+    }
+    e.result.Files = append(e.result.Files, &RedisFile{FileName: path.Base(name), Folder: folder, S3Path: key, Size: size})
+    return nil
+}
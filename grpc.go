@@ -0,0 +1,450 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "codecourse/zipper/archive"
+)
+
+// The gRPC API for internal services, described in proto/zipper.proto. It's
+// served over cleartext HTTP/2 on GRPC_PORT with the standard library, which
+// is all the gRPC protocol needs for unary and server streaming calls.
+// Callers authenticate with an API key, so the link checks downloads go
+// through (signatures, IP and OIDC restrictions) don't apply.
+
+// gRPC status codes
+const (
+    grpcOK                 = 0
+    grpcInvalidArgument    = 3
+    grpcNotFound           = 5
+    grpcPermissionDenied   = 7
+    grpcResourceExhausted  = 8
+    grpcFailedPrecondition = 9
+    grpcAborted            = 10
+    grpcInternal           = 13
+    grpcUnavailable        = 14
+    grpcUnauthenticated    = 16
+)
+
+// Requests are small, anything bigger than this isn't one of ours
+const grpcMaxRequest = 4 * 1024 * 1024
+
+// Archive data is sent in messages of about this size
+const grpcChunkSize = 64 * 1024
+
+type grpcError struct {
+    code    int
+    message string
+}
+
+func (e *grpcError) Error() string {
+    return e.message
+}
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+    return &grpcError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+var grpcMux = http.NewServeMux()
+
+// serveGRPC starts the gRPC listener in the background
+func serveGRPC() error {
+    if config.GRPCPort == "" {
+        return nil
+    }
+
+    grpcMethod("CreateToken", scopeTokensWrite, grpcCreateToken)
+    grpcMethod("GetManifest", scopeArchivesRead, grpcGetManifest)
+    grpcMethod("StreamArchive", scopeArchivesRead, grpcStreamArchive)
+    grpcMethod("WatchJob", scopeArchivesRead, grpcWatchJob)
+
+    ln, err := net.Listen("tcp", ":"+config.GRPCPort)
+    if err != nil {
+        return err
+    }
+    slog.Info("gRPC listening", "port", config.GRPCPort)
+
+    var protocols http.Protocols
+    protocols.SetUnencryptedHTTP2(true)
+
+    // Streams run as long as archives take, so only the headers are timed
+    server := &http.Server{
+        Handler:           grpcMux,
+        Protocols:         &protocols,
+        ReadHeaderTimeout: config.ReadHeaderTimeout,
+    }
+    go func() {
+        fatal("gRPC server stopped", server.Serve(ln))
+    }()
+
+    return nil
+}
+
+// grpcCall is one call in progress
+type grpcCall struct {
+    w       http.ResponseWriter
+    r       *http.Request
+    request []byte
+    sent    bool
+}
+
+// grpcMethod registers a method of the Zipper service. Requests have to
+// carry an x-api-key granting scope.
+func grpcMethod(name, scope string, method func(call *grpcCall) error) {
+    grpcMux.HandleFunc("POST /zipper.v1.Zipper/"+name, assignRequestID(func(w http.ResponseWriter, r *http.Request) {
+        if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+            http.Error(w, "gRPC requests only", 415)
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/grpc")
+        call := &grpcCall{w: w, r: r}
+
+        err := call.authorize(scope)
+        if err == nil {
+            call.request, err = readGRPCMessage(r.Body)
+        }
+        if err == nil {
+            err = method(call)
+        }
+        call.finish(err)
+    }))
+}
+
+func (call *grpcCall) authorize(scope string) error {
+    key := call.r.Header.Get("X-API-Key")
+    if key == "" {
+        return grpcErrorf(grpcUnauthenticated, "x-api-key metadata is required")
+    }
+
+    scopes, ok := apiKeyScopes(call.r.Context(), key)
+    if !ok {
+        return grpcErrorf(grpcUnauthenticated, "unknown API key")
+    }
+    if !hasScope(scopes, scope) {
+        return grpcErrorf(grpcPermissionDenied, "API key lacks the %s scope", scope)
+    }
+    return nil
+}
+
+// send writes a response message, prefixed by its compression flag and
+// length
+func (call *grpcCall) send(message []byte) error {
+    call.sent = true
+
+    var prefix [5]byte
+    binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+    if _, err := call.w.Write(prefix[:]); err != nil {
+        return err
+    }
+    if _, err := call.w.Write(message); err != nil {
+        return err
+    }
+    return http.NewResponseController(call.w).Flush()
+}
+
+// finish reports the call's status in the trailers, or in the only headers
+// when nothing was sent
+func (call *grpcCall) finish(err error) {
+    code, message := grpcOK, ""
+    if err != nil {
+        var grpcErr *grpcError
+        if errors.As(err, &grpcErr) {
+            code, message = grpcErr.code, grpcErr.message
+        } else {
+            slog.ErrorContext(call.r.Context(), "gRPC call failed", "method", call.r.URL.Path, "error", err)
+            code, message = grpcInternal, err.Error()
+        }
+    }
+
+    prefix := http.TrailerPrefix
+    if !call.sent {
+        prefix = ""
+    }
+    call.w.Header().Set(prefix+"Grpc-Status", strconv.Itoa(code))
+    if message != "" {
+        call.w.Header().Set(prefix+"Grpc-Message", grpcEncodeMessage(message))
+    }
+    if !call.sent {
+        call.w.WriteHeader(200)
+    }
+}
+
+// grpcEncodeMessage percent-encodes a status message as the protocol asks
+func grpcEncodeMessage(message string) string {
+    var b strings.Builder
+    for i := 0; i < len(message); i++ {
+        c := message[i]
+        if c < 0x20 || c > 0x7e || c == '%' {
+            fmt.Fprintf(&b, "%%%02X", c)
+            continue
+        }
+        b.WriteByte(c)
+    }
+    return b.String()
+}
+
+// readGRPCMessage reads the single request message of a call
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+    var prefix [5]byte
+    if _, err := io.ReadFull(r, prefix[:]); err != nil {
+        return nil, grpcErrorf(grpcInvalidArgument, "missing request message")
+    }
+    if prefix[0] != 0 {
+        return nil, grpcErrorf(grpcInvalidArgument, "compressed requests are not supported")
+    }
+
+    length := binary.BigEndian.Uint32(prefix[1:])
+    if length > grpcMaxRequest {
+        return nil, grpcErrorf(grpcResourceExhausted, "request message is too large")
+    }
+
+    message := make([]byte, length)
+    if _, err := io.ReadFull(r, message); err != nil {
+        return nil, grpcErrorf(grpcInvalidArgument, "truncated request message")
+    }
+    return message, nil
+}
+
+// grpcLookupError maps the errors from getManifest to status codes, much as
+// writeLookupProblem does for HTTP
+func grpcLookupError(err error) error {
+    switch {
+    case errors.Is(err, errTokenNotFound):
+        return grpcErrorf(grpcNotFound, "no archive exists for this token")
+    case errors.Is(err, errTokenRevoked):
+        return grpcErrorf(grpcNotFound, "this token has been revoked")
+    case errors.Is(err, errTokenInvalid):
+        return grpcErrorf(grpcPermissionDenied, "%s", err.Error())
+    case errors.Is(err, errManifestInvalid):
+        return grpcErrorf(grpcFailedPrecondition, "%s", err.Error())
+    case errors.Is(err, errStoreUnavailable):
+        return grpcErrorf(grpcUnavailable, "the token store is unavailable")
+    default:
+        return err
+    }
+}
+
+// manifest resolves the token a request names in its first field
+func (call *grpcCall) manifest() (token string, manifest *Manifest, err error) {
+    token, err = protoStringField(call.request, 1)
+    if err != nil {
+        return "", nil, grpcErrorf(grpcInvalidArgument, "%s", err.Error())
+    }
+    if !validToken(token) {
+        return "", nil, grpcErrorf(grpcInvalidArgument, "the download token is not in the expected format")
+    }
+
+    manifest, err = getManifest(call.r.Context(), token)
+    if err != nil {
+        return "", nil, grpcLookupError(err)
+    }
+    if err := resolveTenant(call.r, manifest); err != nil {
+        return "", nil, grpcErrorf(grpcPermissionDenied, "%s", err.Error())
+    }
+    if err := listPrefixes(call.r.Context(), manifest); err != nil {
+        if errors.Is(err, errManifestInvalid) {
+            return "", nil, grpcLookupError(err)
+        }
+        slog.ErrorContext(call.r.Context(), "Error listing prefixes", "error", err)
+        return "", nil, grpcErrorf(grpcUnavailable, "could not list the files under a prefix")
+    }
+    return token, manifest, nil
+}
+
+func grpcCreateToken(call *grpcCall) error {
+    var files []*RedisFile
+    var ttl int
+
+    err := protoDecode(call.request, func(field protoField) error {
+        switch field.number {
+        case 1:
+            file, err := unmarshalProtoFile(field.data)
+            if err != nil {
+                return err
+            }
+            files = append(files, file)
+        case 2:
+            ttl = int(int32(field.value))
+        }
+        return nil
+    })
+    if err != nil {
+        return grpcErrorf(grpcInvalidArgument, "%s", err.Error())
+    }
+    if len(files) == 0 {
+        return grpcErrorf(grpcInvalidArgument, "at least one file is required")
+    }
+    if err := checkManifestFiles(files, nil, nil, nil); err != nil {
+        return grpcErrorf(grpcInvalidArgument, "%s", err.Error())
+    }
+
+    token, err := storeToken(call.r.Context(), files, ttl)
+    if err != nil {
+        slog.ErrorContext(call.r.Context(), "Error storing token", "error", err)
+        return grpcErrorf(grpcUnavailable, "could not store the token")
+    }
+
+    return call.send(protoAppendString(nil, 1, token))
+}
+
+func grpcGetManifest(call *grpcCall) error {
+    _, manifest, err := call.manifest()
+    if err != nil {
+        return err
+    }
+
+    var response []byte
+    for _, file := range manifest.Files {
+        response = protoAppendMessage(response, 1, marshalProtoFile(file))
+    }
+    return call.send(response)
+}
+
+// grpcChunkWriter sends everything written to it as ArchiveChunk messages
+type grpcChunkWriter struct {
+    call *grpcCall
+}
+
+func (w grpcChunkWriter) Write(p []byte) (int, error) {
+    if err := w.call.send(protoAppendBytes(nil, 1, p)); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+// grpcStreamArchive streams a token's archive. Like HTTP downloads it shows
+// up in /admin/downloads and the audit trail.
+func grpcStreamArchive(call *grpcCall) error {
+    if err := archiver.Authorize(call.r); err != nil {
+        return grpcErrorf(grpcPermissionDenied, "%s", err.Error())
+    }
+
+    token, manifest, err := call.manifest()
+    if err != nil {
+        return err
+    }
+    if config.EmptyArchiveStatus != 200 && emptyManifest(manifest) {
+        return grpcErrorf(grpcNotFound, "the manifest has no files to archive")
+    }
+    if err := checkArchiveLimits(call.r.Context(), manifest); err != nil {
+        return grpcErrorf(grpcFailedPrecondition, "%s", err.Error())
+    }
+
+    r := call.r
+    ctx, cancel := context.WithCancel(r.Context())
+    defer cancel()
+
+    id := newToken()
+    finishQuota, err := startTenantArchive(r.Context(), manifest, id)
+    if err != nil {
+        return grpcErrorf(grpcResourceExhausted, "%s", err.Error())
+    }
+
+    active := trackDownload(id, token, clientIP(r), len(manifest.Files), cancel)
+    defer untrackDownload(id)
+    defer func() { finishQuota(active.bytesStreamed.Load()) }()
+
+    var failedFiles []string
+    chunks := bufio.NewWriterSize(active.writer(grpcChunkWriter{call: call}), grpcChunkSize)
+    err = writeArchive(ctx, chunks, manifest, false, func(update archiveUpdate) {
+        active.update(update)
+        if update.Error != "" {
+            failedFiles = append(failedFiles, update.CurrentFile)
+        }
+    })
+    if err == nil {
+        err = chunks.Flush()
+    }
+    if errors.Is(err, archive.ErrEmpty) {
+        err = grpcErrorf(grpcNotFound, "%s", err.Error())
+    }
+
+    result := "ok"
+    switch {
+    case active.terminated.Load():
+        result = "terminated"
+        err = grpcErrorf(grpcAborted, "download terminated")
+    case err != nil:
+        result = "failed"
+    }
+    archivesTotal.inc("grpc", result)
+    recordUsage(r.Context(), "grpc", id, manifest, result, active.bytesStreamed.Load())
+
+    audit(r.Context(), &auditRecord{
+        Time:        active.startedAt,
+        DownloadID:  id,
+        RequestID:   requestID(r.Context()),
+        Token:       token,
+        IP:          active.clientIP,
+        UserAgent:   r.UserAgent(),
+        Result:      result,
+        Bytes:       active.bytesStreamed.Load(),
+        FilesTotal:  len(manifest.Files),
+        FailedFiles: failedFiles,
+    })
+
+    return err
+}
+
+// grpcWatchJob sends a job's state, then again on every change until it
+// finishes
+func grpcWatchJob(call *grpcCall) error {
+    id, err := protoStringField(call.request, 1)
+    if err != nil {
+        return grpcErrorf(grpcInvalidArgument, "%s", err.Error())
+    }
+
+    // Subscribe first so nothing is missed between loading and listening
+    events, unsubscribe := subscribeProgress(jobProgressKey(id))
+    defer unsubscribe()
+
+    job, err := loadJob(call.r.Context(), id)
+    if err == errJobNotFound {
+        return grpcErrorf(grpcNotFound, "no job exists with this ID")
+    }
+    if err != nil {
+        return grpcErrorf(grpcUnavailable, "could not load the job")
+    }
+
+    for {
+        if err := call.send(marshalProtoJob(job)); err != nil {
+            return err
+        }
+        if jobFinished(job) {
+            return nil
+        }
+
+        select {
+        case <-call.r.Context().Done():
+            return nil
+        case event := <-events:
+            if event.Event == progressDone {
+                // The result URL is only in the stored job
+                if stored, err := loadJob(call.r.Context(), id); err == nil {
+                    job = stored
+                    continue
+                }
+            }
+            if event.State != "" {
+                job.State = event.State
+            }
+            job.FilesDone = event.FilesDone
+            job.BytesStreamed = event.BytesStreamed
+            job.CurrentFile = event.CurrentFile
+            if event.Event == progressDone {
+                job.Error = event.Error
+            }
+        }
+    }
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "time"
+)
+
+// How long a dependency gets to answer a health check
+const healthTimeout = 3 * time.Second
+
+type dependencyHealth struct {
+    Status  string `json:"status"`
+    Latency string `json:"latency,omitempty"`
+    Error   string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+    Status       string                      `json:"status"`
+    Dependencies map[string]dependencyHealth `json:"dependencies,omitempty"`
+}
+
+// pingRedis checks that Redis answers PING
+func pingRedis() error {
+    return redisClient.Ping(context.Background()).Err()
+}
+
+// pingS3 makes the cheapest call that proves the bucket is reachable with
+// our credentials
+func pingS3() error {
+    resp, err := aws_bucket.Head("", nil)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    return nil
+}
+
+// checkDependency runs a ping, giving up on it after healthTimeout
+func checkDependency(ping func() error) dependencyHealth {
+    start := time.Now()
+    result := make(chan error, 1)
+    go func() {
+        result <- ping()
+    }()
+
+    select {
+    case err := <-result:
+        if err != nil {
+            return dependencyHealth{Status: "error", Error: err.Error()}
+        }
+        return dependencyHealth{Status: "ok", Latency: time.Since(start).Round(time.Microsecond).String()}
+    case <-time.After(healthTimeout):
+        return dependencyHealth{Status: "error", Error: "timed out"}
+    }
+}
+
+// checkDependencies pings Redis and S3 at the same time
+func checkDependencies() (healthy bool, dependencies map[string]dependencyHealth) {
+    redis := make(chan dependencyHealth, 1)
+    s3 := make(chan dependencyHealth, 1)
+    go func() { redis <- checkDependency(pingRedis) }()
+    go func() { s3 <- checkDependency(pingS3) }()
+
+    dependencies = map[string]dependencyHealth{"redis": <-redis, "s3": <-s3}
+
+    healthy = true
+    for _, dependency := range dependencies {
+        if dependency.Status != "ok" {
+            healthy = false
+        }
+    }
+    return
+}
+
+// livezHandler only shows the process is up and serving, so restarts aren't
+// triggered by a dependency being down
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Cache-Control", "no-store")
+    writeJSON(w, 200, map[string]string{"status": "ok"})
+}
+
+// readyzHandler fails while draining for shutdown or when a dependency is
+// unreachable, so traffic goes elsewhere without the pod being restarted
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Cache-Control", "no-store")
+
+    if draining.Load() {
+        writeJSON(w, 503, healthResponse{Status: "draining"})
+        return
+    }
+
+    healthy, dependencies := checkDependencies()
+    if !healthy {
+        writeJSON(w, 503, healthResponse{Status: "unavailable", Dependencies: dependencies})
+        return
+    }
+
+    writeJSON(w, 200, healthResponse{Status: "ok", Dependencies: dependencies})
+}
+
+// healthzHandler reports the status of each dependency, with a 503 when any
+// of them is down
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+    healthy, dependencies := checkDependencies()
+
+    resp := healthResponse{Status: "ok", Dependencies: dependencies}
+    status := 200
+    if !healthy {
+        resp.Status = "unavailable"
+        status = 503
+    }
+
+    w.Header().Set("Cache-Control", "no-store")
+    writeJSON(w, status, resp)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "path"
+    "slices"
+    "strings"
+)
+
+// A manifest entry can pull in another token's files instead of being a
+// file itself, so a list shared between archives is kept once:
+//
+//	{"Type": "token", "Token": "<token>", "Folder": "shared"}
+//
+// The token's files go where the entry is, under its Folder. Included
+// tokens can include others in turn, up to maxIncludeDepth deep. They have
+// to be for the same tenant, and can't have restrictions of their own,
+// since it's the including token that's checked.
+//
+// An entry can also take every object under an S3 prefix, and in versioned
+// manifests an S3Path with wildcards is every object it matches, see
+// prefix.go. Very large prefixes can be read from an S3 Inventory, see
+// inventory.go.
+
+const maxIncludeDepth = 5
+
+const (
+    entryToken     = "token"
+    entryPrefix    = "prefix"
+    entryInventory = "inventory"
+)
+
+// manifestEntry is an entry of a manifest's files as stored, a file or a
+// token to include
+type manifestEntry struct {
+    RedisFile
+    Type  string // "file" or empty, or "token"
+    Token string
+}
+
+// manifestInclude is a token, prefix or glob to be included, At the
+// position in Files its files go
+type manifestInclude struct {
+    At     int
+    Token  string
+    Prefix string
+    Glob   string
+    Folder string
+
+    // Whether Prefix is read from the tenant's S3 Inventory
+    Inventory bool
+}
+
+// addEntry adds a stored entry to the manifest's files or includes
+func (m *Manifest) addEntry(entry *manifestEntry) error {
+    if entry == nil {
+        m.Files = append(m.Files, nil)
+        return nil
+    }
+
+    switch strings.ToLower(entry.Type) {
+    case "", "file":
+        m.Files = append(m.Files, &entry.RedisFile)
+    case entryToken:
+        if entry.Token == "" {
+            return manifestErrors{fmt.Sprintf("files[%d].Token is required", len(m.Files)+len(m.Includes))}
+        }
+        m.Includes = append(m.Includes, manifestInclude{At: len(m.Files), Token: entry.Token, Folder: entry.Folder})
+    case entryPrefix:
+        if entry.S3Path == "" {
+            return manifestErrors{fmt.Sprintf("files[%d].S3Path is required", len(m.Files)+len(m.Includes))}
+        }
+        m.Includes = append(m.Includes, manifestInclude{At: len(m.Files), Prefix: entry.S3Path, Folder: entry.Folder})
+    case entryInventory:
+        m.Includes = append(m.Includes, manifestInclude{At: len(m.Files), Prefix: entry.S3Path, Folder: entry.Folder, Inventory: true})
+    default:
+        return manifestErrors{fmt.Sprintf("files[%d].Type %q should be file, token, prefix or inventory", len(m.Files)+len(m.Includes), entry.Type)}
+    }
+    return nil
+}
+
+// isGlob reports whether an S3Path has wildcards, as path.Match has them
+func isGlob(s3Path string) bool {
+    return strings.ContainsAny(s3Path, "*?[")
+}
+
+// collectGlobs moves files whose S3Path has wildcards to the includes, to be
+// listed with the prefixes. Only versioned manifests have globs, older ones
+// could have keys with * in them.
+func (m *Manifest) collectGlobs() {
+    var files []*RedisFile
+    var includes []manifestInclude
+    next := 0
+    for i, file := range m.Files {
+        for ; next < len(m.Includes) && m.Includes[next].At <= i; next++ {
+            include := m.Includes[next]
+            include.At = len(files)
+            includes = append(includes, include)
+        }
+        if file != nil && isGlob(file.S3Path) {
+            includes = append(includes, manifestInclude{At: len(files), Glob: file.S3Path, Folder: file.Folder})
+            continue
+        }
+        files = append(files, file)
+    }
+    for ; next < len(m.Includes); next++ {
+        include := m.Includes[next]
+        include.At = len(files)
+        includes = append(includes, include)
+    }
+    m.Files, m.Includes = files, includes
+}
+
+// includeTokens replaces the manifest's token includes with the files of
+// the tokens they name, leaving prefixes and globs for listPrefixes. chain is the
+// tokens including this one, to catch loops.
+func includeTokens(ctx context.Context, manifest *Manifest, chain []string) error {
+    if len(manifest.Includes) == 0 {
+        return nil
+    }
+    if len(chain) > maxIncludeDepth {
+        return includeError("tokens are included more than %d deep", maxIncludeDepth)
+    }
+
+    out := &Manifest{}
+    next := 0
+    for _, include := range manifest.Includes {
+        out.Files = append(out.Files, manifest.Files[next:include.At]...)
+        next = include.At
+
+        if include.Token == "" {
+            include.At = len(out.Files)
+            out.Includes = append(out.Includes, include)
+            continue
+        }
+        if slices.Contains(chain, include.Token) {
+            return includeError("token %s includes itself", include.Token)
+        }
+
+        included, err := loadManifest(ctx, include.Token)
+        if errors.Is(err, errStoreUnavailable) {
+            return err
+        }
+        if err != nil {
+            return includeError("included token %s: %v", include.Token, err)
+        }
+        if included.Tenant != manifest.Tenant {
+            return includeError("included token %s is for another tenant", include.Token)
+        }
+        if len(included.AllowedSubjects) > 0 || len(included.AllowedCIDRs) > 0 || len(included.DeniedCIDRs) > 0 {
+            return includeError("included token %s has restrictions of its own", include.Token)
+        }
+        if err := includeTokens(ctx, included, append(chain, include.Token)); err != nil {
+            return err
+        }
+        out.appendManifest(included, include.Folder)
+    }
+    manifest.Files = append(out.Files, manifest.Files[next:]...)
+    manifest.Includes = out.Includes
+    return nil
+}
+
+// appendManifest adds another manifest's files and the prefixes still to be
+// listed to this one's, under folder
+func (m *Manifest) appendManifest(other *Manifest, folder string) {
+    for _, include := range other.Includes {
+        include.At += len(m.Files)
+        include.Folder = path.Join(folder, include.Folder)
+        m.Includes = append(m.Includes, include)
+    }
+    for _, file := range other.Files {
+        m.Files = append(m.Files, rootFile(file, folder))
+    }
+}
+
+func includeError(format string, args ...interface{}) error {
+    return fmt.Errorf("%w: %w", errManifestInvalid, manifestErrors{fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "sync"
+
+    "codecourse/zipper/archive"
+)
+
+// How many HEAD requests to run at once when inspecting a manifest
+const headConcurrency = 8
+
+// fileStatus describes one manifest entry as found in S3
+type fileStatus struct {
+    FileName string `json:"fileName"`
+    Folder   string `json:"folder,omitempty"`
+    Path     string `json:"path"`
+    S3Path   string `json:"s3Path"`
+    Exists   bool   `json:"exists"`
+    Size     int64  `json:"size"`
+    Error    string `json:"error,omitempty"`
+}
+
+type validateResponse struct {
+    Valid     bool         `json:"valid"`
+    Files     []fileStatus `json:"files"`
+    Missing   int          `json:"missing"`
+    TotalSize int64        `json:"totalSize"`
+}
+
+// headFiles HEADs every entry in the manifest, a few at a time, and reports
+// what exists and how big it is. With trustSizes, entries whose size is in
+// the manifest are taken at their word instead. Null entries, which only
+// unversioned manifests can have, are left out, and it stops HEADing once
+// ctx is done.
+func headFiles(ctx context.Context, manifest *Manifest, trustSizes bool) []fileStatus {
+    var files []*RedisFile
+    for _, file := range manifest.Files {
+        if file != nil {
+            files = append(files, file)
+        }
+    }
+    source := tenantFor(manifest).archiver.Source
+    statuses := make([]fileStatus, len(files))
+    sem := make(chan struct{}, headConcurrency)
+    var wg sync.WaitGroup
+
+    for i, file := range files {
+        statuses[i] = fileStatus{
+            FileName: file.FileName,
+            Folder:   file.Folder,
+            Path:     archive.Path(file),
+            S3Path:   file.S3Path,
+        }
+
+        if file.S3Path == "" {
+            statuses[i].Error = "missing path"
+            continue
+        }
+
+        if trustSizes && file.Size > 0 {
+            statuses[i].Exists = true
+            statuses[i].Size = file.Size
+            continue
+        }
+
+        wg.Add(1)
+        sem <- struct{}{}
+        go func(status *fileStatus) {
+            defer wg.Done()
+            defer func() { <-sem }()
+
+            if err := ctx.Err(); err != nil {
+                status.Error = err.Error()
+                return
+            }
+            info, err := source.Stat(ctx, status.S3Path)
+            if err != nil {
+                status.Error = err.Error()
+                return
+            }
+
+            status.Exists = true
+            status.Size = info.Size
+        }(&statuses[i])
+    }
+
+    wg.Wait()
+    return statuses
+}
+
+// validateHandler resolves a token and checks every object exists without
+// streaming anything
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+    _, manifest, ok := authorizeDownload(w, r)
+    if !ok {
+        return
+    }
+
+    resp := validateResponse{Files: headFiles(r.Context(), manifest, false)}
+    for _, status := range resp.Files {
+        if status.Exists {
+            resp.TotalSize += status.Size
+        } else {
+            resp.Missing++
+        }
+    }
+    resp.Valid = resp.Missing == 0
+
+    writeJSON(w, 200, resp)
+}
+
+// writeJSON replies with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+    "compress/gzip"
+    "context"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "codecourse/zipper/archive"
+    "github.com/AdRoll/goamz/s3"
+)
+
+// Listing a prefix with millions of objects takes thousands of requests. A
+// bucket with an S3 Inventory can be read from that instead, with
+// S3_INVENTORY, or TENANT_<NAME>_S3_INVENTORY, pointing at its reports:
+//
+//	S3_INVENTORY=s3://<destination bucket>/<prefix>/<source bucket>/<inventory ID>
+//
+// Manifests opt in per entry, since the inventory is up to a day behind:
+//
+//	{"Type": "inventory", "S3Path": "photos/", "Folder": "photos"}
+//
+// takes every object under photos/ in the latest report, as a prefix entry
+// would, and an empty S3Path takes the whole bucket. Objects deleted since
+// are skipped as missing. Only CSV inventories can be read.
+
+// How long the latest report is used before looking for a newer one
+const inventoryRefresh = time.Hour
+
+// inventory reads the reports of one inventory configuration
+type inventory struct {
+    bucket *s3.Bucket
+    prefix string
+
+    lock    sync.Mutex
+    latest  *inventoryManifest
+    checked time.Time
+}
+
+// inventoryManifest is a report's manifest.json, the data files it's in
+type inventoryManifest struct {
+    FileFormat string `json:"fileFormat"`
+    FileSchema string `json:"fileSchema"`
+    Files      []struct {
+        Key string `json:"key"`
+    } `json:"files"`
+}
+
+var errNoInventory = errors.New("no S3 Inventory report has been delivered yet")
+
+// parseInventory splits S3_INVENTORY into the destination bucket and the
+// folder the reports are in
+func parseInventory(raw string) (bucket, prefix string, err error) {
+    u, err := url.Parse(raw)
+    if err != nil || u.Scheme != "s3" || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+        return "", "", fmt.Errorf("%q should be s3://<destination bucket>/<path to the inventory>", raw)
+    }
+    return u.Host, strings.Trim(u.Path, "/") + "/", nil
+}
+
+// newInventory reads S3_INVENTORY, reaching the destination bucket through
+// conn
+func newInventory(raw string, conn *s3.S3) (*inventory, error) {
+    bucket, prefix, err := parseInventory(raw)
+    if err != nil {
+        return nil, err
+    }
+    return &inventory{bucket: conn.Bucket(bucket), prefix: prefix}, nil
+}
+
+// List goes through the objects under prefix in the latest report. It's an
+// archive.Lister, though the keys don't come in order.
+func (inv *inventory) List(ctx context.Context, prefix string, fn func(ref string, info archive.Info) error) error {
+    manifest, err := inv.manifest()
+    if err != nil {
+        return err
+    }
+    if manifest.FileFormat != "CSV" {
+        return fmt.Errorf("the inventory is %s, only CSV inventories can be read", manifest.FileFormat)
+    }
+
+    columns := map[string]int{}
+    for i, name := range strings.Split(manifest.FileSchema, ",") {
+        columns[strings.TrimSpace(name)] = i
+    }
+    keyColumn, ok := columns["Key"]
+    if !ok {
+        return errors.New("the inventory has no Key column")
+    }
+
+    for _, file := range manifest.Files {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        if err := inv.readFile(file.Key, func(row []string) error {
+            if len(row) <= keyColumn {
+                return nil
+            }
+            // Only the current version of versioned buckets
+            if column("IsLatest", columns, row) == "false" || column("IsDeleteMarker", columns, row) == "true" {
+                return nil
+            }
+
+            key, err := url.QueryUnescape(row[keyColumn])
+            if err != nil || !strings.HasPrefix(key, prefix) {
+                return nil
+            }
+            info := archive.Info{}
+            info.Size, _ = strconv.ParseInt(column("Size", columns, row), 10, 64)
+            info.ModTime, _ = time.Parse(time.RFC3339, column("LastModifiedDate", columns, row))
+            return fn(key, info)
+        }); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func column(name string, columns map[string]int, row []string) string {
+    if i, ok := columns[name]; ok && i < len(row) {
+        return row[i]
+    }
+    return ""
+}
+
+// readFile calls fn with each row of a gzipped CSV data file
+func (inv *inventory) readFile(key string, fn func(row []string) error) error {
+    body, err := inv.bucket.GetReader(key)
+    if err != nil {
+        return fmt.Errorf("reading %s: %w", key, err)
+    }
+    defer body.Close()
+
+    gz, err := gzip.NewReader(body)
+    if err != nil {
+        return fmt.Errorf("reading %s: %w", key, err)
+    }
+    rows := csv.NewReader(gz)
+    rows.FieldsPerRecord = -1
+    rows.ReuseRecord = true
+    for {
+        row, err := rows.Read()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return fmt.Errorf("reading %s: %w", key, err)
+        }
+        if err := fn(row); err != nil {
+            return err
+        }
+    }
+}
+
+// manifest is the latest report's manifest, looked for again every
+// inventoryRefresh
+func (inv *inventory) manifest() (*inventoryManifest, error) {
+    inv.lock.Lock()
+    defer inv.lock.Unlock()
+    if inv.latest != nil && time.Since(inv.checked) < inventoryRefresh {
+        return inv.latest, nil
+    }
+
+    // Reports are in folders named for when they were made, like
+    // 2024-05-01T01-00Z/, which sort by time
+    var reports []string
+    marker := ""
+    for {
+        resp, err := inv.bucket.List(inv.prefix, "/", marker, 1000)
+        if err != nil {
+            return nil, fmt.Errorf("listing inventory reports: %w", err)
+        }
+        for _, folder := range resp.CommonPrefixes {
+            if strings.HasSuffix(folder, "Z/") {
+                reports = append(reports, folder)
+            }
+        }
+        if !resp.IsTruncated || len(resp.CommonPrefixes) == 0 {
+            break
+        }
+        marker = resp.CommonPrefixes[len(resp.CommonPrefixes)-1]
+    }
+    sort.Sort(sort.Reverse(sort.StringSlice(reports)))
+
+    // manifest.json is written last, so a report still being delivered
+    // doesn't have one
+    for _, report := range reports {
+        data, err := inv.bucket.Get(report + "manifest.json")
+        if e, ok := err.(*s3.Error); ok && e.StatusCode == 404 {
+            continue
+        }
+        if err != nil {
+            return nil, fmt.Errorf("reading %smanifest.json: %w", report, err)
+        }
+
+        manifest := &inventoryManifest{}
+        if err := json.Unmarshal(data, manifest); err != nil {
+            return nil, fmt.Errorf("reading %smanifest.json: %w", report, err)
+        }
+        inv.latest, inv.checked = manifest, time.Now()
+        return manifest, nil
+    }
+    return nil, errNoInventory
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/netip"
+    "strings"
+    "sync/atomic"
+)
+
+var (
+    errIPDenied     = errors.New("address is denied")
+    errIPNotAllowed = errors.New("address is not allowed")
+)
+
+// ipFilter is IP_ALLOW and IP_DENY parsed, swapped whole when they're
+// reloaded
+type ipFilter struct {
+    allow, deny []netip.Prefix
+}
+
+var globalIPFilter atomic.Pointer[ipFilter]
+
+func initIPFilter() {
+    loadIPFilter(config)
+}
+
+func loadIPFilter(c Configuration) {
+    globalIPFilter.Store(&ipFilter{
+        allow: parsePrefixes(strings.Split(c.IPAllow, ",")),
+        deny:  parsePrefixes(strings.Split(c.IPDeny, ",")),
+    })
+}
+
+// parsePrefixes parses configured CIDRs and bare addresses, skipping
+// anything invalid
+func parsePrefixes(values []string) (prefixes []netip.Prefix) {
+    for _, value := range values {
+        value = strings.TrimSpace(value)
+        if value == "" {
+            continue
+        }
+
+        prefix, err := parsePrefix(value)
+        if err != nil {
+            slog.Warn("Ignoring invalid CIDR", "value", value)
+            continue
+        }
+        prefixes = append(prefixes, prefix)
+    }
+    return
+}
+
+// parseManifestPrefixes parses a manifest's CIDRs. Unlike the configured
+// ones, a single invalid entry fails the lot, since dropping it could leave
+// an allow list empty and the download open to anyone.
+func parseManifestPrefixes(values []string) ([]netip.Prefix, error) {
+    prefixes := make([]netip.Prefix, 0, len(values))
+    for _, value := range values {
+        prefix, err := parsePrefix(strings.TrimSpace(value))
+        if err != nil {
+            return nil, fmt.Errorf("%w: the manifest's CIDR %q is invalid", errIPNotAllowed, value)
+        }
+        prefixes = append(prefixes, prefix)
+    }
+    return prefixes, nil
+}
+
+// parsePrefix parses a CIDR or a bare address
+func parsePrefix(value string) (netip.Prefix, error) {
+    if !strings.Contains(value, "/") {
+        addr, err := netip.ParseAddr(value)
+        if err != nil {
+            return netip.Prefix{}, err
+        }
+        return netip.PrefixFrom(addr, addr.BitLen()), nil
+    }
+
+    prefix, err := netip.ParsePrefix(value)
+    if err != nil {
+        return netip.Prefix{}, err
+    }
+    return prefix.Masked(), nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+    for _, prefix := range prefixes {
+        if prefix.Contains(addr) {
+            return true
+        }
+    }
+    return false
+}
+
+// checkIP applies deny then allow lists to an address. An empty allow list
+// allows everything that isn't denied.
+func checkIP(ip string, allow, deny []netip.Prefix) error {
+    if len(allow) == 0 && len(deny) == 0 {
+        return nil
+    }
+
+    addr, err := netip.ParseAddr(ip)
+    if err != nil {
+        return errIPNotAllowed
+    }
+    addr = addr.Unmap()
+
+    if containsAddr(deny, addr) {
+        return errIPDenied
+    }
+
+    if len(allow) > 0 && !containsAddr(allow, addr) {
+        return errIPNotAllowed
+    }
+
+    return nil
+}
+
+// checkGlobalIP enforces IP_ALLOW and IP_DENY
+func checkGlobalIP(ip string) error {
+    filter := globalIPFilter.Load()
+    return checkIP(ip, filter.allow, filter.deny)
+}
+
+// checkManifestIP enforces the manifest's own CIDR lists, refusing
+// everyone when they can't be read
+func checkManifestIP(ip string, manifest *Manifest) error {
+    allow, err := parseManifestPrefixes(manifest.AllowedCIDRs)
+    if err != nil {
+        return err
+    }
+    deny, err := parseManifestPrefixes(manifest.DeniedCIDRs)
+    if err != nil {
+        return err
+    }
+    return checkIP(ip, allow, deny)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+    "errors"
+    "net/netip"
+    "testing"
+)
+
+func TestParsePrefix(t *testing.T) {
+    tests := []struct {
+        value string
+        want  string
+    }{
+        {"192.0.2.1", "192.0.2.1/32"},
+        {"2001:db8::1", "2001:db8::1/128"},
+        {"192.0.2.0/24", "192.0.2.0/24"},
+        {"192.0.2.77/24", "192.0.2.0/24"},
+        {"2001:db8::1/32", "2001:db8::/32"},
+        {"192.0.2.0/33", ""},
+        {"192.0.2", ""},
+        {"example.com", ""},
+        {"", ""},
+    }
+    for _, test := range tests {
+        prefix, err := parsePrefix(test.value)
+        if test.want == "" {
+            if err == nil {
+                t.Errorf("parsePrefix(%q) = %v, want an error", test.value, prefix)
+            }
+            continue
+        }
+        if err != nil || prefix.String() != test.want {
+            t.Errorf("parsePrefix(%q) = %v, %v, want %s", test.value, prefix, err, test.want)
+        }
+    }
+}
+
+func TestCheckIP(t *testing.T) {
+    prefixes := func(values ...string) []netip.Prefix { return parsePrefixes(values) }
+
+    tests := []struct {
+        name        string
+        ip          string
+        allow, deny []netip.Prefix
+        want        error
+    }{
+        {"no lists", "192.0.2.1", nil, nil, nil},
+        {"no lists, bad address", "nonsense", nil, nil, nil},
+        {"allowed", "192.0.2.1", prefixes("192.0.2.0/24"), nil, nil},
+        {"outside the allow list", "198.51.100.1", prefixes("192.0.2.0/24"), nil, errIPNotAllowed},
+        {"allow list edge", "192.0.2.255", prefixes("192.0.2.0/24"), nil, nil},
+        {"just past the edge", "192.0.3.0", prefixes("192.0.2.0/24"), nil, errIPNotAllowed},
+        {"denied", "192.0.2.1", nil, prefixes("192.0.2.1"), errIPDenied},
+        {"not denied", "192.0.2.2", nil, prefixes("192.0.2.1"), nil},
+        {"deny beats allow", "192.0.2.1", prefixes("192.0.2.0/24"), prefixes("192.0.2.1"), errIPDenied},
+        {"IPv4 mapped address", "::ffff:192.0.2.1", prefixes("192.0.2.0/24"), nil, nil},
+        {"IPv6", "2001:db8::5", prefixes("2001:db8::/32"), nil, nil},
+        {"IPv6 outside an IPv4 list", "2001:db8::5", prefixes("192.0.2.0/24"), nil, errIPNotAllowed},
+        {"bad address", "nonsense", prefixes("192.0.2.0/24"), nil, errIPNotAllowed},
+    }
+    for _, test := range tests {
+        if err := checkIP(test.ip, test.allow, test.deny); !errors.Is(err, test.want) || (err == nil) != (test.want == nil) {
+            t.Errorf("%s: err = %v, want %v", test.name, err, test.want)
+        }
+    }
+}
+
+func TestCheckManifestIP(t *testing.T) {
+    tests := []struct {
+        name        string
+        allow, deny []string
+        want        error
+    }{
+        {"allowed", []string{"192.0.2.0/24"}, nil, nil},
+        {"not allowed", []string{"198.51.100.0/24"}, nil, errIPNotAllowed},
+        {"denied", nil, []string{" 192.0.2.1 "}, errIPDenied},
+        {"invalid allow entry", []string{"192.0.2.0/24", "nonsense"}, nil, errIPNotAllowed},
+        {"invalid deny entry", nil, []string{"nonsense"}, errIPNotAllowed},
+    }
+    for _, test := range tests {
+        manifest := &Manifest{AllowedCIDRs: test.allow, DeniedCIDRs: test.deny}
+        if err := checkManifestIP("192.0.2.1", manifest); !errors.Is(err, test.want) || (err == nil) != (test.want == nil) {
+            t.Errorf("%s: err = %v, want %v", test.name, err, test.want)
+        }
+    }
+}
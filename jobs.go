@@ -0,0 +1,440 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log/slog"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/AdRoll/goamz/s3"
+    goredis "github.com/redis/go-redis/v9"
+)
+
+// Job states
+const (
+    jobQueued    = "queued"
+    jobRunning   = "running"
+    jobUploading = "uploading"
+    jobDone      = "done"
+    jobFailed    = "failed"
+    jobCancelled = "cancelled"
+)
+
+// Archives larger than this are uploaded in parts
+const jobPartSize = 100 * 1024 * 1024
+
+var errJobNotFound = errors.New("job not found")
+
+// Job is an archive built in the background and uploaded to S3. Its state
+// lives in Redis so any replica can report on it.
+type Job struct {
+    ID            string    `json:"id"`
+    RequestID     string    `json:"requestId,omitempty"`
+    State         string    `json:"state"`
+    FilesTotal    int       `json:"filesTotal"`
+    FilesDone     int       `json:"filesDone"`
+    BytesStreamed int64     `json:"bytesStreamed"`
+    CurrentFile   string    `json:"currentFile,omitempty"`
+    LastError     string    `json:"lastError,omitempty"`
+    ResultURL     string    `json:"resultUrl,omitempty"`
+    Error         string    `json:"error,omitempty"`
+    Tenant        string    `json:"tenant,omitempty"`
+    CreatedAt     time.Time `json:"createdAt"`
+    UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+type queuedJob struct {
+    job      *Job
+    manifest *Manifest
+    name     string
+    store    bool
+
+    // Settles the job's tenant quota, see startTenantArchive
+    finishQuota func(bytes int64)
+}
+
+// runningJob is a job this replica is working on
+type runningJob struct {
+    job    *Job
+    cancel context.CancelFunc
+}
+
+var jobQueue chan *queuedJob
+
+// jobs tracks the jobs this replica is working on
+var jobs = struct {
+    sync.Mutex
+    running map[string]*runningJob
+}{running: map[string]*runningJob{}}
+
+func initJobs() {
+    jobQueue = make(chan *queuedJob, config.JobQueueSize)
+    for i := 0; i < config.JobWorkers; i++ {
+        go jobWorker()
+    }
+}
+
+func jobKey(id string) string {
+    return redisKey("job:" + id)
+}
+
+// jobFinished reports whether a job has reached a final state
+func jobFinished(job *Job) bool {
+    return job.State == jobDone || job.State == jobFailed || job.State == jobCancelled
+}
+
+// jobCancelKey is set when a job is cancelled so whichever replica is
+// running it notices
+func jobCancelKey(id string) string {
+    return redisKey("job:" + id + ":cancel")
+}
+
+func jobCancelRequested(id string) bool {
+    cancelled, _ := redisClient.Exists(context.Background(), jobCancelKey(id)).Result()
+    return cancelled > 0
+}
+
+// saveJob writes the job's current state to Redis
+func saveJob(job *Job) error {
+    job.UpdatedAt = time.Now().UTC()
+
+    data, err := json.Marshal(job)
+    if err != nil {
+        return err
+    }
+
+    // Not the job's context, the final state is saved after it's cancelled
+    return redisClient.Set(context.Background(), jobKey(job.ID), data, config.JobTTL).Err()
+}
+
+// loadJob reads a job's state from Redis
+func loadJob(ctx context.Context, id string) (*Job, error) {
+    data, err := redisClient.Get(ctx, jobKey(id)).Bytes()
+    if err == goredis.Nil {
+        return nil, errJobNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    job := &Job{}
+    return job, json.Unmarshal(data, job)
+}
+
+func jobWorker() {
+    for queued := range jobQueue {
+        runJob(queued)
+    }
+}
+
+// runJob builds the archive into a temporary file, then uploads it
+func runJob(queued *queuedJob) {
+    job := queued.job
+    defer func() { queued.finishQuota(job.BytesStreamed) }()
+
+    // Cancelled while it sat in the queue
+    if jobCancelRequested(job.ID) {
+        return
+    }
+
+    // Logs carry the ID of the request that queued the job
+    ctx, cancel := context.WithCancel(withRequestID(context.Background(), job.RequestID))
+    defer cancel()
+
+    ctx, span := startSpan(ctx, "job", spanKindInternal)
+    span.set("zipper.job_id", job.ID)
+    span.set("zipper.files", job.FilesTotal)
+    defer span.finish()
+
+    jobs.Lock()
+    jobs.running[job.ID] = &runningJob{job: job, cancel: cancel}
+    jobs.Unlock()
+
+    defer func() {
+        jobs.Lock()
+        delete(jobs.running, job.ID)
+        jobs.Unlock()
+    }()
+
+    fail := func(err error) {
+        span.fail(err)
+
+        // Cancellation has already recorded the job's final state
+        if ctx.Err() != nil {
+            slog.InfoContext(ctx, "Job cancelled", "job_id", job.ID)
+            archivesTotal.inc("job", "cancelled")
+            recordUsage(ctx, "job", job.ID, queued.manifest, "cancelled", job.BytesStreamed)
+            return
+        }
+
+        slog.ErrorContext(ctx, "Job failed", "job_id", job.ID, "error", err)
+        archivesTotal.inc("job", "failed")
+        recordUsage(ctx, "job", job.ID, queued.manifest, "failed", job.BytesStreamed)
+        recordError("Job " + job.ID + ": " + err.Error())
+        captureMessage("error", nil, "Job failed: "+err.Error(), map[string]interface{}{"job_id": job.ID})
+        job.State = jobFailed
+        job.Error = err.Error()
+        saveJob(job)
+        publishEvent(jobProgressKey(job.ID), jobEvent(job))
+    }
+
+    job.State = jobRunning
+    saveJob(job)
+
+    file, err := os.CreateTemp("", "zipper-job-*.zip")
+    if err != nil {
+        fail(err)
+        return
+    }
+    defer os.Remove(file.Name())
+    defer file.Close()
+
+    lastSave := time.Now()
+    err = writeArchive(ctx, file, queued.manifest, queued.store, func(update archiveUpdate) {
+        job.FilesDone = update.FilesDone
+        job.BytesStreamed = update.BytesWritten
+        job.CurrentFile = update.CurrentFile
+        if update.Error != "" {
+            job.LastError = update.CurrentFile + ": " + update.Error
+        }
+        publishProgress(jobProgressKey(job.ID), job.RequestID, job.FilesTotal, update)
+        if time.Since(lastSave) >= config.ProgressInterval {
+            // Another replica may have been asked to cancel us
+            if jobCancelRequested(job.ID) {
+                cancel()
+                return
+            }
+            saveJob(job)
+            lastSave = time.Now()
+        }
+    })
+    if err != nil {
+        fail(err)
+        return
+    }
+
+    job.State = jobUploading
+    saveJob(job)
+    publishEvent(jobProgressKey(job.ID), jobEvent(job))
+
+    key := jobResultKey(job.ID)
+    bucket := tenantFor(queued.manifest).bucket
+    if err := uploadFile(ctx, bucket, file, key, queued.name); err != nil {
+        if ctx.Err() == nil {
+            s3Errors.inc("put")
+        }
+        fail(err)
+        return
+    }
+
+    // Cancelled just as the upload finished
+    if jobCancelRequested(job.ID) {
+        bucket.Del(key)
+        return
+    }
+
+    job.State = jobDone
+    job.ResultURL = bucket.SignedURL(key, time.Now().Add(config.JobTTL))
+    saveJob(job)
+    archivesTotal.inc("job", "ok")
+    recordUsage(ctx, "job", job.ID, queued.manifest, "ok", job.BytesStreamed)
+    publishEvent(jobProgressKey(job.ID), jobEvent(job))
+}
+
+func jobResultKey(id string) string {
+    return config.JobPrefix + id + ".zip"
+}
+
+// contextFile fails reads once its context is cancelled, which is the only
+// way to interrupt an upload in progress
+type contextFile struct {
+    ctx  context.Context
+    file *os.File
+}
+
+func (f contextFile) Read(p []byte) (int, error) {
+    if err := f.ctx.Err(); err != nil {
+        return 0, err
+    }
+    return f.file.Read(p)
+}
+
+func (f contextFile) ReadAt(p []byte, off int64) (int, error) {
+    if err := f.ctx.Err(); err != nil {
+        return 0, err
+    }
+    return f.file.ReadAt(p, off)
+}
+
+func (f contextFile) Seek(offset int64, whence int) (int64, error) {
+    return f.file.Seek(offset, whence)
+}
+
+// tenantBucket is where a tenant's job results go
+func tenantBucket(name string) *s3.Bucket {
+    return tenantFor(&Manifest{Tenant: name}).bucket
+}
+
+// uploadFile puts the finished archive in S3, in parts when it's too big for
+// a single PUT
+func uploadFile(ctx context.Context, bucket *s3.Bucket, file *os.File, key, name string) error {
+    info, err := file.Stat()
+    if err != nil {
+        return err
+    }
+
+    if _, err := file.Seek(0, 0); err != nil {
+        return err
+    }
+
+    body := contextFile{ctx: ctx, file: file}
+    options := s3.Options{ContentDisposition: "attachment; filename=\"" + name + "\""}
+
+    if info.Size() <= jobPartSize {
+        return bucket.PutReader(key, body, info.Size(), "application/zip", s3.Private, options)
+    }
+
+    multi, err := bucket.InitMulti(key, "application/zip", s3.Private, options)
+    if err != nil {
+        return err
+    }
+
+    parts, err := multi.PutAll(body, jobPartSize)
+    if err != nil {
+        multi.Abort()
+        return err
+    }
+
+    return multi.Complete(parts)
+}
+
+// createJobHandler queues a background build of a token's archive
+func createJobHandler(w http.ResponseWriter, r *http.Request) {
+    if err := archiver.Authorize(r); err != nil {
+        writeProblem(w, r, 403, codeForbidden, err.Error())
+        return
+    }
+
+    _, manifest, ok := authorizeDownload(w, r)
+    if !ok {
+        return
+    }
+    store, err := storeRequested(r)
+    if err != nil {
+        writeProblem(w, r, 400, codeBadRequest, err.Error())
+        return
+    }
+    if refuseEmpty(w, r, manifest) {
+        return
+    }
+    if err := checkArchiveLimits(r.Context(), manifest); err != nil {
+        writeLimitProblem(w, r, err)
+        return
+    }
+
+    now := time.Now().UTC()
+    job := &Job{
+        ID:         newToken(),
+        RequestID:  requestID(r.Context()),
+        State:      jobQueued,
+        FilesTotal: len(manifest.Files),
+        CreatedAt:  now,
+        Tenant:     manifest.Tenant,
+    }
+
+    // Queued jobs count as building, so a tenant can't queue around the limit
+    finishQuota, err := startTenantArchive(r.Context(), manifest, job.ID)
+    if err != nil {
+        writeQuotaProblem(w, r, err)
+        return
+    }
+
+    if err := saveJob(job); err != nil {
+        finishQuota(0)
+        slog.ErrorContext(r.Context(), "Error saving job", "error", err)
+        writeProblem(w, r, 503, codeStorageUnreachable, "Could not create the job")
+        return
+    }
+
+    select {
+    case jobQueue <- &queuedJob{job: job, manifest: manifest, name: downloadName(r, manifest), store: store, finishQuota: finishQuota}:
+    default:
+        finishQuota(0)
+        job.State = jobFailed
+        job.Error = "job queue is full"
+        saveJob(job)
+        writeProblem(w, r, 503, codeJobQueueFull, "Too many jobs are queued, try again later")
+        return
+    }
+
+    w.Header().Set("Location", strings.TrimSuffix(config.BasePath, "/")+"/v1/jobs/"+job.ID)
+    writeJSON(w, 202, job)
+}
+
+// jobStatusHandler reports a job's state and progress
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+    job, err := loadJob(r.Context(), r.PathValue("id"))
+    if err == errJobNotFound {
+        writeProblem(w, r, 404, codeJobNotFound, "No job exists with this ID")
+        return
+    }
+    if err != nil {
+        slog.ErrorContext(r.Context(), "Error loading job", "error", err)
+        writeProblem(w, r, 503, codeStorageUnreachable, "Could not load the job")
+        return
+    }
+
+    writeJSON(w, 200, job)
+}
+
+// cancelJobHandler aborts a job, wherever it's running, and removes any
+// archive it has already uploaded
+func cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+    job, err := loadJob(r.Context(), r.PathValue("id"))
+    if err == errJobNotFound {
+        writeProblem(w, r, 404, codeJobNotFound, "No job exists with this ID")
+        return
+    }
+    if err != nil {
+        slog.ErrorContext(r.Context(), "Error loading job", "error", err)
+        writeProblem(w, r, 503, codeStorageUnreachable, "Could not load the job")
+        return
+    }
+
+    if job.State == jobCancelled || job.State == jobFailed {
+        writeJSON(w, 200, job)
+        return
+    }
+
+    if err := redisClient.Set(r.Context(), jobCancelKey(job.ID), 1, config.JobTTL).Err(); err != nil {
+        slog.ErrorContext(r.Context(), "Error cancelling job", "error", err)
+        writeProblem(w, r, 503, codeStorageUnreachable, "Could not cancel the job")
+        return
+    }
+
+    // Stop it straight away if it's running here, other replicas notice the
+    // cancel key on their next progress update
+    jobs.Lock()
+    if running, ok := jobs.running[job.ID]; ok {
+        running.cancel()
+    }
+    jobs.Unlock()
+
+    if job.State == jobDone {
+        if err := tenantBucket(job.Tenant).Del(jobResultKey(job.ID)); err != nil {
+            slog.ErrorContext(r.Context(), "Error deleting job result", "job_id", job.ID, "error", err)
+        }
+    }
+
+    job.State = jobCancelled
+    job.ResultURL = ""
+    saveJob(job)
+    publishEvent(jobProgressKey(job.ID), jobEvent(job))
+
+    writeJSON(w, 200, job)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/hmac"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "math/big"
+    "os"
+    "strings"
+    "time"
+)
+
+var (
+    errJWTMalformed = errors.New("malformed JWT")
+    errJWTAlgorithm = errors.New("unexpected JWT algorithm")
+    errJWTSignature = errors.New("invalid JWT signature")
+    errJWTExpired   = errors.New("JWT expired")
+    errJWTNotYet    = errors.New("JWT not valid yet")
+)
+
+// jwtPublicKey is the key used to verify asymmetric JWTs, loaded from
+// JWT_PUBLIC_KEY at startup
+var jwtPublicKey crypto.PublicKey
+
+type jwtHeader struct {
+    Alg string `json:"alg"`
+    Typ string `json:"typ"`
+}
+
+type jwtClaims struct {
+    ExpiresAt int64 `json:"exp"`
+    NotBefore int64 `json:"nbf"`
+}
+
+func initJWT() {
+    if config.JWTPublicKey == "" {
+        return
+    }
+
+    data, err := os.ReadFile(config.JWTPublicKey)
+    if err != nil {
+        panic(err)
+    }
+
+    block, _ := pem.Decode(data)
+    if block == nil {
+        panic("JWT_PUBLIC_KEY does not contain a PEM block")
+    }
+
+    jwtPublicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+    if err != nil {
+        panic(err)
+    }
+}
+
+// jwtEnabled reports whether self-contained JWT tokens are accepted
+func jwtEnabled() bool {
+    return secrets().JWTSecret != "" || jwtPublicKey != nil
+}
+
+// looksLikeJWT reports whether the token has the three-segment JWT shape
+func looksLikeJWT(token string) bool {
+    return strings.Count(token, ".") == 2
+}
+
+// getManifestFromJWT verifies a JWT and returns the manifest embedded in its claims
+func getManifestFromJWT(token string) (manifest *Manifest, err error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, errJWTMalformed
+    }
+
+    var header jwtHeader
+    if err = decodeJWTSegment(parts[0], &header); err != nil {
+        return nil, err
+    }
+
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, errJWTMalformed
+    }
+
+    if err = verifyJWTSignature(header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+        return nil, err
+    }
+
+    var claims jwtClaims
+    if err = decodeJWTSegment(parts[1], &claims); err != nil {
+        return nil, err
+    }
+
+    // The rest of the claims are the manifest itself
+    manifest = &Manifest{}
+    if err = decodeJWTSegment(parts[1], manifest); err != nil {
+        return nil, err
+    }
+    if err = checkManifest(manifest); err != nil {
+        return nil, err
+    }
+
+    now := time.Now().Unix()
+    if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+        return nil, errJWTExpired
+    }
+    if claims.NotBefore != 0 && now < claims.NotBefore {
+        return nil, errJWTNotYet
+    }
+
+    return manifest, nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+    data, err := base64.RawURLEncoding.DecodeString(segment)
+    if err != nil {
+        return errJWTMalformed
+    }
+
+    if err := json.Unmarshal(data, v); err != nil {
+        return errJWTMalformed
+    }
+
+    return nil
+}
+
+// verifyJWTSignature checks the signature using the algorithm implied by the
+// configured key, never the one the token asks for, so a token can't switch
+// an RSA deployment over to HMAC or "none".
+func verifyJWTSignature(alg, signed string, signature []byte) error {
+    if secret := secrets().JWTSecret; secret != "" {
+        if alg != "HS256" {
+            return errJWTAlgorithm
+        }
+        mac := hmac.New(sha256.New, []byte(secret))
+        mac.Write([]byte(signed))
+        if !hmac.Equal(signature, mac.Sum(nil)) {
+            return errJWTSignature
+        }
+        return nil
+    }
+
+    return verifyJWTSignatureWithKey(jwtPublicKey, alg, signed, signature)
+}
+
+// verifyJWTSignatureWithKey checks an asymmetric signature, requiring the
+// algorithm to match the key type
+func verifyJWTSignatureWithKey(publicKey crypto.PublicKey, alg, signed string, signature []byte) error {
+    switch key := publicKey.(type) {
+    case *rsa.PublicKey:
+        if alg != "RS256" {
+            return errJWTAlgorithm
+        }
+        digest := sha256.Sum256([]byte(signed))
+        if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+            return errJWTSignature
+        }
+    case *ecdsa.PublicKey:
+        if alg != "ES256" || len(signature) != 64 {
+            return errJWTAlgorithm
+        }
+        digest := sha256.Sum256([]byte(signed))
+        r := new(big.Int).SetBytes(signature[:32])
+        s := new(big.Int).SetBytes(signature[32:])
+        if !ecdsa.Verify(key, digest[:], r, s) {
+            return errJWTSignature
+        }
+    case ed25519.PublicKey:
+        if alg != "EdDSA" {
+            return errJWTAlgorithm
+        }
+        if !ed25519.Verify(key, []byte(signed), signature) {
+            return errJWTSignature
+        }
+    default:
+        return fmt.Errorf("unsupported JWT key type %T", publicKey)
+    }
+
+    return nil
+}
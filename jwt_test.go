@@ -0,0 +1,116 @@
+package main
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "errors"
+    "testing"
+)
+
+// hs256 is the HMAC-SHA256 of signed under the secret
+func hs256(secret []byte, signed string) []byte {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte(signed))
+    return mac.Sum(nil)
+}
+
+func TestVerifyJWTSignatureHMAC(t *testing.T) {
+    loadSecrets(Configuration{JWTSecret: "secret"})
+    t.Cleanup(func() { loadSecrets(Configuration{}) })
+
+    const signed = "header.payload"
+    tests := []struct {
+        name      string
+        alg       string
+        signature []byte
+        want      error
+    }{
+        {"valid", "HS256", hs256([]byte("secret"), signed), nil},
+        {"another secret", "HS256", hs256([]byte("other"), signed), errJWTSignature},
+        {"tampered", "HS256", hs256([]byte("secret"), signed+"x"), errJWTSignature},
+        {"no signature", "HS256", nil, errJWTSignature},
+        {"none", "none", nil, errJWTAlgorithm},
+        {"HS512", "HS512", hs256([]byte("secret"), signed), errJWTAlgorithm},
+        {"RS256", "RS256", hs256([]byte("secret"), signed), errJWTAlgorithm},
+        {"lower case", "hs256", hs256([]byte("secret"), signed), errJWTAlgorithm},
+    }
+    for _, test := range tests {
+        if err := verifyJWTSignature(test.alg, signed, test.signature); !errors.Is(err, test.want) || (err == nil) != (test.want == nil) {
+            t.Errorf("%s: err = %v, want %v", test.name, err, test.want)
+        }
+    }
+}
+
+func TestVerifyJWTSignatureWithKey(t *testing.T) {
+    const signed = "header.payload"
+    digest := sha256.Sum256([]byte(signed))
+
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rsaSignature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+    if err != nil {
+        t.Fatal(err)
+    }
+    rsaDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+    if err != nil {
+        t.Fatal(err)
+    }
+    ecSignature := make([]byte, 64)
+    r.FillBytes(ecSignature[:32])
+    s.FillBytes(ecSignature[32:])
+
+    edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    edSignature := ed25519.Sign(edPrivate, []byte(signed))
+
+    tests := []struct {
+        name      string
+        key       crypto.PublicKey
+        alg       string
+        signature []byte
+        want      error
+    }{
+        {"RS256", &rsaKey.PublicKey, "RS256", rsaSignature, nil},
+        {"RS256 tampered", &rsaKey.PublicKey, "RS256", append([]byte{rsaSignature[0] ^ 1}, rsaSignature[1:]...), errJWTSignature},
+        // The public key is no secret, so HMAC with it must not pass
+        {"RSA key with HS256", &rsaKey.PublicKey, "HS256", hs256(rsaDER, signed), errJWTAlgorithm},
+        {"RSA key with none", &rsaKey.PublicKey, "none", nil, errJWTAlgorithm},
+        {"RSA key with PS256", &rsaKey.PublicKey, "PS256", rsaSignature, errJWTAlgorithm},
+        {"ES256", &ecKey.PublicKey, "ES256", ecSignature, nil},
+        {"ES256 tampered", &ecKey.PublicKey, "ES256", append([]byte{ecSignature[0] ^ 1}, ecSignature[1:]...), errJWTSignature},
+        {"ES256 short", &ecKey.PublicKey, "ES256", ecSignature[:63], errJWTAlgorithm},
+        {"EC key with RS256", &ecKey.PublicKey, "RS256", ecSignature, errJWTAlgorithm},
+        {"EdDSA", edPublic, "EdDSA", edSignature, nil},
+        {"EdDSA tampered", edPublic, "EdDSA", append([]byte{edSignature[0] ^ 1}, edSignature[1:]...), errJWTSignature},
+        {"Ed25519 key with ES256", edPublic, "ES256", edSignature, errJWTAlgorithm},
+    }
+    for _, test := range tests {
+        if err := verifyJWTSignatureWithKey(test.key, test.alg, signed, test.signature); !errors.Is(err, test.want) || (err == nil) != (test.want == nil) {
+            t.Errorf("%s: err = %v, want %v", test.name, err, test.want)
+        }
+    }
+
+    if err := verifyJWTSignatureWithKey(nil, "none", signed, nil); err == nil {
+        t.Errorf("no key: err = nil, want the token refused")
+    }
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+)
+
+// An archive that would take hours to stream only to be too big for anyone
+// to use is refused before it starts, with MAX_ARCHIVE_FILES files or
+// MAX_ARCHIVE_BYTES of files in it. Sizes come from the manifest, and files
+// without one are HEADed unless PREFLIGHT_HEAD is off, when they count as
+// nothing. Estimates and listings aren't limited, so callers can see why.
+//
+// An archive with no files in it is refused too, unless EMPTY_ARCHIVE_STATUS
+// is 200, since an empty zip looks like the client's fault. That's checked
+// before it starts, and again once every file has failed, as long as nothing
+// has been sent.
+
+var errArchiveTooLarge = errors.New("the archive is too large")
+
+// checkArchiveLimits says why the manifest's archive is too large, if it is
+func checkArchiveLimits(ctx context.Context, manifest *Manifest) error {
+    files := 0
+    var unsized []*RedisFile
+    for _, file := range manifest.Files {
+        if file == nil {
+            continue
+        }
+        files++
+        if file.Size <= 0 {
+            unsized = append(unsized, file)
+        }
+    }
+
+    if config.MaxArchiveFiles > 0 && files > config.MaxArchiveFiles {
+        return fmt.Errorf("%w: it would have %d files, more than the %d allowed", errArchiveTooLarge, files, config.MaxArchiveFiles)
+    }
+    if config.MaxArchiveBytes <= 0 {
+        return nil
+    }
+
+    // Only the files the manifest doesn't size are HEADed, and only when the
+    // rest aren't over already
+    size := manifestSize(manifest)
+    if len(unsized) > 0 && config.PreflightHead && size <= config.MaxArchiveBytes {
+        for _, status := range headFiles(ctx, &Manifest{Tenant: manifest.Tenant, Files: unsized}, false) {
+            size += status.Size
+        }
+    }
+    if size > config.MaxArchiveBytes {
+        return fmt.Errorf("%w: its files add up to %d bytes, more than the %d allowed", errArchiveTooLarge, size, config.MaxArchiveBytes)
+    }
+    return nil
+}
+
+// emptyManifest reports whether the manifest has no files that could be
+// added
+func emptyManifest(manifest *Manifest) bool {
+    for _, file := range manifest.Files {
+        if file != nil && file.S3Path != "" {
+            return false
+        }
+    }
+    return true
+}
+
+// refuseEmpty answers a download of an empty manifest as
+// EMPTY_ARCHIVE_STATUS says, reporting whether it did
+func refuseEmpty(w http.ResponseWriter, r *http.Request, manifest *Manifest) bool {
+    if config.EmptyArchiveStatus == 200 || !emptyManifest(manifest) {
+        return false
+    }
+    writeProblem(w, r, config.EmptyArchiveStatus, codeArchiveEmpty, "The manifest has no files to archive")
+    return true
+}
+
+// writeLimitProblem answers a checkArchiveLimits refusal
+func writeLimitProblem(w http.ResponseWriter, r *http.Request, err error) {
+    writeProblem(w, r, 422, codeArchiveTooLarge, err.Error())
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+    "net/http"
+
+    "codecourse/zipper/archive"
+)
+
+type listResponse struct {
+    Count int          `json:"count"`
+    Files []fileStatus `json:"files"`
+}
+
+// listHandler returns what's in a token's archive. Sizes come from the
+// manifest where present and S3 otherwise, unless ?sizes=false.
+func listHandler(w http.ResponseWriter, r *http.Request) {
+    _, manifest, ok := authorizeDownload(w, r)
+    if !ok {
+        return
+    }
+
+    var files []fileStatus
+    if r.URL.Query().Get("sizes") == "false" {
+        for _, file := range manifest.Files {
+            if file == nil {
+                continue
+            }
+            files = append(files, fileStatus{
+                FileName: file.FileName,
+                Folder:   file.Folder,
+                Path:     archive.Path(file),
+                S3Path:   file.S3Path,
+                Exists:   file.S3Path != "",
+                Size:     file.Size,
+            })
+        }
+    } else {
+        files = headFiles(r.Context(), manifest, true)
+    }
+
+    writeJSON(w, 200, listResponse{Count: len(files), Files: files})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "time"
+)
+
+// isLockedOut reports whether the address is serving a ban for guessing tokens
+func isLockedOut(ctx context.Context, ip string) bool {
+    if config.LockoutThreshold <= 0 {
+        return false
+    }
+
+    banned, err := redisClient.Exists(ctx, redisKey("lockout:banned:"+ip)).Result()
+    if err != nil {
+        slog.WarnContext(ctx, "Lockout check unavailable", "error", err)
+        return false
+    }
+
+    return banned > 0
+}
+
+// recordFailedLookup counts an unknown or invalid token against the address
+// and bans it once LOCKOUT_THRESHOLD failures land within LOCKOUT_WINDOW
+func recordFailedLookup(ctx context.Context, ip string) {
+    if config.LockoutThreshold <= 0 {
+        return
+    }
+
+    key := redisKey("lockout:failures:" + ip)
+
+    failures, err := redisClient.Incr(ctx, key).Result()
+    if err != nil {
+        slog.ErrorContext(ctx, "Error recording failed lookup", "error", err)
+        return
+    }
+
+    // The window starts at the first failure
+    if failures == 1 {
+        redisClient.Expire(ctx, key, time.Duration(config.LockoutWindow)*time.Second)
+    }
+
+    if failures < int64(config.LockoutThreshold) {
+        return
+    }
+
+    slog.WarnContext(ctx, "Locking out address", "ip", ip, "failures", failures)
+
+    if err := redisClient.Set(ctx, redisKey("lockout:banned:"+ip), failures, time.Duration(config.LockoutDuration)*time.Second).Err(); err != nil {
+        slog.ErrorContext(ctx, "Error locking out address", "ip", ip, "error", err)
+        return
+    }
+
+    redisClient.Del(ctx, key)
+}
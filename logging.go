@@ -0,0 +1,64 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "os"
+    "strings"
+)
+
+// initLogging sets up the default slog logger from LOG_FORMAT (text or json)
+// and LOG_LEVEL (debug, info, warn or error). Anything logged through the
+// log package, like vendored code, ends up there at info level.
+func initLogging() {
+    loadLogLevel(config)
+
+    options := &slog.HandlerOptions{Level: &logLevel}
+
+    var handler slog.Handler
+    if strings.EqualFold(config.LogFormat, "json") {
+        handler = slog.NewJSONHandler(os.Stderr, options)
+    } else {
+        handler = slog.NewTextHandler(os.Stderr, options)
+    }
+
+    slog.SetDefault(slog.New(requestIDHandler{newSampleHandler(handler)}))
+}
+
+// logLevel can change while serving, when the configuration is reloaded
+var logLevel slog.LevelVar
+
+func loadLogLevel(c Configuration) {
+    var level slog.Level
+    if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+        level = slog.LevelInfo
+    }
+    logLevel.Set(level)
+}
+
+// requestIDHandler adds the request ID to everything logged with a request's
+// context
+type requestIDHandler struct {
+    slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+    if id := requestID(ctx); id != "" {
+        record.AddAttrs(slog.String("request_id", id))
+    }
+    return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+    return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal logs err and exits
+func fatal(msg string, err error) {
+    slog.Error(msg, "error", err)
+    os.Exit(1)
+}
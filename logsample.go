@@ -0,0 +1,138 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "sync"
+    "time"
+)
+
+// Warnings and errors repeat in bursts, a bad manifest can produce thousands
+// of identical "File not found" lines. Only the first LOG_SAMPLE_BURST of
+// each message are logged per LOG_SAMPLE_WINDOW, the rest are counted and
+// reported in a single line when the window ends.
+
+type logSample struct {
+    level      slog.Level
+    message    string
+    windowEnd  time.Time
+    logged     int
+    suppressed int
+}
+
+type logSampler struct {
+    mu      sync.Mutex
+    samples map[string]*logSample
+}
+
+// sampleHandler applies the sampler to warnings and errors, everything
+// quieter is passed straight through
+type sampleHandler struct {
+    slog.Handler
+    sampler *logSampler
+}
+
+func newSampleHandler(handler slog.Handler) slog.Handler {
+    if config.LogSampleBurst <= 0 || config.LogSampleWindow <= 0 {
+        return handler
+    }
+
+    sampler := &logSampler{samples: map[string]*logSample{}}
+    go sampler.flush(handler)
+
+    return sampleHandler{Handler: handler, sampler: sampler}
+}
+
+func (h sampleHandler) Handle(ctx context.Context, record slog.Record) error {
+    if record.Level < slog.LevelWarn {
+        return h.Handler.Handle(ctx, record)
+    }
+
+    allowed, summary := h.sampler.allow(record)
+    if summary != nil {
+        h.Handler.Handle(ctx, *summary)
+    }
+    if !allowed {
+        logLinesSuppressed.inc()
+        return nil
+    }
+    return h.Handler.Handle(ctx, record)
+}
+
+func (h sampleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return sampleHandler{Handler: h.Handler.WithAttrs(attrs), sampler: h.sampler}
+}
+
+func (h sampleHandler) WithGroup(name string) slog.Handler {
+    return sampleHandler{Handler: h.Handler.WithGroup(name), sampler: h.sampler}
+}
+
+// allow reports whether a record is still within its message's burst.
+// Messages are compared without their attributes, which is what varies
+// between otherwise identical lines. When the record starts a new window,
+// the summary of the last one comes back with it.
+func (s *logSampler) allow(record slog.Record) (allowed bool, summary *slog.Record) {
+    key := record.Level.String() + " " + record.Message
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    sample := s.samples[key]
+    if sample == nil || record.Time.After(sample.windowEnd) {
+        if sample != nil {
+            summary = sample.summary(record.Time)
+        }
+        s.samples[key] = &logSample{level: record.Level, message: record.Message, windowEnd: record.Time.Add(config.LogSampleWindow), logged: 1}
+        return true, summary
+    }
+
+    if sample.logged < config.LogSampleBurst {
+        sample.logged++
+        return true, nil
+    }
+
+    sample.suppressed++
+    return false, nil
+}
+
+// summary describes the lines dropped during the sample's window, if any
+func (sample *logSample) summary(now time.Time) *slog.Record {
+    if sample.suppressed == 0 {
+        return nil
+    }
+
+    summary := slog.NewRecord(now, sample.level, "Suppressed repeated log lines", 0)
+    summary.AddAttrs(
+        slog.String("message", sample.message),
+        slog.Int("count", sample.suppressed),
+        slog.Duration("window", config.LogSampleWindow),
+    )
+    return &summary
+}
+
+// flush reports on messages whose window ended without them coming up
+// again, and forgets them so they start a new burst
+func (s *logSampler) flush(handler slog.Handler) {
+    ticker := time.NewTicker(config.LogSampleWindow / 2)
+    defer ticker.Stop()
+
+    for now := range ticker.C {
+        var summaries []slog.Record
+
+        s.mu.Lock()
+        for key, sample := range s.samples {
+            if now.Before(sample.windowEnd) {
+                continue
+            }
+            if summary := sample.summary(now); summary != nil {
+                summaries = append(summaries, *summary)
+            }
+            delete(s.samples, key)
+        }
+        s.mu.Unlock()
+
+        for _, summary := range summaries {
+            handler.Handle(context.Background(), summary)
+        }
+    }
+}
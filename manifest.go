@@ -0,0 +1,314 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "regexp"
+    "strings"
+)
+
+// Redis tokens are UUIDs unless TOKEN_PATTERN says otherwise
+const defaultTokenPattern = `^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`
+
+var tokenPattern *regexp.Regexp
+
+func initTokenPattern() {
+    tokenPattern = regexp.MustCompile(config.TokenPattern)
+}
+
+// validToken reports whether a token is worth looking up. Self-contained
+// tokens are checked cryptographically instead.
+func validToken(token string) bool {
+    if looksLikePASETO(token) || (jwtEnabled() && looksLikeJWT(token)) {
+        return true
+    }
+    return tokenPattern.MatchString(token)
+}
+
+var (
+    errTokenNotFound    = errors.New("token not found")
+    errTokenInvalid     = errors.New("token invalid")
+    errManifestInvalid  = errors.New("manifest invalid")
+    errStoreUnavailable = errors.New("token store unavailable")
+)
+
+// Manifest is what a token resolves to: the files to put in the archive and
+// any restrictions on who may download them
+type Manifest struct {
+    // Zero for the original loosely checked manifests, see checkManifest
+    Version int
+
+    Files []*RedisFile
+
+    // OIDC subjects allowed to download the archive, empty for anyone
+    AllowedSubjects []string
+
+    // CIDRs the archive may or may not be downloaded from
+    AllowedCIDRs []string
+    DeniedCIDRs  []string
+
+    // Which of TENANTS' buckets the files are in, empty for S3_BUCKET
+    Tenant string
+
+    // Who made the token, for usage accounting
+    Owner string
+
+    // What the archive is called, overriding ?as=, see archivename.go
+    ArchiveName string
+
+    // The prefix archives uploaded to /v1/extract go under, see extract.go
+    ExtractTo string
+
+    // Tokens and prefixes whose files go in too, until getManifest and
+    // listPrefixes replace them with the files, see include.go
+    Includes []manifestInclude `json:"-"`
+}
+
+// UnmarshalJSON accepts both the original bare list of files and a full
+// manifest object
+func (m *Manifest) UnmarshalJSON(data []byte) error {
+    var entries []*manifestEntry
+    data = bytes.TrimSpace(data)
+    if len(data) > 0 && data[0] == '[' {
+        if err := json.Unmarshal(data, &entries); err != nil {
+            return err
+        }
+    } else {
+        type manifest Manifest
+        decoded := struct {
+            *manifest
+            Files []*manifestEntry
+        }{manifest: (*manifest)(m)}
+        if err := json.Unmarshal(data, &decoded); err != nil {
+            return err
+        }
+        entries = decoded.Files
+    }
+
+    m.Files, m.Includes = nil, nil
+    for _, entry := range entries {
+        if err := m.addEntry(entry); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Stored manifests are JSON unless their first byte, which JSON can't start
+// with, says otherwise. Producers with millions of files save a lot of
+// encoding and decoding with either.
+const (
+    manifestProtobuf    = 0x01 // a Manifest message from proto/zipper.proto
+    manifestMessagePack = 0x02 // the same shape as the JSON
+)
+
+// decodeManifest reads a stored manifest in whichever encoding it's in.
+// Versioned manifests can't have fields this build doesn't know about, and
+// have to pass checkManifest.
+func decodeManifest(r io.Reader, manifest *Manifest) error {
+    buffered := bufio.NewReader(r)
+    first, _ := buffered.Peek(1)
+
+    var err error
+    if len(first) > 0 && (first[0] == manifestProtobuf || first[0] == manifestMessagePack) {
+        var data []byte
+        if data, err = io.ReadAll(buffered); err != nil {
+            return err
+        }
+        if data[0] == manifestProtobuf {
+            err = unmarshalProtoManifest(data[1:], manifest)
+        } else {
+            err = decodeMsgpackManifest(data[1:], manifest)
+        }
+    } else {
+        err = decodeJSONManifest(buffered, manifest)
+    }
+    if err != nil {
+        return err
+    }
+    return checkManifest(manifest)
+}
+
+// decodeJSONManifest reads a JSON manifest a token at a time, so a chunked,
+// list or hash manifest is never in memory as text and as files at once.
+// That's all it bounds: every file is still decoded before the archive
+// starts, since authorizing, limits and includes need the whole list, a
+// plain string manifest comes in with one GET, and protobuf and MessagePack
+// are read whole. Unknown fields are noted as they go by, they're only a
+// problem once the manifest turns out to have a version, which can come
+// last.
+func decodeJSONManifest(r io.Reader, manifest *Manifest) error {
+    decoder := json.NewDecoder(r)
+    decoder.DisallowUnknownFields()
+    var unknown manifestErrors
+
+    start, err := decoder.Token()
+    if err != nil {
+        return err
+    }
+    switch start {
+    case nil:
+        // null, an empty manifest
+    case json.Delim('['):
+        if err = decodeJSONFiles(decoder, manifest, &unknown); err != nil {
+            return err
+        }
+    case json.Delim('{'):
+        for decoder.More() {
+            key, err := decoder.Token()
+            if err != nil {
+                return err
+            }
+
+            name, _ := key.(string)
+            switch strings.ToLower(name) {
+            case "version":
+                err = decoder.Decode(&manifest.Version)
+            case "files":
+                var start json.Token
+                if start, err = decoder.Token(); err == nil && start != nil {
+                    if start != json.Delim('[') {
+                        return errors.New("Files isn't a list")
+                    }
+                    err = decodeJSONFiles(decoder, manifest, &unknown)
+                }
+            case "allowedsubjects":
+                err = decoder.Decode(&manifest.AllowedSubjects)
+            case "allowedcidrs":
+                err = decoder.Decode(&manifest.AllowedCIDRs)
+            case "deniedcidrs":
+                err = decoder.Decode(&manifest.DeniedCIDRs)
+            case "tenant":
+                err = decoder.Decode(&manifest.Tenant)
+            case "owner":
+                err = decoder.Decode(&manifest.Owner)
+            case "archivename":
+                err = decoder.Decode(&manifest.ArchiveName)
+            case "extractto":
+                err = decoder.Decode(&manifest.ExtractTo)
+            default:
+                unknown = append(unknown, fmt.Sprintf("unknown field %q", name))
+                var skipped json.RawMessage
+                err = decoder.Decode(&skipped)
+            }
+            if err != nil {
+                return err
+            }
+        }
+        if _, err := decoder.Token(); err != nil {
+            return err
+        }
+    default:
+        return errors.New("a manifest should be a list of files or an object")
+    }
+
+    if _, err := decoder.Token(); err != io.EOF {
+        return errors.New("trailing data after the manifest")
+    }
+    if manifest.Version != 0 && len(unknown) > 0 {
+        return unknown
+    }
+    return nil
+}
+
+// decodeJSONFiles reads the entries of a list whose [ has been read into
+// the manifest, one at a time
+func decodeJSONFiles(decoder *json.Decoder, manifest *Manifest, unknown *manifestErrors) error {
+    for i := 0; decoder.More(); i++ {
+        var entry *manifestEntry
+        if err := decoder.Decode(&entry); err != nil {
+            // The rest of the entry is still read after an unknown field
+            if !strings.HasPrefix(err.Error(), "json: unknown field ") {
+                return err
+            }
+            *unknown = append(*unknown, fmt.Sprintf("files[%d]: %s", i, strings.TrimPrefix(err.Error(), "json: ")))
+        }
+        if err := manifest.addEntry(entry); err != nil {
+            return err
+        }
+    }
+
+    _, err := decoder.Token()
+    return err
+}
+
+// getManifest resolves the manifest for a token, with the files of any
+// tokens it includes
+func getManifest(ctx context.Context, token string) (*Manifest, error) {
+    manifest, err := loadManifest(ctx, token)
+    if err != nil {
+        return nil, err
+    }
+    if err := includeTokens(ctx, manifest, []string{token}); err != nil {
+        return nil, err
+    }
+    return manifest, nil
+}
+
+// loadManifest reads the manifest for a token, either from the token itself
+// when it is a PASETO or JWT or from the token store
+func loadManifest(ctx context.Context, token string) (manifest *Manifest, err error) {
+    // Self-contained tokens are there to download without Redis, so they're
+    // let through when it can't say whether they've been revoked
+    selfContained := looksLikePASETO(token) || jwtEnabled() && looksLikeJWT(token)
+    revoked, err := tokenRevoked(ctx, token)
+    if err != nil && !selfContained {
+        return nil, fmt.Errorf("%w: %w", errStoreUnavailable, err)
+    }
+    if err != nil {
+        slog.WarnContext(ctx, "Revocation check unavailable", "error", err)
+    }
+    if revoked {
+        return nil, errTokenRevoked
+    }
+
+    if looksLikePASETO(token) {
+        manifest, err = getManifestFromPASETO(token)
+        if err != nil {
+            slog.InfoContext(ctx, "Rejected PASETO token", "error", err)
+            err = fmt.Errorf("%w: %w", errTokenInvalid, err)
+        }
+        return
+    }
+
+    if jwtEnabled() && looksLikeJWT(token) {
+        manifest, err = getManifestFromJWT(token)
+        if err != nil {
+            slog.InfoContext(ctx, "Rejected JWT", "error", err)
+            err = fmt.Errorf("%w: %w", errTokenInvalid, err)
+        }
+        return
+    }
+
+    return getManifestFromStore(ctx, token)
+}
+
+func getManifestFromStore(ctx context.Context, token string) (manifest *Manifest, err error) {
+    manifest = &Manifest{}
+
+    data, err := openManifest(ctx, token)
+    if errors.Is(err, errTokenNotFound) || errors.Is(err, errManifestInvalid) {
+        return nil, err
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%w: %w", errStoreUnavailable, err)
+    }
+    defer data.Close()
+
+    // Stores reading a manifest in pieces fail with their own errors
+    err = decodeManifest(data, manifest)
+    if errors.Is(err, errManifestInvalid) || errors.Is(err, errStoreUnavailable) {
+        return nil, err
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%w: %w", errManifestInvalid, err)
+    }
+
+    return
+}
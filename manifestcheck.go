@@ -0,0 +1,174 @@
+package main
+
+import (
+    "fmt"
+    "path"
+    "strings"
+)
+
+// The newest manifest version this build understands. Manifests without a
+// version are read as leniently as they always were; versioned ones are
+// checked strictly, so a producer bug fails the download loudly instead of
+// building an archive with half the files missing or misplaced.
+const manifestVersion = 1
+
+// Zip entry names can't be longer than this
+const maxManifestPath = 65535
+
+// How many problems are spelled out before the rest are just counted
+const maxManifestErrors = 10
+
+// manifestErrors are everything wrong with a manifest, each prefixed by
+// where it is, like files[3].FileName
+type manifestErrors []string
+
+func (e manifestErrors) Error() string {
+    if len(e) <= maxManifestErrors {
+        return strings.Join(e, "; ")
+    }
+    return fmt.Sprintf("%s; and %d more", strings.Join(e[:maxManifestErrors], "; "), len(e)-maxManifestErrors)
+}
+
+// checkManifest validates a versioned manifest, passing unversioned ones.
+// Files with globs are moved to the includes first, as they aren't files.
+func checkManifest(m *Manifest) error {
+    if m.Version == 0 {
+        return nil
+    }
+    if m.Version < 0 || m.Version > manifestVersion {
+        return manifestErrors{fmt.Sprintf("Version %d isn't supported, %d is the newest", m.Version, manifestVersion)}
+    }
+    m.collectGlobs()
+    problems, _ := checkManifestFiles(m.Files, m.Includes, m.AllowedCIDRs, m.DeniedCIDRs).(manifestErrors)
+
+    // Tokens that are only for extracting to don't need files
+    if len(m.Files) == 0 && len(m.Includes) == 0 && m.ExtractTo == "" {
+        problems = append(manifestErrors{"Files is empty"}, problems...)
+    }
+    if reason := archiveNameProblem(m.ArchiveName); reason != "" {
+        problems = append(problems, fmt.Sprintf("ArchiveName %q %s", m.ArchiveName, reason))
+    }
+    if m.ExtractTo != "" {
+        if reason := folderProblem(m.ExtractTo); reason != "" {
+            problems = append(problems, fmt.Sprintf("ExtractTo %q %s", m.ExtractTo, reason))
+        }
+    }
+
+    if len(problems) > 0 {
+        return problems
+    }
+    return nil
+}
+
+// checkManifestFiles reports everything wrong with a list of files, tokens
+// included and restrictions at once, though not an empty list. It's also
+// used on files posted to /tokens, which are stored unversioned.
+func checkManifestFiles(files []*RedisFile, includes []manifestInclude, allowed, denied []string) error {
+    var problems manifestErrors
+    problem := func(format string, args ...interface{}) {
+        problems = append(problems, fmt.Sprintf(format, args...))
+    }
+    for i, include := range includes {
+        // Where it was in the list, with the files and includes before it
+        at := fmt.Sprintf("files[%d]", include.At+i)
+        if include.Token != "" && !validToken(include.Token) {
+            problem("%s.Token %q isn't a token", at, include.Token)
+        }
+        if _, err := path.Match(include.Glob, ""); err != nil {
+            problem("%s.S3Path %q isn't a valid pattern", at, include.Glob)
+        }
+        if include.Folder != "" {
+            if reason := folderProblem(include.Folder); reason != "" {
+                problem("%s.Folder %q %s", at, include.Folder, reason)
+            }
+        }
+    }
+
+    included := 0
+    for i, file := range files {
+        for included < len(includes) && includes[included].At <= i {
+            included++
+        }
+        at := fmt.Sprintf("files[%d]", i+included)
+        if file == nil {
+            problem("%s is null", at)
+            continue
+        }
+
+        switch {
+        case file.FileName == "":
+            problem("%s.FileName is required", at)
+        case file.FileName == "." || file.FileName == "..":
+            problem("%s.FileName %q isn't a file name", at, file.FileName)
+        case strings.ContainsAny(file.FileName, `/\`):
+            problem("%s.FileName %q can't contain a slash, use Folder", at, file.FileName)
+        case hasControlChars(file.FileName):
+            problem("%s.FileName %q has control characters", at, file.FileName)
+        }
+
+        if file.Folder != "" {
+            if reason := folderProblem(file.Folder); reason != "" {
+                problem("%s.Folder %q %s", at, file.Folder, reason)
+            }
+        }
+        if len(file.Folder)+1+len(file.FileName) > maxManifestPath {
+            problem("%s path is longer than %d bytes", at, maxManifestPath)
+        }
+
+        if file.S3Path == "" {
+            problem("%s.S3Path is required", at)
+        }
+        if file.Size < 0 {
+            problem("%s.Size can't be negative", at)
+        }
+    }
+
+    for _, list := range []struct {
+        name   string
+        values []string
+    }{{"AllowedCIDRs", allowed}, {"DeniedCIDRs", denied}} {
+        for i, value := range list.values {
+            if !validCIDR(strings.TrimSpace(value)) {
+                problem("%s[%d] %q isn't an address or CIDR", list.name, i, value)
+            }
+        }
+    }
+
+    if len(problems) > 0 {
+        return problems
+    }
+    return nil
+}
+
+// folderProblem is what's wrong with a folder, if anything, so it can't
+// climb out of the archive
+func folderProblem(folder string) string {
+    folder = strings.TrimSuffix(folder, "/")
+    switch {
+    case strings.HasPrefix(folder, "/") || strings.Contains(folder, `\`):
+        return "should be a relative path with forward slashes"
+    case hasControlChars(folder):
+        return "has control characters"
+    }
+    for _, segment := range strings.Split(folder, "/") {
+        if segment == "" || segment == "." || segment == ".." {
+            return "can't have empty, . or .. segments"
+        }
+    }
+    return ""
+}
+
+// validCIDR accepts what checkManifestIP does
+func validCIDR(value string) bool {
+    _, err := parsePrefix(value)
+    return err == nil
+}
+
+func hasControlChars(s string) bool {
+    for _, c := range s {
+        if c < 0x20 || c == 0x7f {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "path"
+    "strings"
+)
+
+// Several tokens can be downloaded as one archive, with ?token=a&token=b or
+// ?token=a,b, and the same in the path. ?folder= puts each token's files
+// under a folder of its own, given in the same order, empty to leave one at
+// the top. Each token is checked as it would be alone, and they all have to
+// be for the same tenant. A signed URL signs the tokens joined by commas.
+
+// The most tokens one archive can combine
+const maxMergedTokens = 20
+
+var errTenantsDiffer = errors.New("the tokens belong to different tenants")
+
+// requestTokens returns the download tokens from the path or "token" query
+// parameters, split on commas
+func requestTokens(r *http.Request) []string {
+    values := r.URL.Query()["token"]
+    if token := r.PathValue("token"); token != "" {
+        values = []string{token}
+    }
+
+    var tokens []string
+    for _, value := range values {
+        for _, token := range strings.Split(value, ",") {
+            if token = strings.TrimSpace(token); token != "" {
+                tokens = append(tokens, token)
+            }
+        }
+    }
+    return tokens
+}
+
+// requestFolders returns ?folder= as a folder per token, checking they stay
+// inside the archive
+func requestFolders(r *http.Request, tokens int) ([]string, error) {
+    var folders []string
+    for _, value := range r.URL.Query()["folder"] {
+        folders = append(folders, strings.Split(value, ",")...)
+    }
+    if folders == nil {
+        return nil, nil
+    }
+    if len(folders) != tokens {
+        return nil, fmt.Errorf("folder has %d folders for %d tokens", len(folders), tokens)
+    }
+
+    for i, folder := range folders {
+        folder = strings.Trim(strings.TrimSpace(folder), "/")
+        if folder != "" {
+            if reason := folderProblem(folder); reason != "" {
+                return nil, fmt.Errorf("folder %q %s", folder, reason)
+            }
+        }
+        folders[i] = folder
+    }
+    return folders, nil
+}
+
+// mergeManifests makes one manifest of several, each under its folder when
+// there are folders. The tenant, owner and archive name are the first's.
+func mergeManifests(manifests []*Manifest, folders []string) (*Manifest, error) {
+    if len(manifests) == 1 && folders == nil {
+        return manifests[0], nil
+    }
+
+    merged := &Manifest{Tenant: manifests[0].Tenant, Owner: manifests[0].Owner, ArchiveName: manifests[0].ArchiveName}
+    for i, manifest := range manifests {
+        if manifest.Tenant != merged.Tenant {
+            return nil, errTenantsDiffer
+        }
+
+        folder := ""
+        if folders != nil {
+            folder = folders[i]
+        }
+        merged.appendManifest(manifest, folder)
+    }
+    return merged, nil
+}
+
+// rootFile returns a copy of the file under folder, or the file itself when
+// there's no folder
+func rootFile(file *RedisFile, folder string) *RedisFile {
+    if file == nil || folder == "" {
+        return file
+    }
+    rooted := *file
+    rooted.Folder = path.Join(folder, file.Folder)
+    return &rooted
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "io"
+    "math"
+    "net"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+
+    goredis "github.com/redis/go-redis/v9"
+)
+
+// A minimal Prometheus registry, enough for the handful of metrics we keep
+// without pulling in the client library and its dependencies
+
+type metric interface {
+    write(w io.Writer)
+}
+
+var registry []metric
+
+// counterVec is a counter with labels
+type counterVec struct {
+    name, help string
+    labels     []string
+
+    mu     sync.Mutex
+    values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counterVec {
+    c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+    if len(labels) == 0 {
+        c.values[""] = 0
+    }
+    registry = append(registry, c)
+    return c
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+    key := strings.Join(labelValues, "\xff")
+    c.mu.Lock()
+    c.values[key] += v
+    c.mu.Unlock()
+
+    emitStatsD(c.name, v, "c", c.labels, labelValues)
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+    c.add(1, labelValues...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for _, key := range sortedKeys(c.values) {
+        fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatValue(c.values[key]))
+    }
+}
+
+// gaugeFunc reads its value when scraped
+type gaugeFunc struct {
+    name, help string
+    value      func() float64
+}
+
+func newGaugeFunc(name, help string, value func() float64) *gaugeFunc {
+    g := &gaugeFunc{name: name, help: help, value: value}
+    registry = append(registry, g)
+    return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatValue(g.value()))
+}
+
+// histogramVec is a histogram with labels
+type histogramVec struct {
+    name, help string
+    labels     []string
+    buckets    []float64
+
+    mu     sync.Mutex
+    series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+    counts []uint64
+    count  uint64
+    sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+    h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+    registry = append(registry, h)
+    return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+    key := strings.Join(labelValues, "\xff")
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    s, ok := h.series[key]
+    if !ok {
+        s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+        h.series[key] = s
+    }
+    for i, upper := range h.buckets {
+        if v <= upper {
+            s.counts[i]++
+        }
+    }
+    s.count++
+    s.sum += v
+
+    // Histograms are all of durations in seconds, StatsD times in ms
+    emitStatsD(h.name, v*1000, "ms", h.labels, labelValues)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    keys := make([]string, 0, len(h.series))
+    for key := range h.series {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+        s := h.series[key]
+        for i, upper := range h.buckets {
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, formatValue(upper)), s.counts[i])
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), s.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatValue(s.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+    }
+}
+
+func sortedKeys(values map[string]float64) []string {
+    keys := make([]string, 0, len(values))
+    for key := range values {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders {name="value",...}, adding le for histogram buckets
+func formatLabels(names []string, key, le string) string {
+    var pairs []string
+    if len(names) > 0 {
+        for i, value := range strings.Split(key, "\xff") {
+            if i < len(names) {
+                pairs = append(pairs, names[i]+`="`+labelEscaper.Replace(value)+`"`)
+            }
+        }
+    }
+    if le != "" {
+        pairs = append(pairs, `le="`+le+`"`)
+    }
+    if len(pairs) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+    if math.IsInf(v, 1) {
+        return "+Inf"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+    requestsTotal = newCounter("zipper_http_requests_total",
+        "HTTP requests by method and status code.", "method", "code")
+    archivesTotal = newCounter("zipper_archives_total",
+        "Archives built, by kind (download or job) and result.", "kind", "result")
+    bytesStreamed = newCounter("zipper_bytes_streamed_total",
+        "Bytes of archive data sent to clients.")
+    fileFetchSeconds = newHistogram("zipper_file_fetch_duration_seconds",
+        "Time taken to fetch and compress each file from S3, by result.",
+        []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}, "result")
+    ownerArchives = newCounter("zipper_owner_archives_total",
+        "Archives built, by manifest Owner and result.", "owner", "result")
+    ownerBytes = newCounter("zipper_owner_bytes_streamed_total",
+        "Bytes of archive data built, by manifest Owner.", "owner")
+    s3Errors = newCounter("zipper_s3_errors_total",
+        "Failed S3 requests, by operation.", "operation")
+    redisErrors = newCounter("zipper_redis_errors_total",
+        "Failed Redis commands and connections.")
+    logLinesSuppressed = newCounter("zipper_log_lines_suppressed_total",
+        "Repeated warnings and errors left out of the log by sampling.")
+    _ = newGaugeFunc("zipper_downloads_in_flight",
+        "Archives currently streaming to clients.", func() float64 {
+            activeDownloads.Lock()
+            defer activeDownloads.Unlock()
+            return float64(len(activeDownloads.byID))
+        })
+    _ = newGaugeFunc("zipper_jobs_running",
+        "Background jobs currently being built.", func() float64 {
+            jobs.Lock()
+            defer jobs.Unlock()
+            return float64(len(jobs.running))
+        })
+)
+
+// metricsHandler serves everything in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    for _, m := range registry {
+        m.write(w)
+    }
+}
+
+// statusRecorder remembers the status code a handler responds with
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+    if w.status == 0 {
+        w.status = status
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+    if w.status == 0 {
+        w.status = 200
+    }
+    return w.ResponseWriter.Write(p)
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    w.status = 101
+    return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// countRequests counts every request by method and status
+func countRequests(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        recorder := &statusRecorder{ResponseWriter: w}
+        next(recorder, r)
+
+        if recorder.status == 0 {
+            recorder.status = 200
+        }
+        requestsTotal.inc(r.Method, strconv.Itoa(recorder.status))
+    }
+}
+
+// redisErrorHook counts failed Redis commands and connections. A missing
+// key or a transaction a WATCH called off isn't a failure.
+type redisErrorHook struct{}
+
+func (redisErrorHook) DialHook(next goredis.DialHook) goredis.DialHook {
+    return func(ctx context.Context, network, address string) (net.Conn, error) {
+        conn, err := next(ctx, network, address)
+        if err != nil {
+            redisErrors.inc()
+        }
+        return conn, err
+    }
+}
+
+func (redisErrorHook) ProcessHook(next goredis.ProcessHook) goredis.ProcessHook {
+    return func(ctx context.Context, cmd goredis.Cmder) error {
+        err := next(ctx, cmd)
+        if redisFailed(err) {
+            redisErrors.inc()
+        }
+        return err
+    }
+}
+
+func (redisErrorHook) ProcessPipelineHook(next goredis.ProcessPipelineHook) goredis.ProcessPipelineHook {
+    return func(ctx context.Context, cmds []goredis.Cmder) error {
+        err := next(ctx, cmds)
+        for _, cmd := range cmds {
+            if redisFailed(cmd.Err()) {
+                redisErrors.inc()
+            }
+        }
+        return err
+    }
+}
+
+func redisFailed(err error) bool {
+    return err != nil && err != goredis.Nil && err != goredis.TxFailedErr
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+)
+
+// defaultMiddleware is the order public routes have always been wrapped in,
+// outermost first
+const defaultMiddleware = "request-id,access-log,metrics,recover,version,security-headers,cors,rate-limit"
+
+// middlewares are what MIDDLEWARE can put in front of the public routes
+var middlewares = map[string]func(http.HandlerFunc) http.HandlerFunc{
+    "request-id":       assignRequestID,
+    "access-log":       logAccess,
+    "metrics":          countRequests,
+    "recover":          recoverPanics,
+    "version":          versionHeader,
+    "security-headers": securityHeaders,
+    "cors":             cors,
+    "rate-limit":       rateLimit,
+    "auth":             requireAnyAPIKey,
+}
+
+// middlewareChain is MIDDLEWARE parsed, outermost first
+var middlewareChain []func(http.HandlerFunc) http.HandlerFunc
+
+// initMiddleware reads the chain from MIDDLEWARE, a comma separated list of
+// names run in order. "none" serves the routes bare.
+func initMiddleware() {
+    middlewareChain = nil
+    if config.Middleware == "none" {
+        return
+    }
+
+    for _, name := range strings.Split(config.Middleware, ",") {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            continue
+        }
+
+        middleware, ok := middlewares[name]
+        if !ok {
+            fatal("Error reading MIDDLEWARE", fmt.Errorf("unknown middleware %q", name))
+        }
+        middlewareChain = append(middlewareChain, middleware)
+    }
+}
+
+// requireAnyAPIKey puts a route behind API keys, whatever their scopes, for
+// deployments where nothing should be public
+func requireAnyAPIKey(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        key := r.Header.Get("X-API-Key")
+        if key == "" {
+            writeProblem(w, r, 401, codeUnauthorized, "An X-API-Key header is required")
+            return
+        }
+
+        if _, ok := apiKeyScopes(r.Context(), key); !ok {
+            writeProblem(w, r, 401, codeUnauthorized, "Unknown API key")
+            return
+        }
+
+        next(w, r)
+    }
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math"
+    "strings"
+)
+
+// Just enough MessagePack to read manifests, the same shapes as the JSON:
+// an array of file maps, or a map with Files and the restrictions. Keys
+// match the JSON field names, in any case.
+
+var errMsgpackMalformed = errors.New("malformed MessagePack")
+
+type msgpackReader struct {
+    b []byte
+
+    // Keys that were skipped, which a versioned manifest can't have
+    unknown []string
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+    if n < 0 || len(r.b) < n {
+        return nil, errMsgpackMalformed
+    }
+    b := r.b[:n]
+    r.b = r.b[n:]
+    return b, nil
+}
+
+func (r *msgpackReader) byte() (byte, error) {
+    b, err := r.next(1)
+    if err != nil {
+        return 0, err
+    }
+    return b[0], nil
+}
+
+// length reads an 8, 16 or 32 bit big endian length
+func (r *msgpackReader) length(size int) (int, error) {
+    b, err := r.next(size)
+    if err != nil {
+        return 0, err
+    }
+    switch size {
+    case 1:
+        return int(b[0]), nil
+    case 2:
+        return int(binary.BigEndian.Uint16(b)), nil
+    }
+    n := binary.BigEndian.Uint32(b)
+    if uint64(n) > uint64(len(r.b)) {
+        // More entries than bytes left, each takes at least one
+        return 0, errMsgpackMalformed
+    }
+    return int(n), nil
+}
+
+func (r *msgpackReader) peek() (byte, error) {
+    if len(r.b) == 0 {
+        return 0, errMsgpackMalformed
+    }
+    return r.b[0], nil
+}
+
+func (r *msgpackReader) arrayLen() (int, error) {
+    c, err := r.byte()
+    if err != nil {
+        return 0, err
+    }
+    switch {
+    case c&0xf0 == 0x90:
+        return int(c & 0x0f), nil
+    case c == 0xdc:
+        return r.length(2)
+    case c == 0xdd:
+        return r.length(4)
+    }
+    return 0, errMsgpackMalformed
+}
+
+func (r *msgpackReader) mapLen() (int, error) {
+    c, err := r.byte()
+    if err != nil {
+        return 0, err
+    }
+    switch {
+    case c&0xf0 == 0x80:
+        return int(c & 0x0f), nil
+    case c == 0xde:
+        return r.length(2)
+    case c == 0xdf:
+        return r.length(4)
+    }
+    return 0, errMsgpackMalformed
+}
+
+// string reads a str or bin, or nil as an empty string
+func (r *msgpackReader) string() (string, error) {
+    c, err := r.byte()
+    if err != nil {
+        return "", err
+    }
+
+    var n int
+    switch {
+    case c == 0xc0:
+        return "", nil
+    case c&0xe0 == 0xa0:
+        n = int(c & 0x1f)
+    case c == 0xd9 || c == 0xc4:
+        n, err = r.length(1)
+    case c == 0xda || c == 0xc5:
+        n, err = r.length(2)
+    case c == 0xdb || c == 0xc6:
+        n, err = r.length(4)
+    default:
+        return "", errMsgpackMalformed
+    }
+    if err != nil {
+        return "", err
+    }
+
+    b, err := r.next(n)
+    return string(b), err
+}
+
+func (r *msgpackReader) int() (int64, error) {
+    c, err := r.byte()
+    if err != nil {
+        return 0, err
+    }
+
+    switch {
+    case c <= 0x7f:
+        return int64(c), nil
+    case c >= 0xe0:
+        return int64(int8(c)), nil
+    case c == 0xc0:
+        return 0, nil
+    }
+
+    sizes := map[byte]int{0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, 0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8, 0xca: 4, 0xcb: 8}
+    size, ok := sizes[c]
+    if !ok {
+        return 0, errMsgpackMalformed
+    }
+    b, err := r.next(size)
+    if err != nil {
+        return 0, err
+    }
+
+    switch c {
+    case 0xcc:
+        return int64(b[0]), nil
+    case 0xcd:
+        return int64(binary.BigEndian.Uint16(b)), nil
+    case 0xce:
+        return int64(binary.BigEndian.Uint32(b)), nil
+    case 0xcf:
+        return int64(binary.BigEndian.Uint64(b)), nil
+    case 0xd0:
+        return int64(int8(b[0])), nil
+    case 0xd1:
+        return int64(int16(binary.BigEndian.Uint16(b))), nil
+    case 0xd2:
+        return int64(int32(binary.BigEndian.Uint32(b))), nil
+    case 0xd3:
+        return int64(binary.BigEndian.Uint64(b)), nil
+    case 0xca:
+        return int64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+    }
+    return int64(math.Float64frombits(binary.BigEndian.Uint64(b))), nil
+}
+
+func (r *msgpackReader) strings() ([]string, error) {
+    if c, err := r.peek(); err == nil && c == 0xc0 {
+        r.b = r.b[1:]
+        return nil, nil
+    }
+
+    n, err := r.arrayLen()
+    if err != nil {
+        return nil, err
+    }
+    values := make([]string, n)
+    for i := range values {
+        if values[i], err = r.string(); err != nil {
+            return nil, err
+        }
+    }
+    return values, nil
+}
+
+// skip passes over a value of any type
+func (r *msgpackReader) skip() error {
+    c, err := r.peek()
+    if err != nil {
+        return err
+    }
+
+    switch {
+    case c <= 0x7f || c >= 0xe0 || c == 0xc0 || c == 0xc2 || c == 0xc3:
+        r.b = r.b[1:]
+        return nil
+    case c&0xe0 == 0xa0 || (c >= 0xc4 && c <= 0xc6) || (c >= 0xd9 && c <= 0xdb):
+        _, err := r.string()
+        return err
+    case (c >= 0xca && c <= 0xd3):
+        _, err := r.int()
+        return err
+    case c&0xf0 == 0x90 || c == 0xdc || c == 0xdd:
+        n, err := r.arrayLen()
+        for i := 0; err == nil && i < n; i++ {
+            err = r.skip()
+        }
+        return err
+    case c&0xf0 == 0x80 || c == 0xde || c == 0xdf:
+        n, err := r.mapLen()
+        for i := 0; err == nil && i < 2*n; i++ {
+            err = r.skip()
+        }
+        return err
+    }
+
+    // Extension types
+    r.b = r.b[1:]
+    sizes := map[byte]int{0xd4: 1, 0xd5: 2, 0xd6: 4, 0xd7: 8, 0xd8: 16}
+    if size, ok := sizes[c]; ok {
+        _, err := r.next(size + 1)
+        return err
+    }
+    sizes = map[byte]int{0xc7: 1, 0xc8: 2, 0xc9: 4}
+    if size, ok := sizes[c]; ok {
+        n, err := r.length(size)
+        if err != nil {
+            return err
+        }
+        _, err = r.next(n + 1)
+        return err
+    }
+    return errMsgpackMalformed
+}
+
+// decodeMsgpackManifest reads a manifest, or the bare list of its files
+func decodeMsgpackManifest(b []byte, manifest *Manifest) error {
+    r := &msgpackReader{b: b}
+
+    c, err := r.peek()
+    if err != nil {
+        return err
+    }
+    if c&0xf0 == 0x90 || c == 0xdc || c == 0xdd {
+        return r.files(manifest)
+    }
+    if err := r.manifest(manifest); err != nil {
+        return err
+    }
+
+    if manifest.Version != 0 && len(r.unknown) > 0 {
+        problems := manifestErrors{}
+        for _, key := range r.unknown {
+            problems = append(problems, fmt.Sprintf("unknown field %s", key))
+        }
+        return problems
+    }
+    return nil
+}
+
+// manifest reads the fields of a manifest map
+func (r *msgpackReader) manifest(manifest *Manifest) error {
+    n, err := r.mapLen()
+    if err != nil {
+        return err
+    }
+    for i := 0; i < n; i++ {
+        key, err := r.string()
+        if err != nil {
+            return err
+        }
+
+        switch strings.ToLower(key) {
+        case "version":
+            var version int64
+            version, err = r.int()
+            manifest.Version = int(version)
+        case "files":
+            err = r.files(manifest)
+        case "allowedsubjects":
+            manifest.AllowedSubjects, err = r.strings()
+        case "allowedcidrs":
+            manifest.AllowedCIDRs, err = r.strings()
+        case "deniedcidrs":
+            manifest.DeniedCIDRs, err = r.strings()
+        case "tenant":
+            manifest.Tenant, err = r.string()
+        case "owner":
+            manifest.Owner, err = r.string()
+        case "archivename":
+            manifest.ArchiveName, err = r.string()
+        case "extractto":
+            manifest.ExtractTo, err = r.string()
+        default:
+            r.unknown = append(r.unknown, key)
+            err = r.skip()
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// files reads a list of entries into the manifest
+func (r *msgpackReader) files(manifest *Manifest) error {
+    n, err := r.arrayLen()
+    if err != nil {
+        return err
+    }
+
+    manifest.Files = make([]*RedisFile, 0, n)
+    for i := 0; i < n; i++ {
+        entry, err := r.file(i)
+        if err != nil {
+            return err
+        }
+        if err := manifest.addEntry(entry); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (r *msgpackReader) file(index int) (*manifestEntry, error) {
+    n, err := r.mapLen()
+    if err != nil {
+        return nil, err
+    }
+
+    entry := &manifestEntry{}
+    file := &entry.RedisFile
+    for i := 0; i < n; i++ {
+        key, err := r.string()
+        if err != nil {
+            return nil, err
+        }
+
+        switch strings.ToLower(key) {
+        case "filename":
+            file.FileName, err = r.string()
+        case "folder":
+            file.Folder, err = r.string()
+        case "s3path":
+            file.S3Path, err = r.string()
+        case "size":
+            file.Size, err = r.int()
+        case "type":
+            entry.Type, err = r.string()
+        case "token":
+            entry.Token, err = r.string()
+        default:
+            r.unknown = append(r.unknown, fmt.Sprintf("files[%d].%s", index, key))
+            err = r.skip()
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    return entry, nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/big"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+var (
+    errOIDCMissing      = errors.New("missing ID token")
+    errOIDCIssuer       = errors.New("ID token issuer mismatch")
+    errOIDCAudience     = errors.New("ID token audience mismatch")
+    errOIDCSubject      = errors.New("ID token subject not allowed for this download")
+    errOIDCUnknownKey   = errors.New("ID token signed with unknown key")
+    errOIDCUnconfigured = errors.New("manifest requires OIDC but no issuer is configured")
+)
+
+// How long fetched signing keys are trusted before being refreshed
+const oidcKeysTTL = time.Hour
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcKeys caches the issuer's JSON Web Key Set
+var oidcKeys struct {
+    sync.Mutex
+    keys      map[string]crypto.PublicKey
+    fetchedAt time.Time
+}
+
+// oidcFetch is held while the key set is fetched, so only one request
+// fetches it at a time without holding up the ones whose key is cached
+var oidcFetch sync.Mutex
+
+type jsonWebKey struct {
+    Kid string `json:"kid"`
+    Kty string `json:"kty"`
+    Crv string `json:"crv"`
+    N   string `json:"n"`
+    E   string `json:"e"`
+    X   string `json:"x"`
+    Y   string `json:"y"`
+}
+
+// authorizeOIDC requires a valid ID token whenever the manifest restricts
+// its subjects or OIDC_REQUIRED is set
+func authorizeOIDC(r *http.Request, manifest *Manifest) error {
+    if len(manifest.AllowedSubjects) == 0 && !config.OIDCRequired {
+        return nil
+    }
+
+    if config.OIDCIssuer == "" {
+        return errOIDCUnconfigured
+    }
+
+    token := r.URL.Query().Get("id_token")
+    if token == "" {
+        token = bearerToken(r)
+    }
+    if token == "" {
+        return errOIDCMissing
+    }
+
+    claims, err := verifyIDToken(token)
+    if err != nil {
+        return err
+    }
+
+    if len(manifest.AllowedSubjects) == 0 {
+        return nil
+    }
+
+    for _, value := range claimValues(claims[config.OIDCSubjectClaim]) {
+        for _, allowed := range manifest.AllowedSubjects {
+            if value == allowed {
+                return nil
+            }
+        }
+    }
+
+    return errOIDCSubject
+}
+
+// verifyIDToken checks the signature, issuer, audience and expiry of an ID
+// token and returns its claims
+func verifyIDToken(token string) (claims map[string]interface{}, err error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, errJWTMalformed
+    }
+
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    if err = decodeJWTSegment(parts[0], &header); err != nil {
+        return nil, err
+    }
+
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, errJWTMalformed
+    }
+
+    key, err := oidcKey(header.Kid)
+    if err != nil {
+        return nil, err
+    }
+
+    if err = verifyJWTSignatureWithKey(key, header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+        return nil, err
+    }
+
+    if err = decodeJWTSegment(parts[1], &claims); err != nil {
+        return nil, err
+    }
+
+    if iss, _ := claims["iss"].(string); iss != config.OIDCIssuer {
+        return nil, errOIDCIssuer
+    }
+
+    audienceOK := false
+    for _, aud := range claimValues(claims["aud"]) {
+        if aud == config.OIDCAudience {
+            audienceOK = true
+        }
+    }
+    if !audienceOK {
+        return nil, errOIDCAudience
+    }
+
+    exp, _ := claims["exp"].(float64)
+    if time.Now().Unix() >= int64(exp) {
+        return nil, errJWTExpired
+    }
+
+    return claims, nil
+}
+
+// claimValues flattens a claim that may be a single string or a list
+func claimValues(claim interface{}) (values []string) {
+    switch v := claim.(type) {
+    case string:
+        values = append(values, v)
+    case []interface{}:
+        for _, item := range v {
+            if s, ok := item.(string); ok {
+                values = append(values, s)
+            }
+        }
+    }
+    return
+}
+
+// oidcKey returns the issuer's signing key with the given ID, refreshing the
+// key set when it is stale or the key is unknown
+func oidcKey(kid string) (crypto.PublicKey, error) {
+    key, ok, fetchedAt := cachedOIDCKey(kid)
+
+    // Don't let unknown key IDs hammer the issuer
+    if ok && time.Since(fetchedAt) <= oidcKeysTTL {
+        return key, nil
+    }
+    if !ok && time.Since(fetchedAt) < time.Minute {
+        return nil, errOIDCUnknownKey
+    }
+
+    // A stale key will do while another request fetches new ones
+    if !oidcFetch.TryLock() {
+        if ok {
+            return key, nil
+        }
+        oidcFetch.Lock()
+    }
+    defer oidcFetch.Unlock()
+
+    // Someone else may have fetched them while this waited
+    if latest, found, at := cachedOIDCKey(kid); at.After(fetchedAt) {
+        if !found {
+            return nil, errOIDCUnknownKey
+        }
+        return latest, nil
+    }
+
+    keys, err := fetchOIDCKeys()
+    if err != nil {
+        if ok {
+            return key, nil
+        }
+        return nil, err
+    }
+
+    oidcKeys.Lock()
+    oidcKeys.keys = keys
+    oidcKeys.fetchedAt = time.Now()
+    oidcKeys.Unlock()
+
+    if key, ok = keys[kid]; !ok {
+        return nil, errOIDCUnknownKey
+    }
+    return key, nil
+}
+
+// cachedOIDCKey looks a key up in the cached key set, also saying when the
+// set was fetched
+func cachedOIDCKey(kid string) (crypto.PublicKey, bool, time.Time) {
+    oidcKeys.Lock()
+    defer oidcKeys.Unlock()
+    key, ok := oidcKeys.keys[kid]
+    return key, ok, oidcKeys.fetchedAt
+}
+
+func fetchOIDCKeys() (map[string]crypto.PublicKey, error) {
+    var discovery struct {
+        JWKSURI string `json:"jwks_uri"`
+    }
+    if err := getJSON(strings.TrimSuffix(config.OIDCIssuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+        return nil, err
+    }
+
+    var jwks struct {
+        Keys []jsonWebKey `json:"keys"`
+    }
+    if err := getJSON(discovery.JWKSURI, &jwks); err != nil {
+        return nil, err
+    }
+
+    keys := map[string]crypto.PublicKey{}
+    for _, jwk := range jwks.Keys {
+        key, err := jwk.publicKey()
+        if err != nil {
+            continue
+        }
+        keys[jwk.Kid] = key
+    }
+
+    return keys, nil
+}
+
+func getJSON(url string, v interface{}) error {
+    resp, err := oidcClient.Get(url)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != 200 {
+        return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+    }
+
+    return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+    decode := base64.RawURLEncoding.DecodeString
+
+    switch jwk.Kty {
+    case "RSA":
+        n, err := decode(jwk.N)
+        if err != nil {
+            return nil, err
+        }
+        e, err := decode(jwk.E)
+        if err != nil {
+            return nil, err
+        }
+        return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+    case "EC":
+        if jwk.Crv != "P-256" {
+            return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+        }
+        x, err := decode(jwk.X)
+        if err != nil {
+            return nil, err
+        }
+        y, err := decode(jwk.Y)
+        if err != nil {
+            return nil, err
+        }
+        return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+    case "OKP":
+        if jwk.Crv != "Ed25519" {
+            return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+        }
+        x, err := decode(jwk.X)
+        if err != nil {
+            return nil, err
+        }
+        // ed25519.Verify panics on a key of any other length
+        if len(x) != ed25519.PublicKeySize {
+            return nil, fmt.Errorf("an Ed25519 key is %d bytes, not %d", len(x), ed25519.PublicKeySize)
+        }
+        return ed25519.PublicKey(x), nil
+    }
+
+    return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
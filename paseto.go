@@ -0,0 +1,129 @@
+package main
+
+import (
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "strings"
+    "time"
+)
+
+// Only the v4.public purpose is supported: producers sign with their Ed25519
+// private key and zipper verifies with the public half.
+const pasetoV4PublicHeader = "v4.public."
+
+var (
+    errPASETOMalformed = errors.New("malformed PASETO token")
+    errPASETOSignature = errors.New("invalid PASETO signature")
+    errPASETOExpired   = errors.New("PASETO token expired")
+    errPASETONotYet    = errors.New("PASETO token not valid yet")
+)
+
+// pasetoPublicKey verifies v4.public tokens, loaded from PASETO_PUBLIC_KEY
+var pasetoPublicKey ed25519.PublicKey
+
+type pasetoClaims struct {
+    ExpiresAt string `json:"exp"`
+    NotBefore string `json:"nbf"`
+}
+
+func initPASETO() {
+    if config.PASETOPublicKey == "" {
+        return
+    }
+
+    key, err := hex.DecodeString(config.PASETOPublicKey)
+    if err != nil || len(key) != ed25519.PublicKeySize {
+        panic("PASETO_PUBLIC_KEY must be a hex encoded Ed25519 public key")
+    }
+
+    pasetoPublicKey = ed25519.PublicKey(key)
+}
+
+// looksLikePASETO reports whether the token is a v4.public PASETO token
+func looksLikePASETO(token string) bool {
+    return pasetoPublicKey != nil && strings.HasPrefix(token, pasetoV4PublicHeader)
+}
+
+// getManifestFromPASETO verifies a v4.public token and returns the manifest
+// embedded in its claims
+func getManifestFromPASETO(token string) (manifest *Manifest, err error) {
+    parts := strings.Split(strings.TrimPrefix(token, pasetoV4PublicHeader), ".")
+    if len(parts) > 2 {
+        return nil, errPASETOMalformed
+    }
+
+    payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+    if err != nil || len(payload) < ed25519.SignatureSize {
+        return nil, errPASETOMalformed
+    }
+
+    var footer []byte
+    if len(parts) == 2 {
+        if footer, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+            return nil, errPASETOMalformed
+        }
+    }
+
+    message := payload[:len(payload)-ed25519.SignatureSize]
+    signature := payload[len(payload)-ed25519.SignatureSize:]
+
+    signed := pasetoPAE([]byte(pasetoV4PublicHeader), message, footer, nil)
+    if !ed25519.Verify(pasetoPublicKey, signed, signature) {
+        return nil, errPASETOSignature
+    }
+
+    var claims pasetoClaims
+    if err = json.Unmarshal(message, &claims); err != nil {
+        return nil, errPASETOMalformed
+    }
+
+    // The rest of the claims are the manifest itself
+    manifest = &Manifest{}
+    if err = json.Unmarshal(message, manifest); err != nil {
+        return nil, errPASETOMalformed
+    }
+    if err = checkManifest(manifest); err != nil {
+        return nil, err
+    }
+
+    now := time.Now()
+    if claims.ExpiresAt != "" {
+        exp, err := time.Parse(time.RFC3339, claims.ExpiresAt)
+        if err != nil {
+            return nil, errPASETOMalformed
+        }
+        if !now.Before(exp) {
+            return nil, errPASETOExpired
+        }
+    }
+    if claims.NotBefore != "" {
+        nbf, err := time.Parse(time.RFC3339, claims.NotBefore)
+        if err != nil {
+            return nil, errPASETOMalformed
+        }
+        if now.Before(nbf) {
+            return nil, errPASETONotYet
+        }
+    }
+
+    return manifest, nil
+}
+
+// pasetoPAE implements the PASETO pre-authentication encoding
+func pasetoPAE(pieces ...[]byte) []byte {
+    out := make([]byte, 8)
+    binary.LittleEndian.PutUint64(out, uint64(len(pieces)))
+
+    for _, piece := range pieces {
+        var length [8]byte
+        binary.LittleEndian.PutUint64(length[:], uint64(len(piece)))
+        out = append(out, length[:]...)
+        out = append(out, piece...)
+    }
+
+    return out
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestPASETOPAE(t *testing.T) {
+    // The vectors from the PASETO specification
+    tests := []struct {
+        pieces [][]byte
+        want   string
+    }{
+        {nil, "\x00\x00\x00\x00\x00\x00\x00\x00"},
+        {[][]byte{{}}, "\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"},
+        {[][]byte{{}, {}}, "\x02\x00\x00\x00\x00\x00\x00\x00" + "\x00\x00\x00\x00\x00\x00\x00\x00" + "\x00\x00\x00\x00\x00\x00\x00\x00"},
+        {[][]byte{[]byte("Paragon")}, "\x01\x00\x00\x00\x00\x00\x00\x00\x07\x00\x00\x00\x00\x00\x00\x00Paragon"},
+        {[][]byte{[]byte("Paragon"), []byte("Initiative")}, "\x02\x00\x00\x00\x00\x00\x00\x00\x07\x00\x00\x00\x00\x00\x00\x00Paragon\x0a\x00\x00\x00\x00\x00\x00\x00Initiative"},
+        // Lengths keep the pieces apart, so moving a boundary changes the encoding
+        {[][]byte{[]byte("Paragon\x0a\x00\x00\x00\x00\x00\x00\x00Initiative")}, "\x01\x00\x00\x00\x00\x00\x00\x00\x19\x00\x00\x00\x00\x00\x00\x00Paragon\x0a\x00\x00\x00\x00\x00\x00\x00Initiative"},
+    }
+    for i, test := range tests {
+        if got := pasetoPAE(test.pieces...); !bytes.Equal(got, []byte(test.want)) {
+            t.Errorf("%d: pasetoPAE = %q, want %q", i, got, test.want)
+        }
+    }
+}
+
+// signPASETO makes a v4.public token with the claims and footer
+func signPASETO(t *testing.T, key ed25519.PrivateKey, claims interface{}, footer string) string {
+    t.Helper()
+    message, err := json.Marshal(claims)
+    if err != nil {
+        t.Fatal(err)
+    }
+    signature := ed25519.Sign(key, pasetoPAE([]byte(pasetoV4PublicHeader), message, []byte(footer), nil))
+    token := pasetoV4PublicHeader + base64.RawURLEncoding.EncodeToString(append(message, signature...))
+    if footer != "" {
+        token += "." + base64.RawURLEncoding.EncodeToString([]byte(footer))
+    }
+    return token
+}
+
+func TestGetManifestFromPASETO(t *testing.T) {
+    setupHandlerTest(t, nil)
+    public, private, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, otherPrivate, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pasetoPublicKey = public
+    t.Cleanup(func() { pasetoPublicKey = nil })
+
+    files := []*RedisFile{{FileName: "a.txt", S3Path: "a.txt"}}
+    claims := func(exp, nbf time.Duration) map[string]interface{} {
+        c := map[string]interface{}{"Files": files}
+        if exp != 0 {
+            c["exp"] = time.Now().Add(exp).Format(time.RFC3339)
+        }
+        if nbf != 0 {
+            c["nbf"] = time.Now().Add(nbf).Format(time.RFC3339)
+        }
+        return c
+    }
+    valid := signPASETO(t, private, claims(time.Hour, 0), "")
+    withFooter := signPASETO(t, private, claims(time.Hour, 0), `{"kid":"a"}`)
+
+    tests := []struct {
+        name  string
+        token string
+        want  error
+    }{
+        {"valid", valid, nil},
+        {"valid with a footer", withFooter, nil},
+        {"another key", signPASETO(t, otherPrivate, claims(time.Hour, 0), ""), errPASETOSignature},
+        {"expired", signPASETO(t, private, claims(-time.Hour, 0), ""), errPASETOExpired},
+        {"not yet valid", signPASETO(t, private, claims(time.Hour, time.Hour), ""), errPASETONotYet},
+        {"footer dropped", withFooter[:bytes.LastIndexByte([]byte(withFooter), '.')], errPASETOSignature},
+        {"footer swapped", withFooter[:bytes.LastIndexByte([]byte(withFooter), '.')+1] + base64.RawURLEncoding.EncodeToString([]byte(`{"kid":"b"}`)), errPASETOSignature},
+        {"too many parts", valid + ".e30.e30", errPASETOMalformed},
+        {"too short", pasetoV4PublicHeader + "AAAA", errPASETOMalformed},
+        {"not base64", pasetoV4PublicHeader + "!!!", errPASETOMalformed},
+    }
+    for _, test := range tests {
+        manifest, err := getManifestFromPASETO(test.token)
+        if !errors.Is(err, test.want) || (err == nil) != (test.want == nil) {
+            t.Errorf("%s: err = %v, want %v", test.name, err, test.want)
+            continue
+        }
+        if err == nil && (len(manifest.Files) != 1 || manifest.Files[0].FileName != "a.txt") {
+            t.Errorf("%s: files = %v, want a.txt", test.name, manifest.Files)
+        }
+    }
+
+    // Flip a bit in the claims
+    payload, _ := base64.RawURLEncoding.DecodeString(valid[len(pasetoV4PublicHeader):])
+    payload[2] ^= 1
+    tampered := pasetoV4PublicHeader + base64.RawURLEncoding.EncodeToString(payload)
+    if _, err := getManifestFromPASETO(tampered); !errors.Is(err, errPASETOSignature) {
+        t.Errorf("tampered claims: err = %v, want %v", err, errPASETOSignature)
+    }
+}
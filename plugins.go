@@ -0,0 +1,385 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+
+    "codecourse/zipper/archive"
+    "github.com/tetratelabs/wazero"
+    "github.com/tetratelabs/wazero/api"
+    "github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// WASM plugins listed in PLUGINS can rename, skip and transform entries as
+// they stream. A plugin is a WASI module, built as a reactor, exporting:
+//
+//	zipper_alloc(size i32) i32
+//	    Returns size bytes of guest memory for the host to write input to.
+//	zipper_entry(ptr i32, len i32) i64
+//	    Optional. Given an entry as JSON, returns JSON with "skip": true to
+//	    drop it or new "fileName"/"folder" values, or nothing to keep it.
+//	zipper_transform_start(ptr i32, len i32) i32
+//	    Optional. Given an entry as JSON, returns 1 to transform its
+//	    contents with zipper_transform.
+//	zipper_transform(ptr i32, len i32) i64
+//	    Given the next chunk of an entry, returns what to write in its
+//	    place. An empty chunk marks the end of the entry, for anything
+//	    still buffered.
+//
+// i64 results are the output's pointer in the high 32 bits and its length in
+// the low 32. The output must stay put until the next call. Each entry being
+// transformed has an instance of the module to itself.
+
+// How much of an entry is handed to zipper_transform at a time
+const pluginChunkSize = 64 * 1024
+
+// pluginEntry is an entry as plugins see it
+type pluginEntry struct {
+    FileName string `json:"fileName"`
+    Folder   string `json:"folder,omitempty"`
+    Path     string `json:"path"`
+    Size     int64  `json:"size,omitempty"`
+}
+
+// pluginDecision is what zipper_entry returns
+type pluginDecision struct {
+    Skip     bool    `json:"skip"`
+    FileName *string `json:"fileName"`
+    Folder   *string `json:"folder"`
+}
+
+// plugin is a compiled module and the idle instances of it
+type plugin struct {
+    name     string
+    runtime  wazero.Runtime
+    compiled wazero.CompiledModule
+
+    entry     bool
+    transform bool
+
+    mu   sync.Mutex
+    idle []api.Module
+}
+
+var pluginErrors = newCounter("zipper_plugin_errors_total", "Calls to WASM plugins that failed.", "plugin")
+
+// initPlugins loads the modules in PLUGINS and adds them to the archiver's
+// hooks, in order
+func initPlugins() {
+    if config.Plugins == "" {
+        return
+    }
+
+    ctx := context.Background()
+
+    // Calls are aborted when the download they're for goes away
+    runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+    wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+    for _, path := range strings.Split(config.Plugins, ",") {
+        path = strings.TrimSpace(path)
+        if path == "" {
+            continue
+        }
+
+        p, err := loadPlugin(ctx, runtime, path)
+        if err != nil {
+            fatal("Error loading plugin "+path, err)
+        }
+
+        archiver.Hooks = append(archiver.Hooks, p.hooks())
+        slog.Info("Loaded plugin", "plugin", p.name, "entry", p.entry, "transform", p.transform)
+    }
+}
+
+func loadPlugin(ctx context.Context, runtime wazero.Runtime, path string) (*plugin, error) {
+    code, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    compiled, err := runtime.CompileModule(ctx, code)
+    if err != nil {
+        return nil, err
+    }
+
+    exports := compiled.ExportedFunctions()
+    if exports["zipper_alloc"] == nil {
+        return nil, errors.New("zipper_alloc isn't exported")
+    }
+
+    p := &plugin{
+        name:      strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+        runtime:   runtime,
+        compiled:  compiled,
+        entry:     exports["zipper_entry"] != nil,
+        transform: exports["zipper_transform"] != nil,
+    }
+    if !p.entry && !p.transform {
+        return nil, errors.New("neither zipper_entry nor zipper_transform is exported")
+    }
+
+    // Fail now rather than on the first download
+    mod, err := p.acquire()
+    if err != nil {
+        return nil, err
+    }
+    p.release(mod)
+
+    return p, nil
+}
+
+// acquire takes an idle instance or starts a new one
+func (p *plugin) acquire() (api.Module, error) {
+    p.mu.Lock()
+    if n := len(p.idle); n > 0 {
+        mod := p.idle[n-1]
+        p.idle = p.idle[:n-1]
+        p.mu.Unlock()
+        return mod, nil
+    }
+    p.mu.Unlock()
+
+    // Instances are anonymous so any number can run at once
+    config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize").WithStderr(os.Stderr)
+    return p.runtime.InstantiateModule(context.Background(), p.compiled, config)
+}
+
+// release returns a healthy instance to the pool
+func (p *plugin) release(mod api.Module) {
+    p.mu.Lock()
+    p.idle = append(p.idle, mod)
+    p.mu.Unlock()
+}
+
+// discard closes an instance that failed or was abandoned, its state can't
+// be trusted
+func (p *plugin) discard(mod api.Module) {
+    mod.Close(context.Background())
+}
+
+// call copies input into the instance and runs fn on it, returning a copy
+// of the output
+func (p *plugin) call(ctx context.Context, mod api.Module, fn string, input []byte) ([]byte, uint64, error) {
+    var ptr uint64
+    if len(input) > 0 {
+        results, err := mod.ExportedFunction("zipper_alloc").Call(ctx, uint64(len(input)))
+        if err != nil {
+            return nil, 0, err
+        }
+        ptr = results[0]
+        if !mod.Memory().Write(uint32(ptr), input) {
+            return nil, 0, errors.New("zipper_alloc returned memory out of range")
+        }
+    }
+
+    results, err := mod.ExportedFunction(fn).Call(ctx, ptr, uint64(len(input)))
+    if err != nil {
+        return nil, 0, err
+    }
+    if len(results) == 0 {
+        return nil, 0, nil
+    }
+
+    result := results[0]
+    if fn == "zipper_transform_start" {
+        return nil, result, nil
+    }
+
+    offset, length := uint32(result>>32), uint32(result)
+    if length == 0 {
+        return nil, result, nil
+    }
+
+    output, ok := mod.Memory().Read(offset, length)
+    if !ok {
+        return nil, 0, fmt.Errorf("%s returned memory out of range", fn)
+    }
+    return append([]byte(nil), output...), result, nil
+}
+
+func newPluginEntry(file *archive.File) []byte {
+    data, _ := json.Marshal(pluginEntry{FileName: file.FileName, Folder: file.Folder, Path: file.S3Path, Size: file.Size})
+    return data
+}
+
+func (p *plugin) hooks() archive.Hooks {
+    var hooks archive.Hooks
+    if p.entry {
+        hooks.OnEntryStart = p.onEntryStart
+    }
+    if p.transform {
+        hooks.OnEntryOpen = p.onEntryOpen
+    }
+    return hooks
+}
+
+// onEntryStart asks the plugin what to do with an entry. Entries it fails
+// on are left out, so a broken redaction plugin can't leak anything.
+func (p *plugin) onEntryStart(ctx context.Context, file *archive.File) *archive.File {
+    mod, err := p.acquire()
+    if err != nil {
+        pluginErrors.inc(p.name)
+        slog.ErrorContext(ctx, "Error starting plugin", "plugin", p.name, "error", err)
+        return nil
+    }
+
+    output, _, err := p.call(ctx, mod, "zipper_entry", newPluginEntry(file))
+    if err != nil {
+        p.discard(mod)
+        if ctx.Err() == nil {
+            pluginErrors.inc(p.name)
+            slog.ErrorContext(ctx, "Plugin failed, leaving the file out", "plugin", p.name, "path", file.S3Path, "error", err)
+        }
+        return nil
+    }
+    p.release(mod)
+
+    if len(output) == 0 {
+        return file
+    }
+
+    var decision pluginDecision
+    if err := json.Unmarshal(output, &decision); err != nil {
+        pluginErrors.inc(p.name)
+        slog.ErrorContext(ctx, "Plugin returned invalid JSON, leaving the file out", "plugin", p.name, "path", file.S3Path, "error", err)
+        return nil
+    }
+
+    if decision.Skip {
+        slog.DebugContext(ctx, "Plugin skipped file", "plugin", p.name, "path", file.S3Path)
+        return nil
+    }
+
+    rewritten := *file
+    if decision.FileName != nil {
+        rewritten.FileName = *decision.FileName
+    }
+    if decision.Folder != nil {
+        rewritten.Folder = *decision.Folder
+    }
+    return &rewritten
+}
+
+// onEntryOpen streams an entry through zipper_transform when the plugin
+// wants it
+func (p *plugin) onEntryOpen(ctx context.Context, file *archive.File, body io.Reader) io.Reader {
+    mod, err := p.acquire()
+    if err != nil {
+        pluginErrors.inc(p.name)
+        return &pluginReader{err: fmt.Errorf("plugin %s: %w", p.name, err)}
+    }
+
+    if mod.ExportedFunction("zipper_transform_start") != nil {
+        _, want, err := p.call(ctx, mod, "zipper_transform_start", newPluginEntry(file))
+        if err != nil {
+            p.discard(mod)
+            pluginErrors.inc(p.name)
+            return &pluginReader{err: fmt.Errorf("plugin %s: %w", p.name, err)}
+        }
+        if uint32(want) == 0 {
+            p.release(mod)
+            return body
+        }
+    }
+
+    r := &pluginReader{plugin: p, mod: mod, ctx: ctx, body: body}
+
+    // An entry abandoned part way through still gives its instance up
+    r.stop = context.AfterFunc(ctx, func() { r.finish(errPluginStopped) })
+    return r
+}
+
+var errPluginStopped = errors.New("download stopped")
+
+// pluginReader feeds an entry to zipper_transform a chunk at a time
+type pluginReader struct {
+    plugin *plugin
+    mod    api.Module
+    ctx    context.Context
+    body   io.Reader
+    stop   func() bool
+
+    chunk   []byte
+    pending []byte
+
+    mu  sync.Mutex
+    err error // Set once the entry is finished, io.EOF when it went well
+}
+
+func (r *pluginReader) Read(p []byte) (int, error) {
+    for len(r.pending) == 0 {
+        r.mu.Lock()
+        err := r.err
+        r.mu.Unlock()
+        if err != nil {
+            return 0, err
+        }
+
+        if r.chunk == nil {
+            r.chunk = make([]byte, pluginChunkSize)
+        }
+
+        n, readErr := io.ReadFull(r.body, r.chunk)
+        if n > 0 {
+            output, _, err := r.plugin.call(r.ctx, r.mod, "zipper_transform", r.chunk[:n])
+            if err != nil {
+                return 0, r.fail(err)
+            }
+            r.pending = output
+        }
+
+        if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+            output, _, err := r.plugin.call(r.ctx, r.mod, "zipper_transform", nil)
+            if err != nil {
+                return 0, r.fail(err)
+            }
+            r.pending = append(r.pending, output...)
+            r.finish(io.EOF)
+        } else if readErr != nil {
+            return 0, r.finish(readErr)
+        }
+    }
+
+    n := copy(p, r.pending)
+    r.pending = r.pending[n:]
+    return n, nil
+}
+
+// fail finishes the entry because the plugin failed on it
+func (r *pluginReader) fail(err error) error {
+    if r.ctx.Err() == nil {
+        pluginErrors.inc(r.plugin.name)
+    }
+    return r.finish(fmt.Errorf("plugin %s: %w", r.plugin.name, err))
+}
+
+// finish records how the entry ended and gives up the instance, returning
+// err unless it had already finished
+func (r *pluginReader) finish(err error) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if r.err != nil {
+        return r.err
+    }
+    r.err = err
+
+    if r.stop != nil {
+        r.stop()
+    }
+    if err == io.EOF {
+        r.plugin.release(r.mod)
+    } else {
+        r.plugin.discard(r.mod)
+    }
+    return err
+}
@@ -0,0 +1,134 @@
+//go:build wasip1
+
+// Command redact is an example zipper plugin. It leaves private keys out of
+// archives and masks email addresses in text files. Build it with:
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o redact.wasm ./plugins/redact
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "path"
+    "strings"
+    "unsafe"
+)
+
+var redacted = []byte("[redacted]")
+
+// Files with these extensions have their contents redacted
+var textFiles = map[string]bool{".txt": true, ".csv": true, ".log": true, ".json": true, ".md": true}
+
+type entry struct {
+    FileName string `json:"fileName"`
+    Path     string `json:"path"`
+}
+
+// input is where zipper writes its arguments, output holds the last result
+// until the next call
+var input, output []byte
+
+// line buffers the partial line at the end of the last chunk
+var line []byte
+
+func main() {}
+
+//go:wasmexport zipper_alloc
+func zipperAlloc(size int32) int32 {
+    if cap(input) < int(size) {
+        input = make([]byte, size)
+    }
+    input = input[:size]
+    return int32(uintptr(unsafe.Pointer(unsafe.SliceData(input))))
+}
+
+//go:wasmexport zipper_entry
+func zipperEntry(ptr, size int32) int64 {
+    var e entry
+    json.Unmarshal(input[:size], &e)
+
+    if ext := path.Ext(e.Path); ext == ".pem" || ext == ".key" {
+        return result([]byte(`{"skip":true}`))
+    }
+    return 0
+}
+
+//go:wasmexport zipper_transform_start
+func zipperTransformStart(ptr, size int32) int32 {
+    var e entry
+    json.Unmarshal(input[:size], &e)
+
+    line = line[:0]
+    if textFiles[strings.ToLower(path.Ext(e.FileName))] {
+        return 1
+    }
+    return 0
+}
+
+//go:wasmexport zipper_transform
+func zipperTransform(ptr, size int32) int64 {
+    // The end of the entry, whatever's left is the last line
+    if size == 0 {
+        return result(redact(line))
+    }
+
+    // Only whole lines are redacted, so an address can't straddle chunks
+    line = append(line, input[:size]...)
+    end := bytes.LastIndexByte(line, '\n') + 1
+    out := redact(line[:end])
+    line = append(line[:0], line[end:]...)
+    return result(out)
+}
+
+// redact masks anything that looks like an email address. It scans rather
+// than using regexp, which is slow compiled to WASM.
+func redact(text []byte) []byte {
+    out := make([]byte, 0, len(text))
+    last := 0
+
+    for i := 0; i < len(text); i++ {
+        if text[i] != '@' {
+            continue
+        }
+
+        start := i
+        for start > last && isLocal(text[start-1]) {
+            start--
+        }
+        end := i + 1
+        for end < len(text) && isDomain(text[end]) {
+            end++
+        }
+        for end > i+1 && text[end-1] == '.' {
+            end--
+        }
+
+        dot := bytes.LastIndexByte(text[i+1:end], '.')
+        if start == i || dot <= 0 || end-(i+1+dot) < 3 {
+            continue
+        }
+
+        out = append(out, text[last:start]...)
+        out = append(out, redacted...)
+        last = end
+        i = end - 1
+    }
+
+    return append(out, text[last:]...)
+}
+
+func isLocal(c byte) bool {
+    return isDomain(c) || c == '_' || c == '%' || c == '+'
+}
+
+func isDomain(c byte) bool {
+    return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-'
+}
+
+func result(data []byte) int64 {
+    if len(data) == 0 {
+        return 0
+    }
+    output = data
+    return int64(uintptr(unsafe.Pointer(unsafe.SliceData(output))))<<32 | int64(len(output))
+}
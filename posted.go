@@ -0,0 +1,111 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "io"
+    "log/slog"
+    "net/http"
+)
+
+// Callers making one-off archives can POST the manifest to /v1/download
+// instead of storing it under a token first. The body is a manifest as it
+// would be stored, and is signed like a download link, with ?expires=, ?sig=
+// and optionally ?ip=, but over the hex SHA-256 of the body in place of the
+// token:
+//
+//	sig = hex(HMAC-SHA256(SIGNING_KEY, sha256(body) + "\n" + expires + "\n" + ip))
+//
+// The manifest is never stored, so it can't include tokens, though it can
+// take prefixes. The body's hash stands in for the token in progress, logs
+// and the audit log. Without a SIGNING_KEY anyone could archive anything, so
+// it's refused.
+
+// The largest manifest that can be posted
+const maxPostedManifest = 32 << 20
+
+func postedDownloadHandler(w http.ResponseWriter, r *http.Request) {
+    serveArchive(w, r, authorizePostedManifest)
+}
+
+// authorizePostedManifest checks the signature on a posted manifest and
+// reads it, as authorizeDownload does for tokens
+func authorizePostedManifest(w http.ResponseWriter, r *http.Request) (string, *Manifest, bool) {
+    if secrets().SigningKey == "" {
+        writeProblem(w, r, 403, codeForbidden, "Posted manifests need a SIGNING_KEY")
+        return "", nil, false
+    }
+
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPostedManifest))
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        writeProblem(w, r, 413, codeBadRequest, "The manifest is larger than 32 MiB")
+        return "", nil, false
+    }
+    if err != nil {
+        writeProblem(w, r, 400, codeBadRequest, "Could not read the manifest")
+        return "", nil, false
+    }
+    sum := sha256.Sum256(body)
+    digest := hex.EncodeToString(sum[:])
+
+    if err := checkGlobalIP(clientIP(r)); err != nil {
+        slog.InfoContext(r.Context(), "Rejected download", "token", digest, "ip", clientIP(r), "reason", err)
+        writeProblem(w, r, 403, codeAddressForbidden, err.Error())
+        return "", nil, false
+    }
+
+    if err := verifyDownloadSignature(r, digest); err != nil {
+        slog.InfoContext(r.Context(), "Rejected download", "token", digest, "reason", err)
+        code := codeSignatureInvalid
+        if errors.Is(err, errSignatureExpired) {
+            code = codeTokenExpired
+        }
+        writeProblem(w, r, 403, code, err.Error())
+        return "", nil, false
+    }
+
+    if bearerRequired() {
+        if err := verifyBearer(r); err != nil {
+            slog.InfoContext(r.Context(), "Rejected download", "token", digest, "reason", err)
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            writeProblem(w, r, 401, codeUnauthorized, err.Error())
+            return "", nil, false
+        }
+    }
+
+    manifest := &Manifest{}
+    if err := decodeManifest(bytes.NewReader(body), manifest); err != nil {
+        var problems manifestErrors
+        if errors.As(err, &problems) {
+            writeProblem(w, r, 422, codeManifestInvalid, "The manifest is invalid: "+problems.Error())
+        } else {
+            writeProblem(w, r, 422, codeManifestInvalid, "The manifest could not be read: "+err.Error())
+        }
+        return "", nil, false
+    }
+    for _, include := range manifest.Includes {
+        if include.Token != "" {
+            writeProblem(w, r, 422, codeManifestInvalid, "Posted manifests can't include tokens")
+            return "", nil, false
+        }
+    }
+
+    if !checkManifestAccess(w, r, digest, manifest) {
+        return "", nil, false
+    }
+
+    if err := listPrefixes(r.Context(), manifest); err != nil {
+        writePrefixProblem(w, r, err)
+        return "", nil, false
+    }
+
+    if err := subsetManifest(r, manifest); err != nil {
+        writeProblem(w, r, 400, codeBadRequest, err.Error())
+        return "", nil, false
+    }
+
+    return digest, manifest, true
+}
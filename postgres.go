@@ -0,0 +1,99 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "log/slog"
+    "sync"
+    "time"
+
+    _ "github.com/lib/pq"
+)
+
+// postgresTokenStore keeps manifests in a table, for teams whose source of
+// truth is already their database and who'd rather write tokens in the same
+// transaction as everything else:
+//
+//	CREATE TABLE zipper_tokens (
+//	    token    text PRIMARY KEY,
+//	    manifest jsonb NOT NULL,
+//	    expires  timestamptz
+//	);
+//	CREATE INDEX ON zipper_tokens (expires);
+//
+// Manifests have to be JSON there, and never expire when expires is null.
+// Expired rows are ignored, and swept now and then as tokens are stored.
+type postgresTokenStore struct {
+    db    *sql.DB
+    table string
+
+    sync.Mutex
+    swept time.Time
+}
+
+// How often expired rows are deleted, at most
+const postgresSweepInterval = time.Minute
+
+func newPostgresTokenStore(c Configuration) *postgresTokenStore {
+    // Connections are made as they're needed, a database that's down shows
+    // up on the first lookup
+    db, err := sql.Open("postgres", c.PostgresURL)
+    if err != nil {
+        panic(err)
+    }
+    return &postgresTokenStore{db: db, table: c.PostgresTable}
+}
+
+func (s *postgresTokenStore) Get(ctx context.Context, token string) ([]byte, error) {
+    var manifest []byte
+    err := s.db.QueryRowContext(ctx, fmt.Sprintf(
+        "SELECT manifest FROM %s WHERE token = $1 AND (expires IS NULL OR expires > now())", s.table,
+    ), token).Scan(&manifest)
+    if err == sql.ErrNoRows {
+        return nil, errTokenNotFound
+    }
+    return manifest, err
+}
+
+func (s *postgresTokenStore) Put(ctx context.Context, token string, manifest []byte, ttl time.Duration) error {
+    var expires interface{}
+    if ttl > 0 {
+        expires = time.Now().Add(ttl)
+    }
+
+    _, err := s.db.ExecContext(ctx, fmt.Sprintf(
+        "INSERT INTO %s (token, manifest, expires) VALUES ($1, $2, $3) "+
+            "ON CONFLICT (token) DO UPDATE SET manifest = EXCLUDED.manifest, expires = EXCLUDED.expires", s.table,
+    ), token, string(manifest), expires)
+    if err != nil {
+        return err
+    }
+
+    s.sweep(ctx)
+    return nil
+}
+
+// sweep deletes expired rows, if it's been a while
+func (s *postgresTokenStore) sweep(ctx context.Context) {
+    s.Lock()
+    if time.Since(s.swept) < postgresSweepInterval {
+        s.Unlock()
+        return
+    }
+    s.swept = time.Now()
+    s.Unlock()
+
+    if _, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE expires <= now()", s.table)); err != nil {
+        slog.WarnContext(ctx, "Error sweeping expired tokens", "error", err)
+    }
+}
+
+func (s *postgresTokenStore) Delete(ctx context.Context, token string) (bool, error) {
+    result, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE token = $1", s.table), token)
+    if err != nil {
+        return false, err
+    }
+    deleted, err := result.RowsAffected()
+    return deleted > 0, err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "path"
+    "strings"
+
+    "codecourse/zipper/archive"
+)
+
+// A manifest entry can take every object under a prefix of the tenant's
+// bucket, so producers don't have to list thousands of keys themselves:
+//
+//	{"Type": "prefix", "S3Path": "photos/2024/", "Folder": "photos"}
+//
+// In versioned manifests a file's S3Path can have path.Match wildcards
+// instead, like reports/2024-*/summary.pdf, for every key it matches. * and ?
+// don't match slashes, and \ escapes a key that really has them.
+//
+// Each key keeps its path after the last slash before any wildcard, under
+// the entry's Folder, so the summaries above go in 2024-01/summary.pdf and
+// so on. They're listed once the download's tenant is settled. Between them
+// they can add LIST_MAX_FILES files, and a glob can list LIST_MAX_KEYS keys
+// looking for its matches.
+
+var (
+    errTooManyListedFiles = errors.New("too many files under the prefixes")
+    errTooManyListedKeys  = errors.New("too many keys listed for a glob")
+)
+
+// listPrefixes replaces the manifest's prefixes and globs with the objects
+// they take
+func listPrefixes(ctx context.Context, manifest *Manifest) error {
+    if len(manifest.Includes) == 0 {
+        return nil
+    }
+    t := tenantFor(manifest)
+    lister, _ := t.archiver.Source.(archive.Lister)
+
+    var files []*RedisFile
+    next, listed := 0, 0
+    for _, include := range manifest.Includes {
+        files = append(files, manifest.Files[next:include.At]...)
+        next = include.At
+
+        lister := lister
+        if include.Inventory {
+            if t.inventory == nil {
+                return includeError("there's no S3 Inventory to read %q from", include.Prefix)
+            }
+            lister = t.inventory
+        }
+        if lister == nil {
+            return includeError("the files can't be listed, so prefixes and globs can't be used")
+        }
+
+        // Globs are listed from the part before the first wildcard
+        prefix := include.Prefix
+        if include.Glob != "" {
+            prefix = include.Glob[:strings.IndexAny(include.Glob, `*?[\`)]
+        }
+        base := prefix[:strings.LastIndex(prefix, "/")+1]
+
+        keys := 0
+        err := lister.List(ctx, prefix, func(ref string, info archive.Info) error {
+            // Folder placeholders some tools create
+            if strings.HasSuffix(ref, "/") {
+                return nil
+            }
+            if include.Glob != "" {
+                if keys++; keys > config.ListMaxKeys {
+                    return errTooManyListedKeys
+                }
+                if ok, _ := path.Match(include.Glob, ref); !ok {
+                    return nil
+                }
+            }
+            if listed++; listed > config.ListMaxFiles {
+                return errTooManyListedFiles
+            }
+
+            rel := strings.TrimPrefix(ref, base)
+            folder := path.Dir(rel)
+            if folder == "." {
+                folder = ""
+            }
+            files = append(files, &RedisFile{
+                FileName: path.Base(rel),
+                Folder:   path.Join(include.Folder, folder),
+                S3Path:   ref,
+                Size:     info.Size,
+            })
+            return nil
+        })
+        switch {
+        case errors.Is(err, errTooManyListedFiles):
+            return includeError("the prefixes and globs have more than %d files", config.ListMaxFiles)
+        case errors.Is(err, errTooManyListedKeys):
+            return includeError("more than %d keys were listed looking for %s", config.ListMaxKeys, include.Glob)
+        case err != nil:
+            return fmt.Errorf("listing %s: %w", prefix, err)
+        }
+    }
+    manifest.Files = append(files, manifest.Files[next:]...)
+    manifest.Includes = nil
+    return nil
+}
+
+// writePrefixProblem answers a listPrefixes failure
+func writePrefixProblem(w http.ResponseWriter, r *http.Request, err error) {
+    if errors.Is(err, errManifestInvalid) {
+        writeLookupProblem(w, r, err)
+        return
+    }
+    slog.ErrorContext(r.Context(), "Error listing prefixes", "error", err)
+    s3Errors.inc("list")
+    writeProblem(w, r, 503, codeStorageUnreachable, "Could not list the files of a prefix or glob")
+}
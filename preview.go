@@ -0,0 +1,79 @@
+package main
+
+import (
+    "embed"
+    "fmt"
+    "html/template"
+    "log/slog"
+    "net/http"
+    "net/url"
+)
+
+//go:embed assets
+var assets embed.FS
+
+var previewTemplate = template.Must(template.New("preview.html").
+    Funcs(template.FuncMap{"humanSize": humanSize}).
+    ParseFS(assets, "assets/preview.html"))
+
+type previewPage struct {
+    Name        string
+    Count       int
+    TotalSize   int64
+    DownloadURL string
+    Files       []fileStatus
+}
+
+// humanSize formats a byte count for people, e.g. "4.2 GB"
+func humanSize(n int64) string {
+    const unit = 1000
+    if n < unit {
+        return fmt.Sprintf("%d B", n)
+    }
+
+    div, exp := int64(unit), 0
+    for m := n / unit; m >= unit; m /= unit {
+        div *= unit
+        exp++
+    }
+
+    return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
+
+// previewHandler serves a human readable page listing a token's archive
+// with a link to download it
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+    if !config.HTMLPreview {
+        writeProblem(w, r, 404, codeNotFound, "Previews are disabled")
+        return
+    }
+
+    token, manifest, ok := authorizeDownload(w, r)
+    if !ok {
+        return
+    }
+
+    page := previewPage{
+        Name:  downloadName(r, manifest),
+        Files: headFiles(r.Context(), manifest, true),
+    }
+    for _, file := range page.Files {
+        if file.Exists {
+            page.Count++
+            page.TotalSize += file.Size
+        }
+    }
+
+    // Carry signatures and the like over to the download link
+    query := r.URL.Query()
+    query.Del("token")
+    page.DownloadURL = "download/" + url.PathEscape(token)
+    if len(query) > 0 {
+        page.DownloadURL += "?" + query.Encode()
+    }
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    if err := previewTemplate.Execute(w, page); err != nil {
+        slog.ErrorContext(r.Context(), "Error rendering preview", "error", err)
+    }
+}
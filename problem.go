@@ -0,0 +1,93 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+)
+
+// Machine-readable error codes returned in problem responses
+const (
+    codeTokenMissing       = "token_missing"
+    codeTokenMalformed     = "token_malformed"
+    codeTokenInvalid       = "token_invalid"
+    codeTokenNotFound      = "token_not_found"
+    codeTokenRevoked       = "token_revoked"
+    codeManifestInvalid    = "manifest_invalid"
+    codeTokenExpired       = "token_expired"
+    codeSignatureInvalid   = "signature_invalid"
+    codeUnauthorized       = "unauthorized"
+    codeForbidden          = "forbidden"
+    codeAddressForbidden   = "address_forbidden"
+    codeRateLimited        = "rate_limited"
+    codeLockedOut          = "locked_out"
+    codeQuotaExceeded      = "quota_exceeded"
+    codeArchiveTooLarge    = "archive_too_large"
+    codeArchiveEmpty       = "archive_empty"
+    codeBadRequest         = "bad_request"
+    codeNotFound           = "not_found"
+    codeMethodNotAllowed   = "method_not_allowed"
+    codeStorageUnreachable = "storage_unreachable"
+    codeJobNotFound        = "job_not_found"
+    codeJobQueueFull       = "job_queue_full"
+    codeInternal           = "internal_error"
+)
+
+// problem is an RFC 7807 problem details body
+type problem struct {
+    Type     string `json:"type"`
+    Title    string `json:"title"`
+    Status   int    `json:"status"`
+    Code     string `json:"code"`
+    Detail   string `json:"detail,omitempty"`
+    Instance string `json:"instance,omitempty"`
+}
+
+// writeProblem replies with an application/problem+json body
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+    w.Header().Set("Content-Type", "application/problem+json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(status)
+
+    // Server side failures show on the admin dashboard
+    if status >= 500 {
+        recordError(r.Method + " " + r.URL.Path + ": " + code + " " + detail)
+        captureMessage("error", r, code+": "+detail, map[string]interface{}{"status": status})
+    }
+
+    json.NewEncoder(w).Encode(problem{
+        Type:     "urn:zipper:problem:" + code,
+        Title:    http.StatusText(status),
+        Status:   status,
+        Code:     code,
+        Detail:   detail,
+        Instance: r.URL.Path,
+    })
+}
+
+// writeLookupProblem maps a manifest lookup failure to its status and code
+func writeLookupProblem(w http.ResponseWriter, r *http.Request, err error) {
+    switch {
+    case errors.Is(err, errTokenNotFound):
+        writeProblem(w, r, 404, codeTokenNotFound, "No archive exists for this token")
+    case errors.Is(err, errTokenRevoked):
+        writeProblem(w, r, 410, codeTokenRevoked, "This token has been revoked")
+    case errors.Is(err, errJWTExpired), errors.Is(err, errPASETOExpired):
+        writeProblem(w, r, 401, codeTokenExpired, err.Error())
+    case errors.Is(err, errTokenInvalid):
+        writeProblem(w, r, 401, codeTokenInvalid, err.Error())
+    case errors.Is(err, errManifestInvalid):
+        // Versioned manifests say what's wrong with them, for whoever
+        // produced them
+        var problems manifestErrors
+        if errors.As(err, &problems) {
+            writeProblem(w, r, 422, codeManifestInvalid, "The manifest for this token is invalid: "+problems.Error())
+            return
+        }
+        writeProblem(w, r, 422, codeManifestInvalid, "The manifest for this token could not be read")
+    case errors.Is(err, errStoreUnavailable):
+        writeProblem(w, r, 503, codeStorageUnreachable, "The token store is unavailable")
+    default:
+        writeProblem(w, r, 500, codeInternal, "")
+    }
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "golang.org/x/net/websocket"
+)
+
+// Progress event types
+const (
+    progressUpdated = "progress"
+    progressError   = "error"
+    progressDone    = "done"
+)
+
+// How often an idle stream is pinged so proxies don't close it
+const progressHeartbeat = 15 * time.Second
+
+// progressEvent is what progress subscribers are sent. Error on a "done"
+// event means the archive as a whole failed.
+type progressEvent struct {
+    Event         string `json:"-"`
+    RequestID     string `json:"requestId,omitempty"`
+    State         string `json:"state,omitempty"`
+    FilesDone     int    `json:"filesDone"`
+    FilesTotal    int    `json:"filesTotal"`
+    BytesStreamed int64  `json:"bytesStreamed"`
+    CurrentFile   string `json:"currentFile,omitempty"`
+    Error         string `json:"error,omitempty"`
+}
+
+// progressSubscribers maps a download token or job key to the channels
+// listening for its events
+var progressSubscribers = struct {
+    sync.Mutex
+    channels map[string]map[chan progressEvent]bool
+}{channels: map[string]map[chan progressEvent]bool{}}
+
+func tokenProgressKey(token string) string {
+    return "token:" + token
+}
+
+func jobProgressKey(id string) string {
+    return "job:" + id
+}
+
+func subscribeProgress(key string) (events chan progressEvent, unsubscribe func()) {
+    events = make(chan progressEvent, 16)
+
+    progressSubscribers.Lock()
+    if progressSubscribers.channels[key] == nil {
+        progressSubscribers.channels[key] = map[chan progressEvent]bool{}
+    }
+    progressSubscribers.channels[key][events] = true
+    progressSubscribers.Unlock()
+
+    return events, func() {
+        progressSubscribers.Lock()
+        delete(progressSubscribers.channels[key], events)
+        if len(progressSubscribers.channels[key]) == 0 {
+            delete(progressSubscribers.channels, key)
+        }
+        progressSubscribers.Unlock()
+    }
+}
+
+// progressChannel is where events are relayed through Redis pub/sub, so a
+// progress stream on one replica follows a download on another. Without
+// Redis pub/sub, as with the dev Redis, they only reach subscribers on the
+// same replica.
+func progressChannel() string {
+    return redisKey("progress:events")
+}
+
+// How many events can wait to be published before progress updates are
+// dropped
+const progressOutboxSize = 1024
+
+var (
+    progressRelay  atomic.Bool
+    progressOutbox = make(chan relayedEvent, progressOutboxSize)
+)
+
+// relayedEvent is an event on its way through progressChannel
+type relayedEvent struct {
+    Key string `json:"key"`
+    wsProgressMessage
+}
+
+// startProgressRelay subscribes to progressChannel, delivering what every
+// replica publishes to this one's subscribers, and starts publishing this
+// replica's events there
+func startProgressRelay() {
+    if *devMode {
+        return
+    }
+
+    pubsub := redisClient.Subscribe(context.Background(), progressChannel())
+    if _, err := pubsub.Receive(context.Background()); err != nil {
+        slog.Warn("Progress events will only reach this replica's subscribers", "error", err)
+        pubsub.Close()
+        return
+    }
+    progressRelay.Store(true)
+
+    go func() {
+        for message := range pubsub.Channel() {
+            var relayed relayedEvent
+            if err := json.Unmarshal([]byte(message.Payload), &relayed); err != nil {
+                continue
+            }
+            relayed.progressEvent.Event = relayed.Event
+            deliverEvent(relayed.Key, relayed.progressEvent)
+        }
+    }()
+
+    go func() {
+        for relayed := range progressOutbox {
+            data, _ := json.Marshal(relayed)
+            if err := redisClient.Publish(context.Background(), progressChannel(), data).Err(); err != nil {
+                slog.Error("Error publishing progress", "error", err)
+                deliverEvent(relayed.Key, relayed.progressEvent)
+            }
+        }
+    }()
+}
+
+// publishEvent sends an event to its subscribers on every replica. It never
+// blocks the archive for progress updates, which are dropped when Redis
+// falls behind, but waits to queue errors and completion.
+func publishEvent(key string, event progressEvent) {
+    if !progressRelay.Load() {
+        deliverEvent(key, event)
+        return
+    }
+
+    relayed := relayedEvent{Key: key, wsProgressMessage: wsProgressMessage{Event: event.Event, progressEvent: event}}
+    if event.Event != progressUpdated {
+        progressOutbox <- relayed
+        return
+    }
+    select {
+    case progressOutbox <- relayed:
+    default:
+    }
+}
+
+// deliverEvent sends an event to this replica's subscribers. Slow
+// subscribers miss progress events, but make room for errors and
+// completion.
+func deliverEvent(key string, event progressEvent) {
+    progressSubscribers.Lock()
+    defer progressSubscribers.Unlock()
+
+    for events := range progressSubscribers.channels[key] {
+        select {
+        case events <- event:
+            continue
+        default:
+        }
+
+        if event.Event == progressUpdated {
+            continue
+        }
+
+        select {
+        case <-events:
+        default:
+        }
+        select {
+        case events <- event:
+        default:
+        }
+    }
+}
+
+// publishProgress turns an archive update into an event for subscribers
+func publishProgress(key, requestID string, filesTotal int, update archiveUpdate) {
+    event := progressEvent{
+        Event:         progressUpdated,
+        RequestID:     requestID,
+        FilesDone:     update.FilesDone,
+        FilesTotal:    filesTotal,
+        BytesStreamed: update.BytesWritten,
+        CurrentFile:   update.CurrentFile,
+        Error:         update.Error,
+    }
+    if update.Error != "" {
+        event.Event = progressError
+    }
+    publishEvent(key, event)
+}
+
+// jobEvent describes a job's current state as an event
+func jobEvent(job *Job) progressEvent {
+    event := progressEvent{
+        Event:         progressUpdated,
+        RequestID:     job.RequestID,
+        State:         job.State,
+        FilesDone:     job.FilesDone,
+        FilesTotal:    job.FilesTotal,
+        BytesStreamed: job.BytesStreamed,
+        Error:         job.Error,
+    }
+    if jobFinished(job) {
+        event.Event = progressDone
+    }
+    return event
+}
+
+// Download snapshot states
+const (
+    downloadStreaming = "streaming"
+    downloadDone      = "done"
+    downloadFailed    = "failed"
+)
+
+// downloadSnapshot is the progress of a single download, kept in Redis at
+// "progress:<id>" for anything that isn't on the connection
+type downloadSnapshot struct {
+    ID            string    `json:"id"`
+    RequestID     string    `json:"requestId,omitempty"`
+    Token         string    `json:"token"`
+    State         string    `json:"state"`
+    FilesTotal    int       `json:"filesTotal"`
+    FilesDone     int       `json:"filesDone"`
+    BytesStreamed int64     `json:"bytesStreamed"`
+    CurrentFile   string    `json:"currentFile,omitempty"`
+    LastError     string    `json:"lastError,omitempty"`
+    StartedAt     time.Time `json:"startedAt"`
+    UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+func newDownloadSnapshot(requestID, token string, filesTotal int) *downloadSnapshot {
+    return &downloadSnapshot{
+        ID:         newToken(),
+        RequestID:  requestID,
+        Token:      token,
+        State:      downloadStreaming,
+        FilesTotal: filesTotal,
+        StartedAt:  time.Now().UTC(),
+    }
+}
+
+func (d *downloadSnapshot) update(update archiveUpdate) {
+    d.FilesDone = update.FilesDone
+    d.BytesStreamed = update.BytesWritten
+    d.CurrentFile = update.CurrentFile
+    if update.Error != "" {
+        d.LastError = update.CurrentFile + ": " + update.Error
+    }
+}
+
+// save writes the snapshot to Redis. Failures are only logged, progress
+// isn't worth breaking a download over.
+func (d *downloadSnapshot) save() {
+    if config.ProgressTTL <= 0 {
+        return
+    }
+
+    d.UpdatedAt = time.Now().UTC()
+
+    data, err := json.Marshal(d)
+    if err != nil {
+        return
+    }
+
+    if err := redisClient.Set(context.Background(), redisKey("progress:"+d.ID), data, config.ProgressTTL).Err(); err != nil {
+        slog.Error("Error saving download progress", "download_id", d.ID, "error", err)
+    }
+}
+
+// openProgress subscribes to the events for the download token or ?job=<id>
+// being asked about. Tokens have to pass the same checks as a download of
+// them, jobs need an API key that could read their status. Jobs also get
+// their current state to start with. The caller must unsubscribe once ok.
+func openProgress(w http.ResponseWriter, r *http.Request) (initial *progressEvent, events chan progressEvent, unsubscribe func(), ok bool) {
+    if id := r.URL.Query().Get("job"); id != "" {
+        if !checkAPIKey(w, r, scopeArchivesRead) {
+            return nil, nil, nil, false
+        }
+
+        // Subscribe first so nothing is missed between loading and listening
+        events, unsubscribe = subscribeProgress(jobProgressKey(id))
+
+        job, err := loadJob(r.Context(), id)
+        if err == errJobNotFound {
+            unsubscribe()
+            writeProblem(w, r, 404, codeJobNotFound, "No job exists with this ID")
+            return nil, nil, nil, false
+        }
+        if err != nil {
+            unsubscribe()
+            writeProblem(w, r, 503, codeStorageUnreachable, "Could not load the job")
+            return nil, nil, nil, false
+        }
+
+        event := jobEvent(job)
+        return &event, events, unsubscribe, true
+    }
+
+    // Combined downloads are followed with the same list of tokens
+    if len(requestTokens(r)) == 0 {
+        writeProblem(w, r, 400, codeTokenMissing, "A token or job parameter is required")
+        return nil, nil, nil, false
+    }
+    token, _, ok := authorizeTokens(w, r)
+    if !ok {
+        return nil, nil, nil, false
+    }
+
+    events, unsubscribe = subscribeProgress(tokenProgressKey(token))
+    return nil, events, unsubscribe, true
+}
+
+// progressHandler streams Server-Sent Events for a download token, or a
+// background job when called with ?job=<id>
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+    initial, events, unsubscribe, ok := openProgress(w, r)
+    if !ok {
+        return
+    }
+    defer unsubscribe()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("X-Accel-Buffering", "no")
+    w.WriteHeader(200)
+
+    rc := http.NewResponseController(w)
+    rc.SetWriteDeadline(time.Time{})
+
+    send := func(event progressEvent) bool {
+        data, _ := json.Marshal(event)
+        fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, data)
+        rc.Flush()
+        return event.Event != progressDone
+    }
+
+    if initial != nil && !send(*initial) {
+        return
+    }
+    rc.Flush()
+
+    heartbeat := time.NewTicker(progressHeartbeat)
+    defer heartbeat.Stop()
+
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case <-heartbeat.C:
+            fmt.Fprint(w, ": ping\n\n")
+            rc.Flush()
+        case event := <-events:
+            if !send(event) {
+                return
+            }
+        }
+    }
+}
+
+// wsProgressMessage is a progress event as sent over a WebSocket, where the
+// event type has to travel in the message itself
+type wsProgressMessage struct {
+    Event string `json:"event"`
+    progressEvent
+}
+
+// wsProgressHandler publishes the same events as progressHandler over a
+// WebSocket, once the same checks have passed and before upgrading
+func wsProgressHandler(w http.ResponseWriter, r *http.Request) {
+    initial, events, unsubscribe, ok := openProgress(w, r)
+    if !ok {
+        return
+    }
+    defer unsubscribe()
+
+    server := websocket.Server{
+        Handshake: wsCheckOrigin,
+        Handler: func(ws *websocket.Conn) {
+            send := func(event progressEvent) bool {
+                if err := websocket.JSON.Send(ws, wsProgressMessage{Event: event.Event, progressEvent: event}); err != nil {
+                    return false
+                }
+                return event.Event != progressDone
+            }
+
+            if initial != nil && !send(*initial) {
+                return
+            }
+
+            // Clients don't send anything, reading just notices them leaving
+            closed := make(chan struct{})
+            go func() {
+                var discard []byte
+                for websocket.Message.Receive(ws, &discard) == nil {
+                }
+                close(closed)
+            }()
+
+            heartbeat := time.NewTicker(progressHeartbeat)
+            defer heartbeat.Stop()
+
+            for {
+                select {
+                case <-closed:
+                    return
+                case <-heartbeat.C:
+                    ws.PayloadType = websocket.PingFrame
+                    _, err := ws.Write(nil)
+                    ws.PayloadType = websocket.TextFrame
+                    if err != nil {
+                        return
+                    }
+                case event := <-events:
+                    if !send(event) {
+                        return
+                    }
+                }
+            }
+        },
+    }
+
+    server.ServeHTTP(w, r)
+}
+
+// wsCheckOrigin only lets browsers on an allowed CORS origin connect, or any
+// origin when CORS isn't configured
+func wsCheckOrigin(_ *websocket.Config, r *http.Request) error {
+    origin := r.Header.Get("Origin")
+    if origin == "" || !corsEnabled() || corsOrigin(origin) != "" {
+        return nil
+    }
+    return errors.New("origin not allowed")
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+)
+
+// Just enough of the protobuf wire format for the gRPC API's messages, see
+// proto/zipper.proto
+
+// Wire types
+const (
+    protoVarint  = 0
+    protoFixed64 = 1
+    protoBytes   = 2
+    protoFixed32 = 5
+)
+
+var errProtoMalformed = errors.New("malformed protobuf message")
+
+func protoAppendTag(b []byte, field, wireType int) []byte {
+    return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// protoAppendInt leaves out zero values, as proto3 does
+func protoAppendInt(b []byte, field int, v int64) []byte {
+    if v == 0 {
+        return b
+    }
+    b = protoAppendTag(b, field, protoVarint)
+    return binary.AppendUvarint(b, uint64(v))
+}
+
+func protoAppendBytes(b []byte, field int, v []byte) []byte {
+    if len(v) == 0 {
+        return b
+    }
+    b = protoAppendTag(b, field, protoBytes)
+    b = binary.AppendUvarint(b, uint64(len(v)))
+    return append(b, v...)
+}
+
+func protoAppendString(b []byte, field int, v string) []byte {
+    return protoAppendBytes(b, field, []byte(v))
+}
+
+// protoAppendMessage always writes the field, an empty message still counts
+// as an entry in a repeated field
+func protoAppendMessage(b []byte, field int, message []byte) []byte {
+    b = protoAppendTag(b, field, protoBytes)
+    b = binary.AppendUvarint(b, uint64(len(message)))
+    return append(b, message...)
+}
+
+// protoField is one decoded field. Varints are in value, length delimited
+// fields in data.
+type protoField struct {
+    number   int
+    wireType int
+    value    uint64
+    data     []byte
+}
+
+// protoDecode calls fn with each field of a message in turn, skipping over
+// fixed width fields nothing here uses
+func protoDecode(b []byte, fn func(field protoField) error) error {
+    for len(b) > 0 {
+        tag, n := binary.Uvarint(b)
+        if n <= 0 {
+            return errProtoMalformed
+        }
+        b = b[n:]
+
+        field := protoField{number: int(tag >> 3), wireType: int(tag & 7)}
+        switch field.wireType {
+        case protoVarint:
+            field.value, n = binary.Uvarint(b)
+            if n <= 0 {
+                return errProtoMalformed
+            }
+            b = b[n:]
+        case protoBytes:
+            length, n := binary.Uvarint(b)
+            if n <= 0 || uint64(len(b)-n) < length {
+                return errProtoMalformed
+            }
+            field.data = b[n : n+int(length)]
+            b = b[n+int(length):]
+        case protoFixed64:
+            if len(b) < 8 {
+                return errProtoMalformed
+            }
+            b = b[8:]
+            continue
+        case protoFixed32:
+            if len(b) < 4 {
+                return errProtoMalformed
+            }
+            b = b[4:]
+            continue
+        default:
+            return errProtoMalformed
+        }
+
+        if err := fn(field); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func marshalProtoFile(file *RedisFile) []byte {
+    var b []byte
+    b = protoAppendString(b, 1, file.FileName)
+    b = protoAppendString(b, 2, file.Folder)
+    b = protoAppendString(b, 3, file.S3Path)
+    b = protoAppendInt(b, 4, file.Size)
+    return b
+}
+
+func unmarshalProtoFile(b []byte) (*RedisFile, error) {
+    entry, err := unmarshalProtoEntry(b)
+    return &entry.RedisFile, err
+}
+
+// unmarshalProtoEntry reads a File message of a stored manifest, which can
+// be a token to include
+func unmarshalProtoEntry(b []byte) (*manifestEntry, error) {
+    entry := &manifestEntry{}
+    file := &entry.RedisFile
+    err := protoDecode(b, func(field protoField) error {
+        switch field.number {
+        case 1:
+            file.FileName = string(field.data)
+        case 2:
+            file.Folder = string(field.data)
+        case 3:
+            file.S3Path = string(field.data)
+        case 4:
+            file.Size = int64(field.value)
+        case 5:
+            entry.Type = string(field.data)
+        case 6:
+            entry.Token = string(field.data)
+        }
+        return nil
+    })
+    return entry, err
+}
+
+// unmarshalProtoManifest reads a Manifest message, as stored manifests can
+// be as well as JSON
+func unmarshalProtoManifest(b []byte, manifest *Manifest) error {
+    var unknown manifestErrors
+    err := protoDecode(b, func(field protoField) error {
+        switch field.number {
+        case 1:
+            entry, err := unmarshalProtoEntry(field.data)
+            if err != nil {
+                return err
+            }
+            return manifest.addEntry(entry)
+        case 2:
+            manifest.AllowedSubjects = append(manifest.AllowedSubjects, string(field.data))
+        case 3:
+            manifest.AllowedCIDRs = append(manifest.AllowedCIDRs, string(field.data))
+        case 4:
+            manifest.DeniedCIDRs = append(manifest.DeniedCIDRs, string(field.data))
+        case 5:
+            manifest.Version = int(int32(field.value))
+        case 6:
+            manifest.Tenant = string(field.data)
+        case 7:
+            manifest.Owner = string(field.data)
+        case 8:
+            manifest.ArchiveName = string(field.data)
+        case 9:
+            manifest.ExtractTo = string(field.data)
+        default:
+            unknown = append(unknown, fmt.Sprintf("unknown field %d", field.number))
+        }
+        return nil
+    })
+    if err == nil && manifest.Version != 0 && len(unknown) > 0 {
+        return unknown
+    }
+    return err
+}
+
+func marshalProtoJob(job *Job) []byte {
+    var b []byte
+    b = protoAppendString(b, 1, job.ID)
+    b = protoAppendString(b, 2, job.State)
+    b = protoAppendInt(b, 3, int64(job.FilesTotal))
+    b = protoAppendInt(b, 4, int64(job.FilesDone))
+    b = protoAppendInt(b, 5, job.BytesStreamed)
+    b = protoAppendString(b, 6, job.CurrentFile)
+    b = protoAppendString(b, 7, job.ResultURL)
+    b = protoAppendString(b, 8, job.Error)
+    return b
+}
+
+// protoStringField reads a request made of a single string field, which is
+// all of them apart from CreateToken
+func protoStringField(b []byte, number int) (string, error) {
+    var value string
+    err := protoDecode(b, func(field protoField) error {
+        if field.number == number {
+            value = string(field.data)
+        }
+        return nil
+    })
+    return value, err
+}
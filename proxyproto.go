@@ -0,0 +1,167 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+    "net/netip"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// How long a client has to send the PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyListener accepts connections prefixed with a HAProxy PROXY protocol
+// (v1 or v2) header and reports the client address it carries
+type proxyListener struct {
+    net.Listener
+    trusted []netip.Prefix
+}
+
+func newProxyListener(ln net.Listener) net.Listener {
+    return &proxyListener{Listener: ln, trusted: parsePrefixes(strings.Split(config.ProxyProtocolTrusted, ","))}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+    c, err := l.Listener.Accept()
+    if err != nil {
+        return nil, err
+    }
+    return &proxyConn{Conn: c, br: bufio.NewReader(c), listener: l}, nil
+}
+
+// trusts reports whether the peer is allowed to send PROXY headers. With no
+// trusted CIDRs configured none is, anyone could claim any address.
+func (l *proxyListener) trusts(addr net.Addr) bool {
+    tcp, ok := addr.(*net.TCPAddr)
+    if !ok {
+        return false
+    }
+
+    ip, ok := netip.AddrFromSlice(tcp.IP)
+    return ok && containsAddr(l.trusted, ip.Unmap())
+}
+
+// proxyConn reads the PROXY header lazily, on the connection's own
+// goroutine, so a slow client can't stall Accept
+type proxyConn struct {
+    net.Conn
+    br       *bufio.Reader
+    listener *proxyListener
+
+    once   sync.Once
+    remote net.Addr
+    err    error
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+    c.once.Do(c.readHeader)
+    if c.err != nil {
+        return 0, c.err
+    }
+    return c.br.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+    c.once.Do(c.readHeader)
+    if c.remote != nil {
+        return c.remote
+    }
+    return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+    if !c.listener.trusts(c.Conn.RemoteAddr()) {
+        return
+    }
+
+    c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+    defer c.Conn.SetReadDeadline(time.Time{})
+
+    if sig, err := c.br.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+        c.remote, c.err = readProxyV2(c.br)
+    } else {
+        c.remote, c.err = readProxyV1(c.br)
+    }
+
+    if c.err != nil {
+        c.Conn.Close()
+    }
+}
+
+// readProxyV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n"
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+    line, err := br.ReadString('\n')
+    if err != nil || len(line) > 107 || !strings.HasSuffix(line, "\r\n") {
+        return nil, errProxyHeader
+    }
+
+    fields := strings.Fields(line)
+    if len(fields) < 2 || fields[0] != "PROXY" {
+        return nil, errProxyHeader
+    }
+
+    if fields[1] == "UNKNOWN" {
+        return nil, nil
+    }
+
+    if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+        return nil, errProxyHeader
+    }
+
+    ip := net.ParseIP(fields[2])
+    port, err := strconv.Atoi(fields[4])
+    if ip == nil || err != nil {
+        return nil, errProxyHeader
+    }
+
+    return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 parses the binary v2 header
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+    header := make([]byte, 16)
+    if _, err := io.ReadFull(br, header); err != nil {
+        return nil, errProxyHeader
+    }
+
+    if header[12]>>4 != 2 {
+        return nil, errProxyHeader
+    }
+
+    body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+    if _, err := io.ReadFull(br, body); err != nil {
+        return nil, errProxyHeader
+    }
+
+    // LOCAL connections (e.g. health checks) keep the real peer address
+    if header[12]&0x0f == 0 {
+        return nil, nil
+    }
+
+    switch header[13] {
+    case 0x11: // TCP over IPv4
+        if len(body) < 12 {
+            return nil, errProxyHeader
+        }
+        return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+    case 0x21: // TCP over IPv6
+        if len(body) < 36 {
+            return nil, errProxyHeader
+        }
+        return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+    }
+
+    // Unsupported families are accepted without address information
+    return nil, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+
+    goredis "github.com/redis/go-redis/v9"
+)
+
+// Tenants can be held to quotas, so one team can't take the service from
+// the others. Each is optional, unset or 0 for no limit:
+//
+//	TENANT_ACME_MAX_BYTES=100000000000    bytes streamed per TENANT_QUOTA_WINDOW
+//	TENANT_ACME_MAX_ARCHIVES=1000         archives started per TENANT_QUOTA_WINDOW
+//	TENANT_ACME_MAX_CONCURRENT=5          archives building at once
+//
+// Usage is counted in Redis, so the quotas hold across replicas. Windows are
+// fixed, like RATE_LIMIT_WINDOW's. Bytes are only known once an archive is
+// done, so the last archive of a window can take a tenant over.
+
+// tenantQuota is a tenant's limits, 0 for none
+type tenantQuota struct {
+    MaxBytes      int64
+    MaxArchives   int
+    MaxConcurrent int
+}
+
+func (q tenantQuota) limited() bool {
+    return q.MaxBytes > 0 || q.MaxArchives > 0 || q.MaxConcurrent > 0
+}
+
+func loadTenantQuota(prefix string) tenantQuota {
+    return tenantQuota{
+        MaxBytes:      int64(getEnvInt(prefix+"MAX_BYTES", 0)),
+        MaxArchives:   getEnvInt(prefix+"MAX_ARCHIVES", 0),
+        MaxConcurrent: getEnvInt(prefix+"MAX_CONCURRENT", 0),
+    }
+}
+
+// quotaError is a refusal for being over quota
+type quotaError struct {
+    message    string
+    retryAfter time.Duration // 0 when it depends on other archives finishing
+}
+
+func (e *quotaError) Error() string {
+    return e.message
+}
+
+// writeQuotaProblem refuses a request startTenantArchive turned down
+func writeQuotaProblem(w http.ResponseWriter, r *http.Request, err error) {
+    if quota, ok := err.(*quotaError); ok && quota.retryAfter > 0 {
+        w.Header().Set("Retry-After", strconv.Itoa(int(quota.retryAfter.Seconds())))
+    }
+    writeProblem(w, r, 429, codeQuotaExceeded, err.Error())
+}
+
+// tenantUsageKey holds one of a tenant's counters. The tenant is a hash tag
+// so they're all on one Redis Cluster node.
+func tenantUsageKey(tenant, counter string) string {
+    return redisKey("quota:{" + tenant + "}:" + counter)
+}
+
+// quotaWindow is the start of the current window and how long it has left
+func quotaWindow() (start int64, left time.Duration) {
+    window := int64(config.TenantQuotaWindow / time.Second)
+    if window <= 0 {
+        window = 86400
+    }
+    now := time.Now().Unix()
+    start = now - now%window
+    return start, time.Duration(start+window-now) * time.Second
+}
+
+// startTenantArchive counts an archive against its tenant's quotas before
+// it's built, refusing with a *quotaError when it's over one. id is the
+// download or job ID. finish must be called with the bytes written once
+// it's done, whatever happened.
+func startTenantArchive(ctx context.Context, manifest *Manifest, id string) (finish func(bytes int64), err error) {
+    name := manifest.Tenant
+    t, ok := tenants[name]
+    if !ok || !t.quota.limited() {
+        return func(int64) {}, nil
+    }
+    quota := t.quota
+
+    start, left := quotaWindow()
+    window := strconv.FormatInt(start, 10)
+    bytesKey := tenantUsageKey(name, "bytes:"+window)
+    archivesKey := tenantUsageKey(name, "archives:"+window)
+    activeKey := tenantUsageKey(name, "active")
+
+    // Archives on replicas that died are dropped once they'd have timed out
+    now := time.Now()
+    stale := now.Add(-config.WriteTimeout)
+
+    var used *goredis.StringCmd
+    var archives, active *goredis.IntCmd
+    _, err = redisClient.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+        used = pipe.Get(ctx, bytesKey)
+        archives = pipe.Incr(ctx, archivesKey)
+        pipe.Expire(ctx, archivesKey, left+time.Minute)
+        pipe.ZRemRangeByScore(ctx, activeKey, "-inf", strconv.FormatInt(stale.Unix(), 10))
+        pipe.ZAdd(ctx, activeKey, goredis.Z{Score: float64(now.Unix()), Member: id})
+        active = pipe.ZCard(ctx, activeKey)
+        return nil
+    })
+    if err != nil && err != goredis.Nil {
+        // Don't take the service down with Redis
+        slog.WarnContext(ctx, "Tenant quotas unavailable", "tenant", name, "error", err)
+        return func(int64) {}, nil
+    }
+
+    bytes, _ := used.Int64()
+    refuse := func(format string, args ...interface{}) *quotaError {
+        redisClient.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+            pipe.Decr(ctx, archivesKey)
+            pipe.ZRem(ctx, activeKey, id)
+            return nil
+        })
+        return &quotaError{message: fmt.Sprintf("Tenant %s "+format, append([]interface{}{name}, args...)...), retryAfter: left}
+    }
+
+    switch {
+    case quota.MaxBytes > 0 && bytes >= quota.MaxBytes:
+        return nil, refuse("has streamed %d of its %d bytes for this period", bytes, quota.MaxBytes)
+    case quota.MaxBytes > 0 && bytes+manifestSize(manifest) > quota.MaxBytes:
+        return nil, refuse("has %d of its %d bytes left for this period, too few for this archive", quota.MaxBytes-bytes, quota.MaxBytes)
+    case quota.MaxArchives > 0 && archives.Val() > int64(quota.MaxArchives):
+        return nil, refuse("has started all %d of its archives for this period", quota.MaxArchives)
+    case quota.MaxConcurrent > 0 && active.Val() > int64(quota.MaxConcurrent):
+        err := refuse("already has %d archives building, its limit", quota.MaxConcurrent)
+        err.retryAfter = 0
+        return nil, err
+    }
+
+    return func(written int64) {
+        // The request's context may be gone by now
+        ctx := context.WithoutCancel(ctx)
+        _, err := redisClient.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+            pipe.ZRem(ctx, activeKey, id)
+            pipe.IncrBy(ctx, bytesKey, written)
+            pipe.Expire(ctx, bytesKey, left+time.Minute)
+            return nil
+        })
+        if err != nil {
+            slog.WarnContext(ctx, "Error recording tenant usage", "tenant", name, "error", err)
+        }
+    }, nil
+}
+
+// manifestSize is the total of the sizes the manifest gives, which can be
+// less than the archive when some are missing
+func manifestSize(manifest *Manifest) (size int64) {
+    for _, file := range manifest.Files {
+        if file != nil && file.Size > 0 {
+            size += file.Size
+        }
+    }
+    return size
+}
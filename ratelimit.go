@@ -0,0 +1,79 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "sync/atomic"
+    "time"
+
+    goredis "github.com/redis/go-redis/v9"
+)
+
+// rateLimitPolicy is RATE_LIMIT and RATE_LIMIT_WINDOW, swapped whole when
+// they're reloaded
+type rateLimitPolicy struct {
+    limit  int
+    window int64
+}
+
+var rateLimits atomic.Pointer[rateLimitPolicy]
+
+func initRateLimit() {
+    loadRateLimit(config)
+}
+
+func loadRateLimit(c Configuration) {
+    policy := &rateLimitPolicy{limit: c.RateLimit, window: int64(c.RateLimitWindow)}
+    if policy.window <= 0 {
+        policy.window = 60
+    }
+    rateLimits.Store(policy)
+}
+
+// allowRequest counts a request against the client's fixed window in Redis
+// so the limit holds across replicas. It returns how long to wait when the
+// limit is exceeded.
+func allowRequest(ctx context.Context, ip string) (ok bool, retryAfter time.Duration) {
+    policy := rateLimits.Load()
+    if policy.limit <= 0 {
+        return true, 0
+    }
+
+    window := policy.window
+    now := time.Now().Unix()
+    windowStart := now - now%window
+    key := redisKey("ratelimit:" + ip + ":" + strconv.FormatInt(windowStart, 10))
+
+    var count *goredis.IntCmd
+    _, err := redisClient.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+        count = pipe.Incr(ctx, key)
+        pipe.Expire(ctx, key, time.Duration(window)*time.Second)
+        return nil
+    })
+    if err != nil {
+        // Don't take the service down with Redis
+        slog.WarnContext(ctx, "Rate limiting unavailable", "error", err)
+        return true, 0
+    }
+
+    if count.Val() > int64(policy.limit) {
+        return false, time.Duration(windowStart+window-now) * time.Second
+    }
+
+    return true, 0
+}
+
+// rateLimit rejects clients exceeding RATE_LIMIT requests per window
+func rateLimit(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if ok, retryAfter := allowRequest(r.Context(), clientIP(r)); !ok {
+            w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+            writeProblem(w, r, 429, codeRateLimited, "Too many requests from this address")
+            return
+        }
+
+        next(w, r)
+    }
+}
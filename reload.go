@@ -0,0 +1,123 @@
+package main
+
+import (
+    "log/slog"
+    "net/http"
+    "os"
+    "os/signal"
+    "reflect"
+    "sync"
+    "syscall"
+)
+
+// reloadable are the settings SIGHUP and POST /admin/reload apply while
+// serving. Everything else needs a restart.
+var reloadable = []struct {
+    name  string
+    field string
+}{
+    {"LOG_LEVEL", "LogLevel"},
+    {"RATE_LIMIT", "RateLimit"},
+    {"RATE_LIMIT_WINDOW", "RateLimitWindow"},
+    {"CORS_ALLOWED_ORIGINS", "CORSAllowedOrigins"},
+    {"CORS_ALLOWED_METHODS", "CORSAllowedMethods"},
+    {"CORS_ALLOWED_HEADERS", "CORSAllowedHeaders"},
+    {"CORS_EXPOSED_HEADERS", "CORSExposedHeaders"},
+    {"CORS_MAX_AGE", "CORSMaxAge"},
+    {"IP_ALLOW", "IPAllow"},
+    {"IP_DENY", "IPDeny"},
+    {"API_KEYS", "APIKeys"},
+    {"REDIS_PASSWORD", "RedisPassword"},
+    {"SIGNING_KEY", "SigningKey"},
+    {"JWT_SECRET", "JWTSecret"},
+    {"DOWNLOAD_BEARER_SECRET", "BearerSecret"},
+    {"AUDIT_KEY", "AuditKey"},
+}
+
+// reloaders apply the reloadable settings. They're cheap enough to all run
+// whenever anything changes.
+var reloaders = []func(c Configuration){loadLogLevel, loadRateLimit, loadCORS, loadIPFilter, loadAPIKeys, loadSecrets}
+
+// reloads serialises reloads, and applied is the configuration the last one
+// left in effect
+var reloads sync.Mutex
+var applied *Configuration
+
+type reloadResponse struct {
+    Changed []string `json:"changed"`
+}
+
+// watchReload reloads the configuration on SIGHUP
+func watchReload() {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGHUP)
+
+    go func() {
+        for range signals {
+            if _, err := reloadConfig(); err != nil {
+                slog.Error("Error reloading configuration, keeping the current one", "error", err)
+            }
+        }
+    }()
+}
+
+// reloadConfig reads the config file and flags again and applies whatever
+// changed of the reloadable settings. Downloads under way aren't touched,
+// they just see the new settings from then on. config itself keeps the
+// values from startup.
+func reloadConfig() ([]string, error) {
+    reloads.Lock()
+    defer reloads.Unlock()
+
+    if applied == nil {
+        current := config
+        applied = &current
+    }
+
+    settings := fileSettings
+    if *configFile != "" {
+        var err error
+        if settings, err = readConfigFile(*configFile); err != nil {
+            return nil, err
+        }
+    }
+
+    fileSettings = settings
+    settingErrors = nil
+    fresh := loadConfiguration()
+    if err := checkConfig(fresh); err != nil {
+        return nil, err
+    }
+
+    old, updated := reflect.ValueOf(*applied), reflect.ValueOf(fresh)
+
+    changed := []string{}
+    for _, setting := range reloadable {
+        if !reflect.DeepEqual(old.FieldByName(setting.field).Interface(), updated.FieldByName(setting.field).Interface()) {
+            changed = append(changed, setting.name)
+        }
+    }
+
+    if len(changed) > 0 {
+        for _, reload := range reloaders {
+            reload(fresh)
+        }
+        applied = &fresh
+    }
+
+    slog.Info("Reloaded configuration", "changed", changed)
+    return changed, nil
+}
+
+// reloadHandler reloads the configuration like SIGHUP does and reports what
+// changed
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+    changed, err := reloadConfig()
+    if err != nil {
+        slog.ErrorContext(r.Context(), "Error reloading configuration, keeping the current one", "error", err)
+        writeProblem(w, r, 400, codeBadRequest, "Could not reload the configuration: "+err.Error())
+        return
+    }
+
+    writeJSON(w, 200, reloadResponse{Changed: changed})
+}
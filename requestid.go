@@ -0,0 +1,48 @@
+package main
+
+import (
+    "context"
+    "net/http"
+)
+
+// Longest X-Request-ID accepted from a client or proxy
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the request ctx belongs to, if any
+func requestID(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey{}).(string)
+    return id
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+    return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// validRequestID only takes IDs that are safe to echo into headers and logs
+func validRequestID(id string) bool {
+    if id == "" || len(id) > maxRequestIDLength {
+        return false
+    }
+    for _, c := range id {
+        if c < 0x21 || c > 0x7e {
+            return false
+        }
+    }
+    return true
+}
+
+// assignRequestID keeps the caller's X-Request-ID or makes one up, and
+// returns it on the response
+func assignRequestID(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !validRequestID(id) {
+            id = newToken()
+        }
+
+        w.Header().Set("X-Request-ID", id)
+        next(w, r.WithContext(withRequestID(r.Context(), id)))
+    }
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+var errTokenRevoked = errors.New("token revoked")
+
+type revokeTokenResponse struct {
+    Token      string    `json:"token"`
+    Deleted    bool      `json:"deleted"`
+    Terminated int       `json:"terminated"`
+    RevokedAt  time.Time `json:"revokedAt"`
+}
+
+// revocationKey marks a token as revoked. It outlives the manifest so JWT and
+// PASETO tokens, which never touch Redis, are refused too.
+func revocationKey(token string) string {
+    return redisKey("revoked:" + token)
+}
+
+func tokenRevoked(ctx context.Context, token string) (bool, error) {
+    revoked, err := redisClient.Exists(ctx, revocationKey(token)).Result()
+    return revoked > 0, err
+}
+
+// revokeTokenHandler deletes a token's manifest and records the revocation
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+    token := requestToken(r)
+    if !validToken(token) {
+        writeProblem(w, r, 400, codeTokenMalformed, "The token is not in the expected format")
+        return
+    }
+
+    now := time.Now().UTC()
+
+    // Recorded first, so the token stays unusable even if the store fails
+    if err := redisClient.Set(r.Context(), revocationKey(token), now.Format(time.RFC3339), config.RevocationTTL).Err(); err != nil {
+        slog.ErrorContext(r.Context(), "Error revoking token", "error", err)
+        writeProblem(w, r, 503, codeStorageUnreachable, "Could not revoke the token")
+        return
+    }
+
+    deleted, err := tokenStore.Delete(r.Context(), token)
+    if err != nil {
+        slog.ErrorContext(r.Context(), "Error deleting revoked token", "error", err)
+        writeProblem(w, r, 503, codeStorageUnreachable, "Could not revoke the token")
+        return
+    }
+
+    // Downloads already under way on this server stop too
+    terminated := terminateTokenDownloads(token)
+    slog.InfoContext(r.Context(), "Revoked token", "token", token, "terminated", terminated)
+
+    writeJSON(w, 200, revokeTokenResponse{Token: token, Deleted: deleted, Terminated: terminated, RevokedAt: now})
+}
@@ -0,0 +1,112 @@
+// The router relies on method and wildcard patterns, which GOPATH builds
+// would otherwise disable by defaulting to Go 1.20 behaviour.
+//go:debug httpmuxgo121=0
+
+package main
+
+import (
+    "net/http"
+    "slices"
+    "sort"
+    "strings"
+)
+
+// publicMux serves the public port. It isn't http.DefaultServeMux so
+// packages like expvar that register themselves there stay private.
+var publicMux = http.NewServeMux()
+
+// public wraps handlers served on the public listener with the middleware
+// chain from MIDDLEWARE
+func public(h http.HandlerFunc) http.HandlerFunc {
+    for i := len(middlewareChain) - 1; i >= 0; i-- {
+        h = middlewareChain[i](h)
+    }
+    return h
+}
+
+// newHandler returns the public API, expecting requests under BASE_PATH when
+// it's set, e.g. when a proxy mounts the service at /zipper
+func newHandler() http.Handler {
+    registerRoutes(publicMux)
+    if config.BasePath == "" {
+        return publicMux
+    }
+    return http.StripPrefix(strings.TrimSuffix(config.BasePath, "/"), publicMux)
+}
+
+// registerRoutes sets up the versioned API alongside the legacy
+// query-string endpoints
+func registerRoutes(mux *http.ServeMux) {
+    route(mux, "/v1/download/{token}", methods{"GET": public(handler)})
+    route(mux, "/v1/download", methods{"POST": public(postedDownloadHandler)})
+    route(mux, "/v1/tokens", methods{"POST": public(requireAPIKey(scopeTokensWrite, createTokenHandler))})
+    route(mux, "/v1/validate", methods{"GET": public(validateHandler)})
+    route(mux, "/v1/estimate", methods{"GET": public(estimateHandler)})
+    route(mux, "/v1/list", methods{"GET": public(listHandler)})
+    route(mux, "/v1/preview", methods{"GET": public(previewHandler)})
+    route(mux, "/v1/jobs", methods{"POST": public(createJobHandler)})
+    route(mux, "/v1/extract", methods{"POST": public(requireAPIKey(scopeArchivesWrite, extractHandler))})
+    route(mux, "/v1/progress", methods{"GET": public(progressHandler)})
+    route(mux, "/v1/progress/ws", methods{"GET": public(wsProgressHandler)})
+    route(mux, "/v1/jobs/{id}", methods{"GET": public(requireAPIKey(scopeArchivesRead, jobStatusHandler)), "DELETE": public(requireAPIKey(scopeArchivesWrite, cancelJobHandler))})
+    route(mux, "/version", methods{"GET": public(versionHandler)})
+    route(mux, "/openapi.json", methods{"GET": public(func(w http.ResponseWriter, r *http.Request) {
+        http.ServeFileFS(w, r, assets, "assets/openapi.json")
+    })})
+    route(mux, "/v1/assets/", methods{"GET": public(http.StripPrefix("/v1/", http.FileServerFS(assets)).ServeHTTP)})
+
+    // Legacy endpoints
+    route(mux, "/", methods{"GET": public(handler)})
+    route(mux, "/tokens", methods{"POST": public(requireAPIKey(scopeTokensWrite, createTokenHandler))})
+}
+
+// methods maps HTTP methods to the handler serving them on a route
+type methods map[string]http.HandlerFunc
+
+// routeMethods are the methods a route answers with a 405 when it doesn't
+// serve them
+var routeMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// route registers a handler per method on a path and answers OPTIONS with
+// the methods it supports. Any other method gets a 405 problem with an
+// Allow header.
+func route(mux *http.ServeMux, path string, handlers methods) {
+    allowed := []string{"OPTIONS"}
+    for method, h := range handlers {
+        mux.HandleFunc(method+" "+path, h)
+        allowed = append(allowed, method)
+
+        // GET patterns also serve HEAD
+        if method == "GET" {
+            allowed = append(allowed, "HEAD")
+        }
+    }
+    sort.Strings(allowed)
+    allow := strings.Join(allowed, ", ")
+
+    mux.HandleFunc("OPTIONS "+path, public(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Allow", allow)
+        w.WriteHeader(204)
+    }))
+
+    // One pattern per method, as a bare path would conflict with "GET /"
+    notAllowed := func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Allow", allow)
+        writeProblem(w, r, 405, codeMethodNotAllowed, r.Method+" isn't supported here")
+    }
+    for _, method := range routeMethods {
+        if slices.Contains(allowed, method) {
+            continue
+        }
+        mux.HandleFunc(method+" "+path, notAllowed)
+    }
+}
+
+// requestToken returns the download token from the path, falling back to
+// the legacy "token" query parameter, with surrounding whitespace removed
+func requestToken(r *http.Request) string {
+    if token := r.PathValue("token"); token != "" {
+        return strings.TrimSpace(token)
+    }
+    return strings.TrimSpace(r.URL.Query().Get("token"))
+}
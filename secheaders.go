@@ -0,0 +1,61 @@
+package main
+
+import (
+    "bufio"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// htmlHeaderWriter adds the Content-Security-Policy once it knows the
+// response is an HTML page
+type htmlHeaderWriter struct {
+    http.ResponseWriter
+    wroteHeader bool
+}
+
+func (w *htmlHeaderWriter) WriteHeader(status int) {
+    if !w.wroteHeader {
+        w.wroteHeader = true
+        if config.ContentSecurityPolicy != "" && strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+            w.Header().Set("Content-Security-Policy", config.ContentSecurityPolicy)
+        }
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *htmlHeaderWriter) Write(p []byte) (int, error) {
+    if !w.wroteHeader {
+        w.WriteHeader(200)
+    }
+    return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *htmlHeaderWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+// Hijack is needed by the WebSocket endpoint, which can't go through
+// http.ResponseController
+func (w *htmlHeaderWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// securityHeaders sets the configured security headers on every response
+func securityHeaders(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !config.SecurityHeaders {
+            next(w, r)
+            return
+        }
+
+        w.Header().Set("X-Content-Type-Options", "nosniff")
+        if config.HSTSMaxAge > 0 {
+            w.Header().Set("Strict-Transport-Security", "max-age="+strconv.Itoa(config.HSTSMaxAge)+"; includeSubDomains")
+        }
+
+        next(&htmlHeaderWriter{ResponseWriter: w}, r)
+    }
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/AdRoll/goamz/aws"
+)
+
+// The settings holding secrets can name where to fetch them from instead of
+// holding them, for deployments where they can't sit in the environment:
+//
+//	SIGNING_KEY=secretsmanager:prod/zipper#signing_key
+//	REDIS_PASSWORD=vault:secret/data/zipper#redis_password
+//
+// Secrets Manager secrets are by name or ARN, with the #key picking a value
+// out of a JSON secret. Vault paths are read from VAULT_ADDR with
+// VAULT_TOKEN, from either version of the KV engine. They're fetched at
+// startup and on every reload, and every SECRETS_REFRESH when it's set, so a
+// rotated secret is picked up without a restart.
+
+const (
+    secretsManagerPrefix = "secretsmanager:"
+    vaultPrefix          = "vault:"
+)
+
+// How long fetching a secret can take
+const secretTimeout = 10 * time.Second
+
+// secretSetting looks a secret setting up, fetching it when it's a
+// reference. Failures are reported by checkConfig, without the secret.
+func secretSetting(key string) string {
+    value := setting(key)
+    if !strings.HasPrefix(value, secretsManagerPrefix) && !strings.HasPrefix(value, vaultPrefix) {
+        return value
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+    defer cancel()
+
+    secret, err := fetchSecret(ctx, value)
+    if err != nil {
+        settingErrors = append(settingErrors, fmt.Errorf("%s: fetching %s: %w", key, value, err))
+        return ""
+    }
+    return secret
+}
+
+func fetchSecret(ctx context.Context, ref string) (string, error) {
+    if name, ok := strings.CutPrefix(ref, vaultPrefix); ok {
+        path, field, _ := strings.Cut(name, "#")
+        if field == "" {
+            return "", errors.New("a Vault secret needs a #field")
+        }
+        return fetchVaultSecret(ctx, path, field)
+    }
+
+    name := strings.TrimPrefix(ref, secretsManagerPrefix)
+    id, key, _ := strings.Cut(name, "#")
+    return fetchAWSSecret(ctx, id, key)
+}
+
+// fetchAWSSecret reads a secret from Secrets Manager in the region of its
+// ARN, or S3_REGION, with the S3 credentials
+func fetchAWSSecret(ctx context.Context, id, key string) (string, error) {
+    region := setting("S3_REGION")
+    if parts := strings.Split(id, ":"); len(parts) > 3 && parts[0] == "arn" {
+        region = parts[3]
+    }
+    if region == "" {
+        return "", errors.New("S3_REGION is needed for Secrets Manager")
+    }
+
+    auth, err := aws.GetAuth(setting("S3_KEY"), setting("S3_SECRET"), "", time.Now().Add(time.Hour))
+    if err != nil {
+        return "", err
+    }
+
+    endpoint := "https://secretsmanager." + region + ".amazonaws.com/"
+    api := newAWSJSONAPI(auth, "secretsmanager", region, endpoint, "1.1", "secretsmanager")
+
+    var response struct {
+        SecretString string
+        SecretBinary []byte
+    }
+    if err := api.call(ctx, "GetSecretValue", map[string]string{"SecretId": id}, &response); err != nil {
+        return "", err
+    }
+
+    secret := response.SecretString
+    if secret == "" {
+        secret = string(response.SecretBinary)
+    }
+    if key == "" {
+        return secret, nil
+    }
+
+    var values map[string]interface{}
+    if err := json.Unmarshal([]byte(secret), &values); err != nil {
+        return "", fmt.Errorf("#%s needs a JSON secret", key)
+    }
+    return secretField(values, key)
+}
+
+// fetchVaultSecret reads a field of a KV secret
+func fetchVaultSecret(ctx context.Context, path, field string) (string, error) {
+    address := setting("VAULT_ADDR")
+    if address == "" {
+        return "", errors.New("VAULT_ADDR is needed for Vault")
+    }
+
+    req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("X-Vault-Token", setting("VAULT_TOKEN"))
+    if namespace := setting("VAULT_NAMESPACE"); namespace != "" {
+        req.Header.Set("X-Vault-Namespace", namespace)
+    }
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != 200 {
+        return "", fmt.Errorf("Vault responded %s", resp.Status)
+    }
+
+    var response struct {
+        Data map[string]interface{} `json:"data"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+        return "", err
+    }
+
+    // Version 2 of the KV engine nests the secret with its metadata
+    values := response.Data
+    if nested, ok := values["data"].(map[string]interface{}); ok && values["metadata"] != nil {
+        values = nested
+    }
+    return secretField(values, field)
+}
+
+func secretField(values map[string]interface{}, field string) (string, error) {
+    value, ok := values[field].(string)
+    if !ok {
+        return "", fmt.Errorf("the secret has no %s string", field)
+    }
+    return value, nil
+}
+
+// liveSecrets are the secrets in effect, which can change on a reload. Code
+// reading them goes through secrets() rather than config.
+type liveSecrets struct {
+    RedisPassword string
+    SigningKey    string
+    JWTSecret     string
+    BearerSecret  string
+    AuditKey      string
+}
+
+var currentSecrets atomic.Pointer[liveSecrets]
+
+func secrets() *liveSecrets {
+    return currentSecrets.Load()
+}
+
+func loadSecrets(c Configuration) {
+    currentSecrets.Store(&liveSecrets{
+        RedisPassword: c.RedisPassword,
+        SigningKey:    c.SigningKey,
+        JWTSecret:     c.JWTSecret,
+        BearerSecret:  c.BearerSecret,
+        AuditKey:      c.AuditKey,
+    })
+}
+
+// watchSecrets fetches the secrets again every SECRETS_REFRESH, through a
+// reload so the rest of the configuration is checked as usual
+func watchSecrets() {
+    if config.SecretsRefresh <= 0 {
+        return
+    }
+
+    go func() {
+        for range time.Tick(config.SecretsRefresh) {
+            if _, err := reloadConfig(); err != nil {
+                slog.Error("Error refreshing secrets, keeping the current ones", "error", err)
+            }
+        }
+    }()
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+    "bytes"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "os"
+    "runtime"
+    "strings"
+    "time"
+)
+
+// Errors and panics are reported to Sentry through its envelope endpoint
+// when SENTRY_DSN is set
+
+var sentryClient = &http.Client{Timeout: 10 * time.Second}
+
+var sentry struct {
+    envelopeURL string
+    auth        string
+    dsn         string
+    events      chan *sentryEvent
+}
+
+type sentryEvent struct {
+    EventID     string                 `json:"event_id"`
+    Timestamp   string                 `json:"timestamp"`
+    Platform    string                 `json:"platform"`
+    Level       string                 `json:"level"`
+    ServerName  string                 `json:"server_name,omitempty"`
+    Environment string                 `json:"environment,omitempty"`
+    Release     string                 `json:"release,omitempty"`
+    Message     *sentryMessage         `json:"message,omitempty"`
+    Exception   []sentryException      `json:"exception,omitempty"`
+    Request     *sentryRequest         `json:"request,omitempty"`
+    Tags        map[string]string      `json:"tags,omitempty"`
+    Extra       map[string]interface{} `json:"extra,omitempty"`
+}
+
+type sentryMessage struct {
+    Formatted string `json:"formatted"`
+}
+
+type sentryException struct {
+    Type       string            `json:"type"`
+    Value      string            `json:"value"`
+    Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+    Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+    Function string `json:"function"`
+    Filename string `json:"filename"`
+    Lineno   int    `json:"lineno"`
+    InApp    bool   `json:"in_app"`
+}
+
+type sentryRequest struct {
+    URL    string `json:"url"`
+    Method string `json:"method"`
+}
+
+// initSentry parses SENTRY_DSN, https://<key>@<host>/<project id>
+func initSentry() {
+    if config.SentryDSN == "" {
+        return
+    }
+
+    dsn, err := url.Parse(config.SentryDSN)
+    if err != nil || dsn.User == nil {
+        panic(fmt.Sprintf("invalid SENTRY_DSN: %v", err))
+    }
+
+    project := strings.TrimPrefix(dsn.Path, "/")
+    sentry.envelopeURL = dsn.Scheme + "://" + dsn.Host + "/api/" + project + "/envelope/"
+    sentry.auth = "Sentry sentry_version=7, sentry_client=zipper/1.0, sentry_key=" + dsn.User.Username()
+    sentry.dsn = config.SentryDSN
+    sentry.events = make(chan *sentryEvent, 100)
+
+    go sendSentryEvents()
+}
+
+func sentryEnabled() bool {
+    return sentry.events != nil
+}
+
+func newSentryEvent(level string, r *http.Request) *sentryEvent {
+    var id [16]byte
+    rand.Read(id[:])
+    host, _ := os.Hostname()
+
+    event := &sentryEvent{
+        EventID:     hex.EncodeToString(id[:]),
+        Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+        Platform:    "go",
+        Level:       level,
+        ServerName:  host,
+        Environment: config.SentryEnvironment,
+        Release:     config.SentryRelease,
+        Tags:        map[string]string{},
+        Extra:       map[string]interface{}{},
+    }
+
+    if r != nil {
+        event.Request = &sentryRequest{URL: r.URL.Path, Method: r.Method}
+        if id := requestID(r.Context()); id != "" {
+            event.Tags["request_id"] = id
+        }
+
+        // Tokens are credentials so only a hash travels, enough to correlate
+        if token := requestToken(r); token != "" {
+            event.Request.URL = strings.ReplaceAll(r.URL.Path, token, "[token]")
+            event.Tags["token_hash"] = tokenHash(token)
+        }
+    }
+
+    return event
+}
+
+func tokenHash(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:8])
+}
+
+// captureMessage reports an error, with the request it happened in if any
+func captureMessage(level string, r *http.Request, message string, extra map[string]interface{}) {
+    if !sentryEnabled() {
+        return
+    }
+
+    event := newSentryEvent(level, r)
+    event.Message = &sentryMessage{Formatted: message}
+    for key, value := range extra {
+        event.Extra[key] = value
+    }
+    queueSentryEvent(event)
+}
+
+// capturePanic reports a recovered panic with the stack that raised it
+func capturePanic(r *http.Request, recovered interface{}) {
+    if !sentryEnabled() {
+        return
+    }
+
+    pcs := make([]uintptr, 64)
+    n := runtime.Callers(3, pcs)
+    frames := runtime.CallersFrames(pcs[:n])
+
+    var stack []sentryFrame
+    for {
+        frame, more := frames.Next()
+        stack = append(stack, sentryFrame{
+            Function: frame.Function,
+            Filename: frame.File,
+            Lineno:   frame.Line,
+            InApp:    strings.HasPrefix(frame.Function, "main."),
+        })
+        if !more {
+            break
+        }
+    }
+
+    // Sentry wants the innermost frame last
+    for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+        stack[i], stack[j] = stack[j], stack[i]
+    }
+
+    event := newSentryEvent("fatal", r)
+    event.Exception = []sentryException{{
+        Type:       "panic",
+        Value:      fmt.Sprint(recovered),
+        Stacktrace: &sentryStacktrace{Frames: stack},
+    }}
+    queueSentryEvent(event)
+}
+
+func queueSentryEvent(event *sentryEvent) {
+    select {
+    case sentry.events <- event:
+    default:
+        slog.Warn("Sentry queue full, dropped event", "event_id", event.EventID)
+    }
+}
+
+func sendSentryEvents() {
+    for event := range sentry.events {
+        if err := postSentryEvent(event); err != nil {
+            slog.Error("Error sending event to Sentry", "error", err)
+        }
+    }
+}
+
+func postSentryEvent(event *sentryEvent) error {
+    payload, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+
+    header, _ := json.Marshal(map[string]string{"event_id": event.EventID, "dsn": sentry.dsn})
+    item, _ := json.Marshal(map[string]interface{}{"type": "event", "length": len(payload)})
+
+    var body bytes.Buffer
+    body.Write(header)
+    body.WriteByte('\n')
+    body.Write(item)
+    body.WriteByte('\n')
+    body.Write(payload)
+    body.WriteByte('\n')
+
+    req, err := http.NewRequest("POST", sentry.envelopeURL, &body)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/x-sentry-envelope")
+    req.Header.Set("X-Sentry-Auth", sentry.auth)
+
+    resp, err := sentryClient.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("Sentry returned %s", resp.Status)
+    }
+    return nil
+}
+
+// recoverPanics reports handler panics before letting net/http deal with
+// them as usual. Aborted handlers aren't errors.
+func recoverPanics(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        defer func() {
+            if recovered := recover(); recovered != nil {
+                if recovered != http.ErrAbortHandler {
+                    capturePanic(r, recovered)
+                    recordError(r.Method + " " + r.URL.Path + ": panic: " + fmt.Sprint(recovered))
+                }
+                panic(recovered)
+            }
+        }()
+        next(w, r)
+    }
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+    "errors"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+)
+
+// newServer builds the public HTTP server
+func newServer() (*http.Server, error) {
+    server := &http.Server{Handler: newHandler(), ConnContext: withPeerAddr}
+    setTimeouts(server)
+
+    // HTTP/2 is negotiated over TLS, h2c is for proxies that speak
+    // cleartext HTTP/2 with prior knowledge
+    server.Protocols = new(http.Protocols)
+    server.Protocols.SetHTTP1(true)
+    server.Protocols.SetHTTP2(config.HTTP2)
+    server.Protocols.SetUnencryptedHTTP2(config.H2C)
+
+    if tlsEnabled() {
+        tlsConfig, err := buildTLSConfig()
+        if err != nil {
+            return nil, err
+        }
+        server.TLSConfig = tlsConfig
+    }
+
+    return server, nil
+}
+
+// setTimeouts applies the configured timeouts. WriteTimeout bounds a whole
+// response, so it has to allow for the largest archive we expect to stream.
+func setTimeouts(server *http.Server) {
+    server.ReadHeaderTimeout = config.ReadHeaderTimeout
+    server.ReadTimeout = config.ReadTimeout
+    server.WriteTimeout = config.WriteTimeout
+    server.IdleTimeout = config.IdleTimeout
+}
+
+// publicListeners opens the TCP port and/or Unix socket downloads are
+// served on, preferring sockets inherited from systemd
+func publicListeners() (listeners []net.Listener, err error) {
+    if listeners, err = systemdListeners(); err != nil || len(listeners) > 0 {
+        if err != nil {
+            return nil, err
+        }
+
+        slog.Info("Listening on sockets from systemd", "count", len(listeners))
+
+        if config.ProxyProtocol {
+            for i, ln := range listeners {
+                if _, ok := ln.Addr().(*net.TCPAddr); ok {
+                    listeners[i] = newProxyListener(ln)
+                }
+            }
+        }
+        return listeners, nil
+    }
+
+    if config.Port != "" {
+        ln, err := net.Listen("tcp", ":"+config.Port)
+        if err != nil {
+            return nil, err
+        }
+        slog.Info("Listening", "port", config.Port)
+
+        if config.ProxyProtocol {
+            ln = newProxyListener(ln)
+        }
+        listeners = append(listeners, ln)
+    }
+
+    if config.UnixSocket != "" {
+        ln, err := listenUnix(config.UnixSocket, config.UnixSocketMode)
+        if err != nil {
+            return nil, err
+        }
+        slog.Info("Listening", "socket", config.UnixSocket)
+        listeners = append(listeners, ln)
+    }
+
+    if len(listeners) == 0 {
+        return nil, errors.New("set PORT and/or UNIX_SOCKET")
+    }
+
+    return listeners, nil
+}
+
+// listenUnix listens on a Unix socket, replacing any stale socket file left
+// behind by a previous run
+func listenUnix(path, mode string) (net.Listener, error) {
+    if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+        os.Remove(path)
+    }
+
+    ln, err := net.Listen("unix", path)
+    if err != nil {
+        return nil, err
+    }
+
+    perm, err := strconv.ParseUint(mode, 8, 32)
+    if err != nil {
+        ln.Close()
+        return nil, err
+    }
+
+    if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+        ln.Close()
+        return nil, err
+    }
+
+    return ln, nil
+}
+
+// serve serves on every listener and returns the first error
+func serve(server *http.Server, listeners []net.Listener) error {
+    errs := make(chan error, len(listeners))
+
+    for _, ln := range listeners {
+        go func(ln net.Listener) {
+            if server.TLSConfig != nil {
+                errs <- server.ServeTLS(ln, "", "")
+                return
+            }
+            errs <- server.Serve(ln)
+        }(ln)
+    }
+
+    return <-errs
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
+    "time"
+)
+
+// draining is set once shutdown starts so /readyz takes us out of rotation
+var draining atomic.Bool
+
+// serveUntilSignalled serves until SIGTERM or SIGINT, then reports not ready
+// for DRAIN_DELAY before letting in-flight downloads finish, for up to
+// SHUTDOWN_TIMEOUT
+func serveUntilSignalled(server *http.Server, listeners []net.Listener) error {
+    errs := make(chan error, 1)
+    go func() {
+        errs <- serve(server, listeners)
+    }()
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+    select {
+    case err := <-errs:
+        return err
+    case sig := <-signals:
+        slog.Info("Draining", "signal", sig.String(), "delay", config.DrainDelay)
+    }
+
+    draining.Store(true)
+    sdNotify("STOPPING=1")
+
+    // A second signal skips the wait
+    select {
+    case <-signals:
+    case <-time.After(config.DrainDelay):
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+    defer cancel()
+
+    slog.Info("Shutting down, waiting for downloads to finish", "timeout", config.ShutdownTimeout)
+    return server.Shutdown(ctx)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var (
+    errSignatureMissing = errors.New("missing signature")
+    errSignatureInvalid = errors.New("invalid signature")
+    errSignatureExpired = errors.New("signature expired")
+    errSignatureIP      = errors.New("signature not valid for this address")
+)
+
+// signDownload returns the hex HMAC-SHA256 of the token, expiry and optional
+// client IP, in the form expected by the "sig" query parameter.
+func signDownload(key, token, expires, ip string) string {
+    mac := hmac.New(sha256.New, []byte(key))
+    mac.Write([]byte(strings.Join([]string{token, expires, ip}, "\n")))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyDownloadSignature checks the "expires", "sig" and optional "ip" query
+// parameters against the configured signing key. When no key is configured
+// every request is accepted.
+func verifyDownloadSignature(r *http.Request, token string) error {
+    key := secrets().SigningKey
+    if key == "" {
+        return nil
+    }
+
+    query := r.URL.Query()
+    expires := query.Get("expires")
+    sig := query.Get("sig")
+    ip := query.Get("ip")
+
+    if expires == "" || sig == "" {
+        return errSignatureMissing
+    }
+
+    expected := signDownload(key, token, expires, ip)
+    if !hmac.Equal([]byte(sig), []byte(expected)) {
+        return errSignatureInvalid
+    }
+
+    // Only check expiry and address once we know the values weren't tampered with
+    expiresAt, err := strconv.ParseInt(expires, 10, 64)
+    if err != nil {
+        return errSignatureInvalid
+    }
+
+    if time.Now().Unix() > expiresAt {
+        return errSignatureExpired
+    }
+
+    if ip != "" && ip != clientIP(r) {
+        return errSignatureIP
+    }
+
+    return nil
+}
+
+// clientIP returns the address of the client that made the request
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+    "errors"
+    "net/http/httptest"
+    "net/url"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestVerifyDownloadSignature(t *testing.T) {
+    loadSecrets(Configuration{SigningKey: "key"})
+    t.Cleanup(func() { loadSecrets(Configuration{}) })
+
+    future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+    past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+    // httptest requests come from 192.0.2.1
+    tests := []struct {
+        name                    string
+        token, expires, ip, sig string
+        want                    error
+    }{
+        {"valid", testToken, future, "", signDownload("key", testToken, future, ""), nil},
+        {"valid for the address", testToken, future, "192.0.2.1", signDownload("key", testToken, future, "192.0.2.1"), nil},
+        {"expired", testToken, past, "", signDownload("key", testToken, past, ""), errSignatureExpired},
+        {"another address", testToken, future, "192.0.2.2", signDownload("key", testToken, future, "192.0.2.2"), errSignatureIP},
+        {"missing signature", testToken, future, "", "", errSignatureMissing},
+        {"missing expiry", testToken, "", "", signDownload("key", testToken, "", ""), errSignatureMissing},
+        {"another token", testOtherToken, future, "", signDownload("key", testToken, future, ""), errSignatureInvalid},
+        {"expiry pushed back", testToken, future, "", signDownload("key", testToken, past, ""), errSignatureInvalid},
+        {"address dropped", testToken, future, "", signDownload("key", testToken, future, "192.0.2.1"), errSignatureInvalid},
+        {"another key", testToken, future, "", signDownload("other", testToken, future, ""), errSignatureInvalid},
+        {"unreadable expiry", testToken, "soon", "", signDownload("key", testToken, "soon", ""), errSignatureInvalid},
+    }
+    for _, test := range tests {
+        query := url.Values{}
+        for name, value := range map[string]string{"expires": test.expires, "ip": test.ip, "sig": test.sig} {
+            if value != "" {
+                query.Set(name, value)
+            }
+        }
+        r := httptest.NewRequest("GET", "/?"+query.Encode(), nil)
+        if err := verifyDownloadSignature(r, test.token); !errors.Is(err, test.want) || (err == nil) != (test.want == nil) {
+            t.Errorf("%s: err = %v, want %v", test.name, err, test.want)
+        }
+    }
+}
+
+func TestVerifyDownloadSignatureWithoutKey(t *testing.T) {
+    loadSecrets(Configuration{})
+    if err := verifyDownloadSignature(httptest.NewRequest("GET", "/", nil), testToken); err != nil {
+        t.Errorf("err = %v, want unsigned requests accepted", err)
+    }
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+    "net/http"
+    "sync"
+    "time"
+)
+
+// Throughput is kept in 10 second buckets for the last hour
+const (
+    throughputBucket  = 10 * time.Second
+    throughputBuckets = 360
+    recentErrorsKept  = 50
+)
+
+var startedAt = time.Now()
+
+type throughputSample struct {
+    Time  time.Time `json:"time"`
+    Bytes int64     `json:"bytes"`
+}
+
+type recentError struct {
+    Time    time.Time `json:"time"`
+    Message string    `json:"message"`
+}
+
+// stats is what the admin dashboard draws from
+var stats struct {
+    sync.Mutex
+    buckets [throughputBuckets]throughputSample
+    errors  []recentError
+}
+
+// recordThroughput counts bytes sent to clients
+func recordThroughput(n int) {
+    now := time.Now().Truncate(throughputBucket)
+    i := (now.Unix() / int64(throughputBucket.Seconds())) % throughputBuckets
+
+    stats.Lock()
+    if !stats.buckets[i].Time.Equal(now) {
+        stats.buckets[i] = throughputSample{Time: now}
+    }
+    stats.buckets[i].Bytes += int64(n)
+    stats.Unlock()
+}
+
+// recordError keeps an error for the dashboard, dropping the oldest once
+// there are enough
+func recordError(message string) {
+    stats.Lock()
+    stats.errors = append(stats.errors, recentError{Time: time.Now().UTC(), Message: message})
+    if len(stats.errors) > recentErrorsKept {
+        stats.errors = stats.errors[len(stats.errors)-recentErrorsKept:]
+    }
+    stats.Unlock()
+}
+
+type statsResponse struct {
+    Uptime          string             `json:"uptime"`
+    ActiveDownloads int                `json:"activeDownloads"`
+    ActiveJobs      int                `json:"activeJobs"`
+    Throughput      []throughputSample `json:"throughput"`
+    RecentErrors    []recentError      `json:"recentErrors"`
+}
+
+// statsHandler reports this replica's throughput over the last hour, one
+// sample per bucket and oldest first, plus its most recent errors
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+    now := time.Now().Truncate(throughputBucket)
+    first := now.Add(-throughputBucket * (throughputBuckets - 1))
+
+    resp := statsResponse{Uptime: time.Since(startedAt).Round(time.Second).String()}
+
+    stats.Lock()
+    for t := first; !t.After(now); t = t.Add(throughputBucket) {
+        sample := throughputSample{Time: t.UTC()}
+        bucket := stats.buckets[(t.Unix()/int64(throughputBucket.Seconds()))%throughputBuckets]
+        if bucket.Time.Equal(t) {
+            sample.Bytes = bucket.Bytes
+        }
+        resp.Throughput = append(resp.Throughput, sample)
+    }
+    resp.RecentErrors = append([]recentError{}, stats.errors...)
+    stats.Unlock()
+
+    activeDownloads.Lock()
+    resp.ActiveDownloads = len(activeDownloads.byID)
+    activeDownloads.Unlock()
+
+    jobs.Lock()
+    resp.ActiveJobs = len(jobs.running)
+    jobs.Unlock()
+
+    writeJSON(w, 200, resp)
+}
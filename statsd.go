@@ -0,0 +1,129 @@
+package main
+
+import (
+    "log/slog"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Metrics are also sent to StatsD or DogStatsD when STATSD_ADDR is set
+
+const (
+    statsdPacketSize    = 1400
+    statsdFlushInterval = time.Second
+    statsdGaugeInterval = 10 * time.Second
+)
+
+var statsdLines chan string
+var statsdTags []string
+
+func initStatsD() {
+    if config.StatsDAddr == "" {
+        return
+    }
+
+    conn, err := net.Dial("udp", config.StatsDAddr)
+    if err != nil {
+        panic(err)
+    }
+
+    if config.Bucket != "" {
+        statsdTags = append(statsdTags, "bucket:"+config.Bucket)
+    }
+    for _, tag := range strings.Split(config.StatsDTags, ",") {
+        if tag = strings.TrimSpace(tag); tag != "" {
+            statsdTags = append(statsdTags, tag)
+        }
+    }
+
+    statsdLines = make(chan string, 4096)
+    go sendStatsD(conn)
+    go reportGauges()
+
+    slog.Info("Sending metrics to StatsD", "addr", config.StatsDAddr)
+}
+
+// statsdName turns zipper_bytes_streamed_total into zipper.bytes_streamed,
+// with label values appended for plain StatsD which has no tags
+func statsdName(name string, labels, values []string) string {
+    name = strings.TrimPrefix(name, "zipper_")
+    name = strings.TrimSuffix(name, "_total")
+    name = strings.TrimSuffix(name, "_seconds")
+    name = config.StatsDPrefix + name
+
+    if !config.StatsDDogStatsD {
+        for _, value := range values {
+            name += "." + strings.NewReplacer(".", "_", ":", "_", "|", "_").Replace(value)
+        }
+    }
+    return name
+}
+
+// emitStatsD queues a metric, dropping it rather than blocking when the
+// sender is behind
+func emitStatsD(name string, value float64, kind string, labels, values []string) {
+    if statsdLines == nil {
+        return
+    }
+
+    line := statsdName(name, labels, values) + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind
+
+    if config.StatsDDogStatsD {
+        tags := append([]string{}, statsdTags...)
+        for i, label := range labels {
+            if i < len(values) {
+                tags = append(tags, label+":"+values[i])
+            }
+        }
+        if len(tags) > 0 {
+            line += "|#" + strings.Join(tags, ",")
+        }
+    }
+
+    select {
+    case statsdLines <- line:
+    default:
+    }
+}
+
+// sendStatsD packs lines into packets up to statsdPacketSize
+func sendStatsD(conn net.Conn) {
+    ticker := time.NewTicker(statsdFlushInterval)
+    defer ticker.Stop()
+
+    var packet []byte
+    flush := func() {
+        if len(packet) > 0 {
+            conn.Write(packet)
+            packet = packet[:0]
+        }
+    }
+
+    for {
+        select {
+        case line := <-statsdLines:
+            if len(packet)+len(line)+1 > statsdPacketSize {
+                flush()
+            }
+            if len(packet) > 0 {
+                packet = append(packet, '\n')
+            }
+            packet = append(packet, line...)
+        case <-ticker.C:
+            flush()
+        }
+    }
+}
+
+// reportGauges samples the gauges, which otherwise only exist when scraped
+func reportGauges() {
+    for range time.Tick(statsdGaugeInterval) {
+        for _, m := range registry {
+            if g, ok := m.(*gaugeFunc); ok {
+                emitStatsD(g.name, g.value(), "g", nil, nil)
+            }
+        }
+    }
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "path"
+    "strings"
+
+    "codecourse/zipper/archive"
+)
+
+// A download can be cut down to part of its manifest with ?only= and
+// ?exclude=, each a comma separated list of globs that can be repeated.
+// Globs with a slash are matched against the path in the archive, or any
+// folder it's in, so photos/* takes everything under photos. Those without
+// one are matched against the file name, so *.raw is every raw file.
+
+// subsetManifest drops the files ?only= and ?exclude= leave out. A bad glob
+// is an error.
+func subsetManifest(r *http.Request, manifest *Manifest) error {
+    query := r.URL.Query()
+    only, err := subsetGlobs("only", query["only"])
+    if err != nil {
+        return err
+    }
+    exclude, err := subsetGlobs("exclude", query["exclude"])
+    if err != nil {
+        return err
+    }
+    if only == nil && exclude == nil {
+        return nil
+    }
+
+    var files []*RedisFile
+    for _, file := range manifest.Files {
+        if file == nil {
+            continue
+        }
+        p := archive.Path(file)
+        if (only == nil || matchesGlob(only, p)) && !matchesGlob(exclude, p) {
+            files = append(files, file)
+        }
+    }
+    manifest.Files = files
+    return nil
+}
+
+func subsetGlobs(param string, values []string) (globs []string, err error) {
+    for _, value := range values {
+        for _, glob := range strings.Split(value, ",") {
+            if glob = strings.Trim(strings.TrimSpace(glob), "/"); glob == "" {
+                continue
+            }
+            if _, err := path.Match(glob, ""); err != nil {
+                return nil, fmt.Errorf("%s has a bad pattern %q", param, glob)
+            }
+            globs = append(globs, glob)
+        }
+    }
+    return globs, nil
+}
+
+// matchesGlob reports whether any of the globs matches p, as above
+func matchesGlob(globs []string, p string) bool {
+    for _, glob := range globs {
+        if !strings.Contains(glob, "/") {
+            if ok, _ := path.Match(glob, path.Base(p)); ok {
+                return true
+            }
+            continue
+        }
+
+        // The path itself, then each folder it's in
+        for prefix := p; prefix != "." && prefix != "/"; prefix = path.Dir(prefix) {
+            if ok, _ := path.Match(glob, prefix); ok {
+                return true
+            }
+        }
+    }
+    return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "log/slog"
+    "net"
+    "os"
+    "strconv"
+    "time"
+)
+
+// The first file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// if any
+func systemdListeners() (listeners []net.Listener, err error) {
+    if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+        return nil, nil
+    }
+
+    count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+    if err != nil || count == 0 {
+        return nil, nil
+    }
+
+    // Don't pass the sockets on to anything we start
+    os.Unsetenv("LISTEN_PID")
+    os.Unsetenv("LISTEN_FDS")
+    os.Unsetenv("LISTEN_FDNAMES")
+
+    for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+        file := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+        ln, err := net.FileListener(file)
+        file.Close()
+        if err != nil {
+            return nil, err
+        }
+        listeners = append(listeners, ln)
+    }
+
+    return listeners, nil
+}
+
+// sdNotify sends a state update to systemd when running under Type=notify
+func sdNotify(state string) error {
+    socket := os.Getenv("NOTIFY_SOCKET")
+    if socket == "" {
+        return nil
+    }
+
+    // Abstract namespace sockets are given with a leading @
+    if socket[0] == '@' {
+        socket = "\x00" + socket[1:]
+    }
+
+    conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    _, err = conn.Write([]byte(state))
+    return err
+}
+
+// notifyWhenReady tells systemd we're ready once Redis and S3 both respond,
+// so a restart doesn't move traffic over to an instance that can't serve it
+func notifyWhenReady() {
+    if os.Getenv("NOTIFY_SOCKET") == "" {
+        return
+    }
+
+    delay := 100 * time.Millisecond
+    for {
+        redisErr := pingRedis()
+        s3Err := pingS3()
+        if redisErr == nil && s3Err == nil {
+            break
+        }
+
+        slog.Info("Waiting for dependencies before signalling readiness", "redis", redisErr, "s3", s3Err)
+        time.Sleep(delay)
+        if delay < 5*time.Second {
+            delay *= 2
+        }
+    }
+
+    if err := sdNotify("READY=1"); err != nil {
+        slog.Error("Error notifying systemd", "error", err)
+    }
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "errors"
+    "net"
+    "net/http"
+    "net/netip"
+    "strings"
+    "time"
+
+    "codecourse/zipper/archive"
+
+    "github.com/AdRoll/goamz/aws"
+    "github.com/AdRoll/goamz/s3"
+)
+
+// One deployment can serve customers kept apart in their own buckets, with
+// their own credentials. TENANTS names them, and each has its settings under
+// TENANT_<NAME>_, or tenant.<name> in the config file:
+//
+//	TENANTS=acme,globex
+//	TENANT_ACME_S3_BUCKET=acme-downloads
+//	TENANT_ACME_S3_REGION=eu-west-1
+//	TENANT_ACME_S3_KEY=...
+//	TENANT_ACME_S3_SECRET=...
+//
+// A manifest picks its tenant with Tenant. When TENANT_HEADER is set, a
+// proxy in front can pick one for manifests that don't, and is refused for
+// those that name another. Only the proxies in TENANT_HEADER_TRUSTED, or
+// anything on the Unix socket, can set it, anyone else's header is ignored.
+// Everything else uses the S3_* settings.
+
+// tenantSettings are one tenant's settings. The region and credentials are
+// the S3_* ones when they're not set.
+type tenantSettings struct {
+    Name      string
+    Bucket    string
+    Region    string
+    AccessKey string
+    SecretKey string
+    Inventory string
+    Quota     tenantQuota
+}
+
+func loadTenantSettings() []tenantSettings {
+    var tenants []tenantSettings
+    for _, name := range strings.Split(setting("TENANTS"), ",") {
+        if name = strings.TrimSpace(name); name == "" {
+            continue
+        }
+
+        prefix := tenantPrefix(name)
+        tenants = append(tenants, tenantSettings{
+            Name:      name,
+            Bucket:    setting(prefix + "S3_BUCKET"),
+            Region:    getEnv(prefix+"S3_REGION", setting("S3_REGION")),
+            AccessKey: setting(prefix + "S3_KEY"),
+            SecretKey: secretSetting(prefix + "S3_SECRET"),
+            Inventory: setting(prefix + "S3_INVENTORY"),
+            Quota:     loadTenantQuota(prefix),
+        })
+    }
+    return tenants
+}
+
+// tenantPrefix is where a tenant's settings are, TENANT_ACME_ for acme
+func tenantPrefix(name string) string {
+    return "TENANT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// tenant is where a tenant's files are read from and job results go, and
+// how much it may use
+type tenant struct {
+    bucket    *s3.Bucket
+    archiver  *archive.Archiver
+    inventory *inventory // nil without one
+    quota     tenantQuota
+}
+
+var (
+    defaultTenant *tenant
+    tenants       = map[string]*tenant{}
+)
+
+var (
+    errUnknownTenant  = errors.New("the manifest's tenant isn't configured")
+    errTenantMismatch = errors.New("the manifest belongs to another tenant")
+)
+
+// tenantHeaderTrusted is TENANT_HEADER_TRUSTED parsed
+var tenantHeaderTrusted []netip.Prefix
+
+type peerAddrKey struct{}
+
+// withPeerAddr notes the address of whatever is on the other end of the
+// connection, the proxy when there is one, however the client address is
+// reported. It's the server's ConnContext.
+func withPeerAddr(ctx context.Context, c net.Conn) context.Context {
+    if t, ok := c.(*tls.Conn); ok {
+        c = t.NetConn()
+    }
+    if p, ok := c.(*proxyConn); ok {
+        c = p.Conn
+    }
+    return context.WithValue(ctx, peerAddrKey{}, c.RemoteAddr())
+}
+
+// tenantHeaderAllowed reports whether the request came straight from a proxy
+// trusted to set TENANT_HEADER
+func tenantHeaderAllowed(r *http.Request) bool {
+    switch addr := r.Context().Value(peerAddrKey{}).(type) {
+    case *net.UnixAddr:
+        return true
+    case *net.TCPAddr:
+        ip, ok := netip.AddrFromSlice(addr.IP)
+        return ok && containsAddr(tenantHeaderTrusted, ip.Unmap())
+    }
+    return false
+}
+
+// initTenants sets up each tenant's bucket, with an archiver like the
+// default one but reading from it. It runs after the plugins have added
+// their hooks.
+func initTenants() {
+    tenantHeaderTrusted = parsePrefixes(strings.Split(config.TenantHeaderTrusted, ","))
+    defaultTenant = &tenant{bucket: aws_bucket, archiver: archiver}
+    if config.S3Inventory != "" {
+        defaultTenant.inventory = mustInventory(config.S3Inventory, aws_bucket.S3)
+    }
+
+    for _, settings := range config.Tenants {
+        auth := awsAuth
+        if settings.AccessKey != "" {
+            var err error
+            if auth, err = aws.GetAuth(settings.AccessKey, settings.SecretKey, "", time.Now().Add(time.Hour)); err != nil {
+                panic(err)
+            }
+        }
+
+        bucket := s3.New(auth, aws.GetRegion(settings.Region)).Bucket(settings.Bucket)
+        a := *archiver
+        a.Source = archive.S3Source{Bucket: bucket}
+        tenants[settings.Name] = &tenant{bucket: bucket, archiver: &a, quota: settings.Quota}
+        if settings.Inventory != "" {
+            tenants[settings.Name].inventory = mustInventory(settings.Inventory, bucket.S3)
+        }
+    }
+}
+
+func mustInventory(raw string, conn *s3.S3) *inventory {
+    inv, err := newInventory(raw, conn)
+    if err != nil {
+        panic(err)
+    }
+    return inv
+}
+
+// tenantFor is the tenant a manifest belongs to, the default one when it
+// doesn't name one
+func tenantFor(manifest *Manifest) *tenant {
+    if t, ok := tenants[manifest.Tenant]; ok {
+        return t
+    }
+    return defaultTenant
+}
+
+// resolveTenant settles which tenant a download is for, filling it in on
+// the manifest from TENANT_HEADER when the manifest doesn't say and a
+// trusted proxy sent it
+func resolveTenant(r *http.Request, manifest *Manifest) error {
+    if config.TenantHeader != "" && tenantHeaderAllowed(r) {
+        if name := r.Header.Get(config.TenantHeader); name != "" {
+            if manifest.Tenant != "" && manifest.Tenant != name {
+                return errTenantMismatch
+            }
+            manifest.Tenant = name
+        }
+    }
+
+    if _, ok := tenants[manifest.Tenant]; manifest.Tenant != "" && !ok {
+        return errUnknownTenant
+    }
+    return nil
+}
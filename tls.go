@@ -0,0 +1,145 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "net/http"
+    "os"
+    "regexp"
+    "strings"
+
+    "golang.org/x/crypto/acme"
+    "golang.org/x/crypto/acme/autocert"
+)
+
+var errClientSubject = errors.New("client certificate subject not allowed")
+
+// tlsEnabled reports whether zipper terminates TLS itself
+func tlsEnabled() bool {
+    return autocertEnabled() || (config.TLSCertFile != "" && config.TLSKeyFile != "")
+}
+
+// autocertEnabled reports whether certificates come from ACME rather than files
+func autocertEnabled() bool {
+    return config.AutocertHosts != ""
+}
+
+// buildTLSConfig returns the server TLS configuration, including ACME
+// certificates when TLS_AUTOCERT_HOSTS is set and client certificate
+// verification when TLS_CLIENT_CA_FILE is set
+func buildTLSConfig() (*tls.Config, error) {
+    tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+    if !autocertEnabled() {
+        cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+        if err != nil {
+            return nil, err
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+
+    if autocertEnabled() {
+        manager := newAutocertManager()
+        tlsConfig.GetCertificate = manager.GetCertificate
+        tlsConfig.NextProtos = []string{"http/1.1", acme.ALPNProto}
+        if config.HTTP2 {
+            tlsConfig.NextProtos = append([]string{"h2"}, tlsConfig.NextProtos...)
+        }
+
+        // HTTP-01 challenges need a plain HTTP listener, everything else on
+        // it is redirected to HTTPS
+        if config.AutocertHTTPAddr != "" {
+            go func() {
+                fatal("ACME challenge listener stopped", http.ListenAndServe(config.AutocertHTTPAddr, manager.HTTPHandler(nil)))
+            }()
+        }
+    }
+
+    if config.TLSClientCAFile == "" {
+        return tlsConfig, nil
+    }
+
+    bundle, err := os.ReadFile(config.TLSClientCAFile)
+    if err != nil {
+        return nil, err
+    }
+
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(bundle) {
+        return nil, errors.New("TLS_CLIENT_CA_FILE contains no certificates")
+    }
+
+    tlsConfig.ClientCAs = pool
+    tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+    patterns, err := compileSubjectPatterns(config.TLSClientSubjects)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(patterns) > 0 {
+        tlsConfig.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+            for _, chain := range chains {
+                if len(chain) > 0 && subjectAllowed(chain[0], patterns) {
+                    return nil
+                }
+            }
+            return errClientSubject
+        }
+    }
+
+    return tlsConfig, nil
+}
+
+// compileSubjectPatterns reads TLS_CLIENT_SUBJECTS. Each pattern has to
+// match a whole name, so svc-a doesn't let svc-ab in.
+func compileSubjectPatterns(value string) (patterns []*regexp.Regexp, err error) {
+    for _, pattern := range strings.Split(value, ",") {
+        if pattern = strings.TrimSpace(pattern); pattern == "" {
+            continue
+        }
+
+        re, err := regexp.Compile("^(?:" + pattern + ")$")
+        if err != nil {
+            return nil, err
+        }
+        patterns = append(patterns, re)
+    }
+    return
+}
+
+// subjectAllowed matches the certificate's distinguished name, common name
+// and DNS/URI SANs against the allowed patterns
+func subjectAllowed(cert *x509.Certificate, patterns []*regexp.Regexp) bool {
+    names := []string{cert.Subject.String(), cert.Subject.CommonName}
+    names = append(names, cert.DNSNames...)
+    for _, uri := range cert.URIs {
+        names = append(names, uri.String())
+    }
+
+    for _, pattern := range patterns {
+        for _, name := range names {
+            if name != "" && pattern.MatchString(name) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func newAutocertManager() *autocert.Manager {
+    var hosts []string
+    for _, host := range strings.Split(config.AutocertHosts, ",") {
+        if host = strings.TrimSpace(host); host != "" {
+            hosts = append(hosts, host)
+        }
+    }
+
+    return &autocert.Manager{
+        Prompt:     autocert.AcceptTOS,
+        HostPolicy: autocert.HostWhitelist(hosts...),
+        Cache:      autocert.DirCache(config.AutocertCacheDir),
+        Email:      config.AutocertEmail,
+    }
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+// Tokens created through the API expire after a day unless asked otherwise
+const defaultTokenTTL = 24 * 60 * 60
+
+type createTokenRequest struct {
+    Files []*RedisFile `json:"files"`
+    TTL   int          `json:"ttl"`
+}
+
+type createTokenResponse struct {
+    Token string `json:"token"`
+}
+
+// newToken returns a random version 4 UUID
+func newToken() string {
+    var b [16]byte
+    rand.Read(b[:])
+    b[6] = (b[6] & 0x0f) | 0x40
+    b[8] = (b[8] & 0x3f) | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// createTokenHandler stores a manifest in Redis under a fresh token
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+    var req createTokenRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Files) == 0 {
+        writeProblem(w, r, 400, codeBadRequest, "Expected a JSON body with a non-empty files list")
+        return
+    }
+    if err := checkManifestFiles(req.Files, nil, nil, nil); err != nil {
+        writeProblem(w, r, 400, codeBadRequest, "Invalid files: "+err.Error())
+        return
+    }
+
+    token, err := storeToken(r.Context(), req.Files, req.TTL)
+    if err != nil {
+        slog.ErrorContext(r.Context(), "Error storing token", "error", err)
+        writeProblem(w, r, 503, codeStorageUnreachable, "Could not store the token")
+        return
+    }
+
+    writeJSON(w, 201, createTokenResponse{Token: token})
+}
+
+// storeToken saves files as the manifest of a new token, expiring after ttl
+// seconds or a day when that's not positive
+func storeToken(ctx context.Context, files []*RedisFile, ttl int) (string, error) {
+    if ttl <= 0 {
+        ttl = defaultTokenTTL
+    }
+
+    manifest, err := json.Marshal(files)
+    if err != nil {
+        return "", err
+    }
+
+    token := newToken()
+    if err := tokenStore.Put(ctx, token, manifest, time.Duration(ttl)*time.Second); err != nil {
+        return "", err
+    }
+
+    return token, nil
+}
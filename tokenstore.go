@@ -0,0 +1,417 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    goredis "github.com/redis/go-redis/v9"
+)
+
+// TokenStore keeps the manifests of opaque tokens. Manifests are the JSON
+// getManifest decodes, stores don't look inside them.
+type TokenStore interface {
+    // Get returns errTokenNotFound for tokens that don't exist or expired
+    Get(ctx context.Context, token string) ([]byte, error)
+
+    // Put saves a manifest, expiring after ttl or never when it's zero
+    Put(ctx context.Context, token string, manifest []byte, ttl time.Duration) error
+
+    // Delete removes a token, reporting whether it existed
+    Delete(ctx context.Context, token string) (bool, error)
+}
+
+var tokenStore TokenStore
+
+// manifestOpener is a TokenStore that can hand over a manifest a piece at a
+// time, rather than all of it at once
+type manifestOpener interface {
+    Open(ctx context.Context, token string) (io.ReadCloser, error)
+}
+
+// openManifest reads a token's manifest from the store, a piece at a time
+// when it can
+func openManifest(ctx context.Context, token string) (io.ReadCloser, error) {
+    if opener, ok := tokenStore.(manifestOpener); ok {
+        return opener.Open(ctx, token)
+    }
+
+    data, err := tokenStore.Get(ctx, token)
+    if err != nil {
+        return nil, err
+    }
+    return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// initTokenStore picks the store from TOKEN_STORE, Redis unless told
+// otherwise
+func initTokenStore() {
+    switch config.TokenStore {
+    case "redis":
+        tokenStore = newRedisTokenStore(config)
+    case "memory":
+        tokenStore = newMemoryTokenStore()
+    case "dynamodb":
+        tokenStore = newDynamoTokenStore(config)
+    case "postgres":
+        tokenStore = newPostgresTokenStore(config)
+    default:
+        panic(fmt.Sprintf("unknown TOKEN_STORE %q", config.TokenStore))
+    }
+}
+
+// redisTokenStore keeps manifests at "zip:<token>", or wherever
+// REDIS_KEY_PREFIX or REDIS_KEY_TEMPLATE put them. They're usually a JSON
+// string, but can be a list of file entries or a hash of them by position, or
+// split into chunks at "zip:<token>:0" onwards with an index at the key.
+type redisTokenStore struct {
+    template string // with {token} standing for the token
+}
+
+func newRedisTokenStore(c Configuration) redisTokenStore {
+    if c.RedisKeyTemplate != "" {
+        return redisTokenStore{template: c.RedisKeyTemplate}
+    }
+    return redisTokenStore{template: c.RedisKeyPrefix + "{token}"}
+}
+
+func (s redisTokenStore) key(token string) string {
+    return strings.ReplaceAll(s.template, "{token}", token)
+}
+
+func (s redisTokenStore) Get(ctx context.Context, token string) ([]byte, error) {
+    r, err := s.Open(ctx, token)
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+    return io.ReadAll(r)
+}
+
+// Open reads a chunked, list or hash manifest a piece at a time, as it's
+// decoded. A plain string is fetched whole.
+func (s redisTokenStore) Open(ctx context.Context, token string) (io.ReadCloser, error) {
+    key := s.key(token)
+    data, err := redisClient.Get(ctx, key).Bytes()
+    if err == goredis.Nil {
+        return nil, errTokenNotFound
+    }
+    if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+        return openManifestEntries(ctx, key)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    if chunks := manifestChunks(data); chunks > 0 {
+        return &chunkReader{ctx: ctx, key: key, n: chunks}, nil
+    }
+    return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// A chunk index is this small, anything bigger is a manifest
+const maxChunkIndex = 64
+
+// manifestChunks reads how many chunks a manifest is split into from its
+// index, like {"Chunks":12}, or 0 when data is the manifest itself
+func manifestChunks(data []byte) int {
+    if len(data) > maxChunkIndex || !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+        return 0
+    }
+
+    var index struct{ Chunks int }
+    if json.Unmarshal(data, &index) != nil || index.Chunks < 0 {
+        return 0
+    }
+    return index.Chunks
+}
+
+// chunkReader puts back together a manifest too big to be one value, which
+// producers write as consecutive pieces of its bytes at <key>:0 to
+// <key>:<n-1>. They're fetched one at a time as they're read, so only one
+// is in memory and a cluster can keep them on different nodes.
+type chunkReader struct {
+    ctx   context.Context
+    key   string
+    n     int
+    next  int
+    chunk []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+    for len(r.chunk) == 0 {
+        if r.next == r.n {
+            return 0, io.EOF
+        }
+
+        chunk, err := redisClient.Get(r.ctx, fmt.Sprintf("%s:%d", r.key, r.next)).Bytes()
+        if err == goredis.Nil {
+            return 0, fmt.Errorf("%w: chunk %d of %d is missing", errManifestInvalid, r.next, r.n)
+        }
+        if err != nil {
+            return 0, fmt.Errorf("%w: %w", errStoreUnavailable, err)
+        }
+        r.chunk = chunk
+        r.next++
+    }
+
+    n := copy(p, r.chunk)
+    r.chunk = r.chunk[n:]
+    return n, nil
+}
+
+func (r *chunkReader) Close() error {
+    r.chunk = nil
+    return nil
+}
+
+// How many entries of a list or hash manifest are read at a time
+const manifestPageSize = 1000
+
+// openManifestEntries reads a manifest too big for one string, kept as a
+// list of file entries or a hash of them with the positions 0, 1, 2... as
+// fields, in numeric order. It's read as the JSON list of files.
+func openManifestEntries(ctx context.Context, key string) (io.ReadCloser, error) {
+    kind, err := redisClient.Type(ctx, key).Result()
+    if err != nil {
+        return nil, err
+    }
+
+    switch kind {
+    case "list":
+        return &entryReader{ctx: ctx, key: key}, nil
+    case "hash":
+        fields, err := manifestFields(ctx, key)
+        if err != nil {
+            return nil, err
+        }
+        return &entryReader{ctx: ctx, key: key, hash: true, fields: fields}, nil
+    case "none":
+        // Expired since the GET
+        return nil, errTokenNotFound
+    default:
+        return nil, errManifestInvalid
+    }
+}
+
+// manifestFields lists a hash manifest's fields in numeric order, a page at
+// a time so Redis isn't stuck sending one huge reply. Only the fields are
+// kept, the entries are fetched as they're read.
+func manifestFields(ctx context.Context, key string) ([]string, error) {
+    positions := map[int]string{}
+    for cursor := uint64(0); ; {
+        page, next, err := redisClient.HScan(ctx, key, cursor, "", manifestPageSize).Result()
+        if err != nil {
+            return nil, err
+        }
+        for i := 0; i+1 < len(page); i += 2 {
+            n, err := strconv.Atoi(page[i])
+            if err != nil || n < 0 || strconv.Itoa(n) != page[i] {
+                return nil, fmt.Errorf("%w: the hash's field %q isn't a position", errManifestInvalid, page[i])
+            }
+            positions[n] = page[i]
+        }
+        if cursor = next; cursor == 0 {
+            break
+        }
+    }
+
+    order := make([]int, 0, len(positions))
+    for n := range positions {
+        order = append(order, n)
+    }
+    sort.Ints(order)
+    fields := make([]string, len(order))
+    for i, n := range order {
+        fields[i] = positions[n]
+    }
+    return fields, nil
+}
+
+// entryReader reads a list or hash manifest's entries as the JSON list of
+// files. Like chunkReader, they're fetched a page at a time as they're
+// read, so only a page is in memory.
+type entryReader struct {
+    ctx    context.Context
+    key    string
+    hash   bool
+    fields []string // a hash's, in order
+    next   int
+    done   bool
+    buf    []byte
+}
+
+func (r *entryReader) Read(p []byte) (int, error) {
+    for len(r.buf) == 0 {
+        if r.done {
+            return 0, io.EOF
+        }
+        if err := r.fill(); err != nil {
+            return 0, err
+        }
+    }
+
+    n := copy(p, r.buf)
+    r.buf = r.buf[n:]
+    return n, nil
+}
+
+// fill fetches the next page of entries, with the list's brackets and
+// commas around them
+func (r *entryReader) fill() error {
+    page, err := r.page()
+    if err != nil {
+        return err
+    }
+
+    if r.next == 0 {
+        r.buf = append(r.buf, '[')
+    }
+    for i, entry := range page {
+        if !json.Valid([]byte(entry)) {
+            return fmt.Errorf("%w: entry %d isn't JSON", errManifestInvalid, r.next+i)
+        }
+        if r.next+i > 0 {
+            r.buf = append(r.buf, ',')
+        }
+        r.buf = append(r.buf, entry...)
+    }
+    r.next += len(page)
+
+    if len(page) < manifestPageSize || r.hash && r.next == len(r.fields) {
+        r.buf = append(r.buf, ']')
+        r.done = true
+    }
+    return nil
+}
+
+func (r *entryReader) page() ([]string, error) {
+    if !r.hash {
+        page, err := redisClient.LRange(r.ctx, r.key, int64(r.next), int64(r.next+manifestPageSize-1)).Result()
+        if err != nil {
+            return nil, fmt.Errorf("%w: %w", errStoreUnavailable, err)
+        }
+        return page, nil
+    }
+
+    fields := r.fields[r.next:min(r.next+manifestPageSize, len(r.fields))]
+    if len(fields) == 0 {
+        return nil, nil
+    }
+    values, err := redisClient.HMGet(r.ctx, r.key, fields...).Result()
+    if err != nil {
+        return nil, fmt.Errorf("%w: %w", errStoreUnavailable, err)
+    }
+    page := make([]string, len(values))
+    for i, value := range values {
+        entry, ok := value.(string)
+        if !ok {
+            // Changed while it was read
+            return nil, fmt.Errorf("%w: field %s is missing", errManifestInvalid, fields[i])
+        }
+        page[i] = entry
+    }
+    return page, nil
+}
+
+func (r *entryReader) Close() error {
+    r.buf = nil
+    return nil
+}
+
+func (s redisTokenStore) Put(ctx context.Context, token string, manifest []byte, ttl time.Duration) error {
+    return redisClient.Set(ctx, s.key(token), manifest, ttl).Err()
+}
+
+func (s redisTokenStore) Delete(ctx context.Context, token string) (bool, error) {
+    key := s.key(token)
+
+    // Chunks go with their index, rather than wait out their TTL
+    keys := []string{key}
+    data, err := redisClient.Get(ctx, key).Bytes()
+    if err != nil && err != goredis.Nil && !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+        return false, err
+    }
+    for i := 0; i < manifestChunks(data); i++ {
+        keys = append(keys, fmt.Sprintf("%s:%d", key, i))
+    }
+
+    var deleted int64
+    for _, key := range keys {
+        // One at a time, the chunks can be in different cluster slots
+        n, err := redisClient.Del(ctx, key).Result()
+        if err != nil {
+            return false, err
+        }
+        deleted += n
+    }
+    return deleted > 0, nil
+}
+
+// memoryTokenStore keeps manifests in this process only, for a single
+// replica or for embedding zipper in tests
+type memoryTokenStore struct {
+    sync.Mutex
+    tokens map[string]memoryToken
+}
+
+type memoryToken struct {
+    manifest []byte
+    expires  time.Time
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+    return &memoryTokenStore{tokens: map[string]memoryToken{}}
+}
+
+func (s *memoryTokenStore) Get(ctx context.Context, token string) ([]byte, error) {
+    s.Lock()
+    defer s.Unlock()
+
+    t, ok := s.tokens[token]
+    if !ok {
+        return nil, errTokenNotFound
+    }
+    if !t.expires.IsZero() && time.Now().After(t.expires) {
+        delete(s.tokens, token)
+        return nil, errTokenNotFound
+    }
+    return t.manifest, nil
+}
+
+func (s *memoryTokenStore) Put(ctx context.Context, token string, manifest []byte, ttl time.Duration) error {
+    t := memoryToken{manifest: manifest}
+    if ttl > 0 {
+        t.expires = time.Now().Add(ttl)
+    }
+
+    s.Lock()
+    defer s.Unlock()
+
+    // Expired tokens are swept as new ones arrive
+    now := time.Now()
+    for token, old := range s.tokens {
+        if !old.expires.IsZero() && now.After(old.expires) {
+            delete(s.tokens, token)
+        }
+    }
+
+    s.tokens[token] = t
+    return nil
+}
+
+func (s *memoryTokenStore) Delete(ctx context.Context, token string) (bool, error) {
+    s.Lock()
+    defer s.Unlock()
+
+    _, ok := s.tokens[token]
+    delete(s.tokens, token)
+    return ok, nil
+}
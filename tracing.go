@@ -0,0 +1,340 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    goredis "github.com/redis/go-redis/v9"
+)
+
+// Spans are exported with OTLP over HTTP using its JSON encoding, which any
+// OpenTelemetry collector accepts, rather than vendoring the SDK
+
+// OTLP span kinds
+const (
+    spanKindInternal = 1
+    spanKindServer   = 2
+    spanKindClient   = 3
+)
+
+const (
+    traceBatchSize     = 512
+    traceFlushInterval = 5 * time.Second
+)
+
+var traceURL string
+var traceHeaders = http.Header{}
+var traceClient = &http.Client{Timeout: 10 * time.Second}
+var traceQueue chan *span
+
+type span struct {
+    traceID [16]byte
+    spanID  [8]byte
+    parent  [8]byte
+    name    string
+    kind    int
+    start   time.Time
+    end     time.Time
+
+    mu         sync.Mutex
+    attributes map[string]interface{}
+    err        string
+}
+
+type spanContextKey struct{}
+
+// initTracing turns tracing on when an OTLP endpoint is configured
+func initTracing() {
+    traceURL = config.OTLPTracesEndpoint
+    if traceURL == "" && config.OTLPEndpoint != "" {
+        traceURL = strings.TrimSuffix(config.OTLPEndpoint, "/") + "/v1/traces"
+    }
+    if traceURL == "" {
+        return
+    }
+
+    for _, header := range strings.Split(config.OTLPHeaders, ",") {
+        if key, value, ok := strings.Cut(header, "="); ok {
+            traceHeaders.Set(strings.TrimSpace(key), strings.TrimSpace(value))
+        }
+    }
+
+    traceQueue = make(chan *span, traceBatchSize*4)
+    go exportSpans()
+
+    slog.Info("Exporting traces", "url", traceURL)
+}
+
+func tracingEnabled() bool {
+    return traceQueue != nil
+}
+
+// startSpan starts a child of the span in ctx, or a new trace. It returns a
+// nil span, which ignores everything, when tracing is off.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+    if !tracingEnabled() {
+        return ctx, nil
+    }
+
+    s := &span{name: name, kind: kind, start: time.Now(), attributes: map[string]interface{}{}}
+    rand.Read(s.spanID[:])
+
+    if parent, ok := ctx.Value(spanContextKey{}).(*span); ok {
+        s.traceID = parent.traceID
+        s.parent = parent.spanID
+    } else {
+        rand.Read(s.traceID[:])
+    }
+
+    return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// startServerSpan starts the root span for a request, continuing the
+// caller's trace when it sent a W3C traceparent header
+func startServerSpan(r *http.Request, name string) (*http.Request, *span) {
+    ctx := r.Context()
+
+    // traceparent is version-traceid-parentid-flags
+    if parts := strings.Split(r.Header.Get("traceparent"), "-"); tracingEnabled() && len(parts) == 4 {
+        traceID, err1 := hex.DecodeString(parts[1])
+        parentID, err2 := hex.DecodeString(parts[2])
+        if err1 == nil && err2 == nil && len(traceID) == 16 && len(parentID) == 8 {
+            remote := &span{}
+            copy(remote.traceID[:], traceID)
+            copy(remote.spanID[:], parentID)
+            ctx = context.WithValue(ctx, spanContextKey{}, remote)
+        }
+    }
+
+    ctx, s := startSpan(ctx, name, spanKindServer)
+    s.set("http.request.method", r.Method)
+    s.set("url.path", r.URL.Path)
+    s.set("client.address", clientIP(r))
+    if id := requestID(ctx); id != "" {
+        s.set("zipper.request_id", id)
+    }
+
+    return r.WithContext(ctx), s
+}
+
+func (s *span) set(key string, value interface{}) {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    s.attributes[key] = value
+    s.mu.Unlock()
+}
+
+// fail marks the span as failed, ignoring nil errors
+func (s *span) fail(err error) {
+    if s == nil || err == nil {
+        return
+    }
+    s.mu.Lock()
+    s.err = err.Error()
+    s.mu.Unlock()
+}
+
+// finish ends the span and queues it for export, dropping it if the exporter
+// has fallen behind
+func (s *span) finish() {
+    if s == nil {
+        return
+    }
+    s.end = time.Now()
+
+    select {
+    case traceQueue <- s:
+    default:
+    }
+}
+
+func exportSpans() {
+    ticker := time.NewTicker(traceFlushInterval)
+    defer ticker.Stop()
+
+    var batch []*span
+    for {
+        select {
+        case s := <-traceQueue:
+            batch = append(batch, s)
+            if len(batch) < traceBatchSize {
+                continue
+            }
+        case <-ticker.C:
+            if len(batch) == 0 {
+                continue
+            }
+        }
+
+        if err := postSpans(batch); err != nil {
+            slog.Error("Error exporting spans", "count", len(batch), "error", err)
+        }
+        batch = nil
+    }
+}
+
+type otlpAttribute struct {
+    Key   string                 `json:"key"`
+    Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+    TraceID           string          `json:"traceId"`
+    SpanID            string          `json:"spanId"`
+    ParentSpanID      string          `json:"parentSpanId,omitempty"`
+    Name              string          `json:"name"`
+    Kind              int             `json:"kind"`
+    StartTimeUnixNano string          `json:"startTimeUnixNano"`
+    EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+    Attributes        []otlpAttribute `json:"attributes,omitempty"`
+    Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+    Code    int    `json:"code"`
+    Message string `json:"message,omitempty"`
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+    switch v := v.(type) {
+    case bool:
+        return map[string]interface{}{"boolValue": v}
+    case int:
+        return map[string]interface{}{"intValue": strconv.Itoa(v)}
+    case int64:
+        return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+    case float64:
+        return map[string]interface{}{"doubleValue": v}
+    case string:
+        return map[string]interface{}{"stringValue": v}
+    }
+    return map[string]interface{}{"stringValue": ""}
+}
+
+func postSpans(batch []*span) error {
+    spans := make([]otlpSpan, 0, len(batch))
+    for _, s := range batch {
+        o := otlpSpan{
+            TraceID:           hex.EncodeToString(s.traceID[:]),
+            SpanID:            hex.EncodeToString(s.spanID[:]),
+            Name:              s.name,
+            Kind:              s.kind,
+            StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+            EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+        }
+        if s.parent != [8]byte{} {
+            o.ParentSpanID = hex.EncodeToString(s.parent[:])
+        }
+
+        s.mu.Lock()
+        for key, value := range s.attributes {
+            o.Attributes = append(o.Attributes, otlpAttribute{Key: key, Value: otlpValue(value)})
+        }
+        if s.err != "" {
+            o.Status = &otlpStatus{Code: 2, Message: s.err}
+        }
+        s.mu.Unlock()
+
+        spans = append(spans, o)
+    }
+
+    body, err := json.Marshal(map[string]interface{}{
+        "resourceSpans": []interface{}{map[string]interface{}{
+            "resource": map[string]interface{}{
+                "attributes": []otlpAttribute{
+                    {Key: "service.name", Value: otlpValue(config.ServiceName)},
+                    {Key: "service.version", Value: otlpValue(version)},
+                },
+            },
+            "scopeSpans": []interface{}{map[string]interface{}{
+                "scope": map[string]string{"name": "zipper"},
+                "spans": spans,
+            }},
+        }},
+    })
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequest("POST", traceURL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    for key := range traceHeaders {
+        req.Header.Set(key, traceHeaders.Get(key))
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := traceClient.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return errors.New("collector returned " + resp.Status)
+    }
+    return nil
+}
+
+// redisTraceHook makes each Redis command sent for a traced request a
+// child span of the request's. Background work isn't traced.
+type redisTraceHook struct{}
+
+func (redisTraceHook) DialHook(next goredis.DialHook) goredis.DialHook {
+    return next
+}
+
+func (redisTraceHook) ProcessHook(next goredis.ProcessHook) goredis.ProcessHook {
+    return func(ctx context.Context, cmd goredis.Cmder) error {
+        if _, ok := ctx.Value(spanContextKey{}).(*span); !ok {
+            return next(ctx, cmd)
+        }
+
+        _, s := startSpan(ctx, "redis "+cmd.Name(), spanKindClient)
+        s.set("db.system", "redis")
+        s.set("db.operation", cmd.Name())
+
+        err := next(ctx, cmd)
+        if redisFailed(err) {
+            s.fail(err)
+        }
+        s.finish()
+        return err
+    }
+}
+
+func (redisTraceHook) ProcessPipelineHook(next goredis.ProcessPipelineHook) goredis.ProcessPipelineHook {
+    return func(ctx context.Context, cmds []goredis.Cmder) error {
+        if _, ok := ctx.Value(spanContextKey{}).(*span); !ok {
+            return next(ctx, cmds)
+        }
+
+        names := make([]string, len(cmds))
+        for i, cmd := range cmds {
+            names[i] = cmd.Name()
+        }
+        _, s := startSpan(ctx, "redis pipeline", spanKindClient)
+        s.set("db.system", "redis")
+        s.set("db.operation", strings.Join(names, " "))
+
+        err := next(ctx, cmds)
+        if redisFailed(err) {
+            s.fail(err)
+        }
+        s.finish()
+        return err
+    }
+}
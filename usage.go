@@ -0,0 +1,185 @@
+package main
+
+import (
+    "context"
+    "encoding/csv"
+    "log/slog"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    goredis "github.com/redis/go-redis/v9"
+)
+
+// Archives are counted against the manifest's tenant and Owner, the team or
+// service that made the token, so egress can be charged back to it. Each
+// day's counts are a hash in Redis, usage:2024-05-01, with fields like
+// bytes:<tenant>:<owner>, kept for USAGE_RETENTION. They're also Prometheus
+// counters, so owners should be a handful of team names rather than users.
+
+// The longest range a usage report covers
+const maxUsageDays = 366
+
+func usageKey(day time.Time) string {
+    return redisKey("usage:" + day.UTC().Format(time.DateOnly))
+}
+
+// recordUsage counts a finished archive against its owner and sends it to
+// billing. kind and result are as in zipper_archives_total, id is the
+// download or job ID.
+func recordUsage(ctx context.Context, kind, id string, manifest *Manifest, result string, bytes int64) {
+    emitBilling(&billingEvent{
+        ID:     id,
+        Kind:   kind,
+        Time:   time.Now().UTC(),
+        Tenant: manifest.Tenant,
+        Owner:  manifest.Owner,
+        Result: result,
+        Bytes:  bytes,
+        Files:  len(manifest.Files),
+    })
+
+    owner := manifest.Owner
+    ownerArchives.inc(owner, result)
+    ownerBytes.add(float64(bytes), owner)
+
+    if config.UsageRetention <= 0 {
+        return
+    }
+
+    // The client may be gone, the usage still counts
+    ctx = context.WithoutCancel(ctx)
+    key := usageKey(time.Now())
+    who := manifest.Tenant + ":" + owner
+    _, err := redisClient.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+        pipe.HIncrBy(ctx, key, "archives:"+who, 1)
+        pipe.HIncrBy(ctx, key, "bytes:"+who, bytes)
+        if result != "ok" {
+            pipe.HIncrBy(ctx, key, "failures:"+who, 1)
+        }
+        pipe.Expire(ctx, key, config.UsageRetention)
+        return nil
+    })
+    if err != nil {
+        slog.WarnContext(ctx, "Error recording usage", "tenant", manifest.Tenant, "owner", owner, "error", err)
+    }
+}
+
+// usageRow is what a tenant and owner used over a report's days
+type usageRow struct {
+    Tenant    string `json:"tenant"`
+    Owner     string `json:"owner"`
+    Downloads int64  `json:"downloads"`
+    Bytes     int64  `json:"bytes"`
+    Failures  int64  `json:"failures"`
+}
+
+type usageReport struct {
+    From  string      `json:"from"`
+    To    string      `json:"to"`
+    Usage []*usageRow `json:"usage"`
+}
+
+// usageHandler totals the daily counts between from and to, inclusive,
+// defaulting to the month so far. It answers CSV for ?format=csv or an
+// Accept of text/csv, for spreadsheets.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+    now := time.Now().UTC()
+    from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+    to := now
+
+    query := r.URL.Query()
+    for _, param := range []struct {
+        name string
+        day  *time.Time
+    }{{"from", &from}, {"to", &to}} {
+        value := query.Get(param.name)
+        if value == "" {
+            continue
+        }
+        day, err := time.Parse(time.DateOnly, value)
+        if err != nil {
+            writeProblem(w, r, 400, codeBadRequest, param.name+" should be a date like 2024-05-01")
+            return
+        }
+        *param.day = day
+    }
+    if to.Before(from) {
+        writeProblem(w, r, 400, codeBadRequest, "from is after to")
+        return
+    }
+    if to.Sub(from) >= maxUsageDays*24*time.Hour {
+        writeProblem(w, r, 400, codeBadRequest, "Reports can cover "+strconv.Itoa(maxUsageDays)+" days at most")
+        return
+    }
+
+    var days []*goredis.MapStringStringCmd
+    _, err := redisClient.Pipelined(r.Context(), func(pipe goredis.Pipeliner) error {
+        for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+            days = append(days, pipe.HGetAll(r.Context(), usageKey(day)))
+        }
+        return nil
+    })
+    if err != nil {
+        slog.ErrorContext(r.Context(), "Error reading usage", "error", err)
+        writeProblem(w, r, 503, codeStorageUnreachable, "Could not read the usage")
+        return
+    }
+
+    rows := map[string]*usageRow{}
+    for _, day := range days {
+        for field, value := range day.Val() {
+            metric, who, _ := strings.Cut(field, ":")
+            tenant, owner, _ := strings.Cut(who, ":")
+            row := rows[who]
+            if row == nil {
+                row = &usageRow{Tenant: tenant, Owner: owner}
+                rows[who] = row
+            }
+
+            n, _ := strconv.ParseInt(value, 10, 64)
+            switch metric {
+            case "archives":
+                row.Downloads += n
+            case "bytes":
+                row.Bytes += n
+            case "failures":
+                row.Failures += n
+            }
+        }
+    }
+
+    report := usageReport{From: from.Format(time.DateOnly), To: to.Format(time.DateOnly), Usage: []*usageRow{}}
+    for _, row := range rows {
+        report.Usage = append(report.Usage, row)
+    }
+    sort.Slice(report.Usage, func(i, j int) bool {
+        a, b := report.Usage[i], report.Usage[j]
+        if a.Tenant != b.Tenant {
+            return a.Tenant < b.Tenant
+        }
+        return a.Owner < b.Owner
+    })
+
+    if query.Get("format") != "csv" && !strings.Contains(r.Header.Get("Accept"), "text/csv") {
+        writeJSON(w, 200, report)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+    w.Header().Set("Content-Disposition", "attachment; filename=\"usage-"+report.From+"-"+report.To+".csv\"")
+    out := csv.NewWriter(w)
+    out.Write([]string{"tenant", "owner", "downloads", "bytes", "failures"})
+    for _, row := range report.Usage {
+        out.Write([]string{
+            row.Tenant,
+            row.Owner,
+            strconv.FormatInt(row.Downloads, 10),
+            strconv.FormatInt(row.Bytes, 10),
+            strconv.FormatInt(row.Failures, 10),
+        })
+    }
+    out.Flush()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "net/http"
+    "runtime"
+    "runtime/debug"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Builds without them fall back to what the Go toolchain recorded, if any.
+var (
+    version   = "dev"
+    commit    = ""
+    buildDate = ""
+)
+
+type versionResponse struct {
+    Version   string `json:"version"`
+    Commit    string `json:"commit,omitempty"`
+    BuildDate string `json:"buildDate,omitempty"`
+    Go        string `json:"go"`
+}
+
+func init() {
+    info, ok := debug.ReadBuildInfo()
+    if !ok {
+        return
+    }
+
+    for _, setting := range info.Settings {
+        switch setting.Key {
+        case "vcs.revision":
+            if commit == "" {
+                commit = setting.Value
+            }
+        case "vcs.time":
+            if buildDate == "" {
+                buildDate = setting.Value
+            }
+        }
+    }
+}
+
+// versionHeader tells clients which build answered, so a mixed deployment
+// shows up without asking every replica
+func versionHeader(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("X-Zipper-Version", version)
+        next(w, r)
+    }
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, 200, versionResponse{
+        Version:   version,
+        Commit:    commit,
+        BuildDate: buildDate,
+        Go:        runtime.Version(),
+    })
+}
@@ -1,21 +1,23 @@
 package main
 
 import (
-    "archive/zip"
-    "encoding/json"
+    "context"
+    "errors"
+    "flag"
     "fmt"
     "io"
-    "log"
-    "os"
-    "regexp"
+    "log/slog"
+    "strconv"
     "strings"
     "time"
 
     "net/http"
+    "net/url"
 
+    "codecourse/zipper/archive"
     "github.com/AdRoll/goamz/aws"
     "github.com/AdRoll/goamz/s3"
-    redigo "github.com/garyburd/redigo/redis"
+    goredis "github.com/redis/go-redis/v9"
 )
 
 type Configuration struct {
@@ -25,35 +27,397 @@ type Configuration struct {
     Region             string
     RedisServer        string
     RedisPort          string
+    RedisUsername      string
     RedisPassword      string
+    RedisURL           string
+    RedisDB            int
+    RedisTLS           bool
+    RedisTLSCAFile     string
+    RedisTLSServerName string
+    RedisTLSCertFile   string
+    RedisTLSKeyFile    string
+    RedisSentinels     string
+    RedisSentinelMaster string
+    RedisSentinelPassword string
+    RedisClusterNodes  string
+    RedisPoolMaxIdle   int
+    RedisPoolMaxActive int
+    RedisPoolIdleTimeout time.Duration
+    RedisPoolWait      bool
+    RedisTimeout       time.Duration
+    SigningKey         string
+    JWTSecret          string
+    JWTPublicKey       string
+    PASETOPublicKey    string
+    APIKeys            string
+    BearerSecret       string
+    BearerIntrospectionURL string
+    OIDCIssuer         string
+    OIDCAudience       string
+    OIDCSubjectClaim   string
+    OIDCRequired       bool
+    IPAllow            string
+    IPDeny             string
+    RateLimit          int
+    RateLimitWindow    int
+    LockoutThreshold   int
+    LockoutWindow      int
+    LockoutDuration    int
+    CORSAllowedOrigins string
+    CORSAllowedMethods string
+    CORSAllowedHeaders string
+    CORSExposedHeaders string
+    CORSMaxAge         int
+    SecurityHeaders    bool
+    ContentSecurityPolicy string
+    HSTSMaxAge         int
+    TLSCertFile        string
+    TLSKeyFile         string
+    TLSClientCAFile    string
+    TLSClientSubjects  string
+    AutocertHosts      string
+    AutocertEmail      string
+    AutocertCacheDir   string
+    AutocertHTTPAddr   string
+    Port               string
+    UnixSocket         string
+    UnixSocketMode     string
+    ProxyProtocol      bool
+    ProxyProtocolTrusted string
+    AdminPort          string
+    AdminSocket        string
+    TokenPattern       string
+    ListMaxFiles       int
+    ListMaxKeys        int
+    MaxArchiveFiles    int
+    MaxArchiveBytes    int64
+    PreflightHead      bool
+    EmptyArchiveStatus int
+    ExtractMaxBytes    int64
+    ExtractMaxFiles    int
+    ExtractMaxUnpacked int64
+    ExtractTimeout     time.Duration
+    HTMLPreview        bool
+    JobWorkers         int
+    JobQueueSize       int
+    JobPrefix          string
+    JobTTL             time.Duration
+    ProgressInterval   time.Duration
+    ProgressTTL        time.Duration
+    RevocationTTL      time.Duration
+    DrainDelay         time.Duration
+    ShutdownTimeout    time.Duration
+    OTLPEndpoint       string
+    OTLPTracesEndpoint string
+    OTLPHeaders        string
+    ServiceName        string
+    StatsDAddr         string
+    StatsDPrefix       string
+    StatsDTags         string
+    StatsDDogStatsD    bool
+    SentryDSN          string
+    SentryEnvironment  string
+    SentryRelease      string
+    Pprof              bool
+    LogLevel           string
+    LogFormat          string
+    LogSampleBurst     int
+    LogSampleWindow    time.Duration
+    AccessLogFormat    string
+    AccessLogFile      string
+    AuditStream        string
+    AuditKey           string
+    GRPCPort           string
+    DevDir             string
+    BasePath           string
+    SourceURL          string
+    TokenStore         string
+    DynamoDBTable      string
+    DynamoDBEndpoint   string
+    PostgresURL        string
+    PostgresTable      string
+    SecretsRefresh     time.Duration
+    Tenants            []tenantSettings
+    TenantHeader       string
+    TenantHeaderTrusted string
+    TenantQuotaWindow  time.Duration
+    S3Inventory        string
+    UsageRetention     time.Duration
+    BillingSink        string
+    RedisKeyPrefix     string
+    RedisKeyTemplate   string
+    Plugins            string
+    Middleware         string
+    ReadHeaderTimeout  time.Duration
+    ReadTimeout        time.Duration
+    WriteTimeout       time.Duration
+    IdleTimeout        time.Duration
+    HTTP2              bool
+    H2C                bool
 }
 
-var config = Configuration {
-    AccessKey: os.Getenv("S3_KEY"),
-    SecretKey: os.Getenv("S3_SECRET"),
-    Bucket: os.Getenv("S3_BUCKET"),
-    Region: os.Getenv("S3_REGION"),
-    RedisServer: os.Getenv("REDIS_HOST"),
-    RedisPort: os.Getenv("REDIS_PORT"),
-    RedisPassword: os.Getenv("REDIS_PASSWORD"),
+var config Configuration
+
+// loadConfiguration reads every setting, from flags, the environment or the
+// config file in that order of precedence
+func loadConfiguration() Configuration {
+    return Configuration {
+        AccessKey: setting("S3_KEY"),
+        SecretKey: setting("S3_SECRET"),
+        Bucket: setting("S3_BUCKET"),
+        Region: setting("S3_REGION"),
+        RedisServer: setting("REDIS_HOST"),
+        RedisPort: setting("REDIS_PORT"),
+        RedisUsername: setting("REDIS_USERNAME"),
+        RedisPassword: secretSetting("REDIS_PASSWORD"),
+        RedisURL: setting("REDIS_URL"),
+        RedisDB: getEnvInt("REDIS_DB", 0),
+        RedisTLS: getEnvBool("REDIS_TLS", false),
+        RedisTLSCAFile: setting("REDIS_TLS_CA_FILE"),
+        RedisTLSServerName: setting("REDIS_TLS_SERVER_NAME"),
+        RedisTLSCertFile: setting("REDIS_TLS_CERT_FILE"),
+        RedisTLSKeyFile: setting("REDIS_TLS_KEY_FILE"),
+        RedisSentinels: setting("REDIS_SENTINELS"),
+        RedisSentinelMaster: setting("REDIS_SENTINEL_MASTER"),
+        RedisSentinelPassword: secretSetting("REDIS_SENTINEL_PASSWORD"),
+        RedisClusterNodes: setting("REDIS_CLUSTER_NODES"),
+        RedisPoolMaxIdle: getEnvInt("REDIS_POOL_MAX_IDLE", 10),
+        RedisPoolMaxActive: getEnvInt("REDIS_POOL_MAX_ACTIVE", 0),
+        RedisPoolIdleTimeout: getEnvDuration("REDIS_POOL_IDLE_TIMEOUT", 4 * time.Minute),
+        RedisPoolWait: getEnvBool("REDIS_POOL_WAIT", false),
+        RedisTimeout: getEnvDuration("REDIS_TIMEOUT", 3 * time.Second),
+        SigningKey: secretSetting("SIGNING_KEY"),
+        JWTSecret: secretSetting("JWT_SECRET"),
+        JWTPublicKey: setting("JWT_PUBLIC_KEY"),
+        PASETOPublicKey: setting("PASETO_PUBLIC_KEY"),
+        APIKeys: secretSetting("API_KEYS"),
+        BearerSecret: secretSetting("DOWNLOAD_BEARER_SECRET"),
+        BearerIntrospectionURL: setting("DOWNLOAD_BEARER_INTROSPECTION_URL"),
+        OIDCIssuer: setting("OIDC_ISSUER"),
+        OIDCAudience: setting("OIDC_AUDIENCE"),
+        OIDCSubjectClaim: getEnv("OIDC_SUBJECT_CLAIM", "sub"),
+        OIDCRequired: getEnvBool("OIDC_REQUIRED", false),
+        IPAllow: setting("IP_ALLOW"),
+        IPDeny: setting("IP_DENY"),
+        RateLimit: getEnvInt("RATE_LIMIT", 0),
+        RateLimitWindow: getEnvInt("RATE_LIMIT_WINDOW", 60),
+        LockoutThreshold: getEnvInt("LOCKOUT_THRESHOLD", 20),
+        LockoutWindow: getEnvInt("LOCKOUT_WINDOW", 600),
+        LockoutDuration: getEnvInt("LOCKOUT_DURATION", 900),
+        CORSAllowedOrigins: setting("CORS_ALLOWED_ORIGINS"),
+        CORSAllowedMethods: getEnv("CORS_ALLOWED_METHODS", "GET, POST, DELETE, OPTIONS"),
+        CORSAllowedHeaders: getEnv("CORS_ALLOWED_HEADERS", "Authorization, Content-Type, X-API-Key"),
+        CORSExposedHeaders: getEnv("CORS_EXPOSED_HEADERS", "Content-Disposition, Retry-After"),
+        CORSMaxAge: getEnvInt("CORS_MAX_AGE", 600),
+        SecurityHeaders: getEnvBool("SECURITY_HEADERS", true),
+        ContentSecurityPolicy: getEnv("CONTENT_SECURITY_POLICY", "default-src 'self'; frame-ancestors 'none'"),
+        HSTSMaxAge: getEnvInt("HSTS_MAX_AGE", 0),
+        TLSCertFile: setting("TLS_CERT_FILE"),
+        TLSKeyFile: setting("TLS_KEY_FILE"),
+        TLSClientCAFile: setting("TLS_CLIENT_CA_FILE"),
+        TLSClientSubjects: setting("TLS_CLIENT_SUBJECTS"),
+        AutocertHosts: setting("TLS_AUTOCERT_HOSTS"),
+        AutocertEmail: setting("TLS_AUTOCERT_EMAIL"),
+        AutocertCacheDir: getEnv("TLS_AUTOCERT_CACHE", "certs"),
+        AutocertHTTPAddr: setting("TLS_AUTOCERT_HTTP_ADDR"),
+        Port: setting("PORT"),
+        UnixSocket: setting("UNIX_SOCKET"),
+        UnixSocketMode: getEnv("UNIX_SOCKET_MODE", "0660"),
+        ProxyProtocol: getEnvBool("PROXY_PROTOCOL", false),
+        ProxyProtocolTrusted: setting("PROXY_PROTOCOL_TRUSTED"),
+        AdminPort: setting("ADMIN_PORT"),
+        AdminSocket: setting("ADMIN_SOCKET"),
+        TokenPattern: getEnv("TOKEN_PATTERN", defaultTokenPattern),
+        ListMaxFiles: getEnvInt("LIST_MAX_FILES", 100000),
+        ListMaxKeys: getEnvInt("LIST_MAX_KEYS", 1000000),
+        MaxArchiveFiles: getEnvInt("MAX_ARCHIVE_FILES", 0),
+        MaxArchiveBytes: int64(getEnvInt("MAX_ARCHIVE_BYTES", 0)),
+        PreflightHead: getEnvBool("PREFLIGHT_HEAD", true),
+        EmptyArchiveStatus: getEnvInt("EMPTY_ARCHIVE_STATUS", 404),
+        ExtractMaxBytes: int64(getEnvInt("EXTRACT_MAX_BYTES", 10 << 30)),
+        ExtractMaxFiles: getEnvInt("EXTRACT_MAX_FILES", 10000),
+        ExtractMaxUnpacked: int64(getEnvInt("EXTRACT_MAX_UNPACKED_BYTES", 50 << 30)),
+        ExtractTimeout: getEnvDuration("EXTRACT_TIMEOUT", 6 * time.Hour),
+        HTMLPreview: getEnvBool("HTML_PREVIEW", false),
+        JobWorkers: getEnvInt("JOB_WORKERS", 2),
+        JobQueueSize: getEnvInt("JOB_QUEUE_SIZE", 100),
+        JobPrefix: getEnv("JOB_PREFIX", "jobs/"),
+        JobTTL: getEnvDuration("JOB_TTL", 24 * time.Hour),
+        ProgressInterval: getEnvDuration("PROGRESS_INTERVAL", time.Second),
+        ProgressTTL: getEnvDuration("PROGRESS_TTL", time.Hour),
+        RevocationTTL: getEnvDuration("REVOCATION_TTL", 30 * 24 * time.Hour),
+        DrainDelay: getEnvDuration("DRAIN_DELAY", 5 * time.Second),
+        ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", time.Minute),
+        OTLPEndpoint: setting("OTEL_EXPORTER_OTLP_ENDPOINT"),
+        OTLPTracesEndpoint: setting("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+        OTLPHeaders: setting("OTEL_EXPORTER_OTLP_HEADERS"),
+        ServiceName: getEnv("OTEL_SERVICE_NAME", "zipper"),
+        StatsDAddr: setting("STATSD_ADDR"),
+        StatsDPrefix: getEnv("STATSD_PREFIX", "zipper."),
+        StatsDTags: setting("STATSD_TAGS"),
+        StatsDDogStatsD: getEnvBool("STATSD_DOGSTATSD", false),
+        SentryDSN: setting("SENTRY_DSN"),
+        SentryEnvironment: setting("SENTRY_ENVIRONMENT"),
+        SentryRelease: getEnv("SENTRY_RELEASE", version),
+        Pprof: getEnvBool("PPROF", false),
+        LogLevel: getEnv("LOG_LEVEL", "info"),
+        LogFormat: getEnv("LOG_FORMAT", "text"),
+        LogSampleBurst: getEnvInt("LOG_SAMPLE_BURST", 10),
+        LogSampleWindow: getEnvDuration("LOG_SAMPLE_WINDOW", time.Minute),
+        AccessLogFormat: getEnv("ACCESS_LOG", "combined"),
+        AccessLogFile: getEnv("ACCESS_LOG_FILE", "-"),
+        AuditStream: getEnv("AUDIT_STREAM", ""),
+        AuditKey: secretSetting("AUDIT_KEY"),
+        GRPCPort: getEnv("GRPC_PORT", ""),
+        DevDir: getEnv("DEV_DIR", "dev-files"),
+        BasePath: getEnv("BASE_PATH", ""),
+        SourceURL: getEnv("SOURCE_URL", ""),
+        TokenStore: getEnv("TOKEN_STORE", "redis"),
+        DynamoDBTable: getEnv("DYNAMODB_TABLE", ""),
+        DynamoDBEndpoint: getEnv("DYNAMODB_ENDPOINT", ""),
+        PostgresURL: setting("POSTGRES_URL"),
+        PostgresTable: getEnv("POSTGRES_TABLE", "zipper_tokens"),
+        SecretsRefresh: getEnvDuration("SECRETS_REFRESH", 0),
+        Tenants: loadTenantSettings(),
+        TenantHeader: getEnv("TENANT_HEADER", ""),
+        TenantHeaderTrusted: setting("TENANT_HEADER_TRUSTED"),
+        TenantQuotaWindow: getEnvDuration("TENANT_QUOTA_WINDOW", 24 * time.Hour),
+        S3Inventory: setting("S3_INVENTORY"),
+        UsageRetention: getEnvDuration("USAGE_RETENTION", 400 * 24 * time.Hour),
+        BillingSink: getEnv("BILLING_SINK", ""),
+        RedisKeyPrefix: getEnv("REDIS_KEY_PREFIX", defaultRedisKeyPrefix),
+        RedisKeyTemplate: setting("REDIS_KEY_TEMPLATE"),
+        Plugins: getEnv("PLUGINS", ""),
+        Middleware: getEnv("MIDDLEWARE", defaultMiddleware),
+        ReadHeaderTimeout: getEnvDuration("READ_HEADER_TIMEOUT", 10 * time.Second),
+        ReadTimeout: getEnvDuration("READ_TIMEOUT", time.Minute),
+        WriteTimeout: getEnvDuration("WRITE_TIMEOUT", 6 * time.Hour),
+        IdleTimeout: getEnvDuration("IDLE_TIMEOUT", 2 * time.Minute),
+        HTTP2: getEnvBool("HTTP2", true),
+        H2C: getEnvBool("H2C", false),
+    }
 }
 
-var aws_bucket *s3.Bucket
-var redisPool *redigo.Pool
+// getEnv returns the setting or fallback when it is unset
+func getEnv(key, fallback string) string {
+    if value := setting(key); value != "" {
+        return value
+    }
+    return fallback
+}
+
+// getEnvInt returns the setting as an integer, or fallback when it is unset
+// or invalid, which checkConfig reports
+func getEnvInt(key string, fallback int) int {
+    value, err := strconv.Atoi(setting(key))
+    if err != nil {
+        invalidSetting(key, "a whole number")
+        return fallback
+    }
+    return value
+}
+
+// getEnvDuration parses the setting with time.ParseDuration, or returns
+// fallback when it is unset or invalid, which checkConfig reports
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+    value, err := time.ParseDuration(setting(key))
+    if err != nil {
+        invalidSetting(key, "a duration like 30s or 5m")
+        return fallback
+    }
+    return value
+}
 
-type RedisFile struct {
-    FileName string
-    Folder   string
-    S3Path   string
+// getEnvBool treats "1", "true", "yes" and "on" as enabled, or returns
+// fallback when the setting is unset
+func getEnvBool(key string, fallback bool) bool {
+    switch strings.ToLower(setting(key)) {
+    case "":
+        return fallback
+    case "1", "true", "yes", "on":
+        return true
+    case "0", "false", "no", "off":
+        return false
+    }
+    invalidSetting(key, "true or false")
+    return false
 }
 
+var aws_bucket *s3.Bucket
+var awsAuth aws.Auth
+var redisClient goredis.UniversalClient
+
+// archiver streams every archive the server builds
+var archiver *archive.Archiver
+
+// RedisFile is an entry of a manifest, as stored in Redis
+type RedisFile = archive.File
+
 func main() {
+    flag.Parse()
+    if err := loadConfig(); err != nil {
+        fatal("Error loading configuration", err)
+    }
+
+    initLogging()
+    if *devMode {
+        initDev()
+    }
+    mustCheckConfig()
+    initAccessLog()
+    initTracing()
+    initStatsD()
+    initSentry()
     initAwsBucket()
+    initPlugins()
+    initTenants()
+    initBilling()
+    loadSecrets(config)
     InitRedis()
+    startProgressRelay()
+    initTokenStore()
+    if *devMode && flag.Arg(0) == "seed" {
+        seedDev()
+    }
+    initJWT()
+    initPASETO()
+    loadAPIKeys(config)
+    initIPFilter()
+    initCORS()
+    initRateLimit()
+    initTokenPattern()
+    initJobs()
+
+    initMiddleware()
+    registerAdminRoutes()
+
+    server, err := newServer()
+    if err != nil {
+        panic(err)
+    }
+
+    listeners, err := publicListeners()
+    if err != nil {
+        panic(err)
+    }
+
+    if err := serveAdmin(); err != nil {
+        panic(err)
+    }
+
+    if err := serveGRPC(); err != nil {
+        panic(err)
+    }
+
+    watchReload()
+    watchSecrets()
+    go notifyWhenReady()
 
-    fmt.Println("Running on port", os.Getenv("PORT"))
-    http.HandleFunc("/", handler)
-    http.ListenAndServe(":" + os.Getenv("PORT"), nil)
+    if err := serveUntilSignalled(server, listeners); err != nil {
+        fatal("Server stopped", err)
+    }
+    closeBilling()
+    slog.Info("Shut down")
 }
 
 func initAwsBucket() {
@@ -63,159 +427,423 @@ func initAwsBucket() {
     if err != nil {
         panic(err)
     }
+    awsAuth = auth
+
+    region := aws.GetRegion(config.Region)
+    aws_bucket = s3.New(auth, region).Bucket(config.Bucket)
+
+    // s3://<bucket> reads from another bucket with the same credentials
+    archive.Register("s3", func(u *url.URL) (archive.Source, error) {
+        return archive.S3Source{Bucket: s3.New(auth, region).Bucket(u.Host)}, nil
+    })
 
-    aws_bucket = s3.New(auth, aws.GetRegion(config.Region)).Bucket(config.Bucket)
+    var source archive.Source = archive.S3Source{Bucket: aws_bucket}
+    if config.SourceURL != "" {
+        source, err = archive.NewSource(config.SourceURL)
+        if err != nil {
+            panic(err)
+        }
+    }
+
+    archiver = &archive.Archiver{Source: source, FetchHook: observeFetch, RefuseEmpty: config.EmptyArchiveStatus != 200}
 }
 
 func InitRedis() {
-    redisPool = &redigo.Pool{
-        MaxIdle:     10,
-        IdleTimeout: 1 * time.Second,
-        Dial: func() (redigo.Conn, error) {
-            c, err := redigo.Dial("tcp", strings.Join([] string {config.RedisServer, ":", config.RedisPort}, ""))
-
-            if err != nil {
-                return nil, err
-            }
-
-            if _, err := c.Do("AUTH", config.RedisPassword); err != nil {
-                c.Close()
-                return nil, err
-            }
-
-            return c, err
-        },
-        TestOnBorrow: func(c redigo.Conn, t time.Time) (err error) {
-            if err != nil {
-                panic("Error connecting to redis")
-            }
-            return
-        },
+    target := redisTarget{address: devRedisAddress}
+    var clusterNodes []string
+
+    if !*devMode {
+        var err error
+        if target, err = newRedisTarget(config); err != nil {
+            fatal("Error reading the Redis settings", err)
+        }
+        if config.RedisClusterNodes != "" {
+            clusterNodes = strings.Split(config.RedisClusterNodes, ",")
+        }
     }
+
+    redisClient = newRedisClient(target, clusterNodes)
+    redisClient.AddHook(redisErrorHook{})
+    redisClient.AddHook(redisTraceHook{})
 }
 
-// Remove all other unrecognised characters apart from
-var makeSafeFileName = regexp.MustCompile(`[#<>:"/\|?*\\]`)
+// authorizeDownload runs every check that has to pass before a token's
+// archive, or anything about it, is served, and settles which files it
+// has. On failure it has already written the problem response.
+func authorizeDownload(w http.ResponseWriter, r *http.Request) (token string, manifest *Manifest, ok bool) {
+    token, manifest, ok = authorizeTokens(w, r)
+    if !ok {
+        return "", nil, false
+    }
 
-func getFilesFromRedis(token string) (files []*RedisFile, err error) {
-    redis := redisPool.Get()
-    defer redis.Close()
+    if err := listPrefixes(r.Context(), manifest); err != nil {
+        writePrefixProblem(w, r, err)
+        return "", nil, false
+    }
 
-    // Get the value from Redis
-    result, err := redis.Do("GET", "zip:" + token)
-    if err != nil {
-        return
+    if err := subsetManifest(r, manifest); err != nil {
+        writeProblem(w, r, 400, codeBadRequest, err.Error())
+        return "", nil, false
     }
 
-    if (result == nil) {
-        return
+    return token, manifest, true
+}
+
+// authorizeTokens checks the request may use the tokens it names, merging
+// their manifests, without listing prefixes yet
+func authorizeTokens(w http.ResponseWriter, r *http.Request) (token string, manifest *Manifest, ok bool) {
+    // Get the tokens from the path or "token" URL params
+    tokens := requestTokens(r)
+
+    if len(tokens) == 0 {
+        writeProblem(w, r, 400, codeTokenMissing, "A download token is required")
+        return "", nil, false
+    }
+    if len(tokens) > maxMergedTokens {
+        writeProblem(w, r, 400, codeBadRequest, fmt.Sprintf("At most %d tokens can be combined", maxMergedTokens))
+        return "", nil, false
     }
 
-    // Convert to bytes
-    var resultByte []byte
-    var ok bool
-    if resultByte, ok = result.([]byte); !ok {
-        return
+    for _, token := range tokens {
+        if !validToken(token) {
+            writeProblem(w, r, 400, codeTokenMalformed, "The download token is not in the expected format")
+            return "", nil, false
+        }
     }
+    token = strings.Join(tokens, ",")
 
-    // Decode JSON
-    err = json.Unmarshal(resultByte, &files)
+    folders, err := requestFolders(r, len(tokens))
     if err != nil {
-        return
+        writeProblem(w, r, 400, codeBadRequest, err.Error())
+        return "", nil, false
     }
 
-    return
-}
+    if isLockedOut(r.Context(), clientIP(r)) {
+        writeProblem(w, r, 429, codeLockedOut, "Too many invalid tokens from this address")
+        return "", nil, false
+    }
 
-func handler(w http.ResponseWriter, r *http.Request) {
-    start := time.Now()
+    if err := checkGlobalIP(clientIP(r)); err != nil {
+        slog.InfoContext(r.Context(), "Rejected download", "token", token, "ip", clientIP(r), "reason", err)
+        writeProblem(w, r, 403, codeAddressForbidden, err.Error())
+        return "", nil, false
+    }
 
-    // Get "token" URL params
-    tokens, ok := r.URL.Query()["token"]
+    // Check the URL signature before touching Redis
+    if err := verifyDownloadSignature(r, token); err != nil {
+        slog.InfoContext(r.Context(), "Rejected download", "token", token, "reason", err)
+        code := codeSignatureInvalid
+        if errors.Is(err, errSignatureExpired) {
+            code = codeTokenExpired
+        }
+        writeProblem(w, r, 403, code, err.Error())
+        return "", nil, false
+    }
 
-    if !ok || len(tokens) < 1 {
-        http.Error(w, "", 500)
-        return
+    // Some deployments don't consider the link alone to be enough
+    if bearerRequired() {
+        if err := verifyBearer(r); err != nil {
+            slog.InfoContext(r.Context(), "Rejected download", "token", token, "reason", err)
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            writeProblem(w, r, 401, codeUnauthorized, err.Error())
+            return "", nil, false
+        }
     }
 
-    token := tokens[0]
+    manifests := make([]*Manifest, len(tokens))
+    for i, token := range tokens {
+        if manifests[i], ok = authorizeManifest(w, r, token); !ok {
+            return "", nil, false
+        }
+    }
+
+    manifest, err = mergeManifests(manifests, folders)
+    if err != nil {
+        writeProblem(w, r, 400, codeBadRequest, err.Error())
+        return "", nil, false
+    }
+    return token, manifest, true
+}
 
-    // Get 'as' parameter
-    downloadAs, ok := r.URL.Query()["as"]
+// authorizeManifest loads one token's manifest and checks the restrictions
+// it places on who may download it
+func authorizeManifest(w http.ResponseWriter, r *http.Request, token string) (*Manifest, bool) {
+    manifest, err := getManifest(r.Context(), token)
 
-    if !ok && len(downloadAs) > 0 {
-        downloadAs[0] = makeSafeFileName.ReplaceAllString(downloadAs[0], "")
-        if downloadAs[0] == "" {
-            downloadAs[0] = "download.zip"
+    if err != nil {
+        if errors.Is(err, errTokenNotFound) || errors.Is(err, errTokenInvalid) {
+            recordFailedLookup(r.Context(), clientIP(r))
+        }
+        if errors.Is(err, errStoreUnavailable) || errors.Is(err, errManifestInvalid) {
+            slog.ErrorContext(r.Context(), "Error loading manifest", "token", token, "error", err)
         }
-    } else {
-        downloadAs = append(downloadAs, "download.zip")
+        writeLookupProblem(w, r, err)
+        return nil, false
     }
+    return manifest, checkManifestAccess(w, r, token, manifest)
+}
 
-    files, err := getFilesFromRedis(token)
+// checkManifestAccess checks the restrictions a manifest places on who may
+// download it, writing the problem response when they fail
+func checkManifestAccess(w http.ResponseWriter, r *http.Request, token string, manifest *Manifest) bool {
+    if err := checkManifestIP(clientIP(r), manifest); err != nil {
+        slog.InfoContext(r.Context(), "Rejected download", "token", token, "ip", clientIP(r), "reason", err)
+        writeProblem(w, r, 403, codeAddressForbidden, err.Error())
+        return false
+    }
 
-    if err != nil {
-        return
+    if err := authorizeOIDC(r, manifest); err != nil {
+        slog.InfoContext(r.Context(), "Rejected download", "token", token, "reason", err)
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        writeProblem(w, r, 403, codeForbidden, err.Error())
+        return false
     }
 
-    // Start processing the response
-    w.Header().Add("Content-Disposition", "attachment; filename=\""+downloadAs[0]+"\"")
-    w.Header().Add("Content-Type", "application/zip")
+    if err := resolveTenant(r, manifest); err != nil {
+        slog.InfoContext(r.Context(), "Rejected download", "token", token, "tenant", manifest.Tenant, "reason", err)
+        writeProblem(w, r, 403, codeForbidden, err.Error())
+        return false
+    }
+
+    return true
+}
 
-    // Loop over files, add them to the zip
-    zipWriter := zip.NewWriter(w)
-    for _, file := range files {
-        if file.S3Path == "" {
-            log.Printf("Missing path for file: %v", file)
-            continue
+// headArchive answers a HEAD for an archive from the manifest alone, with
+// its size estimated from the sizes the manifest gives
+func headArchive(w http.ResponseWriter, r *http.Request, manifest *Manifest, store bool) {
+    var statuses []fileStatus
+    for _, file := range manifest.Files {
+        if file != nil && file.S3Path != "" {
+            statuses = append(statuses, fileStatus{Path: archive.Path(file), Exists: true, Size: max(file.Size, 0)})
         }
+    }
 
-        // Build safe file file name
-        safeFileName := makeSafeFileName.ReplaceAllString(file.FileName, "")
+    w.Header().Set("Content-Disposition", "attachment; filename=\""+downloadName(r, manifest)+"\"")
+    w.Header().Set("Content-Type", "application/zip")
+    w.Header().Set("Content-Length", strconv.FormatInt(estimateArchive(statuses, store).EstimatedSize, 10))
+    w.WriteHeader(200)
+}
+
+// downloadName returns the archive's file name, from the manifest's
+// ArchiveName if it has one or else the 'as' parameter
+func downloadName(r *http.Request, manifest *Manifest) string {
+    if name := renderArchiveName(manifest, time.Now()); name != "" {
+        return name
+    }
+    downloadAs := archive.SafeName(r.URL.Query().Get("as"))
+    if downloadAs == "" {
+        downloadAs = "download.zip"
+    }
+    return downloadAs
+}
 
-        if safeFileName == "" { // Unlikely but just in case
-            safeFileName = "file"
+// archiveUpdate describes how far along an archive is
+type archiveUpdate = archive.Update
+
+// archiveProgress is told when each file starts, when one fails and when the
+// archive is finished
+type archiveProgress = archive.Progress
+
+// writeArchive streams the manifest's files from its tenant's bucket into a
+// zip written to w, stored uncompressed with store. Missing and unreadable
+// files are logged and skipped. It stops early if ctx is cancelled.
+func writeArchive(ctx context.Context, w io.Writer, manifest *Manifest, store bool, progress archiveProgress) error {
+    archiver := tenantFor(manifest).archiver
+    if store {
+        stored := *archiver
+        stored.Store = true
+        archiver = &stored
+    }
+    return archiver.StreamProgress(ctx, manifest.Files, w, progress)
+}
+
+// storeRequested reads the 'method' parameter, whether the archive's files
+// are to be stored uncompressed rather than deflated
+func storeRequested(r *http.Request) (bool, error) {
+    switch method := r.URL.Query().Get("method"); strings.ToLower(method) {
+    case "", "deflate":
+        return false, nil
+    case "store":
+        return true, nil
+    default:
+        return false, fmt.Errorf("method %q should be deflate or store", method)
+    }
+}
+
+// observeFetch traces and times each file the archiver fetches from S3
+func observeFetch(ctx context.Context, file *RedisFile) func(read int64, err error) {
+    start := time.Now()
+    _, span := startSpan(ctx, "s3 GetObject", spanKindClient)
+    span.set("aws.s3.bucket", config.Bucket)
+    span.set("aws.s3.key", file.S3Path)
+
+    return func(read int64, err error) {
+        span.set("zipper.bytes_read", read)
+        span.fail(err)
+        span.finish()
+
+        // Cancelled downloads aren't S3's fault
+        if ctx.Err() != nil {
+            return
         }
 
-        // Read file from S3, log any errors
-        rdr, err := aws_bucket.GetReader(file.S3Path)
+        result := "ok"
         if err != nil {
-            switch t := err.(type) {
-            case *s3.Error:
-                if t.StatusCode == 404 {
-                    log.Printf("File not found. %s", file.S3Path)
-                }
-            default:
-                log.Printf("Error downloading \"%s\" - %s", file.S3Path, err.Error())
-            }
-            continue
+            result = "error"
+            s3Errors.inc("get")
         }
+        fileFetchSeconds.observe(time.Since(start).Seconds(), result)
+    }
+}
 
-        // Build a good path for the file within the zip
-        zipPath := ""
+func handler(w http.ResponseWriter, r *http.Request) {
+    serveArchive(w, r, authorizeDownload)
+}
 
-        // Prefix folder name, if any
-        if file.Folder != "" {
-            zipPath += file.Folder
-            if !strings.HasSuffix(zipPath, "/") {
-                zipPath += "/"
-            }
-        }
+// serveArchive streams the archive of the manifest authorize returns, along
+// with the token, or what stands in for it, to follow it by
+func serveArchive(w http.ResponseWriter, r *http.Request, authorize func(http.ResponseWriter, *http.Request) (string, *Manifest, bool)) {
+    start := time.Now()
+
+    r, span := startServerSpan(r, "download")
+    defer span.finish()
+
+    if err := archiver.Authorize(r); err != nil {
+        span.set("zipper.authorized", false)
+        writeProblem(w, r, 403, codeForbidden, err.Error())
+        return
+    }
+
+    token, manifest, ok := authorize(w, r)
+    if !ok {
+        span.set("zipper.authorized", false)
+        return
+    }
+    span.set("zipper.files", len(manifest.Files))
+
+    store, err := storeRequested(r)
+    if err != nil {
+        writeProblem(w, r, 400, codeBadRequest, err.Error())
+        return
+    }
+    if refuseEmpty(w, r, manifest) {
+        return
+    }
+    if err := checkArchiveLimits(r.Context(), manifest); err != nil {
+        slog.InfoContext(r.Context(), "Refused download over the limits", "token", token, "reason", err)
+        writeLimitProblem(w, r, err)
+        return
+    }
+
+    // A HEAD gets the headers without the archive being built or charged for
+    if r.Method == http.MethodHead {
+        headArchive(w, r, manifest, store)
+        return
+    }
 
-        zipPath += safeFileName
+    // Other replicas and outside systems can follow it in Redis under this ID
+    snapshot := newDownloadSnapshot(requestID(r.Context()), token, len(manifest.Files))
+
+    finishQuota, err := startTenantArchive(r.Context(), manifest, snapshot.ID)
+    if err != nil {
+        slog.InfoContext(r.Context(), "Refused download over quota", "token", token, "tenant", manifest.Tenant, "reason", err)
+        writeQuotaProblem(w, r, err)
+        return
+    }
 
-        h := &zip.FileHeader {
-            Name:   zipPath,
-            Method: zip.Deflate,
+    // Start processing the response
+    w.Header().Add("Content-Disposition", "attachment; filename=\""+downloadName(r, manifest)+"\"")
+    w.Header().Add("Content-Type", "application/zip")
+
+    // The request ID is repeated after the body, for clients that only look
+    // once the archive is complete
+    w.Header().Set("Trailer", "X-Request-ID")
+
+    w.Header().Set("X-Download-ID", snapshot.ID)
+    snapshot.save()
+
+    // Admins can see and terminate it through /admin/downloads
+    ctx, cancel := context.WithCancel(r.Context())
+    defer cancel()
+    active := trackDownload(snapshot.ID, token, clientIP(r), len(manifest.Files), cancel)
+    defer untrackDownload(snapshot.ID)
+    defer func() { finishQuota(active.bytesStreamed.Load()) }()
+
+    // Anyone watching /v1/progress for this token sees the download advance
+    key, total := tokenProgressKey(token), len(manifest.Files)
+    var last archiveUpdate
+    var failedFiles []string
+    lastSave := time.Now()
+    err = writeArchive(ctx, active.writer(w), manifest, store, func(update archiveUpdate) {
+        last = update
+        active.update(update)
+        if update.Error != "" {
+            failedFiles = append(failedFiles, update.CurrentFile)
+            recordError("Download " + snapshot.ID + ", " + update.CurrentFile + ": " + update.Error)
+            captureMessage("warning", r, "File could not be added to archive: "+update.Error, map[string]interface{}{
+                "download_id": snapshot.ID,
+                "file":        update.CurrentFile,
+            })
         }
+        publishProgress(key, snapshot.RequestID, total, update)
 
-        f, _ := zipWriter.CreateHeader(h)
+        snapshot.update(update)
+        if time.Since(lastSave) >= config.ProgressInterval {
+            snapshot.save()
+            lastSave = time.Now()
+        }
+    })
 
-        io.Copy(f, rdr)
-        rdr.Close()
+    // Nothing has been sent, so the client can still be told plainly
+    if errors.Is(err, archive.ErrEmpty) {
+        w.Header().Del("Content-Disposition")
+        w.Header().Del("Trailer")
+        writeProblem(w, r, config.EmptyArchiveStatus, codeArchiveEmpty, fmt.Sprintf("None of the manifest's %d files could be added to the archive", total))
     }
 
-    zipWriter.Close()
+    done := progressEvent{Event: progressDone, RequestID: snapshot.RequestID, FilesDone: last.FilesDone, FilesTotal: total, BytesStreamed: last.BytesWritten}
+    snapshot.State = downloadDone
+    if err != nil {
+        done.Error = err.Error()
+        snapshot.State = downloadFailed
+        snapshot.LastError = err.Error()
+    }
+    publishEvent(key, done)
+    snapshot.save()
+    w.Header().Set("X-Request-ID", snapshot.RequestID)
+
+    span.set("zipper.bytes_streamed", last.BytesWritten)
+    span.fail(err)
+
+    result := "ok"
+    switch {
+    case active.terminated.Load():
+        result = "terminated"
+    case err != nil:
+        result = "failed"
+    }
+    archivesTotal.inc("download", result)
+    recordUsage(r.Context(), "download", snapshot.ID, manifest, result, active.bytesStreamed.Load())
+
+    audit(r.Context(), &auditRecord{
+        Time:        active.startedAt,
+        DownloadID:  snapshot.ID,
+        RequestID:   snapshot.RequestID,
+        Token:       token,
+        IP:          active.clientIP,
+        UserAgent:   r.UserAgent(),
+        Result:      result,
+        Bytes:       active.bytesStreamed.Load(),
+        FilesTotal:  total,
+        FailedFiles: failedFiles,
+    })
+
+    // Break the connection so the client can't mistake what it got for the
+    // whole archive
+    if active.terminated.Load() {
+        slog.DebugContext(r.Context(), "Download terminated", "method", r.Method, "uri", r.RequestURI, "duration", time.Since(start))
+        panic(http.ErrAbortHandler)
+    }
 
-    log.Printf("%s\t%s\t%s", r.Method, r.RequestURI, time.Since(start))
+    slog.DebugContext(r.Context(), "Download finished", "method", r.Method, "uri", r.RequestURI, "duration", time.Since(start))
 }
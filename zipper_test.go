@@ -0,0 +1,288 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "io"
+    "log/slog"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "codecourse/zipper/archive"
+)
+
+// Tokens for the handler tests, all in the default TOKEN_PATTERN
+const (
+    testToken      = "11111111-1111-4111-8111-111111111111"
+    testOtherToken = "22222222-2222-4222-8222-222222222222"
+    testMissing    = "33333333-3333-4333-8333-333333333333"
+)
+
+// setupHandlerTest serves the download handler from a memory token store,
+// the development Redis lookalike and files in a temporary directory
+func setupHandlerTest(t *testing.T, files map[string]string) {
+    t.Helper()
+    slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+    dir := t.TempDir()
+    for name, content := range files {
+        if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    devStore = &devRedis{values: map[string]devValue{}, versions: map[string]int{}, streams: map[string][]devStreamEntry{}}
+    go serveDevRedis(ln)
+
+    config = loadConfiguration()
+    redisClient = newRedisClient(redisTarget{address: ln.Addr().String()}, nil)
+    t.Cleanup(func() { redisClient.Close() })
+    tokenStore = newMemoryTokenStore()
+    archiver = &archive.Archiver{Source: archive.DirSource(dir), RefuseEmpty: config.EmptyArchiveStatus != 200}
+
+    loadSecrets(config)
+    initIPFilter()
+    initTokenPattern()
+    initJWT()
+    initPASETO()
+    initTenants()
+}
+
+// putManifest stores a manifest for a token
+func putManifest(t *testing.T, token string, manifest interface{}) {
+    t.Helper()
+    data, err := json.Marshal(manifest)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := tokenStore.Put(context.Background(), token, data, time.Hour); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// download asks the handler for a token's archive
+func download(token string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    handler(w, httptest.NewRequest("GET", "/?token="+token, nil))
+    return w
+}
+
+// problemCode is the code of a problem response
+func problemCode(t *testing.T, w *httptest.ResponseRecorder) string {
+    t.Helper()
+    var problem struct{ Code string }
+    if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+        t.Fatalf("reading the problem %q: %v", w.Body.String(), err)
+    }
+    return problem.Code
+}
+
+func TestHandlerServesFoundToken(t *testing.T) {
+    setupHandlerTest(t, map[string]string{"a.txt": "hello"})
+    putManifest(t, testToken, []*RedisFile{{FileName: "a.txt", Folder: "docs", S3Path: "a.txt"}})
+
+    w := download(testToken)
+    if w.Code != 200 {
+        t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+    }
+    if got := w.Header().Get("Content-Type"); got != "application/zip" {
+        t.Errorf("Content-Type = %q, want application/zip", got)
+    }
+
+    body := w.Body.Bytes()
+    archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+    if err != nil {
+        t.Fatalf("reading the zip: %v", err)
+    }
+    if len(archive.File) != 1 || archive.File[0].Name != "docs/a.txt" {
+        t.Fatalf("zip has %d files, want only docs/a.txt", len(archive.File))
+    }
+}
+
+func TestHandlerTokenNotFound(t *testing.T) {
+    setupHandlerTest(t, nil)
+
+    w := download(testMissing)
+    if w.Code != 404 || problemCode(t, w) != codeTokenNotFound {
+        t.Errorf("got %d %s, want 404 %s", w.Code, w.Body, codeTokenNotFound)
+    }
+}
+
+func TestHandlerTokenRevoked(t *testing.T) {
+    setupHandlerTest(t, map[string]string{"a.txt": "hello"})
+    putManifest(t, testToken, []*RedisFile{{FileName: "a.txt", S3Path: "a.txt"}})
+
+    w := httptest.NewRecorder()
+    revokeTokenHandler(w, httptest.NewRequest("DELETE", "/?token="+testToken, nil))
+    if w.Code >= 300 {
+        t.Fatalf("revoking: %d %s", w.Code, w.Body)
+    }
+
+    w = download(testToken)
+    if w.Code != 410 || problemCode(t, w) != codeTokenRevoked {
+        t.Errorf("got %d %s, want 410 %s", w.Code, w.Body, codeTokenRevoked)
+    }
+}
+
+func TestHandlerInvalidVersionedManifest(t *testing.T) {
+    setupHandlerTest(t, nil)
+    putManifest(t, testToken, map[string]interface{}{
+        "Version": 1,
+        "Files":   []map[string]string{{"FileName": "a.txt", "S3Path": "a.txt", "Colour": "blue"}},
+    })
+
+    w := download(testToken)
+    if w.Code != 422 || problemCode(t, w) != codeManifestInvalid {
+        t.Fatalf("got %d %s, want 422 %s", w.Code, w.Body, codeManifestInvalid)
+    }
+    if !strings.Contains(w.Body.String(), "Colour") {
+        t.Errorf("the problem %s doesn't name the unknown field", w.Body)
+    }
+}
+
+func TestHandlerIncludeCycle(t *testing.T) {
+    setupHandlerTest(t, map[string]string{"a.txt": "hello"})
+    putManifest(t, testToken, map[string]interface{}{
+        "Version": 1,
+        "Files": []map[string]string{
+            {"FileName": "a.txt", "S3Path": "a.txt"},
+            {"Type": "token", "Token": testOtherToken},
+        },
+    })
+    putManifest(t, testOtherToken, map[string]interface{}{
+        "Version": 1,
+        "Files":   []map[string]string{{"Type": "token", "Token": testToken}},
+    })
+
+    w := download(testToken)
+    if w.Code != 422 || problemCode(t, w) != codeManifestInvalid {
+        t.Fatalf("got %d %s, want 422 %s", w.Code, w.Body, codeManifestInvalid)
+    }
+    if !strings.Contains(w.Body.String(), "includes itself") {
+        t.Errorf("the problem %s doesn't mention the cycle", w.Body)
+    }
+}
+
+// signJWT makes an HS256 JWT with the claims
+func signJWT(t *testing.T, secret string, claims interface{}) string {
+    t.Helper()
+    payload, err := json.Marshal(claims)
+    if err != nil {
+        t.Fatal(err)
+    }
+    signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(signed))
+    return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandlerJWTWithoutRedis(t *testing.T) {
+    setupHandlerTest(t, map[string]string{"a.txt": "hello"})
+    config.JWTSecret = "secret"
+    loadSecrets(config)
+
+    // Nothing listens at the address any more
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ln.Close()
+    redisClient.Close()
+    redisClient = newRedisClient(redisTarget{address: ln.Addr().String()}, nil)
+
+    token := signJWT(t, "secret", map[string]interface{}{
+        "exp":   time.Now().Add(time.Hour).Unix(),
+        "Files": []*RedisFile{{FileName: "a.txt", S3Path: "a.txt"}},
+    })
+    w := download(token)
+    if w.Code != 200 {
+        t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+    }
+
+    // Stored tokens still need the revocation check
+    putManifest(t, testToken, []*RedisFile{{FileName: "a.txt", S3Path: "a.txt"}})
+    if w := download(testToken); w.Code != 503 {
+        t.Errorf("stored token status = %d, want 503: %s", w.Code, w.Body)
+    }
+}
+
+func TestHandlerHeadSkipsArchive(t *testing.T) {
+    setupHandlerTest(t, map[string]string{"a.txt": "hello"})
+    putManifest(t, testToken, []*RedisFile{{FileName: "a.txt", S3Path: "a.txt", Size: 5}})
+    opened := false
+    archiver.Hooks = []archive.Hooks{{OnEntryStart: func(ctx context.Context, file *archive.File) *archive.File {
+        opened = true
+        return file
+    }}}
+
+    w := httptest.NewRecorder()
+    handler(w, httptest.NewRequest("HEAD", "/?token="+testToken, nil))
+    if w.Code != 200 {
+        t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+    }
+    if opened || w.Body.Len() > 0 {
+        t.Errorf("a HEAD built the archive")
+    }
+    if w.Header().Get("Content-Length") == "" || w.Header().Get("Content-Type") != "application/zip" {
+        t.Errorf("headers = %v, want the archive's", w.Header())
+    }
+}
+
+func TestNullEntriesAreSkipped(t *testing.T) {
+    setupHandlerTest(t, map[string]string{"a.txt": "hello"})
+    if err := tokenStore.Put(context.Background(), testToken, []byte(`[null, {"FileName": "a.txt", "S3Path": "a.txt"}]`), time.Hour); err != nil {
+        t.Fatal(err)
+    }
+
+    handlers := []struct {
+        query   string
+        handler http.HandlerFunc
+    }{
+        {"", validateHandler},
+        {"", listHandler},
+        {"&sizes=false", listHandler},
+        {"", estimateHandler},
+    }
+    for i, h := range handlers {
+        w := httptest.NewRecorder()
+        h.handler(w, httptest.NewRequest("GET", "/?token="+testToken+h.query, nil))
+        if w.Code != 200 {
+            t.Errorf("handler %d: status = %d, want 200: %s", i, w.Code, w.Body)
+        }
+    }
+
+    if w := download(testToken); w.Code != 200 {
+        t.Errorf("download: status = %d, want 200: %s", w.Code, w.Body)
+    }
+}
+
+func TestRouteMethodNotAllowed(t *testing.T) {
+    setupHandlerTest(t, nil)
+    mux := http.NewServeMux()
+    registerRoutes(mux)
+
+    w := httptest.NewRecorder()
+    mux.ServeHTTP(w, httptest.NewRequest("POST", "/v1/list", nil))
+    if w.Code != 405 || problemCode(t, w) != codeMethodNotAllowed {
+        t.Fatalf("got %d %s, want 405 %s", w.Code, w.Body, codeMethodNotAllowed)
+    }
+    if got := w.Header().Get("Allow"); got != "GET, HEAD, OPTIONS" {
+        t.Errorf("Allow = %q, want GET, HEAD, OPTIONS", got)
+    }
+}